@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/client"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+)
+
+// clientConfig is the format of the optional config file, which has to be json, anything not set keeps the baked in value
+// Settings are applied in order baked in < config file < environment < argv, apart from disabled capabilities which are always added to
+type clientConfig struct {
+	// Same format as -d, e.g tls://example.com:443?sni=cdn.example.com
+	Destinations       []string `json:"destinations,omitempty"`
+	Fingerprints       []string `json:"fingerprints,omitempty"`
+	HostCA             []string `json:"host_ca,omitempty"`
+	AllowNoFingerprint *bool    `json:"allow_no_fingerprint,omitempty"`
+
+	Proxy          string `json:"proxy,omitempty"`
+	NTLMProxyCreds string `json:"ntlm_proxy_creds,omitempty"`
+	UseKerberos    *bool  `json:"use_kerberos,omitempty"`
+	SNI            string `json:"sni,omitempty"`
+
+	LogLevel  string `json:"log_level,omitempty"`
+	Reconnect string `json:"reconnect,omitempty"`
+	Failback  string `json:"failback,omitempty"`
+	TLSVerify string `json:"tls_verify,omitempty"`
+
+	Disable   []string `json:"disable,omitempty"`
+	TunPolicy string   `json:"tun_policy,omitempty"`
+}
+
+// Environment variables, all of them are optional
+const (
+	envConfig             = "RSSH_CONFIG"
+	envDestination        = "RSSH_DESTINATION"
+	envFingerprint        = "RSSH_FINGERPRINT"
+	envHostCA             = "RSSH_HOST_CA"
+	envAllowNoFingerprint = "RSSH_ALLOW_NO_FINGERPRINT"
+	envProxy              = "RSSH_PROXY"
+	envNTLMProxyCreds     = "RSSH_NTLM_PROXY_CREDS"
+	envUseKerberos        = "RSSH_USE_KERBEROS"
+	envSNI                = "RSSH_SNI"
+	envLogLevel           = "RSSH_LOG_LEVEL"
+	envReconnect          = "RSSH_RECONNECT"
+	envFailback           = "RSSH_FAILBACK"
+	envTLSVerify          = "RSSH_TLS_VERIFY"
+	envDisable            = "RSSH_DISABLE"
+	envTunPolicy          = "RSSH_TUN_POLICY"
+)
+
+// loadSettings sets the globals from the config file, the environment and then argv, each overwriting what came before it
+func loadSettings(line terminal.ParsedLine) error {
+	configPath, err := line.GetArgString("config")
+	if err != nil {
+		configPath = os.Getenv(envConfig)
+	}
+
+	if configPath != "" {
+		if err := loadConfigFile(configPath); err != nil {
+			return err
+		}
+	}
+
+	configFromEnvironment().apply()
+
+	proxyaddress, _ := line.GetArgString("proxy")
+	if len(proxyaddress) > 0 {
+		proxy = proxyaddress
+	}
+
+	userSpecifiedFingerprint, err := line.GetArgString("fingerprint")
+	if err == nil {
+		fingerprint = userSpecifiedFingerprint
+	}
+
+	userSpecifiedHostCA, err := line.GetArgString("host-ca")
+	if err == nil {
+		hostCA = userSpecifiedHostCA
+	}
+
+	userSpecifiedSNI, err := line.GetArgString("sni")
+	if err == nil {
+		customSNI = userSpecifiedSNI
+	}
+
+	userSpecifiedNTLMCreds, err := line.GetArgString("ntlm-proxy-creds")
+	if err == nil {
+		ntlmProxyCreds = userSpecifiedNTLMCreds
+	}
+
+	if line.IsSet("winauth") || line.IsSet("use-kerberos") {
+		useKerberos = true
+	}
+
+	userSpecifiedDisable, err := line.GetArgString("disable")
+	if err == nil {
+		addDisabled(userSpecifiedDisable)
+	}
+
+	userSpecifiedDestinations, _ := line.GetArgsStringOrdered("d")
+	longDestinations, _ := line.GetArgsStringOrdered("destination")
+	userSpecifiedDestinations = append(userSpecifiedDestinations, longDestinations...)
+
+	if len(userSpecifiedDestinations) > 0 {
+		destination = strings.Join(userSpecifiedDestinations, ",")
+	}
+
+	userSpecifiedFailback, err := line.GetArgString("failback")
+	if err == nil {
+		failback = userSpecifiedFailback
+	}
+
+	userSpecifiedReconnect, err := line.GetArgString("reconnect")
+	if err == nil {
+		reconnect = userSpecifiedReconnect
+	}
+
+	userSpecifiedTunPolicy, err := line.GetArgString("tun-policy")
+	if err == nil {
+		tunPolicy = userSpecifiedTunPolicy
+	}
+
+	userSpecifiedTLSVerify, err := line.GetArgString("tls-verify")
+	if err == nil {
+		tlsVerify = userSpecifiedTLSVerify
+	}
+
+	if line.IsSet("allow-no-fingerprint") {
+		allowNoFingerprint = "true"
+	}
+
+	if len(destination) == 0 && len(line.Arguments) > 1 {
+		// Basically take a guess at the arguments we have and take the last one
+		destination = line.Arguments[len(line.Arguments)-1].Value()
+	}
+
+	userSpecifiedLogLevel, err := line.GetArgString("log-level")
+	if err == nil {
+		logLevel = userSpecifiedLogLevel
+	}
+
+	return nil
+}
+
+func loadConfigFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var c clientConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&c); err != nil {
+		return fmt.Errorf("unable to parse config file %q, only json is supported: %s", path, err)
+	}
+
+	c.apply()
+
+	return nil
+}
+
+func configFromEnvironment() clientConfig {
+	var c clientConfig
+
+	list := func(name string) []string {
+		if value := os.Getenv(name); value != "" {
+			return strings.Split(value, ",")
+		}
+		return nil
+	}
+
+	boolean := func(name string) *bool {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+
+		b := value == "true" || value == "1"
+		return &b
+	}
+
+	c.Destinations = list(envDestination)
+	c.Fingerprints = list(envFingerprint)
+	c.HostCA = list(envHostCA)
+	c.AllowNoFingerprint = boolean(envAllowNoFingerprint)
+	c.Proxy = os.Getenv(envProxy)
+	c.NTLMProxyCreds = os.Getenv(envNTLMProxyCreds)
+	c.UseKerberos = boolean(envUseKerberos)
+	c.SNI = os.Getenv(envSNI)
+	c.LogLevel = os.Getenv(envLogLevel)
+	c.Reconnect = os.Getenv(envReconnect)
+	c.Failback = os.Getenv(envFailback)
+	c.TLSVerify = os.Getenv(envTLSVerify)
+	c.Disable = list(envDisable)
+	c.TunPolicy = os.Getenv(envTunPolicy)
+
+	return c
+}
+
+// apply overwrites the globals with anything set in the config
+func (c clientConfig) apply() {
+	setString := func(target *string, value string) {
+		if value != "" {
+			*target = value
+		}
+	}
+
+	setString(&destination, strings.Join(c.Destinations, ","))
+	setString(&fingerprint, strings.Join(c.Fingerprints, ","))
+	setString(&hostCA, strings.Join(c.HostCA, ","))
+	setString(&proxy, c.Proxy)
+	setString(&ntlmProxyCreds, c.NTLMProxyCreds)
+	setString(&customSNI, c.SNI)
+	setString(&logLevel, c.LogLevel)
+	setString(&reconnect, c.Reconnect)
+	setString(&failback, c.Failback)
+	setString(&tlsVerify, c.TLSVerify)
+	setString(&tunPolicy, c.TunPolicy)
+
+	if c.AllowNoFingerprint != nil {
+		allowNoFingerprint = fmt.Sprintf("%t", *c.AllowNoFingerprint)
+	}
+
+	if c.UseKerberos != nil {
+		useKerberos = *c.UseKerberos
+	}
+
+	addDisabled(strings.Join(c.Disable, ","))
+}
+
+// addDisabled adds to the disabled capabilities, a restriction that was baked in can never be lifted by the config, environment or argv
+func addDisabled(list string) {
+	if list == "" {
+		return
+	}
+
+	if disable == "" {
+		disable = list
+		return
+	}
+
+	disable += "," + list
+}
+
+// printConfig writes the effective settings in the config file format, with passwords removed
+func printConfig(w io.Writer) {
+	split := func(s string) []string {
+		var out []string
+		for _, part := range strings.Split(s, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+		return out
+	}
+
+	allowNoFp := allowNoFingerprint == "true"
+	kerberos := useKerberos
+
+	c := clientConfig{
+		Fingerprints:       split(fingerprint),
+		HostCA:             split(hostCA),
+		AllowNoFingerprint: &allowNoFp,
+		Proxy:              redactURL(proxy),
+		UseKerberos:        &kerberos,
+		SNI:                customSNI,
+		LogLevel:           logLevel,
+		Reconnect:          reconnect,
+		Failback:           failback,
+		TLSVerify:          tlsVerify,
+		Disable:            split(disable),
+		TunPolicy:          tunPolicy,
+	}
+
+	// Only the per destination options are shown here, the defaults are in proxy and sni
+	destinations, _ := client.ParseDestinations(destination, "", "")
+	for _, d := range destinations {
+		d.Proxy = redactURL(d.Proxy)
+		c.Destinations = append(c.Destinations, d.String())
+	}
+
+	if domainUser, _, ok := strings.Cut(ntlmProxyCreds, ":"); ok {
+		c.NTLMProxyCreds = domainUser + ":xxxxx"
+	}
+
+	b, _ := json.MarshalIndent(c, "", "    ")
+	fmt.Fprintln(w, string(b))
+}
+
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+
+	return u.Redacted()
+}
@@ -6,11 +6,11 @@ import "C"
 
 //export VoidFunc
 func VoidFunc() {
-	Run(destination, fingerprint, proxy, customSNI, useKerberos)
+	Run(bakedSettings())
 }
 
 //export OnProcessAttach
 func OnProcessAttach() {
 
-	Run(destination, fingerprint, proxy, customSNI, useKerberos)
+	Run(bakedSettings())
 }
@@ -16,5 +16,7 @@ func init() {
 	//If we're loading as a shared lib, stop our children from being polluted
 	os.Setenv("LD_PRELOAD", "")
 
-	client.Run(destination, fingerprint, proxy, customSNI, false)
+	settings := bakedSettings()
+	settings.WinAuth = false
+	client.Run(settings)
 }
@@ -21,7 +21,7 @@ func clientTests() {
 }
 
 func runPrecompiledClient() func() {
-	cmd := exec.Command("./client", "--foreground", "-d", listenAddr)
+	cmd := exec.Command("./client", "--foreground", "--allow-no-fingerprint", "-d", listenAddr)
 
 	r, w, err := os.Pipe()
 	if err != nil {
@@ -0,0 +1,195 @@
+// Package bandwidth counts the bytes going through connections and limits their rate with token buckets that can be changed while in use
+package bandwidth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// The most a limit lets through at once
+const burst = 32 * 1024
+
+// Counter counts bytes sent and received, from the point of view of this process
+type Counter struct {
+	Sent     atomic.Uint64
+	Received atomic.Uint64
+}
+
+func (c *Counter) Total() uint64 {
+	return c.Sent.Load() + c.Received.Load()
+}
+
+// Limit is a token bucket shared by every connection it is applied to, it starts unlimited
+type Limit struct {
+	limiter *rate.Limiter
+}
+
+func NewLimit() *Limit {
+	return &Limit{
+		limiter: rate.NewLimiter(rate.Inf, burst),
+	}
+}
+
+// Set changes the rate in bytes per second, 0 removes the limit
+func (l *Limit) Set(bytesPerSecond uint64) {
+	if bytesPerSecond == 0 {
+		l.limiter.SetLimit(rate.Inf)
+		return
+	}
+
+	l.limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// Rate is the current rate in bytes per second, 0 when unlimited
+func (l *Limit) Rate() uint64 {
+	r := l.limiter.Limit()
+	if r == rate.Inf {
+		return 0
+	}
+
+	return uint64(r)
+}
+
+// wait takes n tokens, a burst at a time as that is all the bucket holds
+func (l *Limit) wait(n int) {
+	for n > 0 {
+		take := min(n, burst)
+		l.limiter.WaitN(context.Background(), take)
+		n -= take
+	}
+}
+
+// Conn counts what is read and written into its counters, waiting on all of its limits first
+type Conn struct {
+	net.Conn
+
+	lck      sync.RWMutex
+	counters []*Counter
+	limits   []*Limit
+}
+
+func NewConn(c net.Conn) *Conn {
+	return &Conn{
+		Conn: c,
+	}
+}
+
+// Track adds a counter and limits to the connection, for when who it belongs to is only known once it is in use
+func (c *Conn) Track(counter *Counter, limits ...*Limit) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if counter != nil {
+		c.counters = append(c.counters, counter)
+	}
+	c.limits = append(c.limits, limits...)
+}
+
+func (c *Conn) current() ([]*Counter, []*Limit) {
+	c.lck.RLock()
+	defer c.lck.RUnlock()
+
+	return c.counters, c.limits
+}
+
+// Reads and writes are never split so datagram boundaries are kept, a large one just waits for longer
+func (c *Conn) Read(b []byte) (int, error) {
+	counters, limits := c.current()
+
+	n, err := c.Conn.Read(b)
+
+	// Waiting after the read holds up the next one, which is what pushes back on the sender
+	for _, l := range limits {
+		l.wait(n)
+	}
+
+	for _, counter := range counters {
+		counter.Received.Add(uint64(n))
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	counters, limits := c.current()
+
+	for _, l := range limits {
+		l.wait(len(b))
+	}
+
+	n, err := c.Conn.Write(b)
+
+	for _, counter := range counters {
+		counter.Sent.Add(uint64(n))
+	}
+
+	return n, err
+}
+
+var units = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// Format prints a number of bytes with a binary unit, e.g 1.5 MiB
+func Format(bytes uint64) string {
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// FormatRate prints a limit in bytes per second, or unlimited
+func FormatRate(bytesPerSecond uint64) string {
+	if bytesPerSecond == 0 {
+		return "unlimited"
+	}
+
+	return Format(bytesPerSecond) + "/s"
+}
+
+// ParseRate reads a rate in bytes per second, with an optional K, M or G (binary) suffix, e.g 512K. 0 or unlimited mean no limit
+func ParseRate(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "UNLIMITED" {
+		return 0, nil
+	}
+
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(s, "/S"), "B"), "I")
+
+	multiplier := uint64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		}
+
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New("invalid rate, expected bytes per second e.g 512K, 10M or unlimited")
+	}
+
+	return uint64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,94 @@
+package bandwidth
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for input, expected := range map[string]uint64{
+		"100":       100,
+		"512K":      512 * 1024,
+		"1.5m":      1024 * 1024 * 3 / 2,
+		"10MiB/s":   10 * 1024 * 1024,
+		"2GB":       2 * 1024 * 1024 * 1024,
+		"0":         0,
+		"unlimited": 0,
+	} {
+		rate, err := ParseRate(input)
+		if err != nil {
+			t.Fatalf("%q: %s", input, err)
+		}
+
+		if rate != expected {
+			t.Fatalf("%q: expected %d got %d", input, expected, rate)
+		}
+	}
+
+	for _, invalid := range []string{"", "fast", "-1K", "10X"} {
+		if _, err := ParseRate(invalid); err == nil {
+			t.Fatalf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for bytes, expected := range map[uint64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+	} {
+		if got := Format(bytes); got != expected {
+			t.Fatalf("%d: expected %q got %q", bytes, expected, got)
+		}
+	}
+
+	if FormatRate(0) != "unlimited" {
+		t.Fatal("a rate of 0 should be unlimited")
+	}
+}
+
+func TestConnCountsAndLimits(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	var counter Counter
+	limit := NewLimit()
+
+	conn := NewConn(a)
+	conn.Track(&counter, limit)
+	defer conn.Close()
+
+	go io.Copy(io.Discard, b)
+
+	// The first burst is free, so it takes roughly a second for the next rate's worth of bytes to go through
+	limit.Set(burst)
+
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 2*burst)); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatalf("write was not held to the limit, took %s", elapsed)
+	}
+
+	limit.Set(0)
+	if limit.Rate() != 0 {
+		t.Fatal("expected the limit to be removed")
+	}
+
+	go b.Write([]byte("hello"))
+
+	buff := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buff); err != nil {
+		t.Fatal(err)
+	}
+
+	if counter.Sent.Load() != 2*burst || counter.Received.Load() != 5 || counter.Total() != 2*burst+5 {
+		t.Fatalf("unexpected counts sent %d received %d", counter.Sent.Load(), counter.Received.Load())
+	}
+}
@@ -0,0 +1,120 @@
+package capabilities
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	Shell         = "shell"
+	Exec          = "exec"
+	SFTP          = "sftp"
+	Subsystems    = "subsystems"
+	Tun           = "tun"
+	RemoteForward = "tcpip-forward"
+	LocalForward  = "direct-tcpip"
+	// rssh specific udp forwarding, see the listen command
+	RemoteUDPForward = "udp-forward"
+	LocalUDPForward  = "direct-udp"
+	// Running a binary downloaded from a url, e.g exec https://example.com/binary
+	Fileless = "fileless"
+
+	// Prefix for disabling a single subsystem, e.g subsystem:list
+	subsystemPrefix = "subsystem:"
+)
+
+var All = []string{Shell, Exec, SFTP, Subsystems, Tun, RemoteForward, LocalForward, RemoteUDPForward, LocalUDPForward, Fileless}
+
+var (
+	lck      sync.RWMutex
+	disabled = map[string]bool{}
+)
+
+// Parse validates a comma separated list of capability names
+func Parse(list string) ([]string, error) {
+	var out []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if !valid(name) {
+			return nil, fmt.Errorf("unknown capability %q, expected one of %s or subsystem:<name>", name, strings.Join(All, ","))
+		}
+
+		out = append(out, name)
+	}
+
+	return out, nil
+}
+
+// Subsystem is the capability for a single subsystem, on top of the Subsystems capability which covers all of them
+func Subsystem(name string) string {
+	return subsystemPrefix + name
+}
+
+func valid(name string) bool {
+	if subsystem, ok := strings.CutPrefix(name, subsystemPrefix); ok {
+		return subsystem != ""
+	}
+
+	for _, c := range All {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Disable turns off capabilities for the lifetime of the process, there is deliberately no way to turn them back on
+func Disable(names ...string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	for _, name := range names {
+		disabled[name] = true
+	}
+}
+
+// Disabled returns the sorted names of all disabled capabilities
+func Disabled() []string {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	var out []string
+	for name := range disabled {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// Check returns an error suitable for sending back to the server if the capability is disabled
+func Check(name string) error {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	if disabled[name] {
+		return fmt.Errorf("%s has been disabled on this client", name)
+	}
+
+	return nil
+}
+
+// CheckAny returns an error if every one of the capabilities is disabled, for things like sessions which can be used for several of them
+func CheckAny(names ...string) error {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	for _, name := range names {
+		if !disabled[name] {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s have all been disabled on this client", strings.Join(names, ", "))
+}
@@ -1,9 +1,7 @@
 package client
 
 import (
-	"bytes"
 	"crypto/tls"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
@@ -15,15 +13,19 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
 	"github.com/NHAS/reverse_ssh/internal/client/connection"
 	"github.com/NHAS/reverse_ssh/internal/client/handlers"
 	"github.com/NHAS/reverse_ssh/internal/client/keys"
+	"github.com/NHAS/reverse_ssh/internal/client/sysinfo"
+	"github.com/NHAS/reverse_ssh/internal/client/update"
+	"github.com/NHAS/reverse_ssh/internal/forwards"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
-	socks "golang.org/x/net/proxy"
 	"golang.org/x/net/websocket"
 )
 
@@ -80,204 +82,30 @@ func GetProxyDetails(proxy string) (string, error) {
 			proxyURL.Host += ":80"
 		}
 	}
-	return proxyURL.Scheme + "://" + proxyURL.Host, nil
+	// Credentials are kept for proxy authentication
+	return (&url.URL{Scheme: proxyURL.Scheme, User: proxyURL.User, Host: proxyURL.Host}).String(), nil
 }
 
 func Connect(addr, proxy string, timeout time.Duration, winauth bool) (conn net.Conn, err error) {
+	dialer, err := NewProxyDialer(proxy, timeout, winauth)
+	if err != nil {
+		return nil, err
+	}
 
-	if len(proxy) != 0 {
-		log.Println("Setting HTTP proxy address as: ", proxy)
-		proxyURL, _ := url.Parse(proxy) // Already parsed
-
-		if proxyURL.Scheme == "http" || proxyURL.Scheme == "https" {
-
-			var (
-				proxyCon net.Conn
-				err      error
-			)
-			switch proxyURL.Scheme {
-			case "http":
-				proxyCon, err = net.DialTimeout("tcp", proxyURL.Host, timeout)
-			case "https":
-				proxyCon, err = tls.DialWithDialer(&net.Dialer{
-					Timeout: timeout,
-				}, "tcp", proxyURL.Host, &tls.Config{
-					InsecureSkipVerify: true,
-				})
-			}
-			if err != nil {
-				return nil, err
-			}
-
-			if tcpC, ok := proxyCon.(*net.TCPConn); ok {
-				tcpC.SetKeepAlivePeriod(2 * time.Hour)
-			}
-
-			// First attempt without auth
-			req := []string{
-				fmt.Sprintf("CONNECT %s HTTP/1.1", addr),
-				fmt.Sprintf("Host: %s", addr),
-			}
-
-			err = WriteHTTPReq(req, proxyCon)
-			if err != nil {
-				return nil, fmt.Errorf("unable to connect proxy %s", proxy)
-			}
-
-			var responseStatus []byte
-			for {
-				b := make([]byte, 1)
-				_, err := proxyCon.Read(b)
-				if err != nil {
-					return conn, fmt.Errorf("reading from proxy failed")
-				}
-				responseStatus = append(responseStatus, b...)
-
-				if len(responseStatus) > 4 && bytes.Equal(responseStatus[len(responseStatus)-4:], []byte("\r\n\r\n")) {
-					break
-				}
-			}
-
-			// If we get a 407 Proxy Authentication Required
-			if bytes.Contains(bytes.ToLower(responseStatus), []byte("407")) {
-				// Check if NTLM is supported
-				if bytes.Contains(bytes.ToLower(responseStatus), []byte("proxy-authenticate: ntlm")) {
-					// Start NTLM negotiation
-					ntlmHeader, err := getNTLMAuthHeader(proxy, nil)
-					if err != nil {
-						return nil, fmt.Errorf("NTLM negotiation failed: %v", err)
-					}
-
-					// Send Type 1 message
-					req = []string{
-						fmt.Sprintf("CONNECT %s HTTP/1.1", addr),
-						fmt.Sprintf("Host: %s", addr),
-						fmt.Sprintf("Proxy-Authorization: %s", ntlmHeader),
-					}
-
-					err = WriteHTTPReq(req, proxyCon)
-					if err != nil {
-						return nil, fmt.Errorf("unable to send NTLM negotiate message: %v", err)
-					}
-
-					// Read challenge response
-					responseStatus = []byte{}
-					for {
-						b := make([]byte, 1)
-						_, err := proxyCon.Read(b)
-						if err != nil {
-							return conn, fmt.Errorf("reading NTLM challenge failed")
-						}
-						responseStatus = append(responseStatus, b...)
-
-						if len(responseStatus) > 4 && bytes.Equal(responseStatus[len(responseStatus)-4:], []byte("\r\n\r\n")) {
-							break
-						}
-					}
-
-					// Extract Type 2 message
-					challengeStart := bytes.Index(responseStatus, []byte("NTLM "))
-					if challengeStart == -1 {
-						return nil, fmt.Errorf("no NTLM challenge received")
-					}
-					challengeStr := string(responseStatus[challengeStart+5:])
-					challengeStr = strings.Split(challengeStr, "\r\n")[0]
-					challenge, err := base64.StdEncoding.DecodeString(challengeStr)
-					if err != nil {
-						return nil, fmt.Errorf("invalid NTLM challenge: %v", err)
-					}
-
-					// Generate Type 3 message
-					ntlmHeader, err = getNTLMAuthHeader(proxy, challenge)
-					if err != nil {
-						return nil, fmt.Errorf("NTLM authentication failed: %v", err)
-					}
-
-					// Send Type 3 message
-					req = []string{
-						fmt.Sprintf("CONNECT %s HTTP/1.1", addr),
-						fmt.Sprintf("Host: %s", addr),
-						fmt.Sprintf("Proxy-Authorization: %s", ntlmHeader),
-					}
-
-					err = WriteHTTPReq(req, proxyCon)
-					if err != nil {
-						return nil, fmt.Errorf("unable to send NTLM authenticate message: %v", err)
-					}
-
-					// Read final response
-					responseStatus = []byte{}
-					for {
-						b := make([]byte, 1)
-						_, err := proxyCon.Read(b)
-						if err != nil {
-							return conn, fmt.Errorf("reading final response failed")
-						}
-						responseStatus = append(responseStatus, b...)
-
-						if len(responseStatus) > 4 && bytes.Equal(responseStatus[len(responseStatus)-4:], []byte("\r\n\r\n")) {
-							break
-						}
-					}
-				} else if winauth {
-					req = additionalHeaders(proxy, req)
-					err = WriteHTTPReq(req, proxyCon)
-					if err != nil {
-						return nil, fmt.Errorf("unable to connect proxy %s", proxy)
-					}
-
-					responseStatus = []byte{}
-					for {
-						b := make([]byte, 1)
-						_, err := proxyCon.Read(b)
-						if err != nil {
-							return conn, fmt.Errorf("reading from proxy failed")
-						}
-						responseStatus = append(responseStatus, b...)
-
-						if len(responseStatus) > 4 && bytes.Equal(responseStatus[len(responseStatus)-4:], []byte("\r\n\r\n")) {
-							break
-						}
-					}
-				}
-			}
-
-			if !(bytes.Contains(bytes.ToLower(responseStatus), []byte("200"))) {
-				parts := bytes.Split(responseStatus, []byte("\r\n"))
-				if len(parts) > 1 {
-					return nil, fmt.Errorf("failed to proxy: %q", parts[0])
-				}
-			}
-
-			log.Println("Proxy accepted CONNECT request, connection set up!")
-
-			return proxyCon, nil
-		}
-		if proxyURL.Scheme == "socks" || proxyURL.Scheme == "socks5" {
-			dial, err := socks.SOCKS5("tcp", proxyURL.Host, nil, nil)
-			if err != nil {
-				return nil, fmt.Errorf("reading from socks failed: %s", err)
-			}
-			proxyCon, err := dial.Dial("tcp", addr)
-			if err != nil {
-				return nil, fmt.Errorf("failed to dial socks: %s", err)
-			}
-
-			log.Println("SOCKS Proxy accepted dial, connection set up!")
+	return connect(addr, dialer)
+}
 
-			return proxyCon, nil
-		}
+func connect(addr string, dialer *ProxyDialer) (conn net.Conn, err error) {
+	if len(dialer.proxies) != 0 {
+		log.Println("Setting proxy address as: ", dialer)
+		return dialer.Dial("tcp", addr)
 	}
 
-	conn, err = net.DialTimeout("tcp", addr, timeout)
+	conn, err = dialer.Dial("tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect: %s", err)
 	}
 
-	if tcpC, ok := conn.(*net.TCPConn); ok {
-		tcpC.SetKeepAlivePeriod(2 * time.Hour)
-	}
-
 	return
 }
 
@@ -299,7 +127,7 @@ func getCaseInsensitiveEnv(envs ...string) (ret []string) {
 	return ret
 }
 
-func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
+func Run(settings Settings) {
 
 	sshPriv, sysinfoError := keys.GetPrivateKey()
 	if sysinfoError != nil {
@@ -308,12 +136,36 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 
 	l := logger.NewLog("client")
 
-	var err error
-	proxyAddr, err = GetProxyDetails(proxyAddr)
+	destinations, err := newDestinationPicker(settings.Destinations)
+	if err != nil {
+		log.Fatal("Invalid destinations: ", err)
+	}
+
+	fingerprints, err := ParseFingerprints(settings.Fingerprint)
 	if err != nil {
-		log.Fatal("Invalid proxy details", proxyAddr, ":", err)
+		log.Fatal("Invalid server fingerprint: ", err)
 	}
 
+	authorities, err := ParseFingerprints(settings.HostCA)
+	if err != nil {
+		log.Fatal("Invalid host CA fingerprint: ", err)
+	}
+
+	if len(fingerprints) == 0 && len(authorities) == 0 && !settings.AllowNoFingerprint {
+		log.Fatal("No server fingerprint specified, refusing to connect. Set --fingerprint, --host-ca or explicitly allow this with --allow-no-fingerprint")
+	}
+
+	if len(fingerprints) > 0 {
+		SetTrustedHostKeys(fingerprints)
+	}
+	setTrustedHostAuthorities(authorities)
+
+	setTLSVerification(settings.TLSVerification)
+
+	capabilities.Disable(settings.Disabled...)
+
+	update.SetCommandLine(settings.CommandLine)
+
 	var username string
 	userInfo, sysinfoError := user.Current()
 	if sysinfoError != nil {
@@ -334,33 +186,59 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(sshPriv),
 		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			if fingerprint == "" { // If a server key isnt supplied, fail open. Potentially should change this for more paranoid people
-				l.Warning("No server key specified, allowing connection to %s", addr)
-				return nil
-			}
+		HostKeyCallback: hostKeyCallback(l),
+		ClientVersion:   "SSH-" + internal.Version + "-" + runtime.GOOS + "_" + runtime.GOARCH,
+	}
 
-			if internal.FingerprintSHA256Hex(key) != fingerprint {
-				return fmt.Errorf("server public key invalid, expected: %s, got: %s", fingerprint, internal.FingerprintSHA256Hex(key))
-			}
+	// fetch the environment variables, but the first proxy is done from the destinations proxy
+	potentialProxies := getCaseInsensitiveEnv("http_proxy", "https_proxy")
+	triedProxyIndex := 0
 
-			return nil
-		},
-		ClientVersion: "SSH-" + internal.Version + "-" + runtime.GOOS + "_" + runtime.GOARCH,
+	if settings.ReconnectPolicy != nil {
+		if err := SetReconnectPolicy(*settings.ReconnectPolicy); err != nil {
+			log.Fatal("Invalid reconnect policy: ", err)
+		}
 	}
 
-	realAddr, scheme := determineConnectionType(addr)
+	if settings.TunPolicy != nil {
+		handlers.SetTunPolicy(*settings.TunPolicy)
+	}
 
-	// fetch the environment variables, but the first proxy is done from the supplied proxyAddr arg
-	potentialProxies := getCaseInsensitiveEnv("http_proxy", "https_proxy")
-	triedProxyIndex := 0
-	initialProxyAddr := proxyAddr
+	var retry reconnector
+
+	// backoff records the current destination as failed, and waits once every destination has been tried. Returns false when the client should give up
+	backoff := func(err error) bool {
+		if !destinations.failed(err) {
+			return true
+		}
+		return retry.wait()
+	}
+
+	var lastDestination *destinationState
+	proxyAddr := ""
 	for {
+		destination := destinations.current()
+		if destination != lastDestination {
+			lastDestination = destination
+			proxyAddr = destination.Proxy
+			triedProxyIndex = 0
+		}
+
+		addr, sni, winauth := destination.Address, destination.SNI, settings.WinAuth
+		realAddr, scheme := determineConnectionType(addr)
+
 		var conn net.Conn
 		if scheme != "stdio" {
 			log.Println("Connecting to", addr)
-			// First create raw TCP connection
-			conn, err = Connect(realAddr, proxyAddr, config.Timeout, winauth)
+
+			// The same dialer is used for every connection a transport makes, so the proxy chain and its credentials are only parsed once
+			var dialer *ProxyDialer
+			dialer, err = NewProxyDialer(proxyAddr, config.Timeout, winauth)
+			if err == nil {
+				// First create raw TCP connection
+				conn, err = connect(realAddr, dialer)
+			}
+
 			if err != nil {
 
 				if errMsg := err.Error(); strings.Contains(errMsg, "missing port in address") {
@@ -371,9 +249,13 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 
 				if len(potentialProxies) > 0 {
 					if len(potentialProxies) <= triedProxyIndex {
-						log.Printf("Unable to connect via proxies (from env), retrying with proxy as %q: %v", potentialProxies, initialProxyAddr)
+						log.Printf("Unable to connect via proxies (from env), retrying with proxy as %q: %v", potentialProxies, destination.Proxy)
 						triedProxyIndex = 0
-						proxyAddr = initialProxyAddr
+						proxyAddr = destination.Proxy
+
+						if !backoff(err) {
+							return
+						}
 						continue
 					}
 					proxy := potentialProxies[triedProxyIndex]
@@ -389,7 +271,9 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 					continue
 				}
 
-				<-time.After(10 * time.Second)
+				if !backoff(err) {
+					return
+				}
 				continue
 			}
 
@@ -405,14 +289,13 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 					}
 				}
 
-				clientTlsConn := tls.Client(conn, &tls.Config{
-					InsecureSkipVerify: true,
-					ServerName:         sniServerName,
-				})
+				clientTlsConn := tls.Client(conn, serverTLSConfig(sniServerName))
 				err = clientTlsConn.Handshake()
 				if err != nil {
 					log.Printf("Unable to connect TLS: %s\n", err)
-					<-time.After(10 * time.Second)
+					if !backoff(err) {
+						return
+					}
 					continue
 				}
 
@@ -424,15 +307,18 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 				c, err := websocket.NewConfig("ws://"+realAddr+"/ws", "ws://"+realAddr)
 				if err != nil {
 					log.Println("Could not create websockets configuration: ", err)
-					<-time.After(10 * time.Second)
-
+					if !backoff(err) {
+						return
+					}
 					continue
 				}
 
 				wsConn, err := websocket.NewClient(c, conn)
 				if err != nil {
 					log.Printf("Unable to connect WS: %s\n", err)
-					<-time.After(10 * time.Second)
+					if !backoff(err) {
+						return
+					}
 					continue
 
 				}
@@ -442,13 +328,18 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 				conn = wsConn
 			case "http", "https":
 
-				conn, err = NewHTTPConn(scheme+"://"+realAddr, func() (net.Conn, error) {
-					return Connect(realAddr, proxyAddr, config.Timeout, winauth)
+				// Only used to check the server (and proxies) were reachable, http polling makes its own connections
+				conn.Close()
+
+				conn, err = NewHTTPConn(scheme+"://"+realAddr, sni, func() (net.Conn, error) {
+					return dialer.Dial("tcp", realAddr)
 				})
 
 				if err != nil {
 					log.Printf("Unable to connect HTTP: %s\n", err)
-					<-time.After(10 * time.Second)
+					if !backoff(err) {
+						return
+					}
 					continue
 				}
 
@@ -462,7 +353,7 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 		// After this the timeout gets updated by the server
 		realConn := &internal.TimeoutConn{Conn: conn, Timeout: 4 * time.Minute}
 
-		sshConn, chans, reqs, err := ssh.NewClientConn(realConn, addr, config)
+		sshConn, chans, reqs, err := ssh.NewClientConn(realConn, realAddr, config)
 		if err != nil {
 			realConn.Close()
 
@@ -473,10 +364,15 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 				return
 			}
 
-			<-time.After(10 * time.Second)
+			if !backoff(err) {
+				return
+			}
 			continue
 		}
 
+		destinations.succeeded()
+		retry.reset()
+
 		if len(potentialProxies) > 0 {
 			// reset proxy counter after success, so we always check the avaliable proxies
 			triedProxyIndex = 0
@@ -484,6 +380,14 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 
 		log.Println("Successfully connnected", addr)
 
+		go func() {
+			if _, _, err := sshConn.SendRequest("client-info", false, ssh.Marshal(clientInfo())); err != nil {
+				log.Println("Unable to send client info: ", err)
+			}
+
+			update.SendConfirmation(sshConn)
+		}()
+
 		go func() {
 
 			for req := range reqs {
@@ -504,6 +408,58 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 
 					realConn.Timeout = time.Duration(timeout*2) * time.Second
 
+				case "reconnect-policy":
+					policy, err := internal.ParseReconnectPolicy(string(req.Payload))
+					if err == nil {
+						err = SetReconnectPolicy(policy)
+					}
+
+					if err != nil {
+						log.Printf("server sent invalid reconnect policy %q: %s", string(req.Payload), err)
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					log.Printf("Reconnect policy set to %s", policy)
+					req.Reply(true, nil)
+
+				case "tun-policy":
+					policy, err := internal.ParseTunPolicy(string(req.Payload))
+					if err != nil {
+						log.Printf("server sent invalid tun policy %q: %s", string(req.Payload), err)
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					handlers.SetServerTunPolicy(policy)
+
+					log.Printf("Server tun policy set to %q", policy)
+					req.Reply(true, nil)
+
+				case "trusted-host-keys":
+					fingerprints, err := ParseFingerprints(string(req.Payload))
+					if err == nil {
+						err = SetTrustedHostKeys(fingerprints)
+					}
+
+					if err != nil {
+						log.Printf("server sent invalid trusted host keys %q: %s", string(req.Payload), err)
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					log.Printf("Trusted server keys set to %s", strings.Join(fingerprints, ", "))
+					req.Reply(true, nil)
+
+				case "client-info":
+					req.Reply(true, ssh.Marshal(clientInfo()))
+
+				case "update-confirmed":
+					update.Confirmed(string(req.Payload))
+
+				case "update-rollback":
+					update.Rollback(string(req.Payload))
+
 				case "log-level":
 					u, err := logger.StrToUrgency(string(req.Payload))
 					if err != nil {
@@ -557,6 +513,50 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 						r.Reply(true, nil)
 					}(req)
 
+				case "query-forwards":
+					req.Reply(true, forwards.Marshal(forwards.All()))
+
+				case "cancel-forward":
+					if err := forwards.Close(string(req.Payload)); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					req.Reply(true, nil)
+
+				case "limit-forward":
+					var limit forwards.LimitRequest
+					if err := ssh.Unmarshal(req.Payload, &limit); err != nil {
+						req.Reply(false, []byte(fmt.Sprintf("Unable to unmarshal forward limit: %s", err)))
+						continue
+					}
+
+					if err := forwards.SetLimit(limit.ID, limit.Rate); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					req.Reply(true, nil)
+
+				case "udp-forward":
+					go handlers.StartRemoteUDPForward(req, sshConn)
+
+				case "cancel-udp-forward":
+					var rf internal.RemoteForwardRequest
+
+					err := ssh.Unmarshal(req.Payload, &rf)
+					if err != nil {
+						req.Reply(false, []byte(fmt.Sprintf("Unable to unmarshal udp forward request in order to stop it: %s", err.Error())))
+						continue
+					}
+
+					if err := handlers.StopRemoteUDPForward(rf); err != nil {
+						req.Reply(false, []byte(err.Error()))
+						continue
+					}
+
+					req.Reply(true, nil)
+
 				default:
 					if req.WantReply {
 						req.Reply(false, nil)
@@ -566,6 +566,15 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 			}
 		}()
 
+		var failingBack atomic.Pointer[destinationState]
+		stopFailback := make(chan bool)
+		if settings.Failback > 0 && len(destinations.preferred()) > 0 {
+			go failback(destinations.preferred(), settings, config.Timeout, stopFailback, func(d *destinationState) {
+				failingBack.Store(d)
+				sshConn.Close()
+			})
+		}
+
 		clientLog := logger.NewLog("client")
 
 		//Do not register new client callbacks here, they are actually within the JumpHandler
@@ -575,9 +584,29 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 			"session":        handlers.Session(connection.NewSession(sshConn)),
 			"jump":           handlers.JumpHandler(sshPriv, sshConn),
 			"log-to-console": handlers.LogToConsole,
+			"direct-tcpip":   handlers.LocalForward,
+			"direct-udp":     handlers.LocalUDPForward,
+			"socks-bind":     handlers.SocksBind,
+			"rssh-update": func(newChannel ssh.NewChannel, log logger.Logger) {
+				update.Receive(newChannel, ServerKey(), log)
+			},
 		})
 
 		sshConn.Close()
+		close(stopFailback)
+
+		// Otherwise a preferred destination that failed enough to be unhealthy would still be tried after the one we are leaving
+		recovered := failingBack.Load()
+		if recovered != nil {
+			destinations.recovered(recovered)
+		}
+
+		destinations.disconnected()
+
+		if recovered != nil {
+			log.Println("Reconnecting to preferred destination")
+			continue
+		}
 
 		if err != nil {
 			log.Printf("Server disconnected unexpectedly: %s\n", err)
@@ -586,7 +615,9 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 				return
 			}
 
-			<-time.After(10 * time.Second)
+			if !retry.wait() {
+				return
+			}
 			continue
 		}
 
@@ -594,8 +625,45 @@ func Run(addr, fingerprint, proxyAddr, sni string, winauth bool) {
 
 }
 
+// failback periodically checks whether any of the preferred destinations are reachable again, and if so calls reconnect with it
+func failback(preferred []*destinationState, settings Settings, timeout time.Duration, stop <-chan bool, reconnect func(*destinationState)) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(settings.Failback):
+		}
+
+		for _, d := range preferred {
+			realAddr, scheme := determineConnectionType(d.Address)
+			if scheme == "stdio" {
+				continue
+			}
+
+			conn, err := Connect(realAddr, d.Proxy, timeout, settings.WinAuth)
+			if err != nil {
+				log.Printf("Preferred destination %s is still unreachable: %s", d.Address, err)
+				continue
+			}
+			conn.Close()
+
+			log.Printf("Preferred destination %s is reachable again, failing back", d.Address)
+			reconnect(d)
+			return
+		}
+	}
+}
+
 var matchSchemeDefinition = regexp.MustCompile(`.*\:\/\/`)
 
+// clientInfo is the system information sent to the server, along with settings that a replacement client has to keep
+func clientInfo() internal.ClientInfo {
+	info := sysinfo.Get()
+	info.TunPolicy = handlers.LocalTunPolicy().String()
+
+	return info
+}
+
 func determineConnectionType(addr string) (resultingAddr, transport string) {
 
 	if !matchSchemeDefinition.MatchString(addr) {
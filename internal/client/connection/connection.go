@@ -21,6 +21,9 @@ type Session struct {
 
 	// Remote forwards sent by user, used to just close user specific remote forwards
 	SupportedRemoteForwards map[internal.RemoteForwardRequest]bool //(set)
+
+	// The server user who opened this jump session, empty for the servers own session or servers that do not say
+	Owner string
 }
 
 func NewSession(connection ssh.Conn) *Session {
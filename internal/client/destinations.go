@@ -0,0 +1,207 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// After this many consecutive failures a destination is tried after all the healthy ones
+const unhealthyAfter = 3
+
+// Destination is a single server the client can connect back to, each with its own transport (from the scheme), proxy and SNI
+type Destination struct {
+	Address string
+	Proxy   string
+	SNI     string
+}
+
+// ParseDestinations parses a comma separated list of destinations in priority order, e.g
+// tls://a.example.com:443?sni=cdn.example.com,ssh.example.com:2222?proxy=http%3A%2F%2F10.0.0.1%3A8080
+// The default proxy and sni are used for any destination that does not set its own
+func ParseDestinations(list, defaultProxy, defaultSNI string) ([]Destination, error) {
+	var destinations []Destination
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		address, query, _ := strings.Cut(entry, "?")
+		if address == "" {
+			return nil, fmt.Errorf("destination %q has no address", entry)
+		}
+
+		d := Destination{
+			Address: address,
+			Proxy:   defaultProxy,
+			SNI:     defaultSNI,
+		}
+
+		if query != "" {
+			values, err := url.ParseQuery(query)
+			if err != nil {
+				return nil, fmt.Errorf("destination %q has invalid options: %s", entry, err)
+			}
+
+			if values.Has("proxy") {
+				d.Proxy = values.Get("proxy")
+			}
+
+			if values.Has("sni") {
+				d.SNI = values.Get("sni")
+			}
+		}
+
+		destinations = append(destinations, d)
+	}
+
+	if len(destinations) == 0 {
+		return nil, errors.New("no destinations specified")
+	}
+
+	return destinations, nil
+}
+
+func (d Destination) String() string {
+	values := url.Values{}
+	if d.Proxy != "" {
+		values.Set("proxy", d.Proxy)
+	}
+
+	if d.SNI != "" {
+		values.Set("sni", d.SNI)
+	}
+
+	if len(values) == 0 {
+		return d.Address
+	}
+
+	return d.Address + "?" + values.Encode()
+}
+
+type destinationState struct {
+	Destination
+
+	priority int
+
+	failures    int
+	lastFailure time.Time
+	lastError   string
+	connected   time.Time
+}
+
+func (d *destinationState) healthy() bool {
+	return d.failures < unhealthyAfter
+}
+
+// destinationPicker walks the destinations in rounds, each round tries every destination once
+// starting with the healthy ones in priority order
+type destinationPicker struct {
+	destinations []*destinationState
+
+	order    []*destinationState
+	position int
+}
+
+func newDestinationPicker(destinations []Destination) (*destinationPicker, error) {
+	if len(destinations) == 0 {
+		return nil, errors.New("no destinations specified")
+	}
+
+	p := &destinationPicker{}
+	for i, d := range destinations {
+		if d.Proxy != "" {
+			// Each destination can have a chain of proxies, so every hop is checked and normalised
+			proxies, err := ParseProxyChain(d.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy details for %s: %s", d.Address, err)
+			}
+
+			hops := make([]string, 0, len(proxies))
+			for _, proxyURL := range proxies {
+				hops = append(hops, proxyURL.String())
+			}
+			d.Proxy = strings.Join(hops, ",")
+		}
+
+		p.destinations = append(p.destinations, &destinationState{Destination: d, priority: i})
+	}
+
+	p.newRound()
+
+	return p, nil
+}
+
+func (p *destinationPicker) newRound() {
+	p.order = p.order[:0]
+	p.position = 0
+
+	for _, d := range p.destinations {
+		if d.healthy() {
+			p.order = append(p.order, d)
+		}
+	}
+
+	for _, d := range p.destinations {
+		if !d.healthy() {
+			p.order = append(p.order, d)
+		}
+	}
+}
+
+func (p *destinationPicker) current() *destinationState {
+	return p.order[p.position]
+}
+
+// failed records that the current destination could not be used and moves on to the next one
+// It returns true once every destination has been tried this round, at which point the caller should back off
+func (p *destinationPicker) failed(err error) bool {
+	d := p.current()
+	d.failures++
+	d.lastFailure = time.Now()
+	if err != nil {
+		d.lastError = err.Error()
+	}
+
+	p.position++
+	if p.position < len(p.order) {
+		log.Printf("Destination %s failed (%d consecutive failures), trying %s", d.Address, d.failures, p.current().Address)
+		return false
+	}
+
+	p.newRound()
+	return true
+}
+
+func (p *destinationPicker) succeeded() {
+	d := p.current()
+	d.failures = 0
+	d.lastError = ""
+	d.connected = time.Now()
+}
+
+// recovered clears the failures of a destination that has been found to be reachable again, so the next round tries it in priority order
+func (p *destinationPicker) recovered(d *destinationState) {
+	d.failures = 0
+	d.lastError = ""
+}
+
+// disconnected starts a fresh round so that after losing a connection the preferred destination is tried first
+func (p *destinationPicker) disconnected() {
+	p.newRound()
+}
+
+// preferred returns the destinations with a higher priority than the one currently in use
+func (p *destinationPicker) preferred() (out []*destinationState) {
+	current := p.current()
+	for _, d := range p.destinations {
+		if d.priority < current.priority {
+			out = append(out, d)
+		}
+	}
+	return
+}
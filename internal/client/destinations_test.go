@@ -0,0 +1,43 @@
+package client
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFailbackToUnhealthyDestination(t *testing.T) {
+	picker, err := newDestinationPicker([]Destination{{Address: "preferred:22"}, {Address: "fallback:22"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The preferred destination keeps failing and the client keeps ending up on the fallback, until preferred is unhealthy
+	for i := 0; i < unhealthyAfter; i++ {
+		if picker.current().Address != "preferred:22" {
+			t.Fatalf("round %d: expected preferred:22 to be tried first, got %s", i, picker.current().Address)
+		}
+
+		picker.failed(errors.New("unreachable"))
+		picker.succeeded()
+		picker.disconnected()
+	}
+
+	if picker.current().Address != "fallback:22" {
+		t.Fatalf("expected the unhealthy preferred destination to be tried last, got %s first", picker.current().Address)
+	}
+
+	picker.succeeded()
+
+	preferred := picker.preferred()
+	if len(preferred) != 1 || preferred[0].Address != "preferred:22" {
+		t.Fatalf("expected preferred:22 to be preferred over the fallback, got %v", preferred)
+	}
+
+	// What the client does when a failback probe reaches the preferred destination
+	picker.recovered(preferred[0])
+	picker.disconnected()
+
+	if picker.current().Address != "preferred:22" {
+		t.Fatalf("expected to fail back to preferred:22, got %s", picker.current().Address)
+	}
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
+	"github.com/NHAS/reverse_ssh/internal/client/connection"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// Capabilities cannot be turned back on, so the test runs itself in a child process to keep the rest of the package unaffected
+const disabledCapabilitiesEnv = "RSSH_TEST_DISABLED_CAPABILITIES"
+
+func TestDisabledCapabilities(t *testing.T) {
+	if os.Getenv(disabledCapabilitiesEnv) != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDisabledCapabilities$", "-test.v")
+		cmd.Env = append(os.Environ(), disabledCapabilitiesEnv+"=1")
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("disabled capabilities test failed: %s\n%s", err, output)
+		}
+		return
+	}
+
+	capabilities.Disable(capabilities.All...)
+
+	signer := testSigner(t)
+	client := startClientHandlers(t, signer)
+
+	directMsg := ssh.Marshal(internal.ChannelOpenDirectMsg{Raddr: "127.0.0.1", Rport: 22, Laddr: "127.0.0.1", Lport: 1234})
+	forwardMsg := ssh.Marshal(internal.RemoteForwardRequest{BindAddr: "127.0.0.1", BindPort: 0})
+	tunMsg := ssh.Marshal(struct {
+		Mode uint32
+		No   uint32
+	}{tunModePointToPoint, tunIDAny})
+
+	t.Run("channels", func(t *testing.T) {
+		for _, c := range []struct {
+			channel, capability string
+			extra               []byte
+		}{
+			{"direct-tcpip", capabilities.LocalForward, directMsg},
+			{"direct-udp", capabilities.LocalUDPForward, directMsg},
+			{"socks-bind", capabilities.RemoteForward, directMsg},
+			{"tun@openssh.com", capabilities.Tun, tunMsg},
+		} {
+			expectProhibited(t, client, c.channel, c.extra, c.capability)
+		}
+	})
+
+	t.Run("global requests", func(t *testing.T) {
+		for _, c := range []struct {
+			request, capability string
+		}{
+			{"tcpip-forward", capabilities.RemoteForward},
+			{"udp-forward", capabilities.RemoteUDPForward},
+		} {
+			expectRefused(t, client, c.request, forwardMsg, c.capability)
+		}
+	})
+
+	t.Run("session", func(t *testing.T) {
+		for _, c := range []struct {
+			request    string
+			payload    []byte
+			capability string
+		}{
+			{"shell", nil, capabilities.Shell},
+			{"attach", ssh.Marshal(internal.ShellStruct{Cmd: "work"}), capabilities.Shell},
+			{"subsystem", ssh.Marshal(internal.ShellStruct{Cmd: "sftp"}), capabilities.SFTP},
+			{"subsystem", ssh.Marshal(internal.ShellStruct{Cmd: "list"}), capabilities.Subsystems},
+		} {
+			session, requests, err := client.OpenChannel("session", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go ssh.DiscardRequests(requests)
+
+			ok, err := session.SendRequest(c.request, true, c.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok {
+				t.Errorf("%s request was accepted with %s disabled", c.request, c.capability)
+			}
+			session.Close()
+		}
+
+		// exec replies before the command is looked at, so the refusal is written to the channel instead
+		for _, c := range []struct {
+			command, capability string
+		}{
+			{"id", capabilities.Exec},
+			// Detached sessions have their own request, so this is a program called attach
+			{"attach work", capabilities.Exec},
+			{"scp -t /tmp", capabilities.SFTP},
+			{"https://127.0.0.1/binary", capabilities.Exec},
+		} {
+			session, requests, err := client.OpenChannel("session", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go ssh.DiscardRequests(requests)
+
+			ok, err := session.SendRequest("exec", true, ssh.Marshal(internal.ShellStruct{Cmd: c.command}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !ok {
+				t.Fatalf("exec %q was not accepted", c.command)
+			}
+
+			output, _ := io.ReadAll(session)
+			if !strings.Contains(string(output), capabilities.Check(c.capability).Error()) {
+				t.Errorf("exec %q returned %q, expected it to be refused as %s is disabled", c.command, output, c.capability)
+			}
+			session.Close()
+		}
+	})
+
+	t.Run("jump", func(t *testing.T) {
+		jumpChannel, requests, err := client.OpenChannel("jump", ssh.Marshal(internal.JumpInfo{Owner: "test"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ssh.DiscardRequests(requests)
+
+		p1, p2 := net.Pipe()
+		go func() {
+			io.Copy(jumpChannel, p2)
+			jumpChannel.Close()
+		}()
+		go func() {
+			io.Copy(p2, jumpChannel)
+			p2.Close()
+		}()
+
+		jumpConn, chans, reqs, err := ssh.NewClientConn(p1, "", &ssh.ClientConfig{
+			User:            "test",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jumped := ssh.NewClient(jumpConn, chans, reqs)
+		defer jumped.Close()
+
+		for _, c := range []struct {
+			channel, capability string
+			extra               []byte
+		}{
+			{"session", capabilities.Shell, nil},
+			{"direct-tcpip", capabilities.LocalForward, directMsg},
+			{"direct-udp", capabilities.LocalUDPForward, directMsg},
+			{"tun@openssh.com", capabilities.Tun, tunMsg},
+		} {
+			expectProhibited(t, jumped, c.channel, c.extra, c.capability)
+		}
+
+		expectRefused(t, jumped, "tcpip-forward", forwardMsg, capabilities.RemoteForward)
+	})
+}
+
+func testSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// startClientHandlers serves the same channels and global requests as a connected client, returning the servers side of the connection
+func startClientHandlers(t *testing.T, signer ssh.Signer) *ssh.Client {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { sshConn.Close() })
+
+		session := connection.NewSession(sshConn)
+
+		go func() {
+			for r := range reqs {
+				switch r.Type {
+				case "tcpip-forward":
+					go StartRemoteForward(session, r, sshConn)
+				case "udp-forward":
+					go StartRemoteUDPForward(r, sshConn)
+				default:
+					r.Reply(false, nil)
+				}
+			}
+		}()
+
+		connection.RegisterChannelCallbacks(chans, logger.NewLog("capabilities_test"), map[string]func(newChannel ssh.NewChannel, log logger.Logger){
+			"session":         Session(session),
+			"jump":            JumpHandler(signer, sshConn),
+			"direct-tcpip":    LocalForward,
+			"direct-udp":      LocalUDPForward,
+			"socks-bind":      SocksBind,
+			"tun@openssh.com": Tun,
+		})
+	}()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func expectProhibited(t *testing.T, client *ssh.Client, channelType string, extra []byte, capability string) {
+	t.Helper()
+
+	channel, requests, err := client.OpenChannel(channelType, extra)
+	if err == nil {
+		go ssh.DiscardRequests(requests)
+		channel.Close()
+		t.Errorf("%s channel was accepted with %s disabled", channelType, capability)
+		return
+	}
+
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("%s channel: %s", channelType, err)
+	}
+
+	if openErr.Reason != ssh.Prohibited || !strings.Contains(openErr.Message, capability) {
+		t.Errorf("%s channel was rejected with %s (%q), expected it to be prohibited as %s is disabled", channelType, openErr.Reason, openErr.Message, capability)
+	}
+}
+
+func expectRefused(t *testing.T, client *ssh.Client, request string, payload []byte, capability string) {
+	t.Helper()
+
+	ok, reply, err := client.SendRequest(request, true, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok {
+		t.Errorf("%s request was accepted with %s disabled", request, capability)
+		return
+	}
+
+	if string(reply) != capabilities.Check(capability).Error() {
+		t.Errorf("%s request was refused with %q, expected it to be refused as %s is disabled", request, reply, capability)
+	}
+}
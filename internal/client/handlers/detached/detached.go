@@ -0,0 +1,262 @@
+package detached
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Maximum number of named shells that can be kept alive at once
+	MaxSessions = 8
+
+	// Maximum amount of output kept for each shell, replayed when it is re-attached
+	MaxScrollback = 256 * 1024
+)
+
+var (
+	lck      sync.Mutex
+	sessions = map[string]*session{}
+)
+
+type Info struct {
+	Name     string
+	Pid      int
+	Started  time.Time
+	Attached bool
+	Buffered int
+}
+
+type session struct {
+	sync.Mutex
+
+	name    string
+	started time.Time
+
+	cmd *exec.Cmd
+	pty io.ReadWriteCloser
+
+	scrollback []byte
+	attached   ssh.Channel
+	// Set once the pty is closed, so it is no longer resized
+	exited bool
+
+	done chan bool
+}
+
+// Attach binds the ssh channel to the named shell, starting it if it doesnt already exist. The shell is kept running when the channel closes
+func Attach(name, command string, ptyReq *internal.PtyReq, connection ssh.Channel, requests <-chan *ssh.Request, log logger.Logger) error {
+	if ptyReq == nil {
+		return errors.New("attaching to a detached session requires a pty")
+	}
+
+	if name == "" {
+		return errors.New("detached session name cannot be empty")
+	}
+
+	s, err := getOrCreate(name, command, ptyReq, log)
+	if err != nil {
+		return err
+	}
+
+	s.bind(connection)
+	defer s.unbind(connection)
+
+	if err := s.resize(ptyReq.Columns, ptyReq.Rows); err != nil {
+		log.Warning("Unable to set terminal size: %s", err)
+	}
+
+	go func() {
+		for req := range requests {
+			switch req.Type {
+			case "window-change":
+				w, h := internal.ParseDims(req.Payload)
+				if err := s.resize(w, h); err != nil {
+					log.Warning("Unable to set terminal size: %s", err)
+				}
+			default:
+				log.Warning("Unknown request %s", req.Type)
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}
+	}()
+
+	closed := make(chan bool)
+	go func() {
+		io.Copy(s.pty, connection)
+		close(closed)
+	}()
+
+	select {
+	case <-s.done:
+	case <-closed:
+	}
+
+	log.Info("Detached from session %q", name)
+
+	return nil
+}
+
+func getOrCreate(name, command string, ptyReq *internal.PtyReq, log logger.Logger) (*session, error) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if s, ok := sessions[name]; ok {
+		return s, nil
+	}
+
+	if len(sessions) >= MaxSessions {
+		return nil, fmt.Errorf("too many detached sessions (%d), kill one first", MaxSessions)
+	}
+
+	cmd, pty, err := start(command, ptyReq)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		name:    name,
+		started: time.Now(),
+		cmd:     cmd,
+		pty:     pty,
+		done:    make(chan bool),
+	}
+
+	sessions[name] = s
+
+	go s.pump(log)
+
+	log.Info("Started detachable session %q (pid %d)", name, cmd.Process.Pid)
+
+	return s, nil
+}
+
+// pump reads the shells output into the scrollback and to whichever channel is currently attached
+func (s *session) pump(log logger.Logger) {
+	buff := make([]byte, 4096)
+	for {
+		n, err := s.pty.Read(buff)
+		if n > 0 {
+			s.Lock()
+			if len(s.scrollback)+n > MaxScrollback {
+				s.scrollback = s.scrollback[len(s.scrollback)+n-MaxScrollback:]
+			}
+			s.scrollback = append(s.scrollback, buff[:n]...)
+
+			if s.attached != nil {
+				s.attached.Write(buff[:n])
+			}
+			s.Unlock()
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	s.cmd.Wait()
+
+	s.Lock()
+	s.pty.Close()
+	s.exited = true
+	s.Unlock()
+
+	lck.Lock()
+	delete(sessions, s.name)
+	lck.Unlock()
+
+	s.Lock()
+	if s.attached != nil {
+		s.attached.Close()
+		s.attached = nil
+	}
+	s.Unlock()
+
+	close(s.done)
+
+	log.Info("Detachable session %q exited", s.name)
+}
+
+func (s *session) resize(w, h uint32) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.exited {
+		return nil
+	}
+
+	return resize(s.pty, w, h)
+}
+
+func (s *session) bind(connection ssh.Channel) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Only one channel can drive the shell, the newest attachment wins
+	if s.attached != nil {
+		fmt.Fprintf(s.attached, "\r\n[rssh] session %q was attached elsewhere\r\n", s.name)
+		s.attached.Close()
+	}
+
+	s.attached = connection
+	connection.Write(s.scrollback)
+}
+
+func (s *session) unbind(connection ssh.Channel) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.attached == connection {
+		s.attached = nil
+	}
+}
+
+func List() (out []Info) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	for _, s := range sessions {
+		s.Lock()
+		out = append(out, Info{
+			Name:     s.name,
+			Pid:      s.cmd.Process.Pid,
+			Started:  s.started,
+			Attached: s.attached != nil,
+			Buffered: len(s.scrollback),
+		})
+		s.Unlock()
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	return out
+}
+
+func Kill(name string) error {
+	lck.Lock()
+	s, ok := sessions[name]
+	lck.Unlock()
+
+	if !ok {
+		return fmt.Errorf("detached session %q not found", name)
+	}
+
+	if err := s.cmd.Process.Kill(); err != nil {
+		return err
+	}
+
+	<-s.done
+	return nil
+}
@@ -0,0 +1,287 @@
+//go:build !windows
+
+package detached
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// testChannel stands in for the clients end of a session channel
+type testChannel struct {
+	net.Conn
+}
+
+func (c testChannel) CloseWrite() error {
+	return nil
+}
+
+func (c testChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (c testChannel) Stderr() io.ReadWriter {
+	return c
+}
+
+// terminal is the users end of an attached channel, collecting everything the shell prints
+type terminal struct {
+	t    *testing.T
+	conn net.Conn
+
+	lck    sync.Mutex
+	output bytes.Buffer
+
+	detached chan error
+}
+
+var testPty = &internal.PtyReq{Term: "xterm", Columns: 80, Rows: 24}
+
+func attach(t *testing.T, name string) *terminal {
+	t.Helper()
+
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh to run detached sessions with")
+	}
+
+	server, client := net.Pipe()
+	term := &terminal{t: t, conn: client, detached: make(chan error, 1)}
+
+	requests := make(chan *ssh.Request)
+	close(requests)
+
+	go func() {
+		term.detached <- Attach(name, "/bin/sh", testPty, testChannel{server}, requests, logger.NewLog("detached_test"))
+		server.Close()
+	}()
+
+	go func() {
+		buff := make([]byte, 4096)
+		for {
+			n, err := client.Read(buff)
+
+			term.lck.Lock()
+			term.output.Write(buff[:n])
+			term.lck.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+
+	return term
+}
+
+func (term *terminal) run(command string) {
+	term.t.Helper()
+
+	if _, err := term.conn.Write([]byte(command + "\n")); err != nil {
+		term.t.Fatal(err)
+	}
+}
+
+// waitFor waits for the shell to print s
+func (term *terminal) waitFor(s string) {
+	term.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		term.lck.Lock()
+		found := strings.Contains(term.output.String(), s)
+		term.lck.Unlock()
+
+		if found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	term.lck.Lock()
+	defer term.lck.Unlock()
+	term.t.Fatalf("shell did not print %q, got %q", s, term.output.String())
+}
+
+func (term *terminal) waitDetached() error {
+	term.t.Helper()
+
+	select {
+	case err := <-term.detached:
+		return err
+	case <-time.After(5 * time.Second):
+		term.t.Fatal("channel was not detached from the session")
+		return nil
+	}
+}
+
+func info(name string) (Info, bool) {
+	for _, s := range List() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Info{}, false
+}
+
+func killAll(t *testing.T) {
+	t.Cleanup(func() {
+		for _, s := range List() {
+			Kill(s.Name)
+		}
+	})
+}
+
+func TestAttachRequirements(t *testing.T) {
+	requests := make(chan *ssh.Request)
+	close(requests)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	if err := Attach("work", "/bin/sh", nil, testChannel{server}, requests, logger.NewLog("detached_test")); err == nil {
+		t.Error("a session was attached without a pty")
+	}
+
+	if err := Attach("", "/bin/sh", testPty, testChannel{server}, requests, logger.NewLog("detached_test")); err == nil {
+		t.Error("a session was attached without a name")
+	}
+
+	if len(List()) != 0 {
+		t.Errorf("sessions were started: %v", List())
+	}
+}
+
+func TestDetachAndReattach(t *testing.T) {
+	killAll(t)
+
+	first := attach(t, "work")
+	first.run("echo started-$((40+2))")
+	first.waitFor("started-42")
+
+	s, ok := info("work")
+	if !ok || !s.Attached || s.Pid == 0 {
+		t.Fatalf("expected an attached session, got %+v (found %t)", s, ok)
+	}
+
+	// Closing the channel leaves the shell running
+	first.conn.Close()
+	if err := first.waitDetached(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, ok = info("work")
+	if !ok || s.Attached {
+		t.Fatalf("expected the session to keep running detached, got %+v (found %t)", s, ok)
+	}
+
+	second := attach(t, "work")
+	// What was printed while attached before is replayed
+	second.waitFor("started-42")
+
+	second.run("echo again-$((1+1))")
+	second.waitFor("again-2")
+
+	if after, _ := info("work"); after.Pid != s.Pid {
+		t.Errorf("re-attaching started a new shell, pid %d became %d", s.Pid, after.Pid)
+	}
+}
+
+func TestAttachElsewhere(t *testing.T) {
+	killAll(t)
+
+	first := attach(t, "shared")
+	first.run("echo ready")
+	first.waitFor("ready")
+
+	second := attach(t, "shared")
+	second.waitFor("ready")
+
+	first.waitFor("attached elsewhere")
+	if err := first.waitDetached(); err != nil {
+		t.Fatal(err)
+	}
+
+	second.run("echo still-$((2+3))")
+	second.waitFor("still-5")
+}
+
+func TestShellExit(t *testing.T) {
+	killAll(t)
+
+	term := attach(t, "exiting")
+	term.run("exit")
+
+	if err := term.waitDetached(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := info("exiting"); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("session was kept after its shell exited")
+}
+
+func TestKill(t *testing.T) {
+	killAll(t)
+
+	term := attach(t, "doomed")
+	term.run("echo alive")
+	term.waitFor("alive")
+
+	if err := Kill("doomed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := info("doomed"); ok {
+		t.Error("session is still listed after it was killed")
+	}
+
+	if err := term.waitDetached(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Kill("doomed"); err == nil {
+		t.Error("killing a session that does not exist did not fail")
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	killAll(t)
+
+	var terms []*terminal
+	for i := 0; i < MaxSessions; i++ {
+		term := attach(t, "session"+string(rune('a'+i)))
+		term.run("echo up")
+		term.waitFor("up")
+		terms = append(terms, term)
+	}
+
+	extra := attach(t, "one-too-many")
+	if err := extra.waitDetached(); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Fatalf("expected the session over the limit to be refused, got %v", err)
+	}
+
+	// Existing sessions can still be attached to
+	again := attach(t, "sessiona")
+	again.waitFor("up")
+
+	if len(List()) != MaxSessions {
+		t.Errorf("expected %d sessions, got %d", MaxSessions, len(List()))
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package detached
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/creack/pty"
+)
+
+func start(command string, ptyReq *internal.PtyReq) (*exec.Cmd, io.ReadWriteCloser, error) {
+	shell := exec.Command(command)
+	shell.Env = append(os.Environ(), "TERM="+ptyReq.Term)
+
+	shellIO, err := pty.StartWithSize(shell, &pty.Winsize{Cols: uint16(ptyReq.Columns), Rows: uint16(ptyReq.Rows)})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return shell, shellIO, nil
+}
+
+func resize(shellIO io.ReadWriteCloser, w, h uint32) error {
+	if shellf, ok := shellIO.(*os.File); ok {
+		return pty.Setsize(shellf, &pty.Winsize{Cols: uint16(w), Rows: uint16(h)})
+	}
+	return nil
+}
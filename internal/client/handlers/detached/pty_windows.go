@@ -0,0 +1,19 @@
+//go:build windows
+
+package detached
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+func start(command string, ptyReq *internal.PtyReq) (*exec.Cmd, io.ReadWriteCloser, error) {
+	return nil, nil, errors.New("detached sessions are not supported on windows yet")
+}
+
+func resize(shellIO io.ReadWriteCloser, w, h uint32) error {
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
 	"github.com/NHAS/reverse_ssh/internal/client/connection"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
@@ -14,6 +15,10 @@ import (
 func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.NewChannel, log logger.Logger) {
 
 	return func(newChannel ssh.NewChannel, log logger.Logger) {
+		// Older servers send nothing
+		var jumpInfo internal.JumpInfo
+		ssh.Unmarshal(newChannel.ExtraData(), &jumpInfo)
+
 		jumpHandle, requests, err := newChannel.Accept()
 		if err != nil {
 			newChannel.Reject(ssh.ResourceShortage, err.Error())
@@ -53,6 +58,7 @@ func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.Ne
 		clientLog.Info("New SSH connection, version %s", conn.ClientVersion())
 
 		session := connection.NewSession(serverConn)
+		session.Owner = jumpInfo.Owner
 
 		go func(in <-chan *ssh.Request) {
 			for r := range in {
@@ -84,9 +90,20 @@ func JumpHandler(sshPriv ssh.Signer, serverConn ssh.Conn) func(newChannel ssh.Ne
 			}
 		}(reqs)
 
+		sessionHandler := Session(session)
+
 		err = connection.RegisterChannelCallbacks(chans, clientLog, map[string]func(newChannel ssh.NewChannel, log logger.Logger){
-			"session":         Session(session),
-			"direct-tcpip":    LocalForward,
+			"session": func(newChannel ssh.NewChannel, log logger.Logger) {
+				// Refuse up front rather than accepting a session that can only fail
+				if err := capabilities.CheckAny(capabilities.Shell, capabilities.Exec, capabilities.SFTP, capabilities.Subsystems); err != nil {
+					newChannel.Reject(ssh.Prohibited, err.Error())
+					return
+				}
+
+				sessionHandler(newChannel, log)
+			},
+			"direct-tcpip":    TrackedLocalForward(session),
+			"direct-udp":      LocalUDPForward,
 			"tun@openssh.com": Tun,
 		})
 
@@ -4,14 +4,34 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
+	"github.com/NHAS/reverse_ssh/internal/client/connection"
+	"github.com/NHAS/reverse_ssh/internal/forwards"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
 )
 
 func LocalForward(newChannel ssh.NewChannel, l logger.Logger) {
+	localForward(newChannel, l, nil)
+}
+
+// TrackedLocalForward is LocalForward for a jump session, each connection is listed by the forwards command until it closes
+func TrackedLocalForward(session *connection.Session) func(newChannel ssh.NewChannel, l logger.Logger) {
+	return func(newChannel ssh.NewChannel, l logger.Logger) {
+		localForward(newChannel, l, session)
+	}
+}
+
+func localForward(newChannel ssh.NewChannel, l logger.Logger, session *connection.Session) {
+	if err := capabilities.Check(capabilities.LocalForward); err != nil {
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
 	a := newChannel.ExtraData()
 
 	var drtMsg internal.ChannelOpenDirectMsg
@@ -42,6 +62,15 @@ func LocalForward(newChannel ssh.NewChannel, l logger.Logger) {
 	}
 	defer connection.Close()
 
+	if session != nil {
+		originator := net.JoinHostPort(drtMsg.Laddr, strconv.Itoa(int(drtMsg.Lport)))
+
+		f := forwards.Add(forwards.Local, session.Owner, "", originator, dest, connection.Close)
+		defer f.Remove()
+
+		tcpConn = f.Conn(tcpConn)
+	}
+
 	go ssh.DiscardRequests(requests)
 
 	go func() {
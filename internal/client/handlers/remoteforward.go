@@ -9,7 +9,9 @@ import (
 	"sync"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
 	"github.com/NHAS/reverse_ssh/internal/client/connection"
+	"github.com/NHAS/reverse_ssh/internal/forwards"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -53,6 +55,10 @@ func StopRemoteForward(rf internal.RemoteForwardRequest) error {
 }
 
 func StartRemoteForward(session *connection.Session, r *ssh.Request, sshConn ssh.Conn) {
+	if err := capabilities.Check(capabilities.RemoteForward); err != nil {
+		r.Reply(false, []byte(err.Error()))
+		return
+	}
 
 	var rf internal.RemoteForwardRequest
 	err := ssh.Unmarshal(r.Payload, &rf)
@@ -94,9 +100,22 @@ func StartRemoteForward(session *connection.Session, r *ssh.Request, sshConn ssh
 	}
 	currentRemoteForwardsLck.Unlock()
 
+	// Where connections end up is decided by whoever receives the forwarded-tcpip channels
+	kind, owner, target := forwards.ServerPort, "", "(server)"
+	if session != nil {
+		kind, owner, target = forwards.Remote, session.Owner, "(ssh client)"
+	}
+
+	f := forwards.Add(kind, owner, "", rf.String(), target, func() error {
+		return StopRemoteForward(rf)
+	})
+	defer f.Remove()
+
+	counted := f.Listener(l)
+
 	for {
 
-		proxyCon, err := l.Accept()
+		proxyCon, err := counted.Accept()
 		if err != nil {
 			return
 		}
@@ -109,7 +128,8 @@ func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh
 
 	log.Println("Accepted new connection: ", proxyCon.RemoteAddr())
 
-	originatorAddress, originatorPort, err := net.SplitHostPort(proxyCon.LocalAddr().String())
+	// The originator is whoever connected to us, rfc4254 7.2
+	originatorAddress, originatorPort, err := net.SplitHostPort(proxyCon.RemoteAddr().String())
 	if err != nil {
 		return err
 	}
@@ -13,7 +13,9 @@ import (
 	"strings"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
 	"github.com/NHAS/reverse_ssh/internal/client/connection"
+	"github.com/NHAS/reverse_ssh/internal/client/handlers/detached"
 	"github.com/NHAS/reverse_ssh/internal/client/handlers/subsystems"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
@@ -83,12 +85,28 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 				command := line.Command.Value()
 
 				if command == "scp" {
+					// scp is file transfer, so it falls under the same restriction as sftp rather than exec
+					if err := capabilities.Check(capabilities.SFTP); err != nil {
+						fmt.Fprintf(connection, "%s\n", err.Error())
+						return
+					}
+
 					scp(line.Chunks[1:], connection, log)
 					return
 				}
 
+				if err := capabilities.Check(capabilities.Exec); err != nil {
+					fmt.Fprintf(connection, "%s\n", err.Error())
+					return
+				}
+
 				u, ok := isUrl(command)
 				if ok {
+					if err := capabilities.Check(capabilities.Fileless); err != nil {
+						fmt.Fprintf(connection, "%s\n", err.Error())
+						return
+					}
+
 					command, err = download(session.ServerConnection, u)
 					if err != nil {
 						fmt.Fprintf(connection, "%s", err.Error())
@@ -103,8 +121,40 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 				runCommand(u.Query().Get("argv"), command, line.Chunks[1:], connection)
 
 				return
+			case "attach":
+				// Sent by connect --attach, it is a request of its own rather than an exec so it cant be mistaken for running a program called attach
+				var attach internal.ShellStruct
+				err := ssh.Unmarshal(req.Payload, &attach)
+				if err != nil || attach.Cmd == "" {
+					req.Reply(false, nil)
+					fmt.Fprintf(connection, "attach takes the name of the session to start or re-attach to\n")
+					return
+				}
+
+				if err := capabilities.Check(capabilities.Shell); err != nil {
+					log.Warning("Refused attach: %s", err)
+					req.Reply(false, []byte(err.Error()))
+					fmt.Fprintf(connection, "%s\n", err.Error())
+					return
+				}
+
+				req.Reply(true, nil)
+
+				err = detached.Attach(attach.Cmd, defaultShell(), session.Pty, connection, requests, log)
+				if err != nil {
+					fmt.Fprintf(connection, "%s\n", err.Error())
+				}
+				return
+
 			case "shell":
 
+				if err := capabilities.Check(capabilities.Shell); err != nil {
+					log.Warning("Refused shell: %s", err)
+					req.Reply(false, []byte(err.Error()))
+					fmt.Fprintf(connection, "%s\n", err.Error())
+					return
+				}
+
 				//We accept the shell request
 				req.Reply(true, nil)
 
@@ -121,6 +171,11 @@ func Session(session *connection.Session) func(newChannel ssh.NewChannel, log lo
 					command := parts[0]
 					u, ok := isUrl(parts[0])
 					if ok {
+						if err := capabilities.Check(capabilities.Fileless); err != nil {
+							fmt.Fprintf(connection, "%s\n", err.Error())
+							return
+						}
+
 						command, err = download(session.ServerConnection, u)
 						if err != nil {
 							fmt.Fprintf(connection, "%s", err.Error())
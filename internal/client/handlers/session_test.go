@@ -0,0 +1,80 @@
+//go:build !windows
+
+package handlers
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/handlers/detached"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAttachRequest(t *testing.T) {
+	if _, err := os.Stat(defaultShell()); err != nil {
+		t.Skipf("no shell to run detached sessions with: %s", err)
+	}
+
+	client := startClientHandlers(t, testSigner(t))
+	t.Cleanup(func() { detached.Kill("attach-test") })
+
+	session, requests, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	go ssh.DiscardRequests(requests)
+
+	if _, err := session.SendRequest("pty-req", true, ssh.Marshal(internal.PtyReq{Term: "xterm", Columns: 80, Rows: 24})); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := session.SendRequest("attach", true, ssh.Marshal(internal.ShellStruct{Cmd: "attach-test"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ok {
+		t.Fatal("attach request was refused")
+	}
+
+	if _, err := session.Write([]byte("echo attached-$((6*7))\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	output := make(chan []byte)
+	go func() {
+		var seen []byte
+		buff := make([]byte, 1024)
+		for {
+			n, err := session.Read(buff)
+			seen = append(seen, buff[:n]...)
+			if bytes.Contains(seen, []byte("attached-42")) || err != nil {
+				output <- seen
+				return
+			}
+		}
+	}()
+
+	select {
+	case seen := <-output:
+		if !strings.Contains(string(seen), "attached-42") {
+			t.Fatalf("shell did not run the command, got %q", seen)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the detached shell")
+	}
+
+	found := false
+	for _, s := range detached.List() {
+		found = found || s.Name == "attach-test"
+	}
+
+	if !found {
+		t.Error("attach did not start a detached session")
+	}
+}
@@ -203,13 +203,17 @@ func runCommandWithPty(argv string, command string, args []string, ptyReq *inter
 	shell.Wait()
 }
 
+func defaultShell() string {
+	if len(shells) != 0 {
+		return shells[0]
+	}
+	return ""
+}
+
 // This basically handles exactly like a SSH server would
 func shell(ptyReq *internal.PtyReq, connection ssh.Channel, requests <-chan *ssh.Request, log logger.Logger) {
 
-	path := ""
-	if len(shells) != 0 {
-		path = shells[0]
-	}
+	path := defaultShell()
 
 	if ptyReq != nil {
 		runCommandWithPty("", path, nil, ptyReq, requests, log, connection)
@@ -27,6 +27,13 @@ func shell(ptyReq *internal.PtyReq, connection ssh.Channel, requests <-chan *ssh
 		return
 	}
 
+	runCommandWithPty("", defaultShell(), nil, ptyReq, requests, log, connection)
+
+	connection.Close()
+
+}
+
+func defaultShell() string {
 	path, err := exec.LookPath("powershell.exe")
 	if err != nil {
 		path, err = exec.LookPath("cmd.exe")
@@ -34,11 +41,7 @@ func shell(ptyReq *internal.PtyReq, connection ssh.Channel, requests <-chan *ssh
 			path = "C:\\WINDOWS\\System32\\WindowsPowerShell\\v1.0\\powershell.exe"
 		}
 	}
-
-	runCommandWithPty("", path, nil, ptyReq, requests, log, connection)
-
-	connection.Close()
-
+	return path
 }
 
 func runCommandWithPty(argv, command string, args []string, pty *internal.PtyReq, requests <-chan *ssh.Request, log logger.Logger, connection ssh.Channel) {
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long a socks BIND waits for the peer to connect
+const socksBindTimeout = 2 * time.Minute
+
+// SocksBind listens for a single tcp connection for a SOCKS BIND on the server. Once listening a "bound" request is sent with the address,
+// and when the peer connects a "connected" request with its address, after which the channel carries the connection
+func SocksBind(newChannel ssh.NewChannel, l logger.Logger) {
+	// Listening for a connection is a remote forward in all but name
+	if err := capabilities.Check(capabilities.RemoteForward); err != nil {
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	var drtMsg internal.ChannelOpenDirectMsg
+	err := ssh.Unmarshal(newChannel.ExtraData(), &drtMsg)
+	if err != nil {
+		l.Warning("Unable to unmarshal socks bind %s", err)
+		newChannel.Reject(ssh.ResourceShortage, "Unable to unmarshal socks bind")
+		return
+	}
+
+	// Listen on the address the peer would reach us on, the wildcard address is no use to tell the socks client
+	bindAddr := ""
+	peer := net.JoinHostPort(drtMsg.Raddr, strconv.Itoa(int(drtMsg.Rport)))
+	if route, err := net.Dial("udp", peer); err == nil {
+		bindAddr = route.LocalAddr().(*net.UDPAddr).IP.String()
+		route.Close()
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindAddr, "0"))
+	if err != nil {
+		l.Warning("Unable to listen for socks bind: %s", err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer listener.Close()
+
+	connection, requests, err := newChannel.Accept()
+	if err != nil {
+		l.Warning("Unable to accept new channel %s", err)
+		return
+	}
+	defer connection.Close()
+
+	go func() {
+		ssh.DiscardRequests(requests)
+		// The server gave up waiting
+		listener.Close()
+	}()
+
+	bound := listener.Addr().(*net.TCPAddr)
+	if bindAddr == "" {
+		bindAddr = bound.IP.String()
+	}
+
+	_, err = connection.SendRequest("bound", false, ssh.Marshal(&internal.RemoteForwardRequest{
+		BindAddr: bindAddr,
+		BindPort: uint32(bound.Port),
+	}))
+	if err != nil {
+		return
+	}
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(socksBindTimeout))
+
+	tcpConn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer tcpConn.Close()
+
+	listener.Close()
+
+	remote := tcpConn.RemoteAddr().(*net.TCPAddr)
+
+	l.Info("Socks bind on %s accepted connection from %s", bound, remote)
+
+	_, err = connection.SendRequest("connected", false, ssh.Marshal(&internal.RemoteForwardRequest{
+		BindAddr: remote.IP.String(),
+		BindPort: uint32(remote.Port),
+	}))
+	if err != nil {
+		return
+	}
+
+	go func() {
+		defer tcpConn.Close()
+		defer connection.Close()
+
+		io.Copy(connection, tcpConn)
+	}()
+
+	io.Copy(tcpConn, connection)
+}
@@ -0,0 +1,49 @@
+package subsystems
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/client/handlers/detached"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"golang.org/x/crypto/ssh"
+)
+
+type detachedSessions bool
+
+func (d *detachedSessions) Execute(line terminal.ParsedLine, connection ssh.Channel, subsystemReq *ssh.Request) error {
+	subsystemReq.Reply(true, nil)
+
+	if line.IsSet("k") {
+		name, err := line.GetArgString("k")
+		if err != nil {
+			fmt.Fprintf(connection, "detached -k takes the name of the session to kill\n")
+			return nil
+		}
+
+		if err := detached.Kill(name); err != nil {
+			fmt.Fprintf(connection, "%s\n", err.Error())
+			return nil
+		}
+
+		fmt.Fprintf(connection, "killed %s\n", name)
+		return nil
+	}
+
+	sessions := detached.List()
+	if len(sessions) == 0 {
+		fmt.Fprintf(connection, "no detached sessions\n")
+		return nil
+	}
+
+	for _, s := range sessions {
+		state := "detached"
+		if s.Attached {
+			state = "attached"
+		}
+
+		fmt.Fprintf(connection, "%s pid: %d, started: %s, %s, scrollback: %d bytes\n", s.Name, s.Pid, s.Started.Format(time.RFC3339), state, s.Buffered)
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package subsystems
 import (
 	"fmt"
 
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"golang.org/x/crypto/ssh"
 )
@@ -11,6 +12,8 @@ import (
 var subsystems = map[string]subsystem{
 	"sftp": new(subSftp),
 	"list": new(list),
+
+	"detached": new(detachedSessions),
 }
 
 type subsystem interface {
@@ -24,6 +27,19 @@ func RunSubsystems(connection ssh.Channel, req *ssh.Request) error {
 	}
 
 	line := terminal.ParseLine(string(req.Payload[4:]), 0)
+
+	capability := capabilities.Subsystems
+	if line.Command.Value() == "sftp" {
+		capability = capabilities.SFTP
+	}
+
+	for _, c := range []string{capability, capabilities.Subsystem(line.Command.Value())} {
+		if err := capabilities.Check(c); err != nil {
+			req.Reply(false, []byte(err.Error()))
+			return err
+		}
+	}
+
 	if subsys, ok := subsystems[line.Command.Value()]; ok {
 
 		return subsys.Execute(line, connection, req)
@@ -1,27 +1,26 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os/exec"
 	"reflect"
 	"runtime"
-	"strings"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"unsafe"
 
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/udpproxy"
 	"github.com/go-ping/ping"
 	"github.com/inetaf/tcpproxy"
 	"gvisor.dev/gvisor/pkg/buffer"
@@ -30,12 +29,12 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/checksum"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
-	"gvisor.dev/gvisor/pkg/tcpip/header/parse"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
-	"gvisor.dev/gvisor/pkg/tcpip/transport/raw"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"gvisor.dev/gvisor/pkg/waiter"
@@ -43,6 +42,14 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// Tunnel modes and the "any" tunnel number, as sent by openssh in the tun@openssh.com channel
+const (
+	tunModePointToPoint = 1
+	tunModeEthernet     = 2
+
+	tunIDAny = 0x7fffffff
+)
+
 var (
 	nicIds    = map[tcpip.NICID]bool{}
 	nicIdsLck sync.Mutex
@@ -50,6 +57,7 @@ var (
 
 type stat struct {
 	NICID tcpip.NICID
+	l     logger.Logger
 
 	closed bool
 
@@ -62,6 +70,36 @@ type stat struct {
 		active   atomic.Int64
 		failures atomic.Int64
 	}
+
+	policy struct {
+		denied atomic.Int64
+	}
+
+	tunPolicy *tunSessionPolicy
+}
+
+// allow checks a new flow against the tun policy, counting and logging anything that is refused
+// An allowed tcp or udp flow holds one of the tunnels flow slots until release is called
+func (s *stat) allow(protocol string, destination tcpip.Address, port uint16) bool {
+	addr, _ := netip.AddrFromSlice(destination.AsSlice())
+
+	if err := s.tunPolicy.admit(protocol, addr, port); err != nil {
+		s.policy.denied.Add(1)
+
+		target := addr.String()
+		if protocol != "icmp" {
+			target = net.JoinHostPort(target, fmt.Sprintf("%d", port))
+		}
+
+		s.l.Warning("TUN NIC %d refused %s to %s: %s", uint32(s.NICID), protocol, target, err)
+		return false
+	}
+
+	return true
+}
+
+func (s *stat) release() {
+	s.tunPolicy.release()
 }
 
 func (s *stat) statsPrinter(l logger.Logger) {
@@ -72,6 +110,8 @@ func (s *stat) statsPrinter(l logger.Logger) {
 	pastUdpActive := s.udp.active.Load()
 	pastUdpFail := s.udp.failures.Load()
 
+	pastDenied := s.policy.denied.Load()
+
 	for !s.closed {
 
 		currentTcpActive := s.tcp.active.Load()
@@ -80,14 +120,18 @@ func (s *stat) statsPrinter(l logger.Logger) {
 		currentUdpActive := s.udp.active.Load()
 		currentUdpFail := s.udp.failures.Load()
 
-		if currentUdpActive != pastUdpActive || currentUdpFail != pastUdpFail || currentTcpActive != pastTcpActive || currentTcpFail != pastTcpFail {
-			l.Info("TUN NIC %d Stats: TCP streams: %d, TCP failures: %d, UDP connections: %d, UDP failures: %d", uint32(s.NICID), currentTcpActive, currentTcpFail, currentUdpActive, currentUdpFail)
+		currentDenied := s.policy.denied.Load()
+
+		if currentUdpActive != pastUdpActive || currentUdpFail != pastUdpFail || currentTcpActive != pastTcpActive || currentTcpFail != pastTcpFail || currentDenied != pastDenied {
+			l.Info("TUN NIC %d Stats: TCP streams: %d, TCP failures: %d, UDP connections: %d, UDP failures: %d, Policy denied: %d (policy: %s)", uint32(s.NICID), currentTcpActive, currentTcpFail, currentUdpActive, currentUdpFail, currentDenied, s.tunPolicy)
 
 			pastTcpActive = currentTcpActive
 			pastTcpFail = currentTcpFail
 
 			pastUdpActive = currentUdpActive
 			pastUdpFail = currentUdpFail
+
+			pastDenied = currentDenied
 		}
 
 		time.Sleep(1 * time.Second)
@@ -103,6 +147,11 @@ func Tun(newChannel ssh.NewChannel, l logger.Logger) {
 		}
 	}()
 
+	if err := capabilities.Check(capabilities.Tun); err != nil {
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
 	var tunInfo struct {
 		Mode uint32
 		No   uint32
@@ -115,11 +164,33 @@ func Tun(newChannel ssh.NewChannel, l logger.Logger) {
 		return
 	}
 
-	if tunInfo.Mode != 1 {
-		newChannel.Reject(ssh.ConnectionFailed, "connection closed")
+	if tunInfo.Mode != tunModePointToPoint && tunInfo.Mode != tunModeEthernet {
+		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unsupported tunnel mode %d", tunInfo.Mode))
 		return
 	}
 
+	ethernetMode := tunInfo.Mode == tunModeEthernet
+
+	policy := newTunSessionPolicy()
+	defer policy.close()
+
+	// In ethernet mode a specific tunnel number picks the client interface (by index) to bridge to
+	// If that isnt possible we fall back to emulating a segment with just us on it
+	var bridge frameConn
+	if ethernetMode && tunInfo.No != tunIDAny && policy.active() {
+		l.Info("Not bridging to interface %d as the tun policy cannot be enforced on raw frames, using userland ethernet emulation", tunInfo.No)
+	} else if ethernetMode && tunInfo.No != tunIDAny {
+		iface, err := net.InterfaceByIndex(int(tunInfo.No))
+		if err != nil {
+			l.Info("No interface with index %d to bridge, using userland ethernet emulation", tunInfo.No)
+		} else {
+			bridge, err = openBridge(iface)
+			if err != nil {
+				l.Warning("Unable to bridge to %s, using userland ethernet emulation: %s", iface.Name, err)
+			}
+		}
+	}
+
 	var NICID tcpip.NICID
 
 	allocatedNicId := false
@@ -172,44 +243,91 @@ func Tun(newChannel ssh.NewChannel, l logger.Logger) {
 	}
 	defer tunnel.Close()
 
+	if bridge != nil {
+		defer bridge.Close()
+
+		sshEP, err := NewSSHEndpoint(tunnel, l)
+		if err != nil {
+			l.Error("failed to create new SSH endpoint: %s", err)
+			return
+		}
+
+		go ssh.DiscardRequests(req)
+
+		// Raw frames cannot be filtered, so a policy set while bridged ends the bridge rather than leaving it unenforced
+		policy.onChange(func() {
+			if policy.active() {
+				l.Info("Closing TAP bridge to %s as a tun policy was set", bridge)
+				bridge.Close()
+			}
+		})
+
+		l.Info("New TAP bridge to %s created", bridge)
+		bridgeFrames(sshEP, bridge, l)
+		l.Info("TAP bridge to %s ended", bridge)
+
+		return
+	}
+
 	l.Info("New TUN NIC %d created", uint32(NICID))
 
+	networkProtocols := []stack.NetworkProtocolFactory{
+		ipv4.NewProtocol,
+		ipv6.NewProtocol,
+	}
+
+	if ethernetMode {
+		// As spoofing is enabled below, the arp endpoint will answer for every address which makes us the segments default gateway
+		networkProtocols = append(networkProtocols, arp.NewProtocol)
+	}
+
 	// Create a new gvisor userland network stack.
 	ns := stack.New(stack.Options{
-		NetworkProtocols: []stack.NetworkProtocolFactory{
-			ipv4.NewProtocol,
-			ipv6.NewProtocol,
-		},
+		NetworkProtocols: networkProtocols,
 		TransportProtocols: []stack.TransportProtocolFactory{
 			tcp.NewProtocol,
 			udp.NewProtocol,
 			icmp.NewProtocol4,
+			icmp.NewProtocol6,
 		},
 		HandleLocal: false,
 	})
 	defer ns.Close()
 
-	linkEP, err := NewSSHEndpoint(tunnel, l)
+	sshEP, err := NewSSHEndpoint(tunnel, l)
 	if err != nil {
 		l.Error("failed to create new SSH endpoint: %s", err)
 		return
 	}
 
+	var tunStat stat
+	tunStat.NICID = NICID
+	tunStat.l = l
+	tunStat.tunPolicy = policy
+
+	if policy.active() {
+		l.Info("TUN NIC %d policy: %s", uint32(NICID), policy)
+	}
+
+	sshEP.echoHandler = icmpResponder(ns, &tunStat)
+
+	var linkEP stack.LinkEndpoint = sshEP
+	if ethernetMode {
+		err = sshEP.UseEthernet()
+		if err != nil {
+			l.Error("failed to set up ethernet endpoint: %s", err)
+			return
+		}
+
+		linkEP = ethernet.New(sshEP)
+	}
+
 	// Create a new NIC
 	if err := ns.CreateNIC(NICID, linkEP); err != nil {
 		l.Error("CreateNIC: %v", err)
 		return
 	}
 
-	err = icmpResponder(ns)
-	if err != nil {
-		l.Error("Unable to create icmp responder: %v", err)
-		return
-	}
-
-	var tunStat stat
-	tunStat.NICID = NICID
-
 	go tunStat.statsPrinter(l)
 	defer func() {
 		tunStat.closed = true
@@ -258,23 +376,79 @@ func Tun(newChannel ssh.NewChannel, l logger.Logger) {
 	l.Info("TUN NIC %d ended", uint32(NICID))
 }
 
+// frameConn is a real client interface, where each Read returns a single ethernet frame and each Write sends one
+type frameConn interface {
+	io.ReadWriteCloser
+	fmt.Stringer
+}
+
+// bridgeFrames copies frames between the tunnel and a client interface until either side closes
+func bridgeFrames(sshEP *SSHEndpoint, bridge frameConn, l logger.Logger) {
+	go func() {
+		defer bridge.Close()
+
+		for {
+			frame, err := sshEP.ReadSSHPacket()
+			if err != nil {
+				return
+			}
+
+			if len(frame) < 4+header.EthernetMinimumSize {
+				continue
+			}
+
+			// The interface takes plain frames, without the tuntap header
+			if _, err := bridge.Write(frame[4:]); err != nil {
+				l.Warning("failed to write frame to %s: %s", bridge, err)
+				return
+			}
+		}
+	}()
+
+	defer sshEP.Close()
+
+	// Large enough for frames coalesced by receive offloading, after room for the tuntap header
+	buff := make([]byte, 4+65536)
+	for {
+		n, err := bridge.Read(buff[4:])
+		if err != nil {
+			return
+		}
+
+		if n < header.EthernetMinimumSize {
+			continue
+		}
+
+		copy(buff, tuntapHeader(header.Ethernet(buff[4:]).Type()))
+		if _, err := sshEP.tunnel.Write(buff[:4+n]); err != nil {
+			return
+		}
+	}
+}
+
 func forwardUDP(tunstats *stat) func(request *udp.ForwarderRequest) {
 	return func(request *udp.ForwarderRequest) {
 		id := request.ID()
 
+		if !tunstats.allow("udp", id.LocalAddress, id.LocalPort) {
+			return
+		}
+
 		var wq waiter.Queue
 		ep, iperr := request.CreateEndpoint(&wq)
 		if iperr != nil {
+			tunstats.release()
 			tunstats.udp.failures.Add(1)
 
 			log.Println("[+] failed to create endpoint for udp: ", iperr)
 			return
 		}
 
-		p, _ := NewUDPProxy(&autoStoppingListener{underlying: gonet.NewUDPConn(&wq, ep)}, func() (net.Conn, error) {
-			return net.Dial("udp", fmt.Sprintf("%s:%d", id.LocalAddress, id.LocalPort))
+		p, _ := udpproxy.New(&autoStoppingListener{underlying: gonet.NewUDPConn(&wq, ep)}, func(net.Addr) (net.Conn, error) {
+			return net.Dial("udp", net.JoinHostPort(id.LocalAddress.String(), fmt.Sprintf("%d", id.LocalPort)))
 		})
 		go func() {
+			defer tunstats.release()
 
 			tunstats.udp.active.Add(1)
 			defer tunstats.udp.active.Add(-1)
@@ -295,6 +469,12 @@ func forwardTCP(tunstats *stat) func(request *tcp.ForwarderRequest) {
 	return func(request *tcp.ForwarderRequest) {
 		id := request.ID()
 
+		if !tunstats.allow("tcp", id.LocalAddress, id.LocalPort) {
+			request.Complete(true)
+			return
+		}
+		defer tunstats.release()
+
 		fwdDst := net.TCPAddr{
 			IP:   net.ParseIP(id.LocalAddress.String()),
 			Port: int(id.LocalPort),
@@ -342,6 +522,13 @@ type SSHEndpoint struct {
 	dispatcher stack.NetworkDispatcher
 	tunnel     ssh.Channel
 
+	// Ethernet endpoints pass whole frames after the tuntap header, and need to be wrapped with ethernet.New
+	ethernet    bool
+	linkAddress tcpip.LinkAddress
+
+	// Takes IP packets before they are delivered to the stack, returning true if it has dealt with the packet
+	echoHandler func(packet []byte) bool
+
 	channelPtr unsafe.Pointer
 
 	pending *sshBuffer
@@ -383,6 +570,22 @@ func NewSSHEndpoint(dev ssh.Channel, l logger.Logger) (*SSHEndpoint, error) {
 	return r, nil
 }
 
+// UseEthernet switches the endpoint to carrying ethernet frames (openssh -o Tunnel=ethernet) with a random locally administered MAC
+func (m *SSHEndpoint) UseEthernet() error {
+	mac := make([]byte, header.EthernetAddressSize)
+	if _, err := rand.Read(mac); err != nil {
+		return err
+	}
+
+	// Locally administered, unicast
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+
+	m.ethernet = true
+	m.linkAddress = tcpip.LinkAddress(mac)
+
+	return nil
+}
+
 func (m *SSHEndpoint) ReadSSHPacket() ([]byte, error) {
 	buff, err := m.pending.ReadSingle()
 	if err != nil {
@@ -408,7 +611,7 @@ func (m *SSHEndpoint) SetOnCloseAction(func()) {
 }
 
 func (m *SSHEndpoint) SetLinkAddress(addr tcpip.LinkAddress) {
-
+	m.linkAddress = addr
 }
 
 func (m *SSHEndpoint) SetMTU(uint32) {
@@ -436,7 +639,7 @@ func (m *SSHEndpoint) MaxHeaderLength() uint16 {
 
 // LinkAddress implements stack.LinkEndpoint.
 func (m *SSHEndpoint) LinkAddress() tcpip.LinkAddress {
-	return ""
+	return m.linkAddress
 }
 
 // Attach implements stack.LinkEndpoint.
@@ -523,10 +726,44 @@ func (m *SSHEndpoint) dispatchLoop() {
 		//   Flags [2 bytes]
 		//   Proto [2 bytes]
 		//   Raw protocol(IP, IPv6, etc) frame.
+		// Openssh opens tap devices without IFF_NO_PI as well, so ethernet frames have it too
 
 		//Remove that
 		packet = packet[4:]
 
+		if m.ethernet {
+			if len(packet) < header.EthernetMinimumSize {
+				continue
+			}
+
+			payload := packet[header.EthernetMinimumSize:]
+			switch header.Ethernet(packet).Type() {
+			case header.IPv4ProtocolNumber, header.IPv6ProtocolNumber:
+				if m.intercept(payload) {
+					continue
+				}
+
+				readdressSolicitation(payload)
+			case header.ARPProtocolNumber:
+				if isAddressProbe(payload) {
+					continue
+				}
+			}
+
+			// The ethernet endpoint wrapping us consumes the link header and picks the protocol from it
+			pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Payload: buffer.MakeWithData(packet),
+			})
+
+			m.dispatcher.DeliverNetworkPacket(0, pkb)
+			pkb.DecRef()
+			continue
+		}
+
+		if m.intercept(packet) {
+			continue
+		}
+
 		switch header.IPVersion(packet) {
 		case header.IPv4Version:
 
@@ -550,6 +787,49 @@ func (m *SSHEndpoint) dispatchLoop() {
 
 }
 
+func (m *SSHEndpoint) intercept(packet []byte) bool {
+	return m.echoHandler != nil && len(packet) > 0 && m.echoHandler(packet)
+}
+
+// readdressSolicitation points neighbor solicitations sent to a solicited-node group at the address being solicited
+// The stack has no addresses so it hasnt joined any groups, but with spoofing it will answer for any unicast address, the same as it does for ARP
+func readdressSolicitation(packet []byte) {
+	iph := header.IPv6(packet)
+	if header.IPVersion(packet) != header.IPv6Version || !iph.IsValid(len(packet)) || iph.NextHeader() != uint8(header.ICMPv6ProtocolNumber) {
+		return
+	}
+
+	destination := iph.DestinationAddress()
+	if !header.IsSolicitedNodeAddr(destination) || iph.SourceAddress() == header.IPv6Any {
+		// Solicitations from the unspecified address are duplicate address detection, which we should never answer
+		return
+	}
+
+	solicitation := header.ICMPv6(iph.Payload())
+	if len(solicitation) < header.ICMPv6NeighborSolicitMinimumSize || solicitation.Type() != header.ICMPv6NeighborSolicit {
+		return
+	}
+
+	target := header.NDPNeighborSolicit(solicitation.MessageBody()).TargetAddress()
+	if header.SolicitedNodeAddr(target) != destination {
+		return
+	}
+
+	solicitation.UpdateChecksumPseudoHeaderAddress(destination, target)
+	iph.SetDestinationAddress(target)
+}
+
+// isAddressProbe returns true for ARP probes and announcements, which are the peer checking or claiming its own address
+func isAddressProbe(packet []byte) bool {
+	arpHdr := header.ARP(packet)
+	if !arpHdr.IsValid() || arpHdr.Op() != header.ARPRequest {
+		return false
+	}
+
+	sender := tcpip.AddrFrom4Slice(arpHdr.ProtocolAddressSender())
+	return sender == header.IPv4Any || sender == tcpip.AddrFrom4Slice(arpHdr.ProtocolAddressTarget())
+}
+
 // IsAttached implements stack.LinkEndpoint.
 func (m *SSHEndpoint) IsAttached() bool {
 	return m.dispatcher != nil
@@ -576,13 +856,8 @@ func (m *SSHEndpoint) writePacket(pkt *stack.PacketBuffer) tcpip.Error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	// 3.2 Frame Format
-	// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/Documentation/networking/tuntap.rst?id=HEAD
-	packet := make([]byte, 4)
-	binary.BigEndian.PutUint16(packet, 1)
-	binary.BigEndian.PutUint16(packet[2:], uint16(pkt.NetworkProtocolNumber))
-
-	packet = append(packet, pktBuf...)
+	// Frames from the wrapping ethernet endpoint already have their link header, but still need the tuntap one
+	packet := append(tuntapHeader(pkt.NetworkProtocolNumber), pktBuf...)
 
 	if _, err := m.tunnel.Write(packet); err != nil {
 
@@ -596,6 +871,17 @@ func (m *SSHEndpoint) writePacket(pkt *stack.PacketBuffer) tcpip.Error {
 	return nil
 }
 
+// tuntapHeader is the 4 byte header openssh expects in front of every packet or frame
+// 3.2 Frame Format
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/Documentation/networking/tuntap.rst?id=HEAD
+func tuntapHeader(proto tcpip.NetworkProtocolNumber) []byte {
+	packet := make([]byte, 4)
+	binary.BigEndian.PutUint16(packet, 1)
+	binary.BigEndian.PutUint16(packet[2:], uint16(proto))
+
+	return packet
+}
+
 // Wait implements stack.LinkEndpoint.Wait.
 func (m *SSHEndpoint) Wait() {}
 
@@ -613,63 +899,91 @@ func (*SSHEndpoint) WriteRawPacket(*stack.PacketBuffer) tcpip.Error {
 	return &tcpip.ErrNotSupported{}
 }
 
-func icmpResponder(s *stack.Stack) error {
+// icmpResponder answers echo requests for the hosts they are addressed to, but only if that host is actually up
+// The endpoint hands echo requests to this before the stack sees them, as the stack would answer for every address itself
+func icmpResponder(s *stack.Stack, tunstats *stat) func(packet []byte) bool {
+	resolve := resolveHost
 
-	var wq waiter.Queue
-	rawProto, rawerr := raw.NewEndpoint(s, ipv4.ProtocolNumber, icmp.ProtocolNumber4, &wq)
-	if rawerr != nil {
-		return errors.New("could not create raw endpoint")
-	}
-	if err := rawProto.Bind(tcpip.FullAddress{}); err != nil {
-		return errors.New("could not bind raw endpoint")
-	}
-	go func() {
-		we, ch := waiter.NewChannelEntry(waiter.ReadableEvents)
-		wq.EventRegister(&we)
-		for {
-			var buff bytes.Buffer
-			_, err := rawProto.Read(&buff, tcpip.ReadOptions{})
-			if _, ok := err.(*tcpip.ErrWouldBlock); ok {
-				// Wait for data to become available.
+	return func(packet []byte) bool {
+		switch header.IPVersion(packet) {
+		case header.IPv4Version:
+			iph := header.IPv4(packet)
+			if !iph.IsValid(len(packet)) || iph.TransportProtocol() != header.ICMPv4ProtocolNumber || iph.More() || iph.FragmentOffset() != 0 {
+				return false
+			}
+
+			hlen := int(iph.HeaderLength())
+			request := header.ICMPv4(packet[hlen:iph.TotalLength()])
+			if len(request) < header.ICMPv4MinimumSize || request.Type() != header.ICMPv4Echo {
+				return false
+			}
+
+			destination := iph.DestinationAddress()
+			if destination == header.IPv4Broadcast || header.IsV4MulticastAddress(destination) {
+				return false
+			}
+
+			if !tunstats.allow("icmp", destination, 0) {
+				return true
+			}
+
+			// Reconstruct a ICMP PacketBuffer from bytes.
+			packetbuff := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Payload: buffer.MakeWithData(packet[:iph.TotalLength()]),
+			})
 
-				for range ch {
+			packetbuff.NetworkProtocolNumber = ipv4.ProtocolNumber
+			packetbuff.TransportProtocolNumber = icmp.ProtocolNumber4
+			packetbuff.NetworkHeader().Consume(hlen)
+			packetbuff.TransportHeader().Consume(header.ICMPv4MinimumSize)
 
-					_, err := rawProto.Read(&buff, tcpip.ReadOptions{})
+			go func() {
+				if resolve(destination.String()) {
+					ProcessICMP(s, packetbuff)
+					return
+				}
+				packetbuff.DecRef()
+			}()
 
-					if err != nil {
+			return true
 
-						continue
-					}
+		case header.IPv6Version:
+			iph := header.IPv6(packet)
+			// Echo requests with extension headers are left to the stack
+			if !iph.IsValid(len(packet)) || iph.NextHeader() != uint8(header.ICMPv6ProtocolNumber) {
+				return false
+			}
 
-					iph := header.IPv4(buff.Bytes())
+			request := header.ICMPv6(iph.Payload())
+			if len(request) < header.ICMPv6EchoMinimumSize || request.Type() != header.ICMPv6EchoRequest {
+				return false
+			}
 
-					hlen := int(iph.HeaderLength())
-					if buff.Len() < hlen {
-						return
-					}
+			destination, source := iph.DestinationAddress(), iph.SourceAddress()
+			if header.IsV6MulticastAddress(destination) {
+				return false
+			}
 
-					// Reconstruct a ICMP PacketBuffer from bytes.
-					view := buffer.MakeWithData(buff.Bytes())
-					packetbuff := stack.NewPacketBuffer(stack.PacketBufferOptions{
-						Payload:            view,
-						ReserveHeaderBytes: hlen,
-					})
+			if request.Checksum() != header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: request, Src: source, Dst: destination}) {
+				// Claim it anyway, the stack shouldnt answer it either
+				return true
+			}
 
-					packetbuff.NetworkProtocolNumber = ipv4.ProtocolNumber
-					packetbuff.TransportProtocolNumber = icmp.ProtocolNumber4
-					packetbuff.NetworkHeader().Consume(hlen)
+			if !tunstats.allow("icmp", destination, 0) {
+				return true
+			}
 
-					go func() {
-						if TryResolve(iph.DestinationAddress().String()) {
-							ProcessICMP(s, packetbuff)
-						}
-					}()
+			go func() {
+				if resolve(destination.String()) {
+					ProcessICMPv6(s, destination, source, request)
 				}
-			}
+			}()
 
+			return true
 		}
-	}()
-	return nil
+
+		return false
+	}
 }
 
 // ProcessICMP send back a ICMP echo reply from after receiving a echo request.
@@ -713,7 +1027,8 @@ func ProcessICMP(nstack *stack.Stack, pkt *stack.PacketBuffer) {
 			localAddr = tcpip.Address{}
 		}
 
-		r, err := nstack.FindRoute(1, localAddr, ipHdr.SourceAddress(), ipv4.ProtocolNumber, false /* multicastLoop */)
+		// Every tun has its own stack with a single NIC, so let the stack pick it
+		r, err := nstack.FindRoute(0, localAddr, ipHdr.SourceAddress(), ipv4.ProtocolNumber, false /* multicastLoop */)
 		if err != nil {
 			// If we cannot find a route to the destination, silently drop the packet.
 			return
@@ -746,15 +1061,7 @@ func ProcessICMP(nstack *stack.Stack, pkt *stack.PacketBuffer) {
 		})
 		defer replyPkt.DecRef()
 
-		// Populate the network/transport headers in the packet buffer so the
-		// ICMP packet goes through IPTables.
-		if ok := parse.IPv4(replyPkt); !ok {
-			panic("expected to parse IPv4 header we just created")
-		}
-		if ok := parse.ICMPv4(replyPkt); !ok {
-			panic("expected to parse ICMPv4 header we just created")
-		}
-
+		// WriteHeaderIncludedPacket takes the IP header from the data, so unlike gvisor it cannot be parsed into the network header here
 		replyPkt.TransportProtocolNumber = header.ICMPv4ProtocolNumber
 		if err := r.WriteHeaderIncludedPacket(replyPkt); err != nil {
 			return
@@ -762,6 +1069,43 @@ func ProcessICMP(nstack *stack.Stack, pkt *stack.PacketBuffer) {
 	}
 }
 
+// ProcessICMPv6 sends an echo reply from localAddr to remoteAddr, for the ICMPv6 echo request that remoteAddr sent
+func ProcessICMPv6(nstack *stack.Stack, localAddr, remoteAddr tcpip.Address, request header.ICMPv6) {
+
+	r, err := nstack.FindRoute(0, localAddr, remoteAddr, ipv6.ProtocolNumber, false /* multicastLoop */)
+	if err != nil {
+		// If we cannot find a route to the destination, silently drop the packet.
+		return
+	}
+	defer r.Release()
+
+	// Same identifier, sequence and data as the request
+	reply := header.ICMPv6(append([]byte(nil), request...))
+	reply.SetType(header.ICMPv6EchoReply)
+	reply.SetCode(0)
+	reply.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: reply,
+		Src:    r.LocalAddress(),
+		Dst:    r.RemoteAddress(),
+	}))
+
+	replyPkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: int(r.MaxHeaderLength()),
+		Payload:            buffer.MakeWithData(reply),
+	})
+	defer replyPkt.DecRef()
+
+	replyPkt.TransportProtocolNumber = header.ICMPv6ProtocolNumber
+
+	r.WritePacket(stack.NetworkHeaderParams{
+		Protocol: header.ICMPv6ProtocolNumber,
+		TTL:      r.DefaultTTL(),
+	}, replyPkt)
+}
+
+// resolveHost decides whether an echo request gets a reply, it is a variable so tests dont depend on the network
+var resolveHost = TryResolve
+
 // TryResolve tries to discover if the remote host is up using ICMP
 func TryResolve(address string) bool {
 	methods := []func(string) (bool, error){
@@ -814,174 +1158,17 @@ func CommandPinger(target string) (bool, error) {
 	return true, nil
 }
 
-// Modified version of https://github.com/moby/moby/blob/master/cmd/docker-proxy/udp_proxy.go and
-// https://github.com/moby/vpnkit/blob/master/go/pkg/libproxy/udp_proxy.go
-
-const (
-	// UDPConnTrackTimeout is the timeout used for UDP connection tracking
-	UDPConnTrackTimeout = 90 * time.Second
-	// UDPBufSize is the buffer size for the UDP proxy
-	UDPBufSize = 65507
-)
-
-// A net.Addr where the IP is split into two fields so you can use it as a key
-// in a map:
-type connTrackKey struct {
-	IPHigh uint64
-	IPLow  uint64
-	Port   int
-}
-
-func newConnTrackKey(addr *net.UDPAddr) *connTrackKey {
-	if len(addr.IP) == net.IPv4len {
-		return &connTrackKey{
-			IPHigh: 0,
-			IPLow:  uint64(binary.BigEndian.Uint32(addr.IP)),
-			Port:   addr.Port,
-		}
-	}
-	return &connTrackKey{
-		IPHigh: binary.BigEndian.Uint64(addr.IP[:8]),
-		IPLow:  binary.BigEndian.Uint64(addr.IP[8:]),
-		Port:   addr.Port,
-	}
-}
-
-type connTrackMap map[connTrackKey]net.Conn
-
-// UDPProxy is proxy for which handles UDP datagrams. It implements the Proxy
-// interface to handle UDP traffic forwarding between the frontend and backend
-// addresses.
-type UDPProxy struct {
-	listener       udpConn
-	dialer         func() (net.Conn, error)
-	connTrackTable connTrackMap
-	connTrackLock  sync.Mutex
-}
-
-// NewUDPProxy creates a new UDPProxy.
-func NewUDPProxy(listener udpConn, dialer func() (net.Conn, error)) (*UDPProxy, error) {
-	return &UDPProxy{
-		listener:       listener,
-		connTrackTable: make(connTrackMap),
-		dialer:         dialer,
-	}, nil
-}
-
-func (proxy *UDPProxy) replyLoop(proxyConn net.Conn, clientAddr net.Addr, clientKey *connTrackKey) {
-	defer func() {
-		proxy.connTrackLock.Lock()
-		delete(proxy.connTrackTable, *clientKey)
-		proxy.connTrackLock.Unlock()
-		proxyConn.Close()
-	}()
-
-	readBuf := make([]byte, UDPBufSize)
-	for {
-		_ = proxyConn.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout))
-	again:
-		read, err := proxyConn.Read(readBuf)
-		if err != nil {
-			if err, ok := err.(*net.OpError); ok && err.Err == syscall.ECONNREFUSED {
-				// This will happen if the last write failed
-				// (e.g: nothing is actually listening on the
-				// proxied port on the container), ignore it
-				// and continue until UDPConnTrackTimeout
-				// expires:
-				goto again
-			}
-			return
-		}
-		for i := 0; i != read; {
-			written, err := proxy.listener.WriteTo(readBuf[i:read], clientAddr)
-			if err != nil {
-				return
-			}
-			i += written
-		}
-	}
-}
-
-// Run starts forwarding the traffic using UDP.
-func (proxy *UDPProxy) Run() {
-	readBuf := make([]byte, UDPBufSize)
-	for {
-		read, from, err := proxy.listener.ReadFrom(readBuf)
-		if err != nil {
-			// NOTE: Apparently ReadFrom doesn't return
-			// ECONNREFUSED like Read do (see comment in
-			// UDPProxy.replyLoop)
-			if !isClosedError(err) {
-				log.Printf("Stopping udp proxy (%s)", err)
-			}
-			break
-		}
-
-		fromKey := newConnTrackKey(from.(*net.UDPAddr))
-		proxy.connTrackLock.Lock()
-		proxyConn, hit := proxy.connTrackTable[*fromKey]
-		if !hit {
-			proxyConn, err = proxy.dialer()
-			if err != nil {
-				log.Printf("Can't proxy a datagram to udp: %s\n", err)
-				proxy.connTrackLock.Unlock()
-				continue
-			}
-			proxy.connTrackTable[*fromKey] = proxyConn
-			go proxy.replyLoop(proxyConn, from, fromKey)
-		}
-		proxy.connTrackLock.Unlock()
-		for i := 0; i != read; {
-			_ = proxyConn.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout))
-			written, err := proxyConn.Write(readBuf[i:read])
-			if err != nil {
-				log.Printf("Can't proxy a datagram to udp: %s\n", err)
-				break
-			}
-			i += written
-		}
-	}
-}
-
-// Close stops forwarding the traffic.
-func (proxy *UDPProxy) Close() error {
-	proxy.listener.Close()
-	proxy.connTrackLock.Lock()
-	defer proxy.connTrackLock.Unlock()
-	for _, conn := range proxy.connTrackTable {
-		conn.Close()
-	}
-	return nil
-}
-
-func isClosedError(err error) bool {
-	/* This comparison is ugly, but unfortunately, net.go doesn't export errClosing.
-	 * See:
-	 * http://golang.org/src/pkg/net/net.go
-	 * https://code.google.com/p/go/issues/detail?id=4337
-	 * https://groups.google.com/forum/#!msg/golang-nuts/0_aaCvBmOcM/SptmDyX1XJMJ
-	 */
-	return strings.HasSuffix(err.Error(), "use of closed network connection")
-}
-
-type udpConn interface {
-	ReadFrom(b []byte) (int, net.Addr, error)
-	WriteTo(b []byte, addr net.Addr) (int, error)
-	SetReadDeadline(t time.Time) error
-	io.Closer
-}
-
 type autoStoppingListener struct {
-	underlying udpConn
+	underlying udpproxy.PacketConn
 }
 
 func (l *autoStoppingListener) ReadFrom(b []byte) (int, net.Addr, error) {
-	_ = l.underlying.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout))
+	_ = l.underlying.SetReadDeadline(time.Now().Add(udpproxy.ConnTrackTimeout))
 	return l.underlying.ReadFrom(b)
 }
 
 func (l *autoStoppingListener) WriteTo(b []byte, addr net.Addr) (int, error) {
-	_ = l.underlying.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout))
+	_ = l.underlying.SetReadDeadline(time.Now().Add(udpproxy.ConnTrackTimeout))
 	return l.underlying.WriteTo(b, addr)
 }
 
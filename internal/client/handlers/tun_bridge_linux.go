@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetSocket is an AF_PACKET socket bound to a single interface in promiscuous mode, which needs CAP_NET_RAW
+// The socket is non blocking and owned by an os.File, so the runtime poller wakes up a blocked Read on Close and only releases the fd after it returns
+type packetSocket struct {
+	file  *os.File
+	raw   syscall.RawConn
+	iface *net.Interface
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func openBridge(iface *net.Interface) (frameConn, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open packet socket: %w", err)
+	}
+
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  iface.Index,
+	})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("unable to bind to %s: %w", iface.Name, err)
+	}
+
+	// Dropped automatically when the socket closes
+	err = unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &unix.PacketMreq{
+		Ifindex: int32(iface.Index),
+		Type:    unix.PACKET_MR_PROMISC,
+	})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("unable to set %s promiscuous: %w", iface.Name, err)
+	}
+
+	file := os.NewFile(uintptr(fd), "packet:"+iface.Name)
+
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &packetSocket{file: file, raw: raw, iface: iface}, nil
+}
+
+func (p *packetSocket) Read(b []byte) (int, error) {
+	for {
+		var (
+			n       int
+			from    unix.Sockaddr
+			recvErr error
+		)
+
+		err := p.raw.Read(func(fd uintptr) bool {
+			n, from, recvErr = unix.Recvfrom(int(fd), b, 0)
+			// Returning false parks us in the poller until there is something to read, or the socket closes
+			return recvErr != unix.EAGAIN
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		if recvErr != nil {
+			if recvErr == unix.EINTR {
+				continue
+			}
+			return 0, recvErr
+		}
+
+		// Frames we wrote to the interface are looped back to us, which would echo them back down the tunnel
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			continue
+		}
+
+		return n, nil
+	}
+}
+
+func (p *packetSocket) Write(b []byte) (int, error) {
+	var (
+		n        int
+		writeErr error
+	)
+
+	err := p.raw.Write(func(fd uintptr) bool {
+		n, writeErr = unix.Write(int(fd), b)
+		return writeErr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, writeErr
+}
+
+func (p *packetSocket) Close() error {
+	return p.file.Close()
+}
+
+func (p *packetSocket) String() string {
+	return p.iface.Name
+}
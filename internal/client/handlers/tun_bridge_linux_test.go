@@ -0,0 +1,178 @@
+//go:build linux
+// +build linux
+
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func openLoopbackBridge(t *testing.T) frameConn {
+	t.Helper()
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+
+	bridge, err := openBridge(lo)
+	if err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			t.Skip("packet sockets need CAP_NET_RAW:", err)
+		}
+		t.Fatal(err)
+	}
+
+	return bridge
+}
+
+func TestOpenBridge(t *testing.T) {
+	bridge := openLoopbackBridge(t)
+	defer bridge.Close()
+
+	if bridge.String() != "lo" {
+		t.Fatalf("bridge named %q rather than after the interface", bridge.String())
+	}
+
+	// Loopback hands the frame back to us as incoming, the outgoing copy should be skipped
+	frame := testFrame(tcpip.LinkAddress([]byte{0x02, 0, 0, 0, 0, 0x64}), tcpip.LinkAddress([]byte{0x02, 0, 0, 0, 0, 0x01}), "bridge test frame")
+	if _, err := bridge.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan []byte)
+	go func() {
+		defer close(read)
+
+		buff := make([]byte, 65536)
+		for {
+			n, err := bridge.Read(buff)
+			if err != nil {
+				return
+			}
+
+			if bytes.Equal(buff[:n], frame) {
+				read <- append([]byte(nil), buff[:n]...)
+			}
+		}
+	}()
+
+	select {
+	case _, ok := <-read:
+		if !ok {
+			t.Fatal("read failed before the frame came back")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("frame written to loopback was not read back")
+	}
+
+	select {
+	case _, ok := <-read:
+		if ok {
+			t.Fatal("frame was read twice, the outgoing copy was not skipped")
+		}
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestBridgeCloseUnblocksRead(t *testing.T) {
+	bridge := openLoopbackBridge(t)
+
+	readErr := make(chan error, 1)
+	go func() {
+		// Nothing else is sending on loopback with this frame, so reads only end when the socket closes
+		buff := make([]byte, 65536)
+		for {
+			if _, err := bridge.Read(buff); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	bridge.Close()
+
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatal("read ended without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after close")
+	}
+
+	if _, err := bridge.Write([]byte{0}); err == nil {
+		t.Fatal("write succeeded after close")
+	}
+}
+
+func TestBridgeClosedByTunPolicy(t *testing.T) {
+	// Only to find out if bridging is possible here
+	openLoopbackBridge(t).Close()
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := startTunChannel(t, tunModeEthernet, uint32(lo.Index), func(newChannel ssh.NewChannel) {
+		Tun(newChannel, logger.NewLog("tun_test"))
+	})
+
+	// The bridge registers for policy changes once it is up
+	deadline := time.Now().Add(5 * time.Second)
+	for !bridgeWatchingPolicy() {
+		if time.Now().After(deadline) {
+			t.Fatal("bridge was not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	policy, err := internal.ParseTunPolicy("max-flows=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetServerTunPolicy(policy)
+	t.Cleanup(func() { SetServerTunPolicy(internal.TunPolicy{}) })
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-p.packets:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("bridge kept running after a policy was set")
+		}
+	}
+}
+
+func bridgeWatchingPolicy() bool {
+	tunPolicyLck.Lock()
+	defer tunPolicyLck.Unlock()
+
+	for s := range tunSessions {
+		s.Lock()
+		watching := s.changed != nil
+		s.Unlock()
+
+		if watching {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package handlers
+
+import (
+	"errors"
+	"net"
+)
+
+func openBridge(iface *net.Interface) (frameConn, error) {
+	return nil, errors.New("bridging to an interface is only supported on linux")
+}
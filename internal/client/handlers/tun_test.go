@@ -0,0 +1,858 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var (
+	tunTestClient = tcpip.AddrFrom16Slice(net.ParseIP("2001:db8::100"))
+	tunTestUp     = tcpip.AddrFrom16Slice(net.ParseIP("2001:db8::1"))
+	tunTestDown   = tcpip.AddrFrom16Slice(net.ParseIP("2001:db8::2"))
+)
+
+// tunPeer is the ssh client side of a tun channel, i.e what openssh would be doing with the tun/tap device
+type tunPeer struct {
+	t    *testing.T
+	mode uint32
+	ep   *SSHEndpoint
+
+	packets chan []byte
+}
+
+// startTun runs the Tun handler behind a real ssh connection, as the endpoint reads the channels internal buffer
+func startTun(t *testing.T, mode uint32) *tunPeer {
+	t.Helper()
+
+	return startTunChannel(t, mode, tunIDAny, func(newChannel ssh.NewChannel) {
+		Tun(newChannel, logger.NewLog("tun_test"))
+	})
+}
+
+// startTunChannel opens a tun channel asking for the mode and tunnel number, which handle is given on the other side
+func startTunChannel(t *testing.T, mode, no uint32, handle func(ssh.NewChannel)) *tunPeer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { sshConn.Close() })
+
+		go ssh.DiscardRequests(reqs)
+
+		for newChannel := range chans {
+			go handle(newChannel)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	t.Cleanup(func() { client.Close() })
+
+	tunnel, requests, err := client.OpenChannel("tun@openssh.com", ssh.Marshal(struct {
+		Mode uint32
+		No   uint32
+	}{mode, no}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(requests)
+
+	ep, err := NewSSHEndpoint(tunnel, logger.NewLog("tun_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &tunPeer{
+		t:       t,
+		mode:    mode,
+		ep:      ep,
+		packets: make(chan []byte, 64),
+	}
+
+	go func() {
+		defer close(p.packets)
+		for {
+			packet, err := ep.ReadSSHPacket()
+			if err != nil {
+				return
+			}
+			if len(packet) > 0 {
+				p.packets <- packet
+			}
+		}
+	}()
+
+	return p
+}
+
+// send writes an IPv6 packet (or a whole frame in ethernet mode) in the format openssh uses for the mode
+func (p *tunPeer) send(packet []byte) {
+	p.t.Helper()
+
+	proto := header.IPv6ProtocolNumber
+	if p.mode == tunModeEthernet {
+		proto = header.Ethernet(packet).Type()
+	}
+
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint16(prefix[2:], uint16(proto))
+	packet = append(prefix, packet...)
+
+	if _, err := p.ep.tunnel.Write(packet); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// expect waits for a packet that match accepts, skipping anything else the stack sends. The packet has its tun header removed
+func (p *tunPeer) expect(timeout time.Duration, match func([]byte) bool) []byte {
+	p.t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case packet, ok := <-p.packets:
+			if !ok {
+				p.t.Fatal("tunnel closed")
+			}
+
+			if len(packet) < 4 {
+				continue
+			}
+
+			proto := binary.BigEndian.Uint16(packet[2:])
+			packet = packet[4:]
+
+			if p.mode == tunModePointToPoint && proto != uint16(header.IPv6ProtocolNumber) {
+				continue
+			}
+
+			if p.mode == tunModeEthernet {
+				if len(packet) < header.EthernetMinimumSize {
+					continue
+				}
+
+				if frameType := header.Ethernet(packet).Type(); proto != uint16(frameType) {
+					p.t.Fatalf("tuntap header has protocol %#x for a frame of type %#x", proto, frameType)
+				}
+			}
+
+			if match(packet) {
+				return packet
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func ipv6Packet(src, dst tcpip.Address, proto tcpip.TransportProtocolNumber, hopLimit uint8, payload []byte) []byte {
+	packet := make([]byte, header.IPv6MinimumSize+len(payload))
+
+	header.IPv6(packet).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(payload)),
+		TransportProtocol: proto,
+		HopLimit:          hopLimit,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	copy(packet[header.IPv6MinimumSize:], payload)
+
+	return packet
+}
+
+func icmpv6Echo(src, dst tcpip.Address, ident, seq uint16, data []byte) []byte {
+	msg := header.ICMPv6(make([]byte, header.ICMPv6EchoMinimumSize+len(data)))
+	msg.SetType(header.ICMPv6EchoRequest)
+	msg.SetIdent(ident)
+	msg.SetSequence(seq)
+	copy(msg.Payload(), data)
+	msg.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: msg, Src: src, Dst: dst}))
+
+	return ipv6Packet(src, dst, header.ICMPv6ProtocolNumber, 64, msg)
+}
+
+// ipv6Transport returns the transport header and payload of an IPv6 packet, if it has the addresses and protocol
+func ipv6Transport(packet []byte, src, dst tcpip.Address, proto tcpip.TransportProtocolNumber) ([]byte, bool) {
+	if len(packet) < header.IPv6MinimumSize || header.IPVersion(packet) != header.IPv6Version {
+		return nil, false
+	}
+
+	ip := header.IPv6(packet)
+	if ip.SourceAddress() != src || ip.DestinationAddress() != dst || ip.TransportProtocol() != proto {
+		return nil, false
+	}
+
+	return ip.Payload(), true
+}
+
+func TestTunICMPv6Echo(t *testing.T) {
+	resolveHost = func(address string) bool {
+		return address == tunTestUp.String()
+	}
+	t.Cleanup(func() { resolveHost = TryResolve })
+
+	p := startTun(t, tunModePointToPoint)
+
+	isReply := func(from tcpip.Address) func([]byte) bool {
+		return func(packet []byte) bool {
+			msg, ok := ipv6Transport(packet, from, tunTestClient, header.ICMPv6ProtocolNumber)
+			return ok && header.ICMPv6(msg).Type() == header.ICMPv6EchoReply
+		}
+	}
+
+	data := []byte("rssh ipv6 echo")
+	p.send(icmpv6Echo(tunTestClient, tunTestUp, 0x1234, 7, data))
+
+	packet := p.expect(5*time.Second, isReply(tunTestUp))
+	if packet == nil {
+		t.Fatal("no echo reply from host that is up")
+	}
+
+	reply := header.ICMPv6(header.IPv6(packet).Payload())
+	if reply.Ident() != 0x1234 || reply.Sequence() != 7 || !bytes.Equal(reply.Payload(), data) {
+		t.Fatalf("echo reply does not match request, ident %x seq %d data %q", reply.Ident(), reply.Sequence(), reply.Payload())
+	}
+
+	if reply.Checksum() != header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: reply, Src: tunTestUp, Dst: tunTestClient}) {
+		t.Fatal("echo reply has a bad checksum")
+	}
+
+	p.send(icmpv6Echo(tunTestClient, tunTestDown, 0x1234, 8, data))
+	if p.expect(time.Second, isReply(tunTestDown)) != nil {
+		t.Fatal("got an echo reply from a host that is down")
+	}
+}
+
+func TestTunICMPv4Echo(t *testing.T) {
+	client := tcpip.AddrFrom4([4]byte{192, 0, 2, 100})
+	up := tcpip.AddrFrom4([4]byte{192, 0, 2, 1})
+	down := tcpip.AddrFrom4([4]byte{192, 0, 2, 2})
+
+	resolveHost = func(address string) bool {
+		return address == up.String()
+	}
+	t.Cleanup(func() { resolveHost = TryResolve })
+
+	p := startTun(t, tunModePointToPoint)
+
+	ping := func(destination tcpip.Address) bool {
+		msg := header.ICMPv4(make([]byte, header.ICMPv4MinimumSize))
+		msg.SetType(header.ICMPv4Echo)
+		msg.SetIdent(1)
+		msg.SetSequence(1)
+		msg.SetChecksum(^checksum.Checksum(msg, 0))
+
+		packet := make([]byte, 4+header.IPv4MinimumSize+len(msg))
+		binary.BigEndian.PutUint16(packet[2:], uint16(header.IPv4ProtocolNumber))
+
+		ip := header.IPv4(packet[4:])
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(header.IPv4MinimumSize + len(msg)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     client,
+			DstAddr:     destination,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		copy(ip.Payload(), msg)
+
+		if _, err := p.ep.tunnel.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.After(time.Second)
+		for {
+			select {
+			case packet := <-p.packets:
+				if len(packet) < 4+header.IPv4MinimumSize || header.IPVersion(packet[4:]) != header.IPv4Version {
+					continue
+				}
+
+				ip := header.IPv4(packet[4:])
+				if ip.SourceAddress() == destination && ip.DestinationAddress() == client && header.ICMPv4(ip.Payload()).Type() == header.ICMPv4EchoReply {
+					return true
+				}
+			case <-deadline:
+				return false
+			}
+		}
+	}
+
+	if !ping(up) {
+		t.Fatal("no echo reply from host that is up")
+	}
+
+	if ping(down) {
+		t.Fatal("got an echo reply from a host that is down")
+	}
+}
+
+// localIPv6 finds a non loopback IPv6 address to forward to, as the stack wont forward to ::1
+func localIPv6(t *testing.T) tcpip.Address {
+	t.Helper()
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+
+		return tcpip.AddrFrom16Slice(ipNet.IP.To16())
+	}
+
+	t.Skip("no global IPv6 address to forward to")
+	return tcpip.Address{}
+}
+
+func TestTunIPv6UDP(t *testing.T) {
+	target := localIPv6(t)
+
+	listener, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IP(target.AsSlice())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	port := uint16(listener.LocalAddr().(*net.UDPAddr).Port)
+
+	p := startTun(t, tunModePointToPoint)
+
+	udpPacket := func(src, dst tcpip.Address, srcPort, dstPort uint16, data []byte) []byte {
+		u := header.UDP(make([]byte, header.UDPMinimumSize+len(data)))
+		u.Encode(&header.UDPFields{SrcPort: srcPort, DstPort: dstPort, Length: uint16(len(u))})
+		copy(u.Payload(), data)
+
+		xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, src, dst, uint16(len(u)))
+		xsum = checksum.Checksum(data, xsum)
+		u.SetChecksum(^u.CalculateChecksum(xsum))
+
+		return ipv6Packet(src, dst, header.UDPProtocolNumber, 64, u)
+	}
+
+	p.send(udpPacket(tunTestClient, target, 40000, port, []byte("ping")))
+
+	buff := make([]byte, 100)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := listener.ReadFromUDP(buff)
+	if err != nil {
+		t.Fatalf("datagram was not forwarded: %s", err)
+	}
+
+	if string(buff[:n]) != "ping" {
+		t.Fatalf("forwarded datagram has the wrong data %q", buff[:n])
+	}
+
+	if _, err := listener.WriteToUDP([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := p.expect(5*time.Second, func(packet []byte) bool {
+		u, ok := ipv6Transport(packet, target, tunTestClient, header.UDPProtocolNumber)
+		return ok && header.UDP(u).SourcePort() == port && header.UDP(u).DestinationPort() == 40000
+	})
+	if packet == nil {
+		t.Fatal("no reply datagram in the tunnel")
+	}
+
+	if data := header.UDP(header.IPv6(packet).Payload()).Payload(); string(data) != "pong" {
+		t.Fatalf("reply datagram has the wrong data %q", data)
+	}
+}
+
+func TestTunIPv6TCP(t *testing.T) {
+	target := localIPv6(t)
+
+	listener, err := net.ListenTCP("tcp6", &net.TCPAddr{IP: net.IP(target.AsSlice())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+			close(accepted)
+		}
+	}()
+
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	p := startTun(t, tunModePointToPoint)
+
+	syn := header.TCP(make([]byte, header.TCPMinimumSize))
+	syn.Encode(&header.TCPFields{
+		SrcPort:    40001,
+		DstPort:    port,
+		SeqNum:     1000,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	syn.SetChecksum(^syn.CalculateChecksum(header.PseudoHeaderChecksum(header.TCPProtocolNumber, tunTestClient, target, uint16(len(syn)))))
+
+	p.send(ipv6Packet(tunTestClient, target, header.TCPProtocolNumber, 64, syn))
+
+	packet := p.expect(5*time.Second, func(packet []byte) bool {
+		segment, ok := ipv6Transport(packet, target, tunTestClient, header.TCPProtocolNumber)
+		return ok && header.TCP(segment).SourcePort() == port && header.TCP(segment).DestinationPort() == 40001
+	})
+	if packet == nil {
+		t.Fatal("no response to SYN in the tunnel")
+	}
+
+	segment := header.TCP(header.IPv6(packet).Payload())
+	if segment.Flags() != header.TCPFlagSyn|header.TCPFlagAck || segment.AckNumber() != 1001 {
+		t.Fatalf("expected SYN-ACK for sequence 1001, got flags %s ack %d", segment.Flags(), segment.AckNumber())
+	}
+
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not forwarded to the listener")
+	}
+}
+
+func TestTunNeighborDiscovery(t *testing.T) {
+	p := startTun(t, tunModeEthernet)
+
+	clientMAC := tcpip.LinkAddress([]byte{0x02, 0, 0, 0, 0, 0x64})
+
+	// Solicit the address of a host on the segment, with our link address as an option
+	options := header.NDPOptionsSerializer{header.NDPSourceLinkLayerAddressOption(clientMAC)}
+	msg := header.ICMPv6(make([]byte, header.ICMPv6NeighborSolicitMinimumSize+options.Length()))
+	msg.SetType(header.ICMPv6NeighborSolicit)
+	header.NDPNeighborSolicit(msg.MessageBody()).SetTargetAddress(tunTestUp)
+
+	header.NDPOptions(msg.MessageBody()[header.NDPNSMinimumSize:]).Serialize(options)
+
+	solicitedNode := header.SolicitedNodeAddr(tunTestUp)
+	msg.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: msg, Src: tunTestClient, Dst: solicitedNode}))
+
+	frame := make([]byte, header.EthernetMinimumSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: clientMAC,
+		DstAddr: header.EthernetAddressFromMulticastIPv6Address(solicitedNode),
+		Type:    header.IPv6ProtocolNumber,
+	})
+
+	// Neighbor discovery has to have a hop limit of 255
+	p.send(append(frame, ipv6Packet(tunTestClient, solicitedNode, header.ICMPv6ProtocolNumber, header.NDPHopLimit, msg)...))
+
+	packet := p.expect(5*time.Second, func(frame []byte) bool {
+		if len(frame) < header.EthernetMinimumSize || header.Ethernet(frame).Type() != header.IPv6ProtocolNumber {
+			return false
+		}
+
+		msg, ok := ipv6Transport(frame[header.EthernetMinimumSize:], tunTestUp, tunTestClient, header.ICMPv6ProtocolNumber)
+		return ok && header.ICMPv6(msg).Type() == header.ICMPv6NeighborAdvert
+	})
+	if packet == nil {
+		t.Fatal("no neighbor advertisement in the tunnel")
+	}
+
+	eth := header.Ethernet(packet)
+	if eth.DestinationAddress() != clientMAC {
+		t.Fatalf("advertisement sent to %s rather than the solicitor %s", eth.DestinationAddress(), clientMAC)
+	}
+
+	advert := header.NDPNeighborAdvert(header.ICMPv6(header.IPv6(packet[header.EthernetMinimumSize:]).Payload()).MessageBody())
+	if advert.TargetAddress() != tunTestUp {
+		t.Fatalf("advertisement is for %s not %s", advert.TargetAddress(), tunTestUp)
+	}
+
+	if !header.IsValidUnicastEthernetAddress(eth.SourceAddress()) {
+		t.Fatalf("advertisement came from %s which is not a unicast link address", eth.SourceAddress())
+	}
+}
+
+func TestTunARP(t *testing.T) {
+	p := startTun(t, tunModeEthernet)
+
+	clientMAC := tcpip.LinkAddress([]byte{0x02, 0, 0, 0, 0, 0x64})
+	clientIP := tcpip.AddrFrom4Slice(net.ParseIP("192.0.2.100").To4())
+	gatewayIP := tcpip.AddrFrom4Slice(net.ParseIP("192.0.2.1").To4())
+
+	frame := make([]byte, header.EthernetMinimumSize+header.ARPSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: clientMAC,
+		DstAddr: header.EthernetBroadcastAddress,
+		Type:    header.ARPProtocolNumber,
+	})
+
+	request := header.ARP(frame[header.EthernetMinimumSize:])
+	request.SetIPv4OverEthernet()
+	request.SetOp(header.ARPRequest)
+	copy(request.HardwareAddressSender(), clientMAC)
+	copy(request.ProtocolAddressSender(), clientIP.AsSlice())
+	copy(request.ProtocolAddressTarget(), gatewayIP.AsSlice())
+
+	p.send(frame)
+
+	packet := p.expect(5*time.Second, func(frame []byte) bool {
+		if header.Ethernet(frame).Type() != header.ARPProtocolNumber {
+			return false
+		}
+
+		reply := header.ARP(frame[header.EthernetMinimumSize:])
+		return reply.IsValid() && reply.Op() == header.ARPReply
+	})
+	if packet == nil {
+		t.Fatal("no arp reply in the tunnel")
+	}
+
+	eth := header.Ethernet(packet)
+	if eth.DestinationAddress() != clientMAC {
+		t.Fatalf("reply sent to %s rather than the requester %s", eth.DestinationAddress(), clientMAC)
+	}
+
+	reply := header.ARP(packet[header.EthernetMinimumSize:])
+	if sender := tcpip.AddrFrom4Slice(reply.ProtocolAddressSender()); sender != gatewayIP {
+		t.Fatalf("reply is for %s not %s", sender, gatewayIP)
+	}
+
+	if !bytes.Equal(reply.HardwareAddressSender(), []byte(eth.SourceAddress())) {
+		t.Fatalf("reply gives %x as the address but came from %s", reply.HardwareAddressSender(), eth.SourceAddress())
+	}
+
+	if !bytes.Equal(reply.HardwareAddressTarget(), []byte(clientMAC)) || tcpip.AddrFrom4Slice(reply.ProtocolAddressTarget()) != clientIP {
+		t.Fatalf("reply is addressed to %x/%s rather than the requester", reply.HardwareAddressTarget(), tcpip.AddrFrom4Slice(reply.ProtocolAddressTarget()))
+	}
+}
+
+func TestUseEthernet(t *testing.T) {
+	for i := 0; i < 32; i++ {
+		var ep SSHEndpoint
+		if err := ep.UseEthernet(); err != nil {
+			t.Fatal(err)
+		}
+
+		mac := ep.LinkAddress()
+		if !ep.ethernet || len(mac) != header.EthernetAddressSize {
+			t.Fatalf("endpoint not switched to ethernet, link address %q", mac)
+		}
+
+		if mac[0]&0x02 == 0 || !header.IsValidUnicastEthernetAddress(mac) {
+			t.Fatalf("%s is not a locally administered unicast address", mac)
+		}
+	}
+}
+
+// fakeInterface is a frameConn with frames read from in and written frames sent to out
+type fakeInterface struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeInterface() *fakeInterface {
+	return &fakeInterface{
+		in:     make(chan []byte, 8),
+		out:    make(chan []byte, 8),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *fakeInterface) Read(b []byte) (int, error) {
+	select {
+	case frame := <-f.in:
+		return copy(b, frame), nil
+	case <-f.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (f *fakeInterface) Write(b []byte) (int, error) {
+	select {
+	case f.out <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-f.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (f *fakeInterface) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeInterface) String() string {
+	return "fake0"
+}
+
+func testFrame(src, dst tcpip.LinkAddress, payload string) []byte {
+	frame := make([]byte, header.EthernetMinimumSize)
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: src,
+		DstAddr: dst,
+		Type:    header.IPv4ProtocolNumber,
+	})
+
+	return append(frame, payload...)
+}
+
+func TestBridgeFrames(t *testing.T) {
+	iface := newFakeInterface()
+	done := make(chan struct{})
+
+	p := startTunChannel(t, tunModeEthernet, 1, func(newChannel ssh.NewChannel) {
+		defer close(done)
+
+		tunnel, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		sshEP, err := NewSSHEndpoint(tunnel, logger.NewLog("tun_test"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		bridgeFrames(sshEP, iface, logger.NewLog("tun_test"))
+	})
+
+	clientMAC := tcpip.LinkAddress([]byte{0x02, 0, 0, 0, 0, 0x64})
+	hostMAC := tcpip.LinkAddress([]byte{0x02, 0, 0, 0, 0, 0x01})
+
+	toHost := testFrame(clientMAC, hostMAC, "to the host")
+	p.send(toHost)
+
+	select {
+	case frame := <-iface.out:
+		if !bytes.Equal(frame, toHost) {
+			t.Fatalf("interface got %x rather than the frame without its tuntap header %x", frame, toHost)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("frame from the tunnel was not written to the interface")
+	}
+
+	toClient := testFrame(hostMAC, clientMAC, "to the client")
+	iface.in <- toClient
+
+	if p.expect(5*time.Second, func(frame []byte) bool { return bytes.Equal(frame, toClient) }) == nil {
+		t.Fatal("frame from the interface was not sent down the tunnel")
+	}
+
+	// Closing the interface ends the bridge, and with it the tunnel
+	iface.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge did not end when the interface closed")
+	}
+}
+
+func TestTunPolicy(t *testing.T) {
+	resolveHost = func(string) bool { return true }
+	t.Cleanup(func() { resolveHost = TryResolve })
+
+	local, err := internal.ParseTunPolicy("proto=icmp,proto=udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := internal.ParseTunPolicy("deny=" + tunTestDown.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetTunPolicy(local)
+	SetServerTunPolicy(server)
+	t.Cleanup(func() {
+		SetTunPolicy(internal.TunPolicy{})
+		SetServerTunPolicy(internal.TunPolicy{})
+	})
+
+	p := startTun(t, tunModePointToPoint)
+
+	isReply := func(from tcpip.Address) func([]byte) bool {
+		return func(packet []byte) bool {
+			msg, ok := ipv6Transport(packet, from, tunTestClient, header.ICMPv6ProtocolNumber)
+			return ok && header.ICMPv6(msg).Type() == header.ICMPv6EchoReply
+		}
+	}
+
+	p.send(icmpv6Echo(tunTestClient, tunTestUp, 1, 1, nil))
+	if p.expect(5*time.Second, isReply(tunTestUp)) == nil {
+		t.Fatal("allowed echo request was not answered")
+	}
+
+	p.send(icmpv6Echo(tunTestClient, tunTestDown, 1, 2, nil))
+	if p.expect(time.Second, isReply(tunTestDown)) != nil {
+		t.Fatal("echo request to a server denied address was answered")
+	}
+
+	// tcp is not in the local policy, so the connection should be reset without being forwarded
+	syn := header.TCP(make([]byte, header.TCPMinimumSize))
+	syn.Encode(&header.TCPFields{
+		SrcPort:    40002,
+		DstPort:    22,
+		SeqNum:     1000,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	syn.SetChecksum(^syn.CalculateChecksum(header.PseudoHeaderChecksum(header.TCPProtocolNumber, tunTestClient, tunTestUp, uint16(len(syn)))))
+
+	p.send(ipv6Packet(tunTestClient, tunTestUp, header.TCPProtocolNumber, 64, syn))
+
+	packet := p.expect(5*time.Second, func(packet []byte) bool {
+		segment, ok := ipv6Transport(packet, tunTestUp, tunTestClient, header.TCPProtocolNumber)
+		return ok && header.TCP(segment).DestinationPort() == 40002
+	})
+	if packet == nil {
+		t.Fatal("no response to SYN in the tunnel")
+	}
+
+	if flags := header.TCP(header.IPv6(packet).Payload()).Flags(); flags&header.TCPFlagRst == 0 {
+		t.Fatalf("expected denied connection to be reset, got flags %s", flags)
+	}
+}
+
+func TestTunSessionPolicyMaxFlows(t *testing.T) {
+	limit, err := internal.ParseTunPolicy("max-flows=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetTunPolicy(limit)
+	t.Cleanup(func() { SetTunPolicy(internal.TunPolicy{}) })
+
+	session := newTunSessionPolicy()
+	defer session.close()
+
+	destination := netip.MustParseAddr("2001:db8::1")
+
+	// Flows arriving together must not all see a free slot before any of them is counted
+	var (
+		wg       sync.WaitGroup
+		admitted atomic.Int64
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if session.admit("tcp", destination, 22) == nil {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if admitted.Load() != 3 {
+		t.Fatalf("expected 3 flows to be admitted, got %d", admitted.Load())
+	}
+
+	if err := session.admit("icmp", destination, 0); err != nil {
+		t.Errorf("icmp is not a flow, but was refused: %s", err)
+	}
+
+	session.release()
+	if err := session.admit("udp", destination, 53); err != nil {
+		t.Errorf("a released slot was not reused: %s", err)
+	}
+
+	// Each tunnel has slots of its own
+	other := newTunSessionPolicy()
+	defer other.close()
+
+	if err := other.admit("tcp", destination, 22); err != nil {
+		t.Errorf("a new tunnel was refused because of another tunnels flows: %s", err)
+	}
+}
+
+func TestTunSessionPolicyUpdated(t *testing.T) {
+	open := newTunSessionPolicy()
+	defer open.close()
+
+	changes := 0
+	open.onChange(func() { changes++ })
+
+	closed := newTunSessionPolicy()
+	closed.close()
+
+	server, err := internal.ParseTunPolicy("deny=2001:db8::2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetServerTunPolicy(server)
+	t.Cleanup(func() { SetServerTunPolicy(internal.TunPolicy{}) })
+
+	if changes != 2 {
+		t.Errorf("expected to be told about the policy when registering and when it changed, got %d calls", changes)
+	}
+
+	denied := netip.MustParseAddr("2001:db8::2")
+	if err := open.admit("tcp", denied, 22); err == nil {
+		t.Error("a policy set by the server did not apply to an open tunnel")
+	}
+
+	if err := closed.admit("tcp", denied, 22); err != nil {
+		t.Error("a tunnel that was closed was still given policies")
+	}
+	closed.release()
+}
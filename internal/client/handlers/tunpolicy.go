@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+var (
+	tunPolicyLck sync.Mutex
+	// From the clients own settings, e.g baked in with link --tun-policy
+	localTunPolicy internal.TunPolicy
+	// Pushed by the server with tun-policy, flows have to pass both
+	serverTunPolicy internal.TunPolicy
+
+	// Every open tun session, so a new policy reaches tunnels that are already open
+	tunSessions = map[*tunSessionPolicy]bool{}
+)
+
+// tunSessionPolicy is the policy attached to a single tun session, along with the flows it has let through
+type tunSessionPolicy struct {
+	sync.Mutex
+
+	local, server internal.TunPolicy
+
+	// Flows that were allowed and have not finished yet, counted against max-flows
+	flows int
+
+	// Called whenever the policy changes, e.g to end a bridge that cannot enforce it
+	changed func()
+}
+
+// SetTunPolicy sets the clients own policy for tun forwarding, it applies to every tunnel including ones already open
+func SetTunPolicy(policy internal.TunPolicy) {
+	setTunPolicies(func() { localTunPolicy = policy })
+}
+
+// LocalTunPolicy returns the clients own policy for tun forwarding
+func LocalTunPolicy() internal.TunPolicy {
+	tunPolicyLck.Lock()
+	defer tunPolicyLck.Unlock()
+
+	return localTunPolicy
+}
+
+// SetServerTunPolicy sets the policy the server has pushed, which is applied on top of the clients own policy
+func SetServerTunPolicy(policy internal.TunPolicy) {
+	setTunPolicies(func() { serverTunPolicy = policy })
+}
+
+func setTunPolicies(set func()) {
+	tunPolicyLck.Lock()
+	defer tunPolicyLck.Unlock()
+
+	set()
+
+	for s := range tunSessions {
+		s.set(localTunPolicy, serverTunPolicy)
+	}
+}
+
+// newTunSessionPolicy starts a session with the current policies, close has to be called when the tunnel ends
+func newTunSessionPolicy() *tunSessionPolicy {
+	tunPolicyLck.Lock()
+	defer tunPolicyLck.Unlock()
+
+	s := &tunSessionPolicy{local: localTunPolicy, server: serverTunPolicy}
+	tunSessions[s] = true
+
+	return s
+}
+
+func (s *tunSessionPolicy) close() {
+	tunPolicyLck.Lock()
+	defer tunPolicyLck.Unlock()
+
+	delete(tunSessions, s)
+}
+
+func (s *tunSessionPolicy) set(local, server internal.TunPolicy) {
+	s.Lock()
+	s.local, s.server = local, server
+	changed := s.changed
+	s.Unlock()
+
+	if changed != nil {
+		changed()
+	}
+}
+
+// onChange calls f now and whenever the policy changes, so a policy set before f was registered is not missed
+func (s *tunSessionPolicy) onChange(f func()) {
+	s.Lock()
+	s.changed = f
+	s.Unlock()
+
+	f()
+}
+
+// admit checks a new flow against the policy, and for tcp and udp takes one of the max-flows slots which release gives back
+func (s *tunSessionPolicy) admit(protocol string, destination netip.Addr, port uint16) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.local.Check(protocol, destination, port); err != nil {
+		return err
+	}
+
+	if err := s.server.Check(protocol, destination, port); err != nil {
+		return err
+	}
+
+	if protocol == "icmp" {
+		return nil
+	}
+
+	if limit := s.maxFlows(); limit > 0 && s.flows >= limit {
+		return fmt.Errorf("tunnel is at its limit of %d flows", limit)
+	}
+	s.flows++
+
+	return nil
+}
+
+func (s *tunSessionPolicy) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.flows--
+}
+
+// maxFlows is the lowest flow limit of the two policies, or 0 if neither has one
+func (s *tunSessionPolicy) maxFlows() int {
+	limit := s.local.MaxFlows
+	if s.server.MaxFlows > 0 && (limit == 0 || s.server.MaxFlows < limit) {
+		limit = s.server.MaxFlows
+	}
+
+	return limit
+}
+
+func (s *tunSessionPolicy) active() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return !s.local.IsZero() || !s.server.IsZero()
+}
+
+func (s *tunSessionPolicy) String() string {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case s.local.IsZero() && s.server.IsZero():
+		return "none"
+	case s.server.IsZero():
+		return s.local.String()
+	case s.local.IsZero():
+		return "server: " + s.server.String()
+	}
+
+	return s.local.String() + " server: " + s.server.String()
+}
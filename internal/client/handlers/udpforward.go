@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/udpproxy"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	currentUDPForwardsLck sync.Mutex
+	currentUDPForwards    = map[internal.RemoteForwardRequest]*udpproxy.Proxy{}
+)
+
+// LocalUDPForward sends the datagrams framed in a direct-udp channel to the channels destination, and the replies back
+func LocalUDPForward(newChannel ssh.NewChannel, l logger.Logger) {
+	if err := capabilities.Check(capabilities.LocalUDPForward); err != nil {
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	var drtMsg internal.ChannelOpenDirectMsg
+	err := ssh.Unmarshal(newChannel.ExtraData(), &drtMsg)
+	if err != nil {
+		l.Warning("Unable to unmarshal udp forward %s", err)
+		newChannel.Reject(ssh.ResourceShortage, "Unable to unmarshal udp forward")
+		return
+	}
+
+	dest := net.JoinHostPort(drtMsg.Raddr, strconv.Itoa(int(drtMsg.Rport)))
+	udpConn, err := net.Dial("udp", dest)
+	if err != nil {
+		l.Warning("Unable to dial udp destination: %s", err)
+		newChannel.Reject(ssh.ConnectionFailed, "Unable to connect to "+dest)
+		return
+	}
+	defer udpConn.Close()
+
+	connection, requests, err := newChannel.Accept()
+	if err != nil {
+		l.Warning("Unable to accept new channel %s", err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	originator := &net.UDPAddr{IP: net.ParseIP(drtMsg.Laddr), Port: int(drtMsg.Lport)}
+
+	udpproxy.Relay(udpproxy.NewStreamConn(connection, originator, udpConn.RemoteAddr()), udpConn)
+}
+
+// StartRemoteUDPForward listens for udp on the client, sending each source address to the server in its own forwarded-udp channel
+func StartRemoteUDPForward(r *ssh.Request, sshConn ssh.Conn) {
+	if err := capabilities.Check(capabilities.RemoteUDPForward); err != nil {
+		r.Reply(false, []byte(err.Error()))
+		return
+	}
+
+	var rf internal.RemoteForwardRequest
+	err := ssh.Unmarshal(r.Payload, &rf)
+	if err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to open udp forward: %s", err.Error())))
+		return
+	}
+
+	listener, err := net.ListenPacket("udp", net.JoinHostPort(rf.BindAddr, strconv.Itoa(int(rf.BindPort))))
+	if err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to open udp forward: %s", err.Error())))
+		return
+	}
+
+	bound := listener.LocalAddr().(*net.UDPAddr)
+
+	proxy, _ := udpproxy.New(listener, func(from net.Addr) (net.Conn, error) {
+		source := from.(*net.UDPAddr)
+
+		drtMsg := internal.ChannelOpenDirectMsg{
+			Raddr: rf.BindAddr,
+			Rport: uint32(bound.Port),
+
+			Laddr: source.IP.String(),
+			Lport: uint32(source.Port),
+		}
+
+		channel, reqs, err := sshConn.OpenChannel("forwarded-udp", ssh.Marshal(&drtMsg))
+		if err != nil {
+			return nil, fmt.Errorf("opening forwarded-udp channel to server failed: %s", err)
+		}
+		go ssh.DiscardRequests(reqs)
+
+		return udpproxy.NewStreamConn(channel, bound, source), nil
+	})
+
+	//https://datatracker.ietf.org/doc/html/rfc4254 same as tcpip-forward, the port is only sent if the server asked for any port
+	responseData := []byte{}
+	if rf.BindPort == 0 {
+		rf.BindPort = uint32(bound.Port)
+		responseData = ssh.Marshal(rf.BindPort)
+	}
+
+	currentUDPForwardsLck.Lock()
+	if _, ok := currentUDPForwards[rf]; ok {
+		currentUDPForwardsLck.Unlock()
+
+		proxy.Close()
+		r.Reply(false, []byte(fmt.Sprintf("udp forward %s already exists", rf.String())))
+		return
+	}
+	currentUDPForwards[rf] = proxy
+	currentUDPForwardsLck.Unlock()
+
+	r.Reply(true, responseData)
+
+	log.Println("Started udp forward on: ", bound)
+
+	// The server forgets its udp forwards when the client disconnects, so dont leave the port open for the next connection
+	go func() {
+		sshConn.Wait()
+		proxy.Close()
+	}()
+
+	proxy.Run()
+	proxy.Close()
+
+	currentUDPForwardsLck.Lock()
+	if currentUDPForwards[rf] == proxy {
+		delete(currentUDPForwards, rf)
+	}
+	currentUDPForwardsLck.Unlock()
+
+	log.Println("Stopped udp forward on: ", bound)
+}
+
+func StopRemoteUDPForward(rf internal.RemoteForwardRequest) error {
+	currentUDPForwardsLck.Lock()
+	defer currentUDPForwardsLck.Unlock()
+
+	proxy, ok := currentUDPForwards[rf]
+	if !ok {
+		return fmt.Errorf("unable to find udp forward %s", rf.String())
+	}
+
+	proxy.Close()
+	delete(currentUDPForwards, rf)
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	trustedHostKeysLck sync.RWMutex
+	// SHA256 hex fingerprints of server keys we will connect to
+	trustedHostKeys = map[string]bool{}
+	// SHA256 hex fingerprints of CAs that may sign the servers host certificate
+	trustedHostAuthorities = map[string]bool{}
+
+	// The key the server presented on the most recent connection, updates have to be signed by it
+	serverKey ssh.PublicKey
+)
+
+// ParseFingerprints splits a comma separated list of SHA256 hex fingerprints
+func ParseFingerprints(list string) ([]string, error) {
+	var fingerprints []string
+	for _, fp := range strings.Split(list, ",") {
+		fp = strings.ToLower(strings.TrimSpace(fp))
+		if fp == "" {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(fp)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("%q is not a SHA256 hex fingerprint", fp)
+		}
+
+		fingerprints = append(fingerprints, fp)
+	}
+
+	return fingerprints, nil
+}
+
+// SetTrustedHostKeys replaces the server keys the client will accept, the host authorities are left as is
+func SetTrustedHostKeys(fingerprints []string) error {
+	if len(fingerprints) == 0 {
+		return errors.New("refusing to set an empty list of trusted host keys")
+	}
+
+	trustedHostKeysLck.Lock()
+	defer trustedHostKeysLck.Unlock()
+
+	trustedHostKeys = map[string]bool{}
+	for _, fp := range fingerprints {
+		trustedHostKeys[fp] = true
+	}
+
+	return nil
+}
+
+func setTrustedHostAuthorities(fingerprints []string) {
+	trustedHostKeysLck.Lock()
+	defer trustedHostKeysLck.Unlock()
+
+	trustedHostAuthorities = map[string]bool{}
+	for _, fp := range fingerprints {
+		trustedHostAuthorities[fp] = true
+	}
+}
+
+func isTrustedHostKey(key ssh.PublicKey) bool {
+	trustedHostKeysLck.RLock()
+	defer trustedHostKeysLck.RUnlock()
+
+	return trustedHostKeys[internal.FingerprintSHA256Hex(key)]
+}
+
+func isTrustedHostAuthority(auth ssh.PublicKey, _ string) bool {
+	trustedHostKeysLck.RLock()
+	defer trustedHostKeysLck.RUnlock()
+
+	return trustedHostAuthorities[internal.FingerprintSHA256Hex(auth)]
+}
+
+func trustsAnyHost() bool {
+	trustedHostKeysLck.RLock()
+	defer trustedHostKeysLck.RUnlock()
+
+	return len(trustedHostKeys) == 0 && len(trustedHostAuthorities) == 0
+}
+
+// certificateHostPort turns a destination like tls://example.com or example.com into the host:port the CertChecker expects,
+// only the host is checked against the certificate principals so the port added is never used
+func certificateHostPort(destination string) string {
+	if _, rest, ok := strings.Cut(destination, "://"); ok {
+		destination = rest
+	}
+
+	destination, _, _ = strings.Cut(destination, "/")
+
+	if _, _, err := net.SplitHostPort(destination); err != nil {
+		destination = net.JoinHostPort(strings.Trim(destination, "[]"), "22")
+	}
+
+	return destination
+}
+
+// hostKeyCallback accepts the server if its key is in the trusted list, or it presents a certificate signed by a trusted host CA
+func hostKeyCallback(l logger.Logger) ssh.HostKeyCallback {
+	fingerprintCheck := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if trustsAnyHost() { // Only possible if the user has explicitly allowed connecting without a server key
+			l.Warning("No server key specified, allowing connection to %s", hostname)
+			return nil
+		}
+
+		if !isTrustedHostKey(key) {
+			return fmt.Errorf("server public key invalid, got: %s", internal.FingerprintSHA256Hex(key))
+		}
+
+		return nil
+	}
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: isTrustedHostAuthority,
+		HostKeyFallback: fingerprintCheck,
+	}
+
+	check := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if cert, ok := key.(*ssh.Certificate); ok {
+			if isTrustedHostAuthority(cert.SignatureKey, hostname) {
+				return checker.CheckHostKey(certificateHostPort(hostname), remote, key)
+			}
+
+			// The server may present a certificate we dont have the CA for, so fall back to the key it certifies
+			key = cert.Key
+		}
+
+		return fingerprintCheck(hostname, remote, key)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := check(hostname, remote, key); err != nil {
+			return err
+		}
+
+		trustedHostKeysLck.Lock()
+		serverKey = key
+		trustedHostKeysLck.Unlock()
+
+		return nil
+	}
+}
+
+// ServerKey returns the host key of the server we last connected to
+func ServerKey() ssh.PublicKey {
+	trustedHostKeysLck.RLock()
+	defer trustedHostKeysLck.RUnlock()
+
+	return serverKey
+}
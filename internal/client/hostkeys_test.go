@@ -0,0 +1,153 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+func testSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+func hostCertificate(t *testing.T, ca ssh.Signer, key ssh.PublicKey, principals ...string) *ssh.Certificate {
+	t.Helper()
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// resetHostKeys puts the trusted keys back to trusting any host once the test is done
+func resetHostKeys(t *testing.T) {
+	t.Cleanup(func() {
+		trustedHostKeysLck.Lock()
+		defer trustedHostKeysLck.Unlock()
+
+		trustedHostKeys = map[string]bool{}
+		trustedHostAuthorities = map[string]bool{}
+		serverKey = nil
+	})
+}
+
+func TestHostKeyCallbackCertificate(t *testing.T) {
+	resetHostKeys(t)
+
+	ca := testSigner(t)
+	host := testSigner(t)
+
+	setTrustedHostAuthorities([]string{internal.FingerprintSHA256Hex(ca.PublicKey())})
+	callback := hostKeyCallback(logger.NewLog("hostkeys_test"))
+
+	cert := hostCertificate(t, ca, host.PublicKey(), "example.com", "1.2.3.4", "::1")
+	remote := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}
+
+	for _, destination := range []string{
+		"example.com:2222",
+		"example.com",
+		"tls://example.com:443",
+		"tls://example.com",
+		"wss://example.com/ws",
+		"ws://1.2.3.4",
+		"http://1.2.3.4:8080",
+		"[::1]:22",
+		"::1",
+	} {
+		if err := callback(destination, remote, cert); err != nil {
+			t.Errorf("%s: expected certificate signed by trusted CA to be accepted, got %s", destination, err)
+		}
+	}
+
+	if ServerKey() != cert {
+		t.Errorf("expected the accepted certificate to be recorded as the server key")
+	}
+
+	if err := callback("tls://other.example.com:443", remote, cert); err == nil {
+		t.Error("expected certificate to be refused for a host it has no principal for")
+	}
+
+	untrusted := hostCertificate(t, testSigner(t), host.PublicKey(), "example.com")
+	if err := callback("tls://example.com", remote, untrusted); err == nil {
+		t.Error("expected certificate from an untrusted CA to be refused")
+	}
+
+	// Without the CA the key it certifies can still be trusted by fingerprint
+	if err := SetTrustedHostKeys([]string{internal.FingerprintSHA256Hex(host.PublicKey())}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := callback("tls://example.com", remote, untrusted); err != nil {
+		t.Errorf("expected certificate for a trusted key to be accepted, got %s", err)
+	}
+}
+
+func TestHostKeyRotation(t *testing.T) {
+	resetHostKeys(t)
+
+	oldKey, newKey, otherKey := testSigner(t).PublicKey(), testSigner(t).PublicKey(), testSigner(t).PublicKey()
+
+	callback := hostKeyCallback(logger.NewLog("hostkeys_test"))
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+
+	// During a rotation both keys are trusted
+	if err := SetTrustedHostKeys([]string{internal.FingerprintSHA256Hex(oldKey), internal.FingerprintSHA256Hex(newKey)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []ssh.PublicKey{oldKey, newKey} {
+		if err := callback("127.0.0.1:2222", remote, key); err != nil {
+			t.Errorf("expected every trusted key to be accepted, got %s", err)
+		}
+	}
+
+	if err := callback("127.0.0.1:2222", remote, otherKey); err == nil {
+		t.Error("expected untrusted key to be refused")
+	}
+
+	// Once the rotation is finished the old key is dropped
+	if err := SetTrustedHostKeys([]string{internal.FingerprintSHA256Hex(newKey)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := callback("127.0.0.1:2222", remote, oldKey); err == nil {
+		t.Error("expected the rotated out key to be refused")
+	}
+
+	if err := callback("127.0.0.1:2222", remote, newKey); err != nil {
+		t.Errorf("expected the new key to be accepted, got %s", err)
+	}
+
+	if err := SetTrustedHostKeys(nil); err == nil {
+		t.Error("expected an empty list of trusted keys to be refused")
+	}
+
+	if err := callback("127.0.0.1:2222", remote, newKey); err != nil {
+		t.Errorf("expected the refused update to leave the trusted keys alone, got %s", err)
+	}
+}
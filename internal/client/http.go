@@ -2,7 +2,6 @@ package client
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -32,7 +31,8 @@ type HTTPConn struct {
 	client *http.Client
 }
 
-func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn, error) {
+// NewHTTPConn starts a http polling session with the server at address, sni is the server name for https and the host in address is used if it is empty
+func NewHTTPConn(address, sni string, connector func() (net.Conn, error)) (*HTTPConn, error) {
 
 	result := &HTTPConn{
 		done:       make(chan interface{}),
@@ -46,9 +46,7 @@ func NewHTTPConn(address string, connector func() (net.Conn, error)) (*HTTPConn,
 			Dial: func(network, addr string) (net.Conn, error) {
 				return connector()
 			},
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+			TLSClientConfig: serverTLSConfig(sni),
 		},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// startHTTPSPolling runs a https server that only opens polling sessions, recording the server name each tls connection asked for
+func startHTTPSPolling(t *testing.T) (*httptest.Server, func() []string) {
+	t.Helper()
+
+	var (
+		lck         sync.Mutex
+		serverNames []string
+	)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && r.URL.Path == "/push" {
+			http.SetCookie(w, &http.Cookie{Name: "NID", Value: "session"})
+			w.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			lck.Lock()
+			serverNames = append(serverNames, hello.ServerName)
+			lck.Unlock()
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		lck.Lock()
+		defer lck.Unlock()
+
+		return append([]string{}, serverNames...)
+	}
+}
+
+func TestHTTPConnSNI(t *testing.T) {
+	server, serverNames := startHTTPSPolling(t)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// The test certificate is only valid for example.com, so verifying it also checks the server name was used
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	verification, err := ParseTLSVerification("ca=" + base64.StdEncoding.EncodeToString(ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTLSVerification(verification)
+	t.Cleanup(func() { setTLSVerification(nil) })
+
+	connector := func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	}
+
+	for _, c := range []struct {
+		address, sni string
+		expected     string
+		fails        bool
+	}{
+		{address: "https://rssh.internal:" + port, sni: "example.com", expected: "example.com"},
+		{address: "https://example.com:" + port, expected: "example.com"},
+		{address: "https://example.com:" + port, sni: "cdn.other.test", expected: "cdn.other.test", fails: true},
+	} {
+		before := len(serverNames())
+
+		conn, err := NewHTTPConn(c.address, c.sni, connector)
+		if err == nil {
+			conn.Close()
+		}
+
+		if c.fails != (err != nil) {
+			t.Errorf("%s with sni %q: expected failure %t, got %v", c.address, c.sni, c.fails, err)
+		}
+
+		names := serverNames()[before:]
+		if len(names) == 0 || names[0] != c.expected {
+			t.Errorf("%s with sni %q: server got %v, expected %q", c.address, c.sni, names, c.expected)
+		}
+
+		if c.fails && err != nil && !strings.Contains(err.Error(), "certificate") {
+			t.Errorf("%s with sni %q: expected a certificate error, got %s", c.address, c.sni, err)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package client
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Enough round trips for NTLM (negotiate, authenticate) plus a stale digest nonce
+const maxProxyAuthAttempts = 4
+
+// bufferedConn keeps any bytes the proxy sent after its response, which would otherwise be lost in the bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// dialProxyServer connects to the proxy itself, through any earlier proxies in the chain
+func dialProxyServer(proxyURL *url.URL, forward dialFunc) (net.Conn, error) {
+	proxyCon, err := forward("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxyURL.Scheme {
+	case "http":
+		return proxyCon, nil
+	case "https":
+		config := proxyTLSConfig()
+		config.ServerName = proxyURL.Hostname()
+
+		tlsCon := tls.Client(proxyCon, config)
+		if err := tlsCon.Handshake(); err != nil {
+			proxyCon.Close()
+			return nil, fmt.Errorf("tls handshake with proxy %s failed: %s", proxyURL.Host, err)
+		}
+
+		return tlsCon, nil
+	}
+
+	proxyCon.Close()
+	return nil, fmt.Errorf("unsupported http proxy scheme %q", proxyURL.Scheme)
+}
+
+// dialHTTPProxy opens a tunnel to addr with CONNECT, answering Basic, Digest, NTLM or (on windows) negotiate challenges from the proxy
+// NTLM authenticates the connection rather than the request, so every leg of the handshake is kept on the same keep-alive connection
+func dialHTTPProxy(addr string, proxyURL *url.URL, forward dialFunc, winauth bool) (net.Conn, error) {
+	proxyCon, err := dialProxyServer(proxyURL, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(proxyCon)
+
+	auth := proxyAuth{
+		proxyURL: proxyURL,
+		target:   addr,
+		winauth:  winauth,
+	}
+
+	authorization := ""
+	for attempt := 0; attempt < maxProxyAuthAttempts; attempt++ {
+
+		req := []string{
+			fmt.Sprintf("CONNECT %s HTTP/1.1", addr),
+			fmt.Sprintf("Host: %s", addr),
+			"Proxy-Connection: Keep-Alive",
+		}
+
+		if authorization != "" {
+			req = append(req, fmt.Sprintf("Proxy-Authorization: %s", authorization))
+		}
+
+		err = WriteHTTPReq(req, proxyCon)
+		if err != nil {
+			proxyCon.Close()
+			return nil, fmt.Errorf("unable to connect proxy %s: %s", proxyURL.Redacted(), err)
+		}
+
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			proxyCon.Close()
+			return nil, fmt.Errorf("reading from proxy failed: %s", err)
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			log.Println("Proxy accepted CONNECT request, connection set up!")
+
+			if br.Buffered() > 0 {
+				return &bufferedConn{Conn: proxyCon, r: br}, nil
+			}
+
+			return proxyCon, nil
+		}
+
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			resp.Body.Close()
+			proxyCon.Close()
+			return nil, fmt.Errorf("failed to proxy: %q", resp.Status)
+		}
+
+		authorization, err = auth.answer(resp.Header.Values("Proxy-Authenticate"))
+		if err != nil {
+			resp.Body.Close()
+			proxyCon.Close()
+			return nil, err
+		}
+
+		if !reusable(resp) {
+			// Connection based schemes cant continue on a new connection
+			if auth.scheme == "ntlm" && auth.step > 1 {
+				proxyCon.Close()
+				return nil, errors.New("proxy closed the connection during NTLM authentication")
+			}
+
+			proxyCon.Close()
+			proxyCon, err = dialProxyServer(proxyURL, forward)
+			if err != nil {
+				return nil, err
+			}
+			br = bufio.NewReader(proxyCon)
+		}
+	}
+
+	proxyCon.Close()
+	return nil, fmt.Errorf("proxy %s did not accept authentication after %d attempts", proxyURL.Redacted(), maxProxyAuthAttempts)
+}
+
+// reusable drains the body of a response so the next request can be sent on the same connection, returning false if that isnt possible
+func reusable(resp *http.Response) bool {
+	defer resp.Body.Close()
+
+	if resp.Close {
+		return false
+	}
+
+	// Without a length the body is terminated by the connection closing
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		return false
+	}
+
+	_, err := io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	return err == nil
+}
+
+// proxyAuth picks an authentication scheme from the proxies challenges, and tracks where we are in multi step schemes
+type proxyAuth struct {
+	proxyURL *url.URL
+	target   string
+	winauth  bool
+
+	scheme string
+	step   int
+}
+
+func (p *proxyAuth) answer(challenges []string) (string, error) {
+	offered := map[string]string{}
+	for _, challenge := range challenges {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		offered[strings.ToLower(scheme)] = strings.TrimSpace(params)
+	}
+
+	if len(offered) == 0 {
+		return "", errors.New("proxy requires authentication but did not send a Proxy-Authenticate challenge")
+	}
+
+	ntlmCreds := ntlmCredentials(p.proxyURL)
+
+	username, password, hasCredentials := "", "", false
+	if p.proxyURL.User != nil {
+		username = p.proxyURL.User.Username()
+		password, hasCredentials = p.proxyURL.User.Password()
+		hasCredentials = hasCredentials || username != ""
+	}
+
+	scheme := p.scheme
+	if scheme == "" {
+		// Strongest scheme we have credentials for
+		switch {
+		case ntlmCreds != "" && hasKey(offered, "ntlm"):
+			scheme = "ntlm"
+		case p.winauth && nativeWinAuth && (hasKey(offered, "negotiate") || hasKey(offered, "kerberos") || hasKey(offered, "ntlm")):
+			scheme = "negotiate"
+		case hasCredentials && hasKey(offered, "digest"):
+			scheme = "digest"
+		case hasCredentials && hasKey(offered, "basic"):
+			scheme = "basic"
+		default:
+			var names []string
+			for name := range offered {
+				names = append(names, name)
+			}
+			return "", fmt.Errorf("proxy requires authentication (%s) but no usable credentials were configured", strings.Join(names, ", "))
+		}
+
+		p.scheme = scheme
+	}
+
+	p.step++
+
+	switch scheme {
+	case "ntlm":
+		challenge, err := base64.StdEncoding.DecodeString(offered["ntlm"])
+		if err != nil {
+			return "", fmt.Errorf("invalid NTLM challenge: %v", err)
+		}
+
+		// The first response is our negotiate message, the second answers the proxies challenge. Anything after that is a failure
+		if (p.step > 1 && len(challenge) == 0) || p.step > 2 {
+			return "", errors.New("proxy rejected NTLM credentials")
+		}
+
+		return getNTLMAuthHeader(ntlmCreds, challenge)
+
+	case "negotiate":
+		if p.step > 1 {
+			return "", errors.New("proxy rejected windows authentication")
+		}
+
+		header, ok := winAuthHeader(p.proxyURL.Scheme + "://" + p.proxyURL.Host)
+		if !ok {
+			return "", errors.New("windows authentication is not supported on this platform")
+		}
+		return header, nil
+
+	case "digest":
+		if !hasKey(offered, "digest") {
+			return "", errors.New("proxy rejected digest credentials")
+		}
+
+		params := parseAuthParams(offered["digest"])
+
+		// A stale nonce means the credentials were fine, so we get one more go with the new nonce
+		if p.step > 1 && !strings.EqualFold(params["stale"], "true") {
+			return "", errors.New("proxy rejected digest credentials")
+		}
+
+		return digestAuthorization(params, username, password, http.MethodConnect, p.target)
+
+	case "basic":
+		if p.step > 1 {
+			return "", errors.New("proxy rejected basic credentials")
+		}
+
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+
+	return "", fmt.Errorf("unsupported proxy authentication scheme %q", scheme)
+}
+
+func hasKey(m map[string]string, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// parseAuthParams parses the comma separated key=value and key="quoted value" pairs of an authentication challenge
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest); i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				} else if rest[i] == '"' {
+					break
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end == -1 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			s = rest[end:]
+		}
+
+		params[key] = value.String()
+	}
+
+	return params
+}
+
+// digestAuthorization answers an RFC 7616 digest challenge, supporting MD5, SHA-256 and SHA-512-256 (and their -sess variants) with qop=auth
+func digestAuthorization(params map[string]string, username, password, method, uri string) (string, error) {
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+
+	var newHash func() hash.Hash
+	base, session := strings.CutSuffix(strings.ToUpper(algorithm), "-SESS")
+	switch base {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	case "SHA-512-256":
+		newHash = sha512.New512_256
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+
+	h := func(parts ...string) string {
+		d := newHash()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	realm, nonce := params["realm"], params["nonce"]
+	if nonce == "" {
+		return "", errors.New("digest challenge did not include a nonce")
+	}
+
+	qop := ""
+	if params["qop"] != "" {
+		for _, option := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(option) == "auth" {
+				qop = "auth"
+			}
+		}
+
+		if qop == "" {
+			return "", fmt.Errorf("unsupported digest qop %q, only auth is supported", params["qop"])
+		}
+	}
+
+	cnonceBytes := make([]byte, 16)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := "00000001"
+
+	ha1 := h(username, realm, password)
+	if session {
+		ha1 = h(ha1, nonce, cnonce)
+	}
+	ha2 := h(method, uri)
+
+	var response string
+	if qop != "" {
+		response = h(ha1, nonce, nc, cnonce, qop, ha2)
+	} else {
+		// RFC 2069 compatibility
+		response = h(ha1, nonce, ha2)
+	}
+
+	if strings.EqualFold(params["userhash"], "true") {
+		username = h(username, realm)
+	}
+
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+
+	header := fmt.Sprintf("Digest username=%s, realm=%s, nonce=%s, uri=%s, algorithm=%s, response=%s",
+		quote(username), quote(realm), quote(nonce), quote(uri), algorithm, quote(response))
+
+	if qop != "" {
+		header += fmt.Sprintf(", qop=%s, nc=%s, cnonce=%s", qop, nc, quote(cnonce))
+	}
+
+	if opaque, ok := params["opaque"]; ok {
+		header += ", opaque=" + quote(opaque)
+	}
+
+	if strings.EqualFold(params["userhash"], "true") {
+		header += ", userhash=true"
+	}
+
+	return header, nil
+}
@@ -0,0 +1,369 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+var ntlmServerChallenge = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+type ntlmProxy struct {
+	addr string
+
+	connections *atomic.Int32
+	// Number of completed NTLM handshakes
+	handshakes *atomic.Int32
+}
+
+func utf16le(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, r)
+	}
+	return b
+}
+
+func fromUTF16le(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// ntlmChallengeMessage builds the servers type 2 message, with domain as the target name
+func ntlmChallengeMessage(domain string) []byte {
+	const (
+		unicode          = 0x00000001
+		requestTarget    = 0x00000004
+		ntlm             = 0x00000200
+		targetTypeDomain = 0x00010000
+		extendedSecurity = 0x00080000
+		targetInfo       = 0x00800000
+	)
+
+	targetName := utf16le(domain)
+
+	// MsvAvNbDomainName then MsvAvEOL
+	var info []byte
+	info = binary.LittleEndian.AppendUint16(info, 2)
+	info = binary.LittleEndian.AppendUint16(info, uint16(len(targetName)))
+	info = append(info, targetName...)
+	info = append(info, 0, 0, 0, 0)
+
+	const headerLen = 48
+
+	var m []byte
+	m = append(m, "NTLMSSP\x00"...)
+	m = binary.LittleEndian.AppendUint32(m, 2)
+	m = binary.LittleEndian.AppendUint16(m, uint16(len(targetName)))
+	m = binary.LittleEndian.AppendUint16(m, uint16(len(targetName)))
+	m = binary.LittleEndian.AppendUint32(m, headerLen)
+	m = binary.LittleEndian.AppendUint32(m, unicode|requestTarget|ntlm|targetTypeDomain|extendedSecurity|targetInfo)
+	m = append(m, ntlmServerChallenge...)
+	m = append(m, make([]byte, 8)...)
+	m = binary.LittleEndian.AppendUint16(m, uint16(len(info)))
+	m = binary.LittleEndian.AppendUint16(m, uint16(len(info)))
+	m = binary.LittleEndian.AppendUint32(m, uint32(headerLen+len(targetName)))
+	m = append(m, targetName...)
+	m = append(m, info...)
+
+	return m
+}
+
+// verifyNTLMAuthenticate checks the NTLMv2 response in a type 3 message the same way a domain controller would
+func verifyNTLMAuthenticate(msg []byte, users map[string]string) error {
+	if len(msg) < 64 || !bytes.HasPrefix(msg, []byte("NTLMSSP\x00")) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		return fmt.Errorf("not an authenticate message")
+	}
+
+	field := func(offset int) ([]byte, error) {
+		length := int(binary.LittleEndian.Uint16(msg[offset:]))
+		start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+		if start+length > len(msg) {
+			return nil, fmt.Errorf("field at %d runs past the message", offset)
+		}
+		return msg[start : start+length], nil
+	}
+
+	ntResponse, err := field(20)
+	if err != nil {
+		return err
+	}
+	domain, err := field(28)
+	if err != nil {
+		return err
+	}
+	user, err := field(36)
+	if err != nil {
+		return err
+	}
+
+	if len(ntResponse) <= 16 {
+		return fmt.Errorf("NTLMv2 response too short (%d), v1 is not accepted", len(ntResponse))
+	}
+
+	username := fromUTF16le(user)
+	password, ok := users[fromUTF16le(domain)+`\`+username]
+	if !ok {
+		return fmt.Errorf("unknown user %s\\%s", fromUTF16le(domain), username)
+	}
+
+	ntHash := md4.New()
+	ntHash.Write(utf16le(password))
+
+	ntowfv2 := hmacMD5(ntHash.Sum(nil), utf16le(strings.ToUpper(username)+fromUTF16le(domain)))
+
+	proof, blob := ntResponse[:16], ntResponse[16:]
+	if !hmac.Equal(proof, hmacMD5(ntowfv2, ntlmServerChallenge, blob)) {
+		return fmt.Errorf("bad NTProofStr for %s", username)
+	}
+
+	return nil
+}
+
+// startNTLMProxy runs a stand in CONNECT proxy that requires NTLM, and tunnels to the requested address once authenticated
+// Like a real proxy the handshake state belongs to the connection, an authenticate message on a fresh connection is rejected
+func startNTLMProxy(t *testing.T, users map[string]string) ntlmProxy {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	p := ntlmProxy{
+		addr:        l.Addr().String(),
+		connections: new(atomic.Int32),
+		handshakes:  new(atomic.Int32),
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			p.connections.Add(1)
+
+			go func() {
+				defer conn.Close()
+
+				challenged := false
+
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+
+					if req.Method != http.MethodConnect {
+						fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+						return
+					}
+
+					token, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "NTLM ")
+					if !ok {
+						challenge(conn, "NTLM", false)
+						continue
+					}
+
+					msg, err := base64.StdEncoding.DecodeString(token)
+					if err != nil || len(msg) < 12 {
+						challenge(conn, "NTLM", true)
+						return
+					}
+
+					switch binary.LittleEndian.Uint32(msg[8:]) {
+					case 1:
+						challenged = true
+						challenge(conn, "NTLM "+base64.StdEncoding.EncodeToString(ntlmChallengeMessage("CORP")), false)
+						continue
+					case 3:
+						if !challenged {
+							challenge(conn, "NTLM", true)
+							return
+						}
+
+						if err := verifyNTLMAuthenticate(msg, users); err != nil {
+							t.Logf("ntlm proxy rejected authentication: %s", err)
+							challenge(conn, "NTLM", true)
+							return
+						}
+					default:
+						challenge(conn, "NTLM", true)
+						return
+					}
+
+					p.handshakes.Add(1)
+
+					target, err := net.Dial("tcp", req.RequestURI)
+					if err != nil {
+						fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+						return
+					}
+					defer target.Close()
+
+					fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+					go io.Copy(target, br)
+					io.Copy(conn, target)
+					return
+				}
+			}()
+		}
+	}()
+
+	return p
+}
+
+func TestProxyNTLMAuth(t *testing.T) {
+	p := startNTLMProxy(t, map[string]string{`CORP\alice`: "Summer2024!"})
+	target := startEcho(t)
+
+	// The domain is part of the username, with the backslash url encoded
+	conn, err := Connect(target, "http://CORP%5Calice:Summer2024%21@"+p.addr, 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectGreeting(t, conn)
+
+	if n := p.connections.Load(); n != 1 {
+		t.Errorf("expected the whole NTLM handshake on one keep-alive connection, proxy saw %d connections", n)
+	}
+}
+
+func TestProxyNTLMCredsSetting(t *testing.T) {
+	p := startNTLMProxy(t, map[string]string{`CORP\bob`: "hunter2"})
+	target := startEcho(t)
+
+	SetNTLMProxyCreds(`CORP\bob:hunter2`)
+	t.Cleanup(func() { SetNTLMProxyCreds("") })
+
+	conn, err := Connect(target, "http://"+p.addr, 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectGreeting(t, conn)
+
+	// Credentials in the url take priority over the setting
+	if _, err := Connect(target, "http://CORP%5Cbob:wrong@"+p.addr, 5*time.Second, false); err == nil {
+		t.Fatal("expected bad NTLM credentials to fail")
+	}
+}
+
+// startPollingEcho runs a stand in for the servers http polling transport, which greets each session and then echoes what it is sent
+func startPollingEcho(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+
+	var (
+		lck     sync.Mutex
+		pending = map[string]*bytes.Buffer{}
+		polls   = new(atomic.Int32)
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lck.Lock()
+		defer lck.Unlock()
+
+		switch {
+		case r.Method == http.MethodHead && r.URL.Path == "/push":
+			id := fmt.Sprintf("session%d", len(pending))
+			pending[id] = bytes.NewBufferString("hello")
+
+			http.SetCookie(w, &http.Cookie{Name: "NID", Value: id})
+			w.WriteHeader(http.StatusTemporaryRedirect)
+		case r.Method == http.MethodPost && r.URL.Path == "/push":
+			buff, ok := pending[r.URL.Query().Get("id")]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			io.Copy(buff, r.Body)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/push/"):
+			buff, ok := pending[r.URL.Query().Get("id")]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			polls.Add(1)
+			io.Copy(w, buff)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server.Listener.Addr().String(), polls
+}
+
+func TestProxyNTLMHTTPPolling(t *testing.T) {
+	p := startNTLMProxy(t, map[string]string{`CORP\alice`: "pass"})
+	target, polls := startPollingEcho(t)
+
+	dialer, err := NewProxyDialer("http://CORP%5Calice:pass@"+p.addr, 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connected the same way as the client does for http polling
+	conn, err := NewHTTPConn("http://"+target, "", func() (net.Conn, error) {
+		return dialer.Dial("tcp", target)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectGreeting(t, conn)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for polls.Load() < 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := polls.Load(); n < 20 {
+		t.Fatalf("polling stopped after %d requests", n)
+	}
+
+	// Writes can overlap with a poll, which needs a second connection, but each should only be authenticated once and then kept alive
+	connections, handshakes := p.connections.Load(), p.handshakes.Load()
+	if connections > 2 {
+		t.Errorf("expected polling to reuse its proxy connections, proxy saw %d connections for %d polls", connections, polls.Load())
+	}
+
+	if handshakes != connections {
+		t.Errorf("expected one NTLM handshake per proxy connection, got %d handshakes for %d connections", handshakes, connections)
+	}
+}
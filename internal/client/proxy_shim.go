@@ -2,7 +2,10 @@
 
 package client
 
-func additionalHeaders(proxy string, req []string) []string {
-	// linux doesnt support using win auth just yet
-	return req
+// There is no SSPI outside of windows, so the logged in users credentials cant be used. NTLM proxies are still supported with explicit
+// credentials, either --ntlm-proxy-creds or a DOMAIN\user username in the proxy url
+const nativeWinAuth = false
+
+func winAuthHeader(proxy string) (string, bool) {
+	return "", false
 }
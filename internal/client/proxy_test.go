@@ -0,0 +1,513 @@
+package client
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const proxyTarget = "rssh.example.com:3232"
+
+// startProxy runs a stand in CONNECT proxy, handle is called for each request on a connection and returns false to close it
+func startProxy(t *testing.T, handle func(conn net.Conn, req *http.Request) bool) (string, *atomic.Int32) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	connections := new(atomic.Int32)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+
+					if req.Method != http.MethodConnect || req.RequestURI != proxyTarget {
+						fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+						return
+					}
+
+					if !handle(conn, req) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), connections
+}
+
+// established accepts the tunnel and sends the greeting in the same write, so it has to survive the clients buffering
+func established(conn net.Conn) {
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+	io.Copy(conn, conn)
+}
+
+func challenge(conn net.Conn, header string, close bool) {
+	body := "authentication required"
+	connection := "keep-alive"
+	if close {
+		connection = "close"
+	}
+
+	fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: %s\r\nConnection: %s\r\nContent-Length: %d\r\n\r\n%s", header, connection, len(body), body)
+}
+
+func expectGreeting(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("reading through tunnel failed: %s", err)
+	}
+
+	if string(b) != "hello" {
+		t.Fatalf("expected greeting through the tunnel, got %q", b)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil || string(b[:4]) != "ping" {
+		t.Fatalf("tunnel did not echo, got %q: %v", b[:4], err)
+	}
+}
+
+func TestProxyNoAuth(t *testing.T) {
+	addr, _ := startProxy(t, func(conn net.Conn, req *http.Request) bool {
+		established(conn)
+		return false
+	})
+
+	conn, err := Connect(proxyTarget, "http://"+addr, 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectGreeting(t, conn)
+}
+
+func TestProxyBasicAuth(t *testing.T) {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:p@ss:word"))
+
+	addr, connections := startProxy(t, func(conn net.Conn, req *http.Request) bool {
+		if req.Header.Get("Proxy-Authorization") != expected {
+			challenge(conn, `Basic realm="proxy"`, false)
+			return true
+		}
+
+		established(conn)
+		return false
+	})
+
+	proxy := (&url.URL{Scheme: "http", User: url.UserPassword("user", "p@ss:word"), Host: addr}).String()
+
+	conn, err := Connect(proxyTarget, proxy, 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectGreeting(t, conn)
+
+	if n := connections.Load(); n != 1 {
+		t.Fatalf("expected the keep-alive connection to be reused, got %d connections", n)
+	}
+}
+
+func TestProxyBasicAuthRejected(t *testing.T) {
+	addr, _ := startProxy(t, func(conn net.Conn, req *http.Request) bool {
+		challenge(conn, `Basic realm="proxy"`, false)
+		return true
+	})
+
+	_, err := Connect(proxyTarget, "http://user:wrong@"+addr, 5*time.Second, false)
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected credentials to be rejected, got: %v", err)
+	}
+}
+
+func TestProxyNoCredentials(t *testing.T) {
+	addr, _ := startProxy(t, func(conn net.Conn, req *http.Request) bool {
+		challenge(conn, `Basic realm="proxy"`, false)
+		return true
+	})
+
+	_, err := Connect(proxyTarget, "http://"+addr, 5*time.Second, false)
+	if err == nil || !strings.Contains(err.Error(), "no usable credentials") {
+		t.Fatalf("expected missing credentials error, got: %v", err)
+	}
+}
+
+func TestProxyDigestAuth(t *testing.T) {
+	const (
+		realm    = "proxy@example.com"
+		nonce    = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+		opaque   = "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"
+		username = "Mufasa"
+		password = "Circle of Life"
+	)
+
+	h := func(parts ...string) string {
+		sum := sha256.Sum256([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum[:])
+	}
+
+	for _, closeAfterChallenge := range []bool{false, true} {
+		t.Run(fmt.Sprintf("close=%t", closeAfterChallenge), func(t *testing.T) {
+
+			addr, connections := startProxy(t, func(conn net.Conn, req *http.Request) bool {
+				scheme, params, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+				if scheme != "Digest" {
+					challenge(conn, fmt.Sprintf(`Digest realm="%s", qop="auth, auth-int", algorithm=SHA-256, nonce="%s", opaque="%s"`, realm, nonce, opaque), closeAfterChallenge)
+					return !closeAfterChallenge
+				}
+
+				p := parseAuthParams(params)
+				expected := h(h(username, realm, password), nonce, p["nc"], p["cnonce"], "auth", h(http.MethodConnect, proxyTarget))
+
+				if p["username"] != username || p["realm"] != realm || p["uri"] != proxyTarget || p["opaque"] != opaque || p["qop"] != "auth" || p["response"] != expected {
+					t.Errorf("bad digest response: %q", params)
+					fmt.Fprint(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+					return false
+				}
+
+				established(conn)
+				return false
+			})
+
+			proxy := (&url.URL{Scheme: "http", User: url.UserPassword(username, password), Host: addr}).String()
+
+			conn, err := Connect(proxyTarget, proxy, 5*time.Second, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			expectGreeting(t, conn)
+
+			want := int32(1)
+			if closeAfterChallenge {
+				want = 2
+			}
+
+			if n := connections.Load(); n != want {
+				t.Fatalf("expected %d connections, got %d", want, n)
+			}
+		})
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`realm="a, \"quoted\" realm", qop="auth,auth-int", algorithm=MD5-sess,stale=TRUE, nonce="abc"`)
+
+	expected := map[string]string{
+		"realm":     `a, "quoted" realm`,
+		"qop":       "auth,auth-int",
+		"algorithm": "MD5-sess",
+		"stale":     "TRUE",
+		"nonce":     "abc",
+	}
+
+	for key, value := range expected {
+		if params[key] != value {
+			t.Errorf("%s: expected %q got %q", key, value, params[key])
+		}
+	}
+
+	if len(params) != len(expected) {
+		t.Errorf("expected %d params, got %d: %v", len(expected), len(params), params)
+	}
+}
+
+func TestDigestAuthorizationHeader(t *testing.T) {
+	// Challenge from the RFC 7616 section 3.9.1 example, the cnonce is random so only the fields around the response are checked
+	header, err := digestAuthorization(map[string]string{
+		"realm":  "http-auth@example.org",
+		"qop":    "auth, auth-int",
+		"nonce":  "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		"opaque": "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+	}, "Mufasa", "Circle of Life", http.MethodGet, "/dir/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, part := range []string{`username="Mufasa"`, `realm="http-auth@example.org"`, `uri="/dir/index.html"`, "algorithm=MD5", "qop=auth", "nc=00000001", `opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`} {
+		if !strings.Contains(header, part) {
+			t.Errorf("digest header %q is missing %q", header, part)
+		}
+	}
+
+	if _, err := digestAuthorization(map[string]string{"nonce": "a", "algorithm": "SHA-1"}, "u", "p", http.MethodConnect, "a:1"); err == nil {
+		t.Error("expected unsupported algorithm to fail")
+	}
+}
+
+// startSocks5 runs a stand in socks5 proxy that requires username/password auth (RFC 1929) and then dials the requested address for real
+func startSocks5(t *testing.T, username, password string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+
+				// version, number of methods, methods
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(br, header); err != nil || header[0] != 5 {
+					return
+				}
+				methods := make([]byte, header[1])
+				if _, err := io.ReadFull(br, methods); err != nil {
+					return
+				}
+
+				if !strings.Contains(string(methods), "\x02") {
+					conn.Write([]byte{5, 0xff})
+					return
+				}
+				conn.Write([]byte{5, 2})
+
+				// auth version, username, password
+				readString := func() string {
+					n, err := br.ReadByte()
+					if err != nil {
+						return ""
+					}
+					b := make([]byte, n)
+					io.ReadFull(br, b)
+					return string(b)
+				}
+
+				if v, _ := br.ReadByte(); v != 1 {
+					return
+				}
+
+				if readString() != username || readString() != password {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+
+				// version, connect, reserved, address type
+				request := make([]byte, 4)
+				if _, err := io.ReadFull(br, request); err != nil || request[1] != 1 {
+					return
+				}
+
+				var host string
+				switch request[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(br, ip)
+					host = net.IP(ip).String()
+				case 3:
+					host = readString()
+				default:
+					conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+
+				port := make([]byte, 2)
+				io.ReadFull(br, port)
+
+				target, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprintf("%d", int(port[0])<<8|int(port[1]))))
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(target, br)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// startEcho stands in for the rssh server at the end of the chain
+func startEcho(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("hello"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestSocks5Auth(t *testing.T) {
+	socksAddr := startSocks5(t, "sockuser", "sockpass")
+	target := startEcho(t)
+
+	conn, err := Connect(target, "socks5://sockuser:sockpass@"+socksAddr, 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectGreeting(t, conn)
+
+	if _, err := Connect(target, "socks5://sockuser:wrong@"+socksAddr, 5*time.Second, false); err == nil {
+		t.Fatal("expected bad socks credentials to fail")
+	}
+}
+
+func TestProxyChain(t *testing.T) {
+	socksAddr := startSocks5(t, "sockuser", "sockpass")
+
+	httpAddr, _ := startProxy(t, func(conn net.Conn, req *http.Request) bool {
+		if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			challenge(conn, `Basic realm="proxy"`, false)
+			return true
+		}
+
+		established(conn)
+		return false
+	})
+
+	// socks5 into http CONNECT, into the server
+	chain := "socks5://sockuser:sockpass@" + socksAddr + ",http://user:pass@" + httpAddr
+
+	conn, err := Connect(proxyTarget, chain, 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectGreeting(t, conn)
+}
+
+func TestDestinationProxyChain(t *testing.T) {
+	socksAddr := startSocks5(t, "sockuser", "sockpass")
+
+	httpAddr, _ := startProxy(t, func(conn net.Conn, req *http.Request) bool {
+		established(conn)
+		return false
+	})
+
+	// Every hop of the chain has to survive being normalised, rather than the chain being parsed as one proxy
+	chain := "socks5://sockuser:sockpass@" + socksAddr + ",http://" + httpAddr
+
+	destinations, err := ParseDestinations("tls://unreachable.invalid?proxy="+url.QueryEscape("http://no-port.invalid")+","+proxyTarget+"?proxy="+url.QueryEscape(chain), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	picker, err := newDestinationPicker(destinations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proxy := picker.destinations[0].Proxy; proxy != "http://no-port.invalid:80" {
+		t.Fatalf("expected single proxy to get a default port, got %q", proxy)
+	}
+
+	if proxy := picker.destinations[1].Proxy; proxy != chain {
+		t.Fatalf("expected the proxy chain to be kept as is, got %q", proxy)
+	}
+
+	dialer, err := NewProxyDialer(picker.destinations[1].Proxy, 5*time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := connect(proxyTarget, dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expectGreeting(t, conn)
+
+	if _, err := newDestinationPicker([]Destination{{Address: proxyTarget, Proxy: "socks4://10.0.0.1:1080,http://10.0.0.2"}}); err == nil {
+		t.Fatal("expected a chain with an unsupported proxy to be refused")
+	}
+}
+
+func TestParseProxyChain(t *testing.T) {
+	proxies, err := ParseProxyChain("socks5://a:b@10.0.0.1, proxy.internal:8080,https://p.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"socks5://a:b@10.0.0.1:1080", "http://proxy.internal:8080", "https://p.example.com:443"}
+	if len(proxies) != len(expected) {
+		t.Fatalf("expected %d proxies got %d", len(expected), len(proxies))
+	}
+
+	for i := range expected {
+		if proxies[i].String() != expected[i] {
+			t.Errorf("hop %d: expected %q got %q", i, expected[i], proxies[i])
+		}
+	}
+
+	if _, err := ParseProxyChain("socks4://10.0.0.1"); err == nil {
+		t.Error("expected socks4 to be rejected")
+	}
+}
@@ -3,12 +3,11 @@
 package client
 
 import (
-	"fmt"
-
 	"github.com/NHAS/reverse_ssh/pkg/wauth"
 )
 
-func additionalHeaders(proxy string, req []string) []string {
-	req = append(req, fmt.Sprintf("Proxy-Authorization: %s", wauth.GetAuthorizationHeader(proxy)))
-	return req
+const nativeWinAuth = true
+
+func winAuthHeader(proxy string) (string, bool) {
+	return wauth.GetAuthorizationHeader(proxy), true
 }
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+var (
+	reconnectPolicyLck sync.RWMutex
+	reconnectPolicy    = internal.DefaultReconnectPolicy
+)
+
+// SetReconnectPolicy changes the policy used the next time the client fails to connect, this can be called while the client is running
+func SetReconnectPolicy(policy internal.ReconnectPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	reconnectPolicyLck.Lock()
+	defer reconnectPolicyLck.Unlock()
+
+	reconnectPolicy = policy
+
+	return nil
+}
+
+func getReconnectPolicy() internal.ReconnectPolicy {
+	reconnectPolicyLck.RLock()
+	defer reconnectPolicyLck.RUnlock()
+
+	return reconnectPolicy
+}
+
+// reconnector tracks consecutive failures to reach the server, and waits according to the reconnect policy
+type reconnector struct {
+	attempts     int
+	firstFailure time.Time
+}
+
+// wait blocks for the next backoff delay, it returns false if the policy says the client should give up
+func (r *reconnector) wait() bool {
+	policy := getReconnectPolicy()
+
+	if r.attempts == 0 {
+		r.firstFailure = time.Now()
+	}
+	r.attempts++
+
+	if policy.MaxAttempts > 0 && r.attempts > policy.MaxAttempts {
+		log.Printf("Failed to connect %d times, giving up", policy.MaxAttempts)
+		return false
+	}
+
+	if policy.GiveUp > 0 && time.Since(r.firstFailure) > policy.GiveUp {
+		log.Printf("Unable to connect for %s, giving up", policy.GiveUp)
+		return false
+	}
+
+	delay := policy.Delay(r.attempts)
+	log.Printf("Reconnecting in %s (attempt %d)", delay.Round(time.Millisecond), r.attempts)
+
+	<-time.After(delay)
+
+	return true
+}
+
+func (r *reconnector) reset() {
+	r.attempts = 0
+}
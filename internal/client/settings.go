@@ -0,0 +1,44 @@
+package client
+
+import (
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+// How long the client stays connected to a fallback destination before checking whether a preferred one is back
+const DefaultFailback = 10 * time.Minute
+
+// Settings is everything the client needs to connect back to the server
+type Settings struct {
+	// In priority order, the first is the preferred destination
+	Destinations []Destination
+
+	// Comma separated SHA256 hex fingerprints of the server keys to trust, more than one allows the server key to be rotated
+	Fingerprint string
+	// Comma separated SHA256 hex fingerprints of CAs that may sign the servers host certificate
+	HostCA string
+	// Connecting without a server fingerprint has to be explicitly allowed as it will trust any server
+	AllowNoFingerprint bool
+
+	// nil does not verify the servers TLS certificate
+	TLSVerification *TLSVerification
+
+	// Use windows authentication with the proxy (only supported on windows)
+	WinAuth bool
+
+	// Zero disables failing back to a preferred destination
+	Failback time.Duration
+
+	// nil uses the default reconnect policy
+	ReconnectPolicy *internal.ReconnectPolicy
+
+	// Capabilities the server is not allowed to use, see the capabilities package
+	Disabled []string
+
+	// Where traffic sent into a tun session can be forwarded, nil allows everything
+	TunPolicy *internal.TunPolicy
+
+	// The arguments the client was started with, an updated client is started with the same ones
+	CommandLine string
+}
@@ -0,0 +1,75 @@
+package sysinfo
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/client/capabilities"
+)
+
+// interfaceNameCleaner stops interface names (which can be almost anything on windows) from breaking the ssh name-list or our own separators
+var interfaceNameCleaner = strings.NewReplacer(",", " ", "|", " ")
+
+// Get collects what we can about the host, anything that cant be found is left empty
+func Get() internal.ClientInfo {
+	info := internal.ClientInfo{
+		Username: "Unknown",
+		Hostname: "Unknown Hostname",
+		GoArch:   runtime.GOARCH,
+		GoOS:     runtime.GOOS,
+		PID:      uint32(os.Getpid()),
+	}
+
+	if u, err := user.Current(); err == nil {
+		info.Username = u.Username
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		info.Hostname = hostname
+	}
+
+	if executable, err := os.Executable(); err == nil {
+		info.Executable = executable
+	}
+
+	info.OSRelease, info.Kernel = release()
+	info.Privileged = privileged()
+	info.Uptime = uptime()
+
+	info.IPs, info.Interfaces = interfaces()
+
+	info.Disabled = capabilities.Disabled()
+
+	return info
+}
+
+func interfaces() (ips, descriptions []string) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		var addresses []string
+		for _, addr := range addrs {
+			addresses = append(addresses, addr.String())
+
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP.String())
+			}
+		}
+
+		descriptions = append(descriptions, interfaceNameCleaner.Replace(iface.Name)+"|"+iface.HardwareAddr.String()+"|"+strings.Join(addresses, " "))
+	}
+
+	return ips, descriptions
+}
@@ -0,0 +1,51 @@
+package sysinfo
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func release() (osRelease, kernel string) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		kernel = unix.ByteSliceToString(uts.Sysname[:]) + " " + unix.ByteSliceToString(uts.Release[:])
+	}
+
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return "", kernel
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		value, ok := strings.CutPrefix(s.Text(), "PRETTY_NAME=")
+		if !ok {
+			continue
+		}
+
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		return value, kernel
+	}
+
+	return "", kernel
+}
+
+func privileged() bool {
+	return os.Geteuid() == 0
+}
+
+func uptime() uint64 {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0
+	}
+
+	return uint64(info.Uptime)
+}
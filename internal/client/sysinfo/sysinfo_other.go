@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package sysinfo
+
+import "os"
+
+func release() (osRelease, kernel string) {
+	return "", ""
+}
+
+func privileged() bool {
+	return os.Geteuid() == 0
+}
+
+func uptime() uint64 {
+	return 0
+}
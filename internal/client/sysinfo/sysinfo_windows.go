@@ -0,0 +1,34 @@
+package sysinfo
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+func release() (osRelease, kernel string) {
+	v := windows.RtlGetVersion()
+	kernel = fmt.Sprintf("Windows NT %d.%d.%d", v.MajorVersion, v.MinorVersion, v.BuildNumber)
+
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows NT\CurrentVersion`, registry.QUERY_VALUE)
+	if err != nil {
+		return "", kernel
+	}
+	defer k.Close()
+
+	osRelease, _, _ = k.GetStringValue("ProductName")
+	if display, _, err := k.GetStringValue("DisplayVersion"); err == nil && display != "" {
+		osRelease += " " + display
+	}
+
+	return osRelease, kernel
+}
+
+func privileged() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
+
+func uptime() uint64 {
+	return uint64(windows.DurationSinceBoot().Seconds())
+}
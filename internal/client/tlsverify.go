@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	TLSVerifyNone   = "none"
+	TLSVerifySystem = "system"
+	TLSVerifyCA     = "ca"
+	TLSVerifySPKI   = "spki"
+)
+
+// TLSVerification decides how the client checks the certificate of the server (and https proxies) when a TLS transport is in use
+// As the ssh host key is also checked this is defense in depth, and defaults to none
+type TLSVerification struct {
+	Mode string
+
+	roots *x509.CertPool
+	pins  [][]byte
+}
+
+var (
+	tlsVerificationLck sync.RWMutex
+	tlsVerification    = &TLSVerification{Mode: TLSVerifyNone}
+)
+
+// ParseTLSVerification parses one of
+// none
+// system					use the operating systems CA pool
+// ca=<path or base64 pem bundle>	only trust certificates issued by these CAs
+// spki=<sha256 hex>[;<sha256 hex>...]	pin the servers leaf certificate public key
+func ParseTLSVerification(s string) (*TLSVerification, error) {
+	mode, value, _ := strings.Cut(strings.TrimSpace(s), "=")
+
+	switch strings.ToLower(mode) {
+	case "", TLSVerifyNone:
+		return &TLSVerification{Mode: TLSVerifyNone}, nil
+	case TLSVerifySystem:
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load system certificate pool: %s", err)
+		}
+		return &TLSVerification{Mode: TLSVerifySystem, roots: roots}, nil
+	case TLSVerifyCA:
+		if value == "" {
+			return nil, errors.New("ca verification requires a path or base64 encoded pem bundle")
+		}
+
+		bundle, err := os.ReadFile(value)
+		if err != nil {
+			bundle, err = base64.StdEncoding.DecodeString(value)
+			if err != nil || !bytes.Contains(bundle, []byte("-----BEGIN")) {
+				return nil, fmt.Errorf("ca bundle %q is neither a readable file or base64 encoded pem", value)
+			}
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("ca bundle did not contain any certificates")
+		}
+		return &TLSVerification{Mode: TLSVerifyCA, roots: roots}, nil
+	case TLSVerifySPKI:
+		v := &TLSVerification{Mode: TLSVerifySPKI}
+		for _, pin := range strings.Split(value, ";") {
+			decoded, err := hex.DecodeString(strings.TrimSpace(pin))
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("spki pin %q is not a sha256 hex digest", pin)
+			}
+			v.pins = append(v.pins, decoded)
+		}
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("unknown tls verification mode %q, expected none, system, ca=... or spki=...", mode)
+}
+
+func setTLSVerification(v *TLSVerification) {
+	if v == nil {
+		v = &TLSVerification{Mode: TLSVerifyNone}
+	}
+
+	tlsVerificationLck.Lock()
+	defer tlsVerificationLck.Unlock()
+
+	tlsVerification = v
+}
+
+func getTLSVerification() *TLSVerification {
+	tlsVerificationLck.RLock()
+	defer tlsVerificationLck.RUnlock()
+
+	return tlsVerification
+}
+
+// serverTLSConfig is used for connections to the rssh server itself
+func serverTLSConfig(serverName string) *tls.Config {
+	v := getTLSVerification()
+
+	switch v.Mode {
+	case TLSVerifySystem, TLSVerifyCA:
+		return &tls.Config{
+			RootCAs:    v.roots,
+			ServerName: serverName,
+		}
+	case TLSVerifySPKI:
+		return &tls.Config{
+			// The chain is not checked, only that the leaf certificate has a key we have pinned
+			InsecureSkipVerify: true,
+			ServerName:         serverName,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return errors.New("server did not present a certificate")
+				}
+
+				leaf, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+
+				digest := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+				for _, pin := range v.pins {
+					if bytes.Equal(pin, digest[:]) {
+						return nil
+					}
+				}
+
+				return fmt.Errorf("server certificate public key %s does not match any pinned key", hex.EncodeToString(digest[:]))
+			},
+		}
+	}
+
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+	}
+}
+
+// proxyTLSConfig is used for https proxies, the pinned CAs or keys are for the rssh server so proxies are checked against the system pool
+func proxyTLSConfig() *tls.Config {
+	if getTLSVerification().Mode == TLSVerifyNone {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	return &tls.Config{}
+}
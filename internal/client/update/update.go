@@ -0,0 +1,274 @@
+package update
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/storage"
+	"golang.org/x/crypto/ssh"
+)
+
+// Set in the environment of the new client, so it can tell the server which client it replaced
+const tokenEnv = "RSSH_UPDATE_TOKEN"
+
+// How long past the servers timeout we wait before rolling back on our own, in case the server never tells us
+const rollbackGrace = 30 * time.Second
+
+type pendingUpdate struct {
+	token string
+	child *os.Process
+
+	// The replaced executable is moved to backup, if backup is empty the new client was run from memory or a temp file instead
+	executable, backup string
+}
+
+var (
+	lck sync.Mutex
+
+	commandLine string
+
+	// Update this client has started, and is waiting to be confirmed
+	current *pendingUpdate
+
+	// Token we were started with, if we are the new client
+	token = takeToken()
+
+	updateLog = logger.NewLog("update")
+)
+
+func takeToken() string {
+	t := os.Getenv(tokenEnv)
+	os.Unsetenv(tokenEnv)
+	return t
+}
+
+// SetCommandLine records the arguments the client was started with, so the new client is started the same way
+func SetCommandLine(argv string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	commandLine = argv
+}
+
+// Receive handles the "rssh-update" channel, verifying the binary was signed by serverKey before starting it
+func Receive(newChannel ssh.NewChannel, serverKey ssh.PublicKey, log logger.Logger) {
+	var header internal.UpdateHeader
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &header); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid update header")
+		return
+	}
+
+	if serverKey == nil {
+		newChannel.Reject(ssh.Prohibited, "no server key to verify the update with")
+		return
+	}
+
+	lck.Lock()
+	inProgress := current != nil
+	lck.Unlock()
+
+	if inProgress {
+		newChannel.Reject(ssh.Prohibited, "an update is already in progress")
+		return
+	}
+
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		log.Warning("Unable to accept update channel: %s", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	err = start(ch, header, serverKey)
+
+	result := internal.UpdateResult{Ok: err == nil}
+	if err != nil {
+		log.Error("Refusing update to %s: %s", header.Version, err)
+		result.Message = err.Error()
+	} else {
+		log.Info("Started updated client %s, waiting for the server to confirm it", header.Version)
+	}
+
+	ch.SendRequest("update-result", false, ssh.Marshal(result))
+}
+
+func start(ch io.Reader, header internal.UpdateHeader, serverKey ssh.PublicKey) error {
+	binary, err := io.ReadAll(io.LimitReader(ch, int64(header.Size)+1))
+	if err != nil {
+		return fmt.Errorf("failed to receive update: %s", err)
+	}
+
+	if uint64(len(binary)) != header.Size {
+		return fmt.Errorf("expected %d bytes, got %d", header.Size, len(binary))
+	}
+
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(header.Signature, &signature); err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+
+	digest := sha256.Sum256(binary)
+	if err := serverKey.Verify(internal.UpdateSignedData(header, digest[:]), &signature); err != nil {
+		return fmt.Errorf("signature does not match the server key: %s", err)
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	if current != nil {
+		return errors.New("an update is already in progress")
+	}
+
+	// Shared objects run inside another process, so there is nothing of ours to replace
+	if commandLine == "" {
+		return errors.New("client was not started as an executable")
+	}
+
+	p := &pendingUpdate{
+		token: header.Token,
+	}
+
+	path, err := p.install(binary)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path)
+	// Run in the foreground with the same arguments, the same way a forked client is started
+	cmd.Env = append(os.Environ(), tokenEnv+"="+header.Token, "F="+commandLine)
+	cmd.SysProcAttr = childAttributes()
+
+	if err := cmd.Start(); err != nil {
+		p.restore()
+		return fmt.Errorf("unable to start new client: %s", err)
+	}
+
+	p.child = cmd.Process
+	current = p
+
+	go func() {
+		err := cmd.Wait()
+		rollback(header.Token, fmt.Sprintf("new client exited before it was confirmed: %v", err))
+	}()
+
+	time.AfterFunc(time.Duration(header.Timeout)*time.Second+rollbackGrace, func() {
+		rollback(header.Token, "server did not confirm the new client")
+	})
+
+	return nil
+}
+
+// install puts the new binary in place of our own executable, keeping the old one so we can roll back
+// If we cant replace ourselves (no write access, or we're running from memory) it goes into memory on linux, or a temp file elsewhere
+func (p *pendingUpdate) install(binary []byte) (string, error) {
+	executable, err := os.Executable()
+	if err == nil && !strings.HasPrefix(executable, "/proc/") && !strings.Contains(executable, "memfd:") && !strings.HasSuffix(executable, "(deleted)") {
+		backup := executable + ".old"
+		if err = os.Rename(executable, backup); err == nil {
+			if err = os.WriteFile(executable, binary, 0700); err == nil {
+				p.executable, p.backup = executable, backup
+				return executable, nil
+			}
+
+			os.Remove(executable)
+			os.Rename(backup, executable)
+		}
+	}
+
+	name, err := internal.RandomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := storage.Store(filepath.Join(os.TempDir(), name), io.NopCloser(bytes.NewReader(binary)))
+	if err != nil {
+		return "", fmt.Errorf("unable to store update: %s", err)
+	}
+	p.executable = path
+
+	return path, nil
+}
+
+// restore puts the original executable back
+func (p *pendingUpdate) restore() {
+	if p.backup == "" {
+		if !strings.HasPrefix(p.executable, "/proc/") {
+			os.Remove(p.executable)
+		}
+		return
+	}
+
+	os.Remove(p.executable)
+	os.Rename(p.backup, p.executable)
+}
+
+func rollback(t, reason string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if current == nil || current.token != t {
+		return
+	}
+
+	updateLog.Warning("Rolling back update: %s", reason)
+
+	current.child.Kill()
+	current.restore()
+	current = nil
+}
+
+// Rollback is sent by the server when the new client didnt connect in time
+func Rollback(t string) {
+	rollback(t, "server did not see the new client connect")
+}
+
+// Confirmed is sent by the server once the new client has connected, at which point this client is no longer needed
+func Confirmed(t string) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if current == nil || current.token != t {
+		return
+	}
+
+	updateLog.Info("Update confirmed by the server, exiting")
+	os.Exit(0)
+}
+
+// SendConfirmation tells the server we are the result of an update, which lets the client we replaced exit
+func SendConfirmation(conn ssh.Conn) {
+	lck.Lock()
+	t := token
+	lck.Unlock()
+
+	if t == "" {
+		return
+	}
+
+	ok, _, err := conn.SendRequest("update-confirmed", true, []byte(t))
+	if err != nil || !ok {
+		updateLog.Warning("Server did not confirm update (%v), the previous client will roll back", err)
+		return
+	}
+
+	lck.Lock()
+	token = ""
+	lck.Unlock()
+
+	// The client we replaced may still have been running from the backup when we started, particularly on windows
+	if executable, err := os.Executable(); err == nil {
+		os.Remove(executable + ".old")
+	}
+}
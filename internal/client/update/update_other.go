@@ -0,0 +1,9 @@
+//go:build !windows
+
+package update
+
+import "syscall"
+
+func childAttributes() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,112 @@
+package update
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+func signedHeader(t *testing.T, signer ssh.Signer, binary []byte) internal.UpdateHeader {
+	t.Helper()
+
+	header := internal.UpdateHeader{
+		Version: "v-test",
+		Token:   "token",
+		Size:    uint64(len(binary)),
+		Timeout: 60,
+	}
+
+	digest := sha256.Sum256(binary)
+	sig, err := signer.Sign(rand.Reader, internal.UpdateSignedData(header, digest[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Signature = ssh.Marshal(sig)
+
+	return header
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// Only the refusal paths are tested, a valid update would replace the test binary
+func TestUpdateRefused(t *testing.T) {
+	server := newSigner(t)
+	other := newSigner(t)
+
+	binary := []byte("not really a client")
+
+	tests := []struct {
+		name   string
+		header func() internal.UpdateHeader
+		body   []byte
+		err    string
+	}{
+		{
+			name:   "wrong key",
+			header: func() internal.UpdateHeader { return signedHeader(t, other, binary) },
+			body:   binary,
+			err:    "signature does not match",
+		},
+		{
+			name: "tampered binary",
+			header: func() internal.UpdateHeader {
+				return signedHeader(t, server, binary)
+			},
+			body: []byte("not really a clienT"),
+			err:  "signature does not match",
+		},
+		{
+			name: "different version signed",
+			header: func() internal.UpdateHeader {
+				h := signedHeader(t, server, binary)
+				h.Version = "v-other"
+				return h
+			},
+			body: binary,
+			err:  "signature does not match",
+		},
+		{
+			// The command line is only set by the client executable, never in tests
+			name:   "valid update without a command line",
+			header: func() internal.UpdateHeader { return signedHeader(t, server, binary) },
+			body:   binary,
+			err:    "not started as an executable",
+		},
+		{
+			name:   "truncated",
+			header: func() internal.UpdateHeader { return signedHeader(t, server, binary) },
+			body:   binary[:5],
+			err:    "expected",
+		},
+	}
+
+	for _, test := range tests {
+		err := start(bytes.NewReader(test.body), test.header(), server.PublicKey())
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	if current != nil {
+		t.Fatal("refused update should not be pending")
+	}
+}
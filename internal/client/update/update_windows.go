@@ -0,0 +1,14 @@
+package update
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+func childAttributes() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		HideWindow:    true,
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+	}
+}
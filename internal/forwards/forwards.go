@@ -0,0 +1,238 @@
+// Package forwards keeps an inventory of the forwards open in this process, so that the forwards command can list and close them wherever they are
+package forwards
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/bandwidth"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ssh -L through a client, there is one for each connection
+	Local = "local"
+	// ssh -R through a client
+	Remote = "remote"
+	// The server control port opened on a client with listen -c
+	ServerPort = "server-port"
+	// A socks listener on the server
+	Dynamic = "dynamic"
+	// udp received on the server and sent from a client
+	UDP = "udp"
+	// udp received on a client and sent from the server
+	RemoteUDP = "remote-udp"
+	// A port on the server opened with ssh -R by a proxy key, these have no client
+	Proxy = "proxy"
+	// A service behind a client published on the server webserver
+	Published = "published"
+)
+
+// Info describes a forward, clients send these to the server with ssh.Marshal
+type Info struct {
+	ID     string
+	Kind   string
+	Owner  string
+	Client string
+	Bind   string
+	Target string
+
+	// Unix time the forward started
+	Started     uint64
+	Connections uint64
+	Bytes       uint64
+	// Bytes per second, 0 when unlimited
+	Limit uint64
+}
+
+// LimitRequest asks a client to change the rate limit of one of its forwards
+type LimitRequest struct {
+	ID   string
+	Rate uint64
+}
+
+func (i Info) Age() time.Duration {
+	return time.Since(time.Unix(int64(i.Started), 0)).Truncate(time.Second)
+}
+
+// Forward is a forward in the inventory, which counts the connections and bytes that go through it
+type Forward struct {
+	info Info
+
+	connections atomic.Uint64
+	counter     bandwidth.Counter
+	limit       *bandwidth.Limit
+
+	close func() error
+}
+
+var (
+	lck      sync.Mutex
+	nextID   uint64
+	forwards = map[string]*Forward{}
+)
+
+// Add puts a forward in the inventory until Remove is called, close is used to stop it from the forwards command
+func Add(kind, owner, client, bind, target string, close func() error) *Forward {
+	lck.Lock()
+	defer lck.Unlock()
+
+	nextID++
+
+	f := &Forward{
+		info: Info{
+			ID:      strconv.FormatUint(nextID, 10),
+			Kind:    kind,
+			Owner:   owner,
+			Client:  client,
+			Bind:    bind,
+			Target:  target,
+			Started: uint64(time.Now().Unix()),
+		},
+		limit: bandwidth.NewLimit(),
+		close: close,
+	}
+
+	forwards[f.info.ID] = f
+
+	return f
+}
+
+func (f *Forward) Remove() {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if forwards[f.info.ID] == f {
+		delete(forwards, f.info.ID)
+	}
+}
+
+func (f *Forward) Info() Info {
+	i := f.info
+	i.Connections = f.connections.Load()
+	i.Bytes = f.counter.Total()
+	i.Limit = f.limit.Rate()
+
+	return i
+}
+
+// Conn counts a new connection through the forward and the bytes read from and written to it, which are held to the forwards limit
+func (f *Forward) Conn(c net.Conn) net.Conn {
+	f.connections.Add(1)
+
+	conn := bandwidth.NewConn(c)
+	conn.Track(&f.counter, f.limit)
+
+	return conn
+}
+
+// Listener counts every connection accepted from l
+func (f *Forward) Listener(l net.Listener) net.Listener {
+	return &countingListener{Listener: l, f: f}
+}
+
+// All returns every forward in the inventory in the order they were started
+func All() (out []Info) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	for _, f := range forwards {
+		out = append(out, f.Info())
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, _ := strconv.ParseUint(out[i].ID, 10, 64)
+		b, _ := strconv.ParseUint(out[j].ID, 10, 64)
+		return a < b
+	})
+
+	return out
+}
+
+// SetLimit changes the rate limit of the forward with id in bytes per second, 0 removes it
+func SetLimit(id string, bytesPerSecond uint64) error {
+	lck.Lock()
+	f, ok := forwards[id]
+	lck.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no forward with id %s", id)
+	}
+
+	f.limit.Set(bytesPerSecond)
+
+	return nil
+}
+
+// Close stops the forward with id and removes it from the inventory
+func Close(id string) error {
+	lck.Lock()
+	f, ok := forwards[id]
+	lck.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no forward with id %s", id)
+	}
+
+	defer f.Remove()
+
+	return f.close()
+}
+
+// Marshal encodes forwards to be sent over ssh, each is length prefixed as there is no ssh encoding for a list of structs
+func Marshal(forwards []Info) []byte {
+	var out []byte
+	for _, f := range forwards {
+		b := ssh.Marshal(&f)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(b)))
+		out = append(out, b...)
+	}
+
+	return out
+}
+
+func Unmarshal(b []byte) (out []Info, err error) {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("forward list is truncated")
+		}
+
+		length := binary.BigEndian.Uint32(b)
+		b = b[4:]
+
+		if uint32(len(b)) < length {
+			return nil, errors.New("forward list is truncated")
+		}
+
+		var f Info
+		if err := ssh.Unmarshal(b[:length], &f); err != nil {
+			return nil, err
+		}
+		b = b[length:]
+
+		out = append(out, f)
+	}
+
+	return out, nil
+}
+
+type countingListener struct {
+	net.Listener
+	f *Forward
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.f.Conn(c), nil
+}
@@ -0,0 +1,79 @@
+package forwards
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	list := []Info{
+		{ID: "1", Kind: Local, Owner: "jim", Bind: "127.0.0.1:5555", Target: "10.0.0.1:22", Started: 100, Connections: 1, Bytes: 4096},
+		{ID: "2", Kind: ServerPort, Bind: ":3232", Target: "(server)", Started: 200},
+	}
+
+	decoded, err := Unmarshal(Marshal(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, list) {
+		t.Fatalf("expected %+v got %+v", list, decoded)
+	}
+
+	if _, err := Unmarshal(Marshal(list)[:10]); err == nil {
+		t.Fatal("expected a truncated list to fail")
+	}
+
+	if decoded, err := Unmarshal(nil); err != nil || len(decoded) != 0 {
+		t.Fatal("expected an empty list to decode to nothing")
+	}
+}
+
+func TestCountingAndClose(t *testing.T) {
+	closed := false
+	f := Add(Remote, "jim", "", ":8080", "(ssh client)", func() error {
+		closed = true
+		return nil
+	})
+
+	a, b := net.Pipe()
+	conn := f.Conn(a)
+
+	go func() {
+		b.Write([]byte("hello"))
+		io.ReadFull(b, make([]byte, 3))
+	}()
+
+	io.ReadFull(conn, make([]byte, 5))
+	conn.Write([]byte("bye"))
+	conn.Close()
+
+	info := f.Info()
+	if info.Connections != 1 || info.Bytes != 8 {
+		t.Fatalf("expected 1 connection and 8 bytes, got %d and %d", info.Connections, info.Bytes)
+	}
+
+	found := false
+	for _, i := range All() {
+		found = found || i.ID == info.ID
+	}
+	if !found {
+		t.Fatal("forward was not listed")
+	}
+
+	if err := Close(info.ID); err != nil || !closed {
+		t.Fatalf("expected forward to be closed: %v", err)
+	}
+
+	if err := Close(info.ID); err == nil {
+		t.Fatal("expected closed forward to be removed")
+	}
+
+	failing := Add(Local, "", "", "", "", func() error { return errors.New("already closed") })
+	if err := Close(failing.Info().ID); err == nil {
+		t.Fatal("expected the close error to be returned")
+	}
+}
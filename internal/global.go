@@ -33,6 +33,11 @@ func (r *RemoteForwardRequest) String() string {
 	return fmt.Sprintf("%s:%d", r.BindAddr, r.BindPort)
 }
 
+// Sent by the server when opening a jump channel, so forwards through the jump can be attributed to the user
+type JumpInfo struct {
+	Owner string
+}
+
 // https://tools.ietf.org/html/rfc4254
 type ChannelOpenDirectMsg struct {
 	Raddr string
@@ -86,11 +91,39 @@ type PtyReq struct {
 	Modes         string
 }
 
+// ClientInfo is sent by clients when they connect ("client-info"), and in reply to the server asking for it again
+// It is ssh.Marshal'd so garble cant rename the fields, which also means nested structures have to be flattened into strings
 type ClientInfo struct {
 	Username string
 	Hostname string
 	GoArch   string
 	GoOS     string
+
+	// e.g "Ubuntu 22.04.4 LTS" or "Windows 10 Pro 22H2"
+	OSRelease string
+	Kernel    string
+
+	PID        uint32
+	Executable string
+	// root, or an elevated token on windows
+	Privileged bool
+
+	// Seconds since the host booted
+	Uptime uint64
+
+	IPs []string
+	// One per interface, "name|mac|address/prefix address/prefix"
+	Interfaces []string
+
+	// Capabilities the server cannot use on this client
+	Disabled []string
+	// The clients own tun policy, empty if it has none
+	TunPolicy string
+}
+
+func ParseClientInfo(b []byte) (info ClientInfo, err error) {
+	err = ssh.Unmarshal(b, &info)
+	return info, err
 }
 
 // =======================
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReconnectPolicy controls how long a client waits between failed attempts to connect back to the server
+type ReconnectPolicy struct {
+	// Delay after the first failure
+	Initial time.Duration
+	// Upper bound on the delay
+	Max time.Duration
+	// Each consecutive failure multiplies the delay by this
+	Multiplier float64
+	// Fraction of the delay to randomly add or remove, so a fleet of clients doesnt reconnect in lock step
+	Jitter float64
+
+	// Give up after this many consecutive failures, 0 never gives up
+	MaxAttempts int
+	// Give up after failing for this long, 0 never gives up
+	GiveUp time.Duration
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{
+	Initial:    10 * time.Second,
+	Max:        5 * time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// ParseReconnectPolicy parses a policy in the form initial=10s,max=5m,multiplier=2,jitter=0.2,attempts=0,giveup=0
+// Any value not set is taken from the default policy
+func ParseReconnectPolicy(s string) (ReconnectPolicy, error) {
+	policy := DefaultReconnectPolicy
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return policy, fmt.Errorf("reconnect policy option %q is not in the form key=value", part)
+		}
+
+		var err error
+		switch strings.ToLower(key) {
+		case "initial":
+			policy.Initial, err = time.ParseDuration(value)
+		case "max":
+			policy.Max, err = time.ParseDuration(value)
+		case "multiplier":
+			policy.Multiplier, err = strconv.ParseFloat(value, 64)
+		case "jitter":
+			policy.Jitter, err = strconv.ParseFloat(value, 64)
+		case "attempts":
+			policy.MaxAttempts, err = strconv.Atoi(value)
+		case "giveup":
+			policy.GiveUp, err = time.ParseDuration(value)
+		default:
+			return policy, fmt.Errorf("unknown reconnect policy option %q", key)
+		}
+
+		if err != nil {
+			return policy, fmt.Errorf("invalid value for reconnect policy option %q: %s", key, err)
+		}
+	}
+
+	return policy, policy.Validate()
+}
+
+func (p ReconnectPolicy) Validate() error {
+	if p.Initial <= 0 {
+		return errors.New("initial delay must be greater than zero")
+	}
+
+	if p.Max < p.Initial {
+		return errors.New("max delay must be at least the initial delay")
+	}
+
+	if p.Multiplier < 1 {
+		return errors.New("multiplier must be at least 1")
+	}
+
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("jitter must be between 0 and 1")
+	}
+
+	if p.MaxAttempts < 0 || p.GiveUp < 0 {
+		return errors.New("attempts and giveup cannot be negative")
+	}
+
+	return nil
+}
+
+func (p ReconnectPolicy) String() string {
+	return fmt.Sprintf("initial=%s,max=%s,multiplier=%s,jitter=%s,attempts=%d,giveup=%s",
+		p.Initial, p.Max, strconv.FormatFloat(p.Multiplier, 'f', -1, 64), strconv.FormatFloat(p.Jitter, 'f', -1, 64), p.MaxAttempts, p.GiveUp)
+}
+
+// Delay returns how long to wait before the given attempt (starting at 1)
+func (p ReconnectPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.Initial)
+	for i := 1; i < attempt && delay < float64(p.Max); i++ {
+		delay *= p.Multiplier
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	// Clamped after the jitter so max really is the longest a client waits
+	if delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+
+	return time.Duration(delay)
+}
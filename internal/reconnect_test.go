@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReconnectPolicy(t *testing.T) {
+	for input, expected := range map[string]ReconnectPolicy{
+		"": DefaultReconnectPolicy,
+		"initial=1s,max=1m": {
+			Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.2,
+		},
+		"initial=10s, max=10s, multiplier=1, jitter=0": {
+			Initial: 10 * time.Second, Max: 10 * time.Second, Multiplier: 1,
+		},
+		"attempts=5,giveup=1h,MULTIPLIER=1.5": {
+			Initial: 10 * time.Second, Max: 5 * time.Minute, Multiplier: 1.5, Jitter: 0.2, MaxAttempts: 5, GiveUp: time.Hour,
+		},
+	} {
+		policy, err := ParseReconnectPolicy(input)
+		if err != nil {
+			t.Fatalf("%q: %s", input, err)
+		}
+
+		if policy != expected {
+			t.Fatalf("%q: expected %+v got %+v", input, expected, policy)
+		}
+
+		again, err := ParseReconnectPolicy(policy.String())
+		if err != nil || again != policy {
+			t.Fatalf("%q: did not survive String(), got %+v (%v)", input, again, err)
+		}
+	}
+
+	for _, invalid := range []string{
+		"initial",
+		"initial=soon",
+		"delay=10s",
+		"initial=0s",
+		"initial=1m,max=1s",
+		"multiplier=0.5",
+		"jitter=2",
+		"attempts=-1",
+		"giveup=-1s",
+	} {
+		if _, err := ParseReconnectPolicy(invalid); err == nil {
+			t.Fatalf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	policy := ReconnectPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+
+	for attempt, expected := range map[int]time.Duration{
+		1:   time.Second,
+		2:   2 * time.Second,
+		3:   4 * time.Second,
+		4:   8 * time.Second,
+		5:   10 * time.Second,
+		100: 10 * time.Second,
+	} {
+		if delay := policy.Delay(attempt); delay != expected {
+			t.Fatalf("attempt %d: expected %s got %s", attempt, expected, delay)
+		}
+	}
+}
+
+func TestReconnectDelayJitterStaysUnderMax(t *testing.T) {
+	policy := ReconnectPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, Jitter: 0.5}
+
+	for i := 0; i < 1000; i++ {
+		if delay := policy.Delay(1); delay < 500*time.Millisecond || delay > 1500*time.Millisecond {
+			t.Fatalf("first delay %s is outside of the jitter", delay)
+		}
+
+		if delay := policy.Delay(10); delay < 5*time.Second || delay > policy.Max {
+			t.Fatalf("delay %s is outside of the jitter or over max", delay)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Package accounting keeps the traffic totals and rate limits for each client and operator, measured on their ssh connections to the server,
+// and for the webserver
+package accounting
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/bandwidth"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long the usage of a client without a limit is kept after it disconnects
+const retention = 24 * time.Hour
+
+// Usage is the traffic through every connection a client or operator has made since the server started
+type Usage struct {
+	Name string
+	bandwidth.Counter
+	// Only applied to clients
+	Limit *bandwidth.Limit
+
+	connections int
+	lastSeen    time.Time
+}
+
+var (
+	// Applies to all client connections together
+	Global = bandwidth.NewLimit()
+
+	// Everything served by the webserver, downloads and published services
+	Webserver bandwidth.Counter
+
+	lck       sync.Mutex
+	clients   = map[string]*Usage{}
+	operators = map[string]*Usage{}
+)
+
+// ClientIdentity is what a clients usage is kept under. Client ids are random for every connection, so it is the host the client runs on
+// and the key it was built with, which stays the same when the client reconnects and tells apart hosts running the same build
+func ClientIdentity(conn *ssh.ServerConn) string {
+	return conn.User() + "/" + conn.Permissions.Extensions["pubkey-fp"]
+}
+
+func get(m map[string]*Usage, name string) *Usage {
+	u, ok := m[name]
+	if !ok {
+		u = &Usage{Name: name, Limit: bandwidth.NewLimit(), lastSeen: time.Now()}
+		m[name] = u
+	}
+
+	return u
+}
+
+func all(m map[string]*Usage) (out []*Usage) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	for _, u := range m {
+		out = append(out, u)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	return out
+}
+
+// prune forgets clients that have been gone for longer than the retention, unless they have a limit that has to apply when they come back
+func prune(now time.Time) {
+	for name, u := range clients {
+		if u.connections == 0 && u.Limit.Rate() == 0 && now.Sub(u.lastSeen) > retention {
+			delete(clients, name)
+		}
+	}
+}
+
+// Client returns the usage of a connected client, which is kept when it disconnects so the limit still applies when it comes back
+func Client(conn *ssh.ServerConn) *Usage {
+	lck.Lock()
+	defer lck.Unlock()
+
+	return get(clients, ClientIdentity(conn))
+}
+
+func Operator(username string) *Usage {
+	lck.Lock()
+	defer lck.Unlock()
+
+	return get(operators, username)
+}
+
+// TrackClient counts conn towards the client and holds it to both its own and the global limit, until the returned function is called when the client disconnects
+func TrackClient(conn *bandwidth.Conn, sshConn *ssh.ServerConn) (disconnected func()) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	prune(time.Now())
+
+	u := get(clients, ClientIdentity(sshConn))
+	u.connections++
+
+	conn.Track(&u.Counter, u.Limit, Global)
+
+	return func() {
+		lck.Lock()
+		defer lck.Unlock()
+
+		u.connections--
+		u.lastSeen = time.Now()
+	}
+}
+
+func TrackOperator(conn *bandwidth.Conn, username string) {
+	conn.Track(&Operator(username).Counter)
+}
+
+// TrackWebserver counts every connection accepted by the webserver
+func TrackWebserver(l net.Listener) net.Listener {
+	return &webserverListener{Listener: l}
+}
+
+func Clients() []*Usage {
+	return all(clients)
+}
+
+func Operators() []*Usage {
+	return all(operators)
+}
+
+type webserverListener struct {
+	net.Listener
+}
+
+func (l *webserverListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := bandwidth.NewConn(c)
+	conn.Track(&Webserver)
+
+	return conn, nil
+}
@@ -0,0 +1,112 @@
+package accounting
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/bandwidth"
+	"golang.org/x/crypto/ssh"
+)
+
+// testConn is the only part of an ssh connection accounting uses, the user the client connected as
+type testConn struct {
+	ssh.Conn
+	user string
+}
+
+func (c testConn) User() string {
+	return c.user
+}
+
+func clientConn(user, fingerprint string) *ssh.ServerConn {
+	return &ssh.ServerConn{
+		Conn:        testConn{user: user},
+		Permissions: &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": fingerprint}},
+	}
+}
+
+// track sends payload from the client over a new connection that is counted towards it
+func track(t *testing.T, sshConn *ssh.ServerConn, payload string) (disconnected func()) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	conn := bandwidth.NewConn(server)
+	disconnected = TrackClient(conn, sshConn)
+
+	go client.Write([]byte(payload))
+
+	b := make([]byte, len(payload))
+	if _, err := conn.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return disconnected
+}
+
+func TestClientIdentity(t *testing.T) {
+	first := clientConn("root.db01", "aaaa")
+
+	disconnected := track(t, first, "hello")
+	Client(first).Limit.Set(1024)
+	disconnected()
+
+	// A new connection has a new client id, but is the same host and key
+	reconnected := clientConn("root.db01", "aaaa")
+	track(t, reconnected, "again")
+
+	usage := Client(reconnected)
+	if usage.Received.Load() != uint64(len("hello")+len("again")) {
+		t.Errorf("expected the totals to carry over the reconnect, received %d", usage.Received.Load())
+	}
+
+	if usage.Limit.Rate() != 1024 {
+		t.Errorf("expected the limit to carry over the reconnect, got %d", usage.Limit.Rate())
+	}
+
+	// Another host running the same build is counted on its own
+	other := clientConn("root.db02", "aaaa")
+	if Client(other) == usage {
+		t.Error("two hosts with the same key share their usage")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	gone := clientConn("root.gone", "bbbb")
+	track(t, gone, "x")()
+
+	limited := clientConn("root.limited", "bbbb")
+	track(t, limited, "x")()
+	Client(limited).Limit.Set(2048)
+
+	connected := clientConn("root.connected", "bbbb")
+	track(t, connected, "x")
+
+	lck.Lock()
+	for _, u := range clients {
+		u.lastSeen = u.lastSeen.Add(-2 * retention)
+	}
+	prune(time.Now())
+
+	_, goneKept := clients[ClientIdentity(gone)]
+	_, limitedKept := clients[ClientIdentity(limited)]
+	_, connectedKept := clients[ClientIdentity(connected)]
+	lck.Unlock()
+
+	if goneKept {
+		t.Error("a client without a limit was kept long after it disconnected")
+	}
+
+	if !limitedKept {
+		t.Error("a client with a limit was forgotten, so the limit would not apply when it reconnects")
+	}
+
+	if !connectedKept {
+		t.Error("a connected client was forgotten")
+	}
+}
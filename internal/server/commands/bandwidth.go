@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/NHAS/reverse_ssh/internal/bandwidth"
+	"github.com/NHAS/reverse_ssh/internal/forwards"
+	"github.com/NHAS/reverse_ssh/internal/server/accounting"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
+)
+
+type bandwidthCommand struct {
+	log logger.Logger
+}
+
+func (b *bandwidthCommand) ValidArgs() map[string]string {
+	r := map[string]string{
+		"limit":   "Rate limit in bytes per second, with an optional K, M or G suffix, e.g --limit 512K. 0 or unlimited removes the limit",
+		"global":  "Apply the limit to all clients together (admin only)",
+		"forward": "Apply the limit to forwards by id, as shown by the forwards command",
+	}
+
+	addDuplicateFlags("Apply the limit to each client matching a pattern, e.g -c *, --client your.hostname.here", r, "client", "c")
+
+	return r
+}
+
+func (b *bandwidthCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if !line.IsSet("limit") {
+		return b.list(user, tty)
+	}
+
+	limitString, err := line.GetArgString("limit")
+	if err != nil {
+		return errors.New("no value specified for --limit, e.g --limit 512K")
+	}
+
+	limit, err := bandwidth.ParseRate(limitString)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case line.IsSet("global"):
+		if user.Privilege() != users.AdminPermissions {
+			return errors.New("only admins can change the global limit")
+		}
+
+		accounting.Global.Set(limit)
+
+		b.log.Info("%s set the global client rate limit to %s", user.Username(), bandwidth.FormatRate(limit))
+		fmt.Fprintf(tty, "global limit set to %s\n", bandwidth.FormatRate(limit))
+
+	case line.IsSet("forward"):
+		ids, err := line.GetArgsString("forward")
+		if err != nil {
+			return errors.New("no value specified for --forward, requires a forward id e.g --forward 3")
+		}
+
+		visible, err := user.SearchClients("*")
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			client, clientForwardID, err := findForward(user, visible, id)
+			if err == nil {
+				if client == nil {
+					err = forwards.SetLimit(id, limit)
+				} else {
+					err = clientForwardRequest(client, "limit-forward", ssh.Marshal(&forwards.LimitRequest{ID: clientForwardID, Rate: limit}))
+				}
+			}
+
+			if err != nil {
+				fmt.Fprintf(tty, "unable to limit forward %s: %s\n", id, err)
+				continue
+			}
+
+			b.log.Info("%s set the rate limit of forward %s to %s", user.Username(), id, bandwidth.FormatRate(limit))
+			fmt.Fprintf(tty, "forward %s limited to %s\n", id, bandwidth.FormatRate(limit))
+		}
+
+	case line.IsSet("c") || line.IsSet("client"):
+		specifier, err := line.GetArgString("c")
+		if err != nil {
+			specifier, err = line.GetArgString("client")
+			if err != nil {
+				return err
+			}
+		}
+
+		clients, err := user.SearchClients(specifier)
+		if err != nil {
+			return err
+		}
+
+		if len(clients) == 0 {
+			return fmt.Errorf("No clients matched '%s'", specifier)
+		}
+
+		for id, sc := range clients {
+			accounting.Client(sc).Limit.Set(limit)
+
+			b.log.Info("%s set the rate limit of client %s to %s", user.Username(), id, bandwidth.FormatRate(limit))
+			fmt.Fprintf(tty, "%s limited to %s\n", id, bandwidth.FormatRate(limit))
+		}
+
+	default:
+		return errors.New("--limit needs one of -c <remote_id>, --forward <id> or --global")
+	}
+
+	return nil
+}
+
+// list shows the traffic of the clients the user can see, and of themselves unless they are an admin who sees everyone
+func (b *bandwidthCommand) list(user *users.User, tty io.ReadWriter) error {
+	visible, err := user.SearchClients("*")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(tty, "Global client limit: %s\n", bandwidth.FormatRate(accounting.Global.Rate()))
+
+	ids := []string{}
+	for id := range visible {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	clients, _ := table.NewTable("Clients", "ID", "Sent", "Received", "Limit")
+	for _, id := range ids {
+		sc := visible[id]
+		u := accounting.Client(sc)
+
+		clients.AddValues(fmt.Sprintf("%s\n%s", id, users.NormaliseHostname(sc.User())), bandwidth.Format(u.Sent.Load()), bandwidth.Format(u.Received.Load()), bandwidth.FormatRate(u.Limit.Rate()))
+	}
+	clients.Fprint(tty)
+
+	operators, _ := table.NewTable("Operators", "User", "Sent", "Received")
+	for _, u := range accounting.Operators() {
+		if user.Privilege() != users.AdminPermissions && u.Name != user.Username() {
+			continue
+		}
+
+		operators.AddValues(u.Name, bandwidth.Format(u.Sent.Load()), bandwidth.Format(u.Received.Load()))
+	}
+	operators.Fprint(tty)
+
+	if user.Privilege() == users.AdminPermissions {
+		fmt.Fprintf(tty, "Webserver (downloads and published services), sent: %s received: %s\n", bandwidth.Format(accounting.Webserver.Sent.Load()), bandwidth.Format(accounting.Webserver.Received.Load()))
+	}
+
+	return nil
+}
+
+func (b *bandwidthCommand) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (b *bandwidthCommand) Help(explain bool) string {
+	const description = "Show traffic per client and operator, and rate limit clients and forwards."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(b.ValidArgs(),
+		"bandwidth",
+		"bandwidth --limit <rate> -c <remote_id or glob pattern>",
+		"bandwidth --limit <rate> --forward <id>...",
+		"bandwidth --limit <rate> --global",
+		description,
+		"Traffic is counted on the ssh connections to the server, so it covers sessions, tun, forwards and downloads over ssh, and on the webserver for everything it serves (shown to admins).",
+		"Sent and received are from the servers point of view. There is no metrics endpoint, this command and ls -t are where the totals can be read.",
+		"Clients are counted by their hostname and key, so totals and limits are kept if the client reconnects. Limits apply on top of the global limit, and a client without one is forgotten a day after it disconnects.",
+		"Very low limits can delay keepalives enough for clients to time out.",
+	)
+}
+
+func Bandwidth(log logger.Logger) *bandwidthCommand {
+	return &bandwidthCommand{
+		log: log,
+	}
+}
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -22,7 +23,12 @@ type connect struct {
 func (c *connect) ValidArgs() map[string]string {
 
 	return map[string]string{
-		"shell": "Set the shell (or program) to start on connection, this also takes an http, https or rssh url that be downloaded to disk and executed",
+		"shell":         "Set the shell (or program) to start on connection, this also takes an http, https or rssh url that be downloaded to disk and executed",
+		"multi":         "Open a shell on every client matching the filter (up to 9) and send input to all of them, Ctrl+] h shows hotkeys",
+		"attach":        "Attach to (or start) a named shell on the client that keeps running after you disconnect",
+		"detached":      "List the named shells running on the client",
+		"kill-detached": "Kill a named shell on the client",
+		"share-rw":      "Let users that attach with sessions --attach --rw type into this shell, otherwise only admins can",
 	}
 }
 
@@ -48,6 +54,11 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 
 	shell, _ := line.GetArgString("shell")
 
+	detachedName, err := line.GetArgString("attach")
+	if err != nil && line.IsSet("attach") {
+		return errors.New("--attach requires the name of the session")
+	}
+
 	client := line.Arguments[len(line.Arguments)-1].Value()
 
 	foundClients, err := user.SearchClients(client)
@@ -59,14 +70,26 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 		return fmt.Errorf("No clients matched '%s'", client)
 	}
 
+	if line.IsSet("detached") || line.IsSet("kill-detached") {
+		return c.detached(term, foundClients, line)
+	}
+
+	if line.IsSet("multi") {
+		return c.multi(term, sess, foundClients, shell)
+	}
+
 	if len(foundClients) > 1 {
 		return fmt.Errorf("'%s' matches multiple clients please choose a more specific identifier", client)
 	}
 
-	var target ssh.Conn
+	var (
+		target   *ssh.ServerConn
+		clientId string
+	)
 	//Horrible way of getting the first element of a map in go
 	for k := range foundClients {
 		target = foundClients[k]
+		clientId = k
 		break
 	}
 
@@ -77,7 +100,12 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 
 	//Attempt to connect to remote host and send inital pty request and screen size
 	// If we cant, report and error to the clients terminal
-	newSession, err := createSession(target, *sess.Pty, shell)
+	var newSession ssh.Channel
+	if detachedName != "" {
+		newSession, err = createAttachSession(target, *sess.Pty, detachedName)
+	} else {
+		newSession, err = createSession(target, *sess.Pty, shell)
+	}
 	if err != nil {
 
 		c.log.Error("Creating session failed: %s", err)
@@ -86,8 +114,20 @@ func (c *connect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedL
 
 	c.log.Info("Connected to %s", target.RemoteAddr().String())
 
+	shared, err := registerSession(user.Username(), clientId, target, newSession, term, line.IsSet("share-rw"))
+	if err != nil {
+		newSession.Close()
+		return err
+	}
+	defer shared.close()
+
+	fmt.Fprintf(term, "Session id %s, others can join with: sessions --attach %s\n", shared.id, shared.id)
+
 	term.EnableRaw()
-	err = attachSession(newSession, term, sess.ShellRequests)
+	err = attachSession(newSession, struct {
+		io.Reader
+		io.Writer
+	}{term, shared}, sess.ShellRequests)
 	if err != nil {
 
 		c.log.Error("Client tried to attach session and failed: %s", err)
@@ -113,6 +153,10 @@ func (c *connect) Help(explain bool) string {
 
 	return terminal.MakeHelpText(c.ValidArgs(),
 		"connect "+autocomplete.RemoteId,
+		"connect --multi <filter>",
+		"connect --attach <name> "+autocomplete.RemoteId,
+		"connect --detached "+autocomplete.RemoteId,
+		"connect --kill-detached <name> "+autocomplete.RemoteId,
 		description,
 	)
 }
@@ -129,6 +173,15 @@ func Connect(
 }
 
 func createSession(sshConn ssh.Conn, ptyReq internal.PtyReq, shell string) (sc ssh.Channel, err error) {
+	return openPtySession(sshConn, ptyReq, "shell", shell)
+}
+
+// createAttachSession starts or re-attaches to the named detached shell on the client
+func createAttachSession(sshConn ssh.Conn, ptyReq internal.PtyReq, name string) (sc ssh.Channel, err error) {
+	return openPtySession(sshConn, ptyReq, "attach", name)
+}
+
+func openPtySession(sshConn ssh.Conn, ptyReq internal.PtyReq, requestType, cmd string) (sc ssh.Channel, err error) {
 
 	splice, newrequests, err := sshConn.OpenChannel("session", nil)
 	if err != nil {
@@ -141,9 +194,9 @@ func createSession(sshConn ssh.Conn, ptyReq internal.PtyReq, shell string) (sc s
 		return sc, fmt.Errorf("Unable to send PTY request: %s", err)
 	}
 
-	_, err = splice.SendRequest("shell", true, ssh.Marshal(internal.ShellStruct{Cmd: shell}))
+	_, err = splice.SendRequest(requestType, true, ssh.Marshal(internal.ShellStruct{Cmd: cmd}))
 	if err != nil {
-		return sc, fmt.Errorf("Unable to start shell: %s", err)
+		return sc, fmt.Errorf("Unable to start %s: %s", requestType, err)
 	}
 
 	go ssh.DiscardRequests(newrequests)
@@ -200,3 +253,46 @@ RequestsProxyPasser:
 
 	return nil
 }
+
+// detached lists or kills the named shells that are kept running on the client
+func (c *connect) detached(tty io.Writer, foundClients map[string]*ssh.ServerConn, line terminal.ParsedLine) error {
+
+	command := "detached"
+	if line.IsSet("kill-detached") {
+		name, err := line.GetArgString("kill-detached")
+		if err != nil {
+			return errors.New("--kill-detached requires the name of the session")
+		}
+
+		if len(foundClients) > 1 {
+			return errors.New("--kill-detached can only be used on a single client")
+		}
+
+		command += " -k " + name
+	}
+
+	for id, target := range foundClients {
+		if len(foundClients) > 1 {
+			fmt.Fprintf(tty, "%s (%s):\n", id, users.NormaliseHostname(target.User()))
+		}
+
+		newChan, r, err := target.OpenChannel("session", nil)
+		if err != nil {
+			fmt.Fprintf(tty, "Failed: %s\n", err)
+			continue
+		}
+		go ssh.DiscardRequests(r)
+
+		ok, err := newChan.SendRequest("subsystem", true, ssh.Marshal(internal.ShellStruct{Cmd: command}))
+		if err != nil || !ok {
+			fmt.Fprintf(tty, "Failed: client does not support detached sessions\n")
+			newChan.Close()
+			continue
+		}
+
+		io.Copy(tty, newChan)
+		newChan.Close()
+	}
+
+	return nil
+}
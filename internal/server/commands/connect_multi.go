@@ -0,0 +1,428 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/fatih/color"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Ctrl+] like telnet, unlikely to be needed by anything running in the remote shells
+	multiHotkey = 0x1d
+
+	// How much output we will hold for a shell that isnt currently focused
+	multiBacklogLimit = 64 * 1024
+
+	// Shells are focused and dropped with the keys 1 to 9
+	multiMaxTargets = 9
+)
+
+type multiTarget struct {
+	index int
+	id    string
+	label string
+
+	conn    ssh.Conn
+	session ssh.Channel
+
+	// output that arrived while another shell had focus
+	backlog []byte
+
+	closed bool
+}
+
+type multiSession struct {
+	sync.Mutex
+
+	tty     io.Writer
+	targets []*multiTarget
+
+	// nil when input is being broadcast to every shell
+	focus *multiTarget
+
+	// the last shell that wrote to the tty, and whether it finished on a new line
+	lastWriter  *multiTarget
+	atLineStart bool
+
+	finished chan bool
+	once     sync.Once
+}
+
+func (c *connect) multi(term *terminal.Terminal, sess *users.Connection, foundClients map[string]*ssh.ServerConn, shell string) error {
+
+	if len(foundClients) > multiMaxTargets {
+		return fmt.Errorf("%d clients matched, at most %d can be connected to at once. Please choose a more specific filter", len(foundClients), multiMaxTargets)
+	}
+
+	ids := []string{}
+	for id := range foundClients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	ms := &multiSession{
+		tty:         term,
+		atLineStart: true,
+		finished:    make(chan bool),
+	}
+
+	for _, id := range ids {
+		target := foundClients[id]
+
+		newSession, err := createSession(target, *sess.Pty, shell)
+		if err != nil {
+			fmt.Fprintf(term, "%s (%s) failed: %s\n", id, users.NormaliseHostname(target.User()), err)
+			c.log.Error("Creating multi session on %s failed: %s", id, err)
+			continue
+		}
+
+		ms.targets = append(ms.targets, &multiTarget{
+			index:   len(ms.targets) + 1,
+			id:      id,
+			label:   users.NormaliseHostname(target.User()),
+			conn:    target,
+			session: newSession,
+		})
+	}
+
+	if len(ms.targets) == 0 {
+		return fmt.Errorf("Unable to start a shell on any of the %d matching clients", len(foundClients))
+	}
+
+	defer func() {
+		for _, t := range ms.targets {
+			t.session.Close()
+			c.log.Info("Disconnected from remote host %s (%s)", t.conn.RemoteAddr(), t.conn.ClientVersion())
+		}
+		term.DisableRaw()
+	}()
+
+	term.EnableRaw()
+
+	fmt.Fprintf(term, "Connected to %d shells, input is broadcast to all of them. Ctrl+] then h for help\r\n", len(ms.targets))
+
+	for _, t := range ms.targets {
+		go ms.readOutput(t)
+	}
+
+	go ms.readInput(term)
+
+	for {
+		select {
+		case r := <-sess.ShellRequests:
+			if r == nil {
+				return fmt.Errorf("Session has terminated.")
+			}
+
+			if r.Type != "window-change" {
+				if r.WantReply {
+					r.Reply(false, nil)
+				}
+				continue
+			}
+
+			w, h := internal.ParseDims(r.Payload)
+			term.SetSize(int(w), int(h))
+			sess.Pty.Columns = w
+			sess.Pty.Rows = h
+
+			for _, t := range ms.live() {
+				t.session.SendRequest(r.Type, r.WantReply, r.Payload)
+			}
+
+			if r.WantReply {
+				r.Reply(true, nil)
+			}
+
+		case <-ms.finished:
+			return fmt.Errorf("Multi session has terminated.")
+		}
+	}
+}
+
+func (ms *multiSession) finish() {
+	ms.once.Do(func() {
+		close(ms.finished)
+	})
+}
+
+func (ms *multiSession) live() (out []*multiTarget) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, t := range ms.targets {
+		if !t.closed {
+			out = append(out, t)
+		}
+	}
+	return
+}
+
+func (ms *multiSession) readOutput(t *multiTarget) {
+	buff := make([]byte, 4096)
+	for {
+		n, err := t.session.Read(buff)
+		if n > 0 {
+			ms.output(t, buff[:n])
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	ms.drop(t, "session ended")
+}
+
+// output writes the output of a shell to the operator, when broadcasting each line is labelled with the shell it came from
+func (ms *multiSession) output(t *multiTarget, data []byte) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.focus != nil {
+		if ms.focus == t {
+			ms.tty.Write(data)
+			return
+		}
+
+		if len(t.backlog)+len(data) > multiBacklogLimit {
+			t.backlog = t.backlog[len(t.backlog)+len(data)-multiBacklogLimit:]
+		}
+		t.backlog = append(t.backlog, data...)
+		return
+	}
+
+	ms.writeLabelled(t, data)
+}
+
+func (ms *multiSession) writeLabelled(t *multiTarget, data []byte) {
+	for len(data) > 0 {
+		if ms.lastWriter != t && !ms.atLineStart {
+			ms.tty.Write([]byte("\r\n"))
+			ms.atLineStart = true
+		}
+
+		if ms.atLineStart {
+			fmt.Fprintf(ms.tty, "%s ", color.YellowString("[%d %s]", t.index, t.label))
+			ms.atLineStart = false
+		}
+		ms.lastWriter = t
+
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			ms.tty.Write(data)
+			return
+		}
+
+		ms.tty.Write(data[:i+1])
+		ms.atLineStart = true
+		data = data[i+1:]
+	}
+}
+
+func (ms *multiSession) drop(t *multiTarget, reason string) {
+	ms.Lock()
+
+	if t.closed {
+		ms.Unlock()
+		return
+	}
+
+	t.closed = true
+	t.session.Close()
+
+	if ms.focus == t {
+		ms.focus = nil
+	}
+
+	remaining := 0
+	for _, target := range ms.targets {
+		if !target.closed {
+			remaining++
+		}
+	}
+
+	ms.notice("%d %s (%s) %s, %d shells remaining", t.index, t.label, t.id, reason, remaining)
+	ms.Unlock()
+
+	if remaining == 0 {
+		ms.finish()
+	}
+}
+
+// notice prints a message from rssh itself, rather than one of the remote shells. Must be called with the lock held
+func (ms *multiSession) notice(format string, v ...interface{}) {
+	if !ms.atLineStart {
+		ms.tty.Write([]byte("\r\n"))
+	}
+	fmt.Fprintf(ms.tty, "%s %s\r\n", color.GreenString("[rssh]"), fmt.Sprintf(format, v...))
+	ms.atLineStart = true
+	ms.lastWriter = nil
+}
+
+func (ms *multiSession) get(index int) *multiTarget {
+	for _, t := range ms.targets {
+		if t.index == index && !t.closed {
+			return t
+		}
+	}
+	return nil
+}
+
+func (ms *multiSession) readInput(tty io.Reader) {
+	var (
+		hotkey   bool
+		dropping bool
+	)
+
+	b := make([]byte, 1024)
+	for {
+		n, err := tty.Read(b)
+		if err != nil {
+			ms.finish()
+			return
+		}
+
+		select {
+		case <-ms.finished:
+			return
+		default:
+		}
+
+		var toSend []byte
+		for _, key := range b[:n] {
+
+			if dropping {
+				dropping = false
+				if key >= '1' && key <= '9' {
+					ms.Lock()
+					t := ms.get(int(key - '0'))
+					ms.Unlock()
+
+					if t != nil {
+						ms.drop(t, "dropped from group")
+						continue
+					}
+				}
+
+				ms.Lock()
+				ms.notice("no shell numbered %q", key)
+				ms.Unlock()
+				continue
+			}
+
+			if !hotkey {
+				if key == multiHotkey {
+					hotkey = true
+					continue
+				}
+				toSend = append(toSend, key)
+				continue
+			}
+
+			hotkey = false
+
+			switch {
+			case key == multiHotkey:
+				// Ctrl+] twice sends a literal Ctrl+]
+				toSend = append(toSend, key)
+			case key >= '1' && key <= '9':
+				ms.send(toSend)
+				toSend = nil
+				ms.setFocus(int(key - '0'))
+			case key == 'a' || key == '0':
+				ms.send(toSend)
+				toSend = nil
+				ms.setFocus(0)
+			case key == 'd':
+				dropping = true
+			case key == 'l':
+				ms.list()
+			case key == 'q':
+				ms.finish()
+				return
+			default:
+				ms.Lock()
+				ms.notice("hotkeys: Ctrl+] then [1-9] focus shell, [a] broadcast to all, [d][1-9] drop shell, [l] list shells, [q] quit, Ctrl+] send literal Ctrl+]")
+				ms.Unlock()
+			}
+		}
+
+		ms.send(toSend)
+	}
+}
+
+func (ms *multiSession) send(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	ms.Lock()
+	focus := ms.focus
+	ms.Unlock()
+
+	if focus != nil {
+		focus.session.Write(data)
+		return
+	}
+
+	for _, t := range ms.live() {
+		t.session.Write(data)
+	}
+}
+
+func (ms *multiSession) setFocus(index int) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if index == 0 {
+		ms.focus = nil
+		ms.notice("broadcasting to all shells")
+
+		for _, t := range ms.targets {
+			if len(t.backlog) > 0 {
+				ms.writeLabelled(t, t.backlog)
+				t.backlog = nil
+			}
+		}
+		return
+	}
+
+	t := ms.get(index)
+	if t == nil {
+		ms.notice("no shell numbered %d", index)
+		return
+	}
+
+	ms.focus = t
+	ms.notice("focused on %d %s (%s), Ctrl+] a to return to broadcast", t.index, t.label, t.id)
+
+	if len(t.backlog) > 0 {
+		ms.tty.Write(t.backlog)
+		t.backlog = nil
+	}
+}
+
+func (ms *multiSession) list() {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, t := range ms.targets {
+		state := "active"
+		if t.closed {
+			state = "closed"
+		} else if ms.focus == t {
+			state = "focused"
+		}
+
+		ms.notice("%d %s (%s %s) %s", t.index, t.label, t.id, t.conn.RemoteAddr(), state)
+	}
+}
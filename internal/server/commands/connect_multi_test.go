@@ -0,0 +1,23 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMultiTargetLimit(t *testing.T) {
+	foundClients := map[string]*ssh.ServerConn{}
+	for i := 0; i <= multiMaxTargets; i++ {
+		foundClients[fmt.Sprintf("client%d", i)] = &ssh.ServerConn{}
+	}
+
+	// Refused before any shells are opened, as the extra ones could not be focused
+	c := &connect{}
+	err := c.multi(nil, nil, foundClients, "")
+	if err == nil || !strings.Contains(err.Error(), "more specific filter") {
+		t.Fatalf("expected %d clients to be refused, got %v", len(foundClients), err)
+	}
+}
@@ -0,0 +1,236 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/bandwidth"
+	"github.com/NHAS/reverse_ssh/internal/forwards"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"golang.org/x/crypto/ssh"
+)
+
+type forwardsCommand struct {
+	log logger.Logger
+}
+
+func (f *forwardsCommand) ValidArgs() map[string]string {
+	r := map[string]string{
+		"l":     "List forwards (default)",
+		"close": "Close forwards by id, e.g --close 3 <remote_id>/2",
+	}
+
+	addDuplicateFlags("Only show forwards on clients matching a pattern, e.g -c *, --client your.hostname.here", r, "client", "c")
+
+	return r
+}
+
+func (f *forwardsCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	// Forwards on clients the user cannot see are left out, as if they did not exist
+	visible, err := user.SearchClients("*")
+	if err != nil {
+		return err
+	}
+
+	if line.IsSet("close") {
+		ids, err := line.GetArgsString("close")
+		if err != nil {
+			return errors.New("no value specified for --close, requires a forward id e.g --close 3")
+		}
+
+		for _, id := range ids {
+			if err := f.close(user, visible, id); err != nil {
+				fmt.Fprintf(tty, "unable to close forward %s: %s\n", id, err)
+				continue
+			}
+
+			f.log.Info("%s closed forward %s", user.Username(), id)
+			fmt.Fprintf(tty, "closed forward %s\n", id)
+		}
+
+		return nil
+	}
+
+	filter := "*"
+	if specifier, err := line.GetArgString("c"); err == nil {
+		filter = specifier
+	} else if specifier, err := line.GetArgString("client"); err == nil {
+		filter = specifier
+	}
+
+	clients, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	var all []forwards.Info
+	for _, fw := range forwards.All() {
+		// Ports opened by proxy keys have no client, so are only left out when looking for particular clients
+		if fw.Client == "" && filter != "*" {
+			continue
+		}
+
+		if canSeeForward(user, clients, fw) {
+			all = append(all, fw)
+		}
+	}
+
+	for id, sc := range clients {
+		ok, response, err := sc.SendRequest("query-forwards", true, nil)
+		if err != nil || !ok {
+			// Clients from before the forwards inventory, not worth making noise about
+			continue
+		}
+
+		clientForwards, err := forwards.Unmarshal(response)
+		if err != nil {
+			fmt.Fprintf(tty, "%s sent an incompatible forward list: %s\n", id, err)
+			continue
+		}
+
+		for _, fw := range clientForwards {
+			fw.ID = id + "/" + fw.ID
+			fw.Client = id
+
+			if fw.Kind == forwards.ServerPort && fw.Owner == "" {
+				fw.Owner = serverPortOwner(id, fw.Bind)
+			}
+
+			all = append(all, fw)
+		}
+	}
+
+	if len(all) == 0 {
+		fmt.Fprintln(tty, "No forwards")
+		return nil
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Started < all[j].Started
+	})
+
+	t, _ := table.NewTable("Forwards", "ID", "Type", "Owner", "Client", "Bind", "Target", "Age", "Connections", "Bytes", "Limit")
+	for _, fw := range all {
+		owner := fw.Owner
+		if owner == "" {
+			owner = "-"
+		}
+
+		client := fw.Client
+		if client == "" {
+			client = "-"
+		} else if sc, ok := clients[fw.Client]; ok {
+			client = fmt.Sprintf("%s\n%s", fw.Client, users.NormaliseHostname(sc.User()))
+		}
+
+		t.AddValues(fw.ID, fw.Kind, owner, client, fw.Bind, fw.Target, fw.Age().String(), strconv.FormatUint(fw.Connections, 10), bandwidth.Format(fw.Bytes), bandwidth.FormatRate(fw.Limit))
+	}
+
+	t.Fprint(tty)
+
+	return nil
+}
+
+// canSeeForward checks a forward on the server goes through a client the user can see, only admins can see the ports opened by proxy keys
+func canSeeForward(user *users.User, visible map[string]*ssh.ServerConn, fw forwards.Info) bool {
+	if fw.Client == "" {
+		return user.Privilege() == users.AdminPermissions
+	}
+
+	_, ok := visible[fw.Client]
+	return ok
+}
+
+// findForward resolves a forward id, returning the client and the id it has there when the forward is not on the server
+func findForward(user *users.User, visible map[string]*ssh.ServerConn, id string) (client *ssh.ServerConn, clientForwardID string, err error) {
+	clientID, clientForwardID, onClient := strings.Cut(id, "/")
+	if !onClient {
+		for _, fw := range forwards.All() {
+			if fw.ID == id && canSeeForward(user, visible, fw) {
+				return nil, "", nil
+			}
+		}
+
+		return nil, "", errors.New("no such forward")
+	}
+
+	client, ok := visible[clientID]
+	if !ok {
+		return nil, "", errors.New("no such forward")
+	}
+
+	return client, clientForwardID, nil
+}
+
+// clientForwardRequest sends a request about one of its forwards to a client
+func clientForwardRequest(client *ssh.ServerConn, request string, payload []byte) error {
+	ok, response, err := client.SendRequest(request, true, payload)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if len(response) == 0 {
+			response = []byte("client does not support managing forwards (may be outdated)")
+		}
+		return errors.New(string(response))
+	}
+
+	return nil
+}
+
+// close stops a forward on the server, or one on a client when the id is prefixed by its client id
+func (f *forwardsCommand) close(user *users.User, visible map[string]*ssh.ServerConn, id string) error {
+	client, clientForwardID, err := findForward(user, visible, id)
+	if err != nil {
+		return err
+	}
+
+	if client == nil {
+		return forwards.Close(id)
+	}
+
+	return clientForwardRequest(client, "cancel-forward", []byte(clientForwardID))
+}
+
+func (f *forwardsCommand) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (f *forwardsCommand) Help(explain bool) string {
+	const description = "List and close the forwards open on the server and clients."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(f.ValidArgs(),
+		"forwards [-c <remote_id or glob pattern>]",
+		"forwards --close <id>...",
+		description,
+		"Lists ssh -L connections and ssh -R listeners through clients, server ports opened with listen -c, udp forwards, socks listeners, published web services and ports opened by proxy keys.",
+		"Only admins see the ports opened by proxy keys, which are owned by the keys comment.",
+		"Forwards on a client have ids prefixed with the client id.",
+	)
+}
+
+func Forwards(log logger.Logger) *forwardsCommand {
+	return &forwardsCommand{
+		log: log,
+	}
+}
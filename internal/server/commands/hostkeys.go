@@ -0,0 +1,165 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+type hostKeys struct {
+	log logger.Logger
+}
+
+func (h *hostKeys) ValidArgs() map[string]string {
+	return map[string]string{
+		"generate": "Generate the next server key and send the updated trust list to all connected clients",
+		"push":     "Send the trust list (current and next key) to clients matching the filter, or all clients if no filter is given",
+		"rotate":   "Switch to the next key for new connections",
+		"force":    "Rotate even if some connected clients have not accepted the next key",
+		"discard":  "Delete the next key without rotating to it",
+	}
+}
+
+func (h *hostKeys) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if user.Privilege() != users.AdminPermissions {
+		return errors.New("only admins can manage the server host keys")
+	}
+
+	switch {
+	case line.IsSet("generate"):
+		next, err := hostkeys.GenerateNext()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tty, "Generated next key: %s\n", internal.FingerprintSHA256Hex(next.PublicKey()))
+
+		return h.push(user, tty, "")
+
+	case line.IsSet("push"):
+		filter := ""
+		if len(line.Arguments) > 0 {
+			filter = line.Arguments[len(line.Arguments)-1].Value()
+		}
+
+		return h.push(user, tty, filter)
+
+	case line.IsSet("rotate"):
+		if hostkeys.Next() == nil {
+			return errors.New("there is no next key to rotate to, generate one with --generate first")
+		}
+
+		connections, err := user.SearchClients("")
+		if err != nil {
+			return err
+		}
+
+		var unconfirmed []string
+		for id := range connections {
+			if !hostkeys.Confirmed(id) {
+				unconfirmed = append(unconfirmed, id)
+			}
+		}
+		sort.Strings(unconfirmed)
+
+		if len(unconfirmed) > 0 && !line.IsSet("force") {
+			for _, id := range unconfirmed {
+				fmt.Fprintf(tty, "%s has not accepted the next key\n", id)
+			}
+			return fmt.Errorf("%d clients would not be able to reconnect after rotation, use --push to retry or --force to rotate anyway", len(unconfirmed))
+		}
+
+		if err := hostkeys.Rotate(); err != nil {
+			return err
+		}
+
+		h.log.Info("Server key rotated by %s", user.Username())
+		fmt.Fprintf(tty, "Rotated, new connections will use %s\n", internal.FingerprintSHA256Hex(hostkeys.Current().PublicKey()))
+		fmt.Fprintln(tty, "Users will need to update their known_hosts entry for this server")
+
+		// Clients no longer need to trust the old key
+		return h.push(user, tty, "")
+
+	case line.IsSet("discard"):
+		if err := hostkeys.DiscardNext(); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(tty, "Next key discarded")
+		return nil
+	}
+
+	fmt.Fprintf(tty, "Current: %s\n", internal.FingerprintSHA256Hex(hostkeys.Current().PublicKey()))
+
+	if next := hostkeys.Next(); next != nil {
+		fmt.Fprintf(tty, "Next:    %s\n", internal.FingerprintSHA256Hex(next.PublicKey()))
+	} else {
+		fmt.Fprintln(tty, "Next:    none")
+	}
+
+	if authority := hostkeys.Authority(); authority != "" {
+		fmt.Fprintf(tty, "Host CA: %s\n", authority)
+	}
+
+	return nil
+}
+
+func (h *hostKeys) push(user *users.User, tty io.ReadWriter, filter string) error {
+	connections, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(connections) == 0 {
+		fmt.Fprintln(tty, "No clients to send the trust list to")
+		return nil
+	}
+
+	failed := 0
+	for id, serverConn := range connections {
+		if err := hostkeys.Push(id, serverConn); err != nil {
+			fmt.Fprintf(tty, "%s failed: %s\n", id, err)
+			failed++
+		}
+	}
+
+	fmt.Fprintf(tty, "Sent trust list to %d/%d clients\n", len(connections)-failed, len(connections))
+
+	return nil
+}
+
+func (h *hostKeys) Expect(line terminal.ParsedLine) []string {
+	if line.IsSet("push") && len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (h *hostKeys) Help(explain bool) string {
+	const description = "Manage the server host keys, and rotate them without breaking deployed clients."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(h.ValidArgs(),
+		"hostkeys [--generate|--push [remote_id or glob pattern]|--rotate [--force]|--discard]",
+		description,
+		"Clients connecting while there is a next key are sent the trust list automatically.",
+		"Pushed trust lists are not persisted by clients, so a client restarted after rotation needs the new key baked in (link does this) or a host CA.",
+	)
+}
+
+func HostKeys(log logger.Logger) *hostKeys {
+	return &hostKeys{
+		log: log,
+	}
+}
@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/fatih/color"
+)
+
+type info struct {
+	log logger.Logger
+}
+
+func (i *info) ValidArgs() map[string]string {
+	return map[string]string{
+		"r":       "Ask the client(s) to send their system information again",
+		"refresh": "Ask the client(s) to send their system information again",
+	}
+}
+
+func (i *info) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	if len(line.Arguments) != 1 {
+		return errors.New(i.Help(false))
+	}
+
+	filter := line.Arguments[0].Value()
+
+	connections, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(connections) == 0 {
+		return fmt.Errorf("No clients matched '%s'", filter)
+	}
+
+	ids := []string{}
+	for id := range connections {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	refresh := line.IsSet("r") || line.IsSet("refresh")
+
+	for n, id := range ids {
+		if n != 0 {
+			fmt.Fprint(tty, "\n")
+		}
+
+		fmt.Fprintf(tty, "%s %s\n", color.YellowString(id), color.BlueString(users.NormaliseHostname(connections[id].User())))
+
+		if refresh {
+			if _, err := users.RefreshClientInfo(id, connections[id]); err != nil {
+				i.log.Warning("Unable to refresh system information of %s: %s", id, err)
+				fmt.Fprintf(tty, "Unable to refresh: %s\n", err)
+			}
+		}
+
+		clientInfo, ok := users.GetClientInfo(id)
+		if !ok {
+			fmt.Fprintf(tty, "No system information, client version: %s\n", connections[id].ClientVersion())
+			continue
+		}
+
+		fmt.Fprint(tty, describeClientInfo(clientInfo))
+	}
+
+	return nil
+}
+
+func describeClientInfo(clientInfo internal.ClientInfo) string {
+	var sb strings.Builder
+
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&sb, "%-12s %s\n", name+":", value)
+		}
+	}
+
+	field("User", clientInfo.Username)
+	field("Hostname", clientInfo.Hostname)
+	field("OS", clientInfo.OSRelease)
+	field("Kernel", clientInfo.Kernel)
+	field("Arch", clientInfo.GoOS+"/"+clientInfo.GoArch)
+	field("Privileged", fmt.Sprintf("%t", clientInfo.Privileged))
+	field("PID", fmt.Sprintf("%d", clientInfo.PID))
+	field("Executable", clientInfo.Executable)
+	if clientInfo.Uptime > 0 {
+		field("Uptime", (time.Duration(clientInfo.Uptime) * time.Second).String())
+	}
+	field("IPs", strings.Join(clientInfo.IPs, ", "))
+	field("Disabled", strings.Join(clientInfo.Disabled, ", "))
+
+	if len(clientInfo.Interfaces) > 0 {
+		sb.WriteString("Interfaces:\n")
+		for _, iface := range clientInfo.Interfaces {
+			parts := strings.SplitN(iface, "|", 3)
+			for len(parts) < 3 {
+				parts = append(parts, "")
+			}
+
+			fmt.Fprintf(&sb, "    %-16s %-17s %s\n", parts[0], parts[1], parts[2])
+		}
+	}
+
+	return sb.String()
+}
+
+// summariseClientInfo is the short version for ls -t
+func summariseClientInfo(clientInfo internal.ClientInfo) string {
+	var lines []string
+	for _, l := range []string{clientInfo.OSRelease, clientInfo.Kernel, strings.Join(clientInfo.IPs, "\n")} {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	process := fmt.Sprintf("pid %d", clientInfo.PID)
+	if clientInfo.Privileged {
+		process += " (privileged)"
+	}
+
+	lines = append(lines, process)
+
+	if len(clientInfo.Disabled) > 0 {
+		lines = append(lines, "disabled: "+strings.Join(clientInfo.Disabled, ","))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (i *info) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (i *info) Help(explain bool) string {
+	if explain {
+		return "Show the system information a client has reported."
+	}
+
+	return terminal.MakeHelpText(i.ValidArgs(),
+		"info [OPTIONS] <remote_id>",
+		"info [OPTIONS] <glob pattern>",
+		"Show the OS, kernel, interfaces, process and privileges clients reported when they connected.",
+	)
+}
+
+func Info(log logger.Logger) *info {
+	return &info{
+		log: log,
+	}
+}
@@ -26,6 +26,18 @@ var allCommands = map[string]terminal.Command{
 	"autocomplete": &shellAutocomplete{},
 	"log":          &logCommand{},
 	"clear":        &clear{},
+	"sessions":     &sessions{},
+	"get":          &get{},
+	"put":          &put{},
+	"reconnect":    &reconnect{},
+	"hostkeys":     &hostKeys{},
+	"info":         &info{},
+	"update":       &update{},
+	"tun-policy":   &tunPolicy{},
+	"socks":        &socksCommand{},
+	"forwards":     &forwardsCommand{},
+	"bandwidth":    &bandwidthCommand{},
+	"publish":      &publishCommand{},
 }
 
 func CreateCommands(session string, user *users.User, log logger.Logger, datadir string) map[string]terminal.Command {
@@ -48,6 +60,18 @@ func CreateCommands(session string, user *users.User, log logger.Logger, datadir
 		"autocomplete": &shellAutocomplete{},
 		"log":          Log(log),
 		"clear":        &clear{},
+		"sessions":     Sessions(session, user, log),
+		"get":          Get(datadir),
+		"put":          Put(datadir),
+		"reconnect":    &reconnect{},
+		"hostkeys":     HostKeys(log),
+		"info":         Info(log),
+		"update":       Update(log),
+		"tun-policy":   &tunPolicy{},
+		"socks":        Socks(log),
+		"forwards":     Forwards(log),
+		"bandwidth":    Bandwidth(log),
+		"publish":      Publish(log),
 	}
 
 	return o
@@ -58,3 +82,20 @@ func addDuplicateFlags(helpText string, m map[string]string, flags ...string) {
 		m[flag] = helpText
 	}
 }
+
+// trailingFilter returns the client filter given as the last argument. The parser also puts flag values in the arguments,
+// so each of valueFlags that is set accounts for one more
+func trailingFilter(line terminal.ParsedLine, valueFlags ...string) (string, bool) {
+	expected := 1
+	for _, flag := range valueFlags {
+		if line.IsSet(flag) {
+			expected++
+		}
+	}
+
+	if len(line.Arguments) != expected {
+		return "", false
+	}
+
+	return line.Arguments[len(line.Arguments)-1].Value(), true
+}
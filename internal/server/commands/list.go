@@ -7,6 +7,9 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/NHAS/reverse_ssh/internal/bandwidth"
+	"github.com/NHAS/reverse_ssh/internal/server/accounting"
+	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -19,13 +22,32 @@ type list struct {
 }
 
 type displayItem struct {
-	sc ssh.ServerConn
-	id string
+	sc    ssh.ServerConn
+	id    string
+	relay string
+}
+
+// relayPath lists the clients a client was relayed through to reach the server, nearest first, as far as the user can see
+func relayPath(visible map[string]*ssh.ServerConn, sc *ssh.ServerConn) (path []string) {
+	seen := map[string]bool{}
+	for {
+		relay, ok := sc.RemoteAddr().(*multiplexer.RelayAddr)
+		if !ok || seen[relay.Via] {
+			return path
+		}
+		seen[relay.Via] = true
+
+		path = append(path, relay.Via)
+
+		if sc, ok = visible[relay.Via]; !ok {
+			return path
+		}
+	}
 }
 
 func fancyTable(tty io.ReadWriter, applicable []displayItem) {
 
-	t, _ := table.NewTable("Targets", "IDs", "Owners", "Version")
+	t, _ := table.NewTable("Targets", "IDs", "Owners", "Version", "System", "Traffic")
 	for _, a := range applicable {
 
 		keyId := a.sc.Permissions.Extensions["pubkey-fp"]
@@ -40,7 +62,20 @@ func fancyTable(tty io.ReadWriter, applicable []displayItem) {
 			owners = strings.Join(strings.Split(a.sc.Permissions.Extensions["owners"], ","), "\n")
 		}
 
-		if err := t.AddValues(fmt.Sprintf("%s\n%s\n%s\n%s\n", a.id, keyId, users.NormaliseHostname(a.sc.User()), a.sc.RemoteAddr().String()), owners, string(a.sc.ClientVersion())); err != nil {
+		system := "unknown"
+		if clientInfo, ok := users.GetClientInfo(a.id); ok {
+			system = summariseClientInfo(clientInfo)
+		}
+
+		usage := accounting.Client(&a.sc)
+		traffic := fmt.Sprintf("sent: %s\nreceived: %s\nlimit: %s", bandwidth.Format(usage.Sent.Load()), bandwidth.Format(usage.Received.Load()), bandwidth.FormatRate(usage.Limit.Rate()))
+
+		address := a.sc.RemoteAddr().String()
+		if a.relay != "" {
+			address += "\nvia " + a.relay
+		}
+
+		if err := t.AddValues(fmt.Sprintf("%s\n%s\n%s\n%s\n", a.id, keyId, users.NormaliseHostname(a.sc.User()), address), owners, string(a.sc.ClientVersion()), system, traffic); err != nil {
 			log.Println("Error drawing pretty ls table (THIS IS A BUG): ", err)
 			return
 		}
@@ -89,8 +124,13 @@ func (l *list) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 
 	sort.Strings(ids)
 
+	visible, err := user.SearchClients("*")
+	if err != nil {
+		return err
+	}
+
 	for _, id := range ids {
-		toReturn = append(toReturn, displayItem{id: id, sc: *matchingClients[id]})
+		toReturn = append(toReturn, displayItem{id: id, sc: *matchingClients[id], relay: strings.Join(relayPath(visible, matchingClients[id]), " via ")})
 	}
 
 	if line.IsSet("t") {
@@ -114,6 +154,14 @@ func (l *list) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine
 
 		fmt.Fprintf(tty, "%s %s %s %s, owners: %s, version: %s", color.YellowString(tr.id), keyId, color.BlueString(users.NormaliseHostname(tr.sc.User())), tr.sc.RemoteAddr().String(), owners, tr.sc.ClientVersion())
 
+		if tr.relay != "" {
+			fmt.Fprintf(tty, ", via: %s", tr.relay)
+		}
+
+		if clientInfo, ok := users.GetClientInfo(tr.id); ok && len(clientInfo.Disabled) > 0 {
+			fmt.Fprintf(tty, ", disabled: %s", color.RedString(strings.Join(clientInfo.Disabled, ",")))
+		}
+
 		if i != len(toReturn)-1 {
 			fmt.Fprint(tty, sep)
 		}
@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
+	"golang.org/x/crypto/ssh"
+)
+
+// addrConn is a client connection that only knows where it came from
+type addrConn struct {
+	ssh.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func relayedClient(via string) *ssh.ServerConn {
+	var addr net.Addr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2222}
+	if via != "" {
+		addr = &multiplexer.RelayAddr{TCPAddr: net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2222}, Via: via}
+	}
+
+	return &ssh.ServerConn{Conn: addrConn{remote: addr}}
+}
+
+func TestRelayPath(t *testing.T) {
+	visible := map[string]*ssh.ServerConn{
+		"direct": relayedClient(""),
+		"first":  relayedClient("direct"),
+		"second": relayedClient("first"),
+		// Relayed through a client the user cannot see
+		"hidden": relayedClient("secret"),
+		// Relayed through each other, which should never happen but must not loop forever
+		"loop1": relayedClient("loop2"),
+		"loop2": relayedClient("loop1"),
+	}
+
+	for id, expected := range map[string][]string{
+		"direct": nil,
+		"first":  {"direct"},
+		"second": {"first", "direct"},
+		"hidden": {"secret"},
+		"loop1":  {"loop2", "loop1"},
+	} {
+		if path := relayPath(visible, visible[id]); !reflect.DeepEqual(path, expected) {
+			t.Errorf("%s: expected relay path %q got %q", id, expected, path)
+		}
+	}
+}
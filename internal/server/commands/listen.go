@@ -6,10 +6,12 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync"
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server/multiplexer"
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/udpforwards"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/internal/terminal"
 	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
@@ -24,6 +26,31 @@ type autostartEntry struct {
 
 var autoStartServerPort = map[internal.RemoteForwardRequest]autostartEntry{}
 
+var (
+	serverPortOwnersLck sync.Mutex
+	// Who opened the server port on a client, as the client only knows the server asked for it
+	serverPortOwners = map[string]string{}
+)
+
+func setServerPortOwner(clientID string, r internal.RemoteForwardRequest, owner string) {
+	serverPortOwnersLck.Lock()
+	defer serverPortOwnersLck.Unlock()
+
+	if owner == "" {
+		delete(serverPortOwners, clientID+" "+r.String())
+		return
+	}
+
+	serverPortOwners[clientID+" "+r.String()] = owner
+}
+
+func serverPortOwner(clientID, bind string) string {
+	serverPortOwnersLck.Lock()
+	defer serverPortOwnersLck.Unlock()
+
+	return serverPortOwners[clientID+" "+bind]
+}
+
 type listen struct {
 	log logger.Logger
 }
@@ -154,7 +181,10 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 			if err != nil {
 				applied--
 				fmt.Fprintln(tty, "error starting port on: ", c, ": ", err)
+				continue
 			}
+
+			setServerPortOwner(c, r, user.Username())
 		}
 
 		fmt.Fprintf(tty, "started %s:%d on %d clients (total %d)\n", r.BindAddr, r.BindPort, applied, len(foundClients))
@@ -164,7 +194,7 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 
 			entry.ObserverID = observers.ConnectionState.Register(func(c observers.ClientState) {
 
-				if !user.Matches(specifier, c.ID, c.IP) || c.Status == "disconnected" {
+				if !user.Matches(specifier, c.ID, c.IP) || c.Status != "connected" {
 					return
 				}
 
@@ -184,6 +214,8 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 					return
 				}
 
+				setServerPortOwner(c.ID, r, user.Username())
+
 			})
 
 			entry.Criteria = specifier
@@ -228,7 +260,10 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 			if err != nil {
 				applied--
 				fmt.Fprintln(tty, "error stop port on: ", c, ": ", err)
+				continue
 			}
+
+			setServerPortOwner(c, r, "")
 		}
 
 		fmt.Fprintf(tty, "stopped %s:%d on %d clients\n", r.BindAddr, r.BindPort, applied)
@@ -244,13 +279,123 @@ func (l *listen) client(user *users.User, tty io.ReadWriter, line terminal.Parse
 	return nil
 }
 
+func (l *listen) udp(user *users.User, tty io.ReadWriter, line terminal.ParsedLine, onAddrs, offAddrs []string) error {
+	if line.IsSet("auto") {
+		return errors.New("--auto is not supported for udp forwards")
+	}
+
+	// Forwards on clients the user cannot see are left out, as if they did not exist
+	visible, err := user.SearchClients("*")
+	if err != nil {
+		return err
+	}
+
+	if line.IsSet("l") {
+		found := false
+		for _, f := range udpforwards.All() {
+			if _, ok := visible[f.ClientID]; ok {
+				fmt.Fprintln(tty, f)
+				found = true
+			}
+		}
+
+		if !found {
+			fmt.Fprintln(tty, "No udp forwards")
+		}
+		return nil
+	}
+
+	remote := line.IsSet("remote")
+
+	specifier, err := line.GetArgString("c")
+	if err != nil {
+		specifier, err = line.GetArgString("client")
+	}
+
+	var foundClients map[string]*ssh.ServerConn
+	if err == nil {
+		foundClients, err = user.SearchClients(specifier)
+		if err != nil {
+			return err
+		}
+
+		if len(foundClients) == 0 {
+			return fmt.Errorf("No clients matched '%s'", specifier)
+		}
+	} else if len(onAddrs) > 0 || remote {
+		return errors.New("udp forwards need a client, e.g -c <remote_id>")
+	}
+
+	if len(onAddrs) > 0 {
+		target, err := line.GetArgString("to")
+		if err != nil {
+			return errors.New("udp forwards need a destination, e.g --to 10.0.0.1:53")
+		}
+
+		// A server listener can only send to one client, but a remote forward can be opened on many
+		if !remote && len(foundClients) != 1 {
+			return fmt.Errorf("'%s' matches %d clients, a server udp listener can only forward through one", specifier, len(foundClients))
+		}
+
+		for _, addr := range onAddrs {
+			for id, sc := range foundClients {
+				var f *udpforwards.Forward
+				if remote {
+					f, err = udpforwards.StartRemote(user.Username(), id, sc, addr, target)
+				} else {
+					f, err = udpforwards.Start(user.Username(), id, sc, addr, target)
+				}
+
+				if err != nil {
+					fmt.Fprintf(tty, "failed to start udp forward %s on %s: %s\n", addr, id, err)
+					continue
+				}
+
+				fmt.Fprintf(tty, "started udp forward %s\n", f)
+			}
+		}
+	}
+
+	for _, addr := range offAddrs {
+		var toStop []*udpforwards.Forward
+		if remote {
+			for id := range foundClients {
+				if f, ok := udpforwards.Get(id, addr, true); ok {
+					toStop = append(toStop, f)
+				}
+			}
+		} else if f, ok := udpforwards.Get("", addr, false); ok && visible[f.ClientID] != nil && (foundClients == nil || foundClients[f.ClientID] != nil) {
+			toStop = append(toStop, f)
+		}
+
+		if len(toStop) == 0 {
+			fmt.Fprintf(tty, "no udp forward on %s\n", addr)
+			continue
+		}
+
+		for _, f := range toStop {
+			if err := udpforwards.Stop(f); err != nil {
+				fmt.Fprintf(tty, "error stopping udp forward %s: %s\n", f, err)
+				continue
+			}
+
+			fmt.Fprintf(tty, "stopped udp forward %s\n", f)
+		}
+	}
+
+	return nil
+}
+
 func (w *listen) ValidArgs() map[string]string {
 
 	r := map[string]string{
-		"on":   "Turn on port, e.g --on :8080 127.0.0.1:4444",
-		"auto": "Automatically turn on server control port on clients that match criteria, (use --off --auto to disable and --l --auto to view)",
-		"off":  "Turn off port, e.g --off :8080 127.0.0.1:4444",
-		"l":    "List all enabled addresses",
+		"on":     "Turn on port, e.g --on :8080 127.0.0.1:4444",
+		"auto":   "Automatically turn on server control port on clients that match criteria, (use --off --auto to disable and --l --auto to view)",
+		"off":    "Turn off port, e.g --off :8080 127.0.0.1:4444",
+		"l":      "List all enabled addresses",
+		"udp":    "Forward udp through a client instead, the server listens on --on and the client sends datagrams to --to, e.g --udp -c <remote_id> --on 127.0.0.1:5353 --to 10.0.0.1:53",
+		"to":     "Where forwarded udp datagrams are sent",
+		"remote": "With --udp, the client listens on --on and the server sends datagrams to --to, e.g --udp --remote -c <remote_id> --on :514 --to 127.0.0.1:514",
 	}
 
 	addDuplicateFlags("Open server port on client/s takes a pattern, e.g -c *, --client your.hostname.here", r, "client", "c")
@@ -283,7 +428,9 @@ func (w *listen) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLi
 		return errors.New("no actionable argument supplied, please add --on, --off or -l (list)")
 	}
 
-	if line.IsSet("server") || line.IsSet("s") {
+	if line.IsSet("udp") {
+		return w.udp(user, tty, line, onAddrs, offAddrs)
+	} else if line.IsSet("server") || line.IsSet("s") {
 		return w.server(tty, line, onAddrs, offAddrs)
 	} else if line.IsSet("client") || line.IsSet("c") || line.IsSet("auto") {
 		return w.client(user, tty, line, onAddrs, offAddrs)
@@ -313,6 +460,8 @@ func (w *listen) Help(explain bool) string {
 		"listen [OPTION] [PORT]",
 		"listen starts or stops listening control ports",
 		"it allows you to change the servers listening port, or open the servers control port on an rssh client, so that forwarding is easier",
+		"clients that connect to a port opened on a client are relayed to the server through it, ls shows which client they came through",
+		"with --udp it forwards udp datagrams through a client, which ssh port forwards cannot do. Use --udp -l to list them and --udp --off <address> to stop them",
 	)
 }
 
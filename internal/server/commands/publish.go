@@ -0,0 +1,199 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal/server/publish"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/server/webserver"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+type publishCommand struct {
+	log logger.Logger
+}
+
+func (p *publishCommand) ValidArgs() map[string]string {
+	r := map[string]string{
+		"target":   "Service as seen from the client, e.g --target 10.0.0.5:8080 or --target https://intranet.local",
+		"path":     "Path prefix to publish the service at on the webserver, which is removed before requests are sent on, e.g --path /wiki",
+		"host":     "Virtual host to publish the service at on the webserver, e.g --host wiki.example.com",
+		"auth":     "Require basic auth, e.g --auth username:password",
+		"header":   "Set a header on requests to the service, or remove it with no value, e.g --header 'Host: intranet.local' --header 'Cookie:'",
+		"insecure": "Do not verify the certificate of https services",
+		"l":        "List published services",
+		"off":      "Stop publishing a service by its route as listed, e.g --off /wiki/ --off wiki.example.com/",
+	}
+
+	addDuplicateFlags("Client to make requests through, e.g -c <remote_id>", r, "client", "c")
+
+	return r
+}
+
+func (p *publishCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	// Services on clients the user cannot see are left out, as if they did not exist
+	visible, err := user.SearchClients("*")
+	if err != nil {
+		return err
+	}
+
+	if line.IsSet("l") {
+		found := false
+		for _, m := range publish.All() {
+			if _, ok := visible[m.ClientID]; ok {
+				fmt.Fprintln(tty, m)
+				found = true
+			}
+		}
+
+		if !found {
+			fmt.Fprintln(tty, "No published services")
+		}
+		return nil
+	}
+
+	routes, err := line.GetArgsString("off")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	if len(routes) > 0 {
+		for _, route := range routes {
+			m, ok := publish.Get(route)
+			if ok {
+				_, ok = visible[m.ClientID]
+			}
+
+			if !ok {
+				fmt.Fprintf(tty, "nothing published at %s\n", route)
+				continue
+			}
+
+			if err := publish.Stop(m); err != nil {
+				fmt.Fprintf(tty, "error unpublishing %s: %s\n", m, err)
+				continue
+			}
+
+			p.log.Info("%s stopped publishing %s", user.Username(), m)
+			fmt.Fprintf(tty, "stopped publishing %s\n", m)
+		}
+		return nil
+	}
+
+	target, err := line.GetArgString("target")
+	if err != nil {
+		return errors.New("no actionable argument supplied, please add --target, --off or -l (list)")
+	}
+
+	if !webserver.Enabled() {
+		return errors.New("web server is not enabled")
+	}
+
+	specifier, err := line.GetArgString("c")
+	if err != nil {
+		specifier, err = line.GetArgString("client")
+		if err != nil {
+			return errors.New("published services need a client, e.g -c <remote_id>")
+		}
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) != 1 {
+		return fmt.Errorf("'%s' matches %d clients, a service can only be published through one", specifier, len(foundClients))
+	}
+
+	opts := publish.Options{
+		Target:   target,
+		Insecure: line.IsSet("insecure"),
+	}
+
+	for flag, value := range map[string]*string{"path": &opts.Path, "host": &opts.Host, "auth": &opts.Credentials} {
+		*value, err = line.GetArgString(flag)
+		if err != nil && err != terminal.ErrFlagNotSet {
+			return err
+		}
+	}
+
+	// Taking over the whole of the servers own host would replace its 404 page, which makes the webserver stand out
+	if opts.Path == "" && opts.Host != "" && strings.EqualFold(opts.Host, connectBackHost()) {
+		return fmt.Errorf("%s is the servers connect back host, publish the service at a path instead", opts.Host)
+	}
+
+	headers, err := line.GetArgsString("header")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	for _, h := range headers {
+		header, err := publish.ParseHeader(h)
+		if err != nil {
+			return err
+		}
+		opts.Headers = append(opts.Headers, header)
+	}
+
+	for id := range foundClients {
+		m, err := publish.Start(user, id, opts, p.log)
+		if err != nil {
+			return err
+		}
+
+		p.log.Info("%s published %s", user.Username(), m)
+		fmt.Fprintf(tty, "published %s\n", m)
+	}
+
+	return nil
+}
+
+func connectBackHost() string {
+	host, _, err := net.SplitHostPort(webserver.DefaultConnectBack)
+	if err != nil {
+		return webserver.DefaultConnectBack
+	}
+	return host
+}
+
+func (p *publishCommand) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (p *publishCommand) Help(explain bool) string {
+	const description = "Publish a http service reachable from a client on the server webserver."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(p.ValidArgs(),
+		"publish -c <remote_id> --target <host:port or url> (--path <prefix> | --host <virtual host>) [--auth username:password] [--header 'Name: value']...",
+		"publish -l",
+		"publish --off <route>...",
+		description,
+		"Requests are reverse proxied over direct-tcpip channels, websockets included. Downloads take precedence over published services on the same path.",
+		"Only admins can publish a service for a whole --host without a --path, and never for the servers connect back host.",
+		"Every new connection to the service is checked against the clients the user who published it can currently access, and the service is unpublished when the client disconnects.",
+	)
+}
+
+func Publish(log logger.Logger) *publishCommand {
+	return &publishCommand{
+		log: log,
+	}
+}
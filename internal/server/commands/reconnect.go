@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+)
+
+type reconnect struct {
+}
+
+func (r *reconnect) ValidArgs() map[string]string {
+	return map[string]string{
+		"policy": "The reconnect policy to set, e.g initial=10s,max=5m,multiplier=2,jitter=0.2,attempts=0,giveup=0. Unset options use the defaults",
+	}
+}
+
+func (r *reconnect) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	filter, ok := trailingFilter(line, "policy")
+	if !ok {
+		return errors.New(r.Help(false))
+	}
+
+	policyString, err := line.GetArgString("policy")
+	if err != nil {
+		return errors.New("missing --policy")
+	}
+
+	policy, err := internal.ParseReconnectPolicy(policyString)
+	if err != nil {
+		return err
+	}
+
+	connections, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(connections) == 0 {
+		return fmt.Errorf("No clients matched '%s'", filter)
+	}
+
+	for id, serverConn := range connections {
+		ok, response, err := serverConn.SendRequest("reconnect-policy", true, []byte(policy.String()))
+		if err != nil {
+			fmt.Fprintf(tty, "%s failed: %s\n", id, err)
+			continue
+		}
+
+		if !ok {
+			if len(response) == 0 {
+				response = []byte("client does not support reconnect policies (may be outdated)")
+			}
+			fmt.Fprintf(tty, "%s failed: %s\n", id, response)
+			continue
+		}
+
+		fmt.Fprintf(tty, "%s reconnect policy set to %s\n", id, policy)
+	}
+
+	return nil
+}
+
+func (r *reconnect) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (r *reconnect) Help(explain bool) string {
+	const description = "Change how clients back off when reconnecting to the server."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(r.ValidArgs(),
+		"reconnect --policy <policy> <remote_id or glob pattern>",
+		description,
+		"Default policy: "+internal.DefaultReconnectPolicy.String(),
+	)
+}
@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+)
+
+func TestReconnectArguments(t *testing.T) {
+	r := &reconnect{}
+
+	for line, expected := range map[string]string{
+		// Parsed, so it gets as far as looking for the client
+		"reconnect --policy initial=5s,max=1m nosuchclient": "No clients matched 'nosuchclient'",
+		"reconnect --policy nonsense nosuchclient":          "nonsense",
+		"reconnect --policy initial=5s":                     r.Help(false),
+		"reconnect nosuchclient":                            "missing --policy",
+		"reconnect --policy initial=5s one two":             r.Help(false),
+	} {
+		var tty bytes.Buffer
+		err := r.Run(&users.User{}, &tty, terminal.ParseLine(line, 0))
+		if err == nil {
+			t.Fatalf("%q: expected an error", line)
+		}
+
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected %q got %q", line, expected, err)
+		}
+	}
+}
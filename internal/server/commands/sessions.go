@@ -0,0 +1,381 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/table"
+	"github.com/fatih/color"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sharedSessionsLck sync.RWMutex
+	// Shared session id to the live connect session
+	sharedSessions = map[string]*sharedSession{}
+)
+
+// How many writes of output can be waiting for a viewer before it misses some, so a slow viewer never holds up the owner
+const viewerBacklog = 256
+
+type sessionViewer struct {
+	username  string
+	tty       io.Writer
+	readWrite bool
+
+	output chan []byte
+}
+
+func (v *sessionViewer) writeOutput() {
+	for b := range v.output {
+		v.tty.Write(b)
+	}
+}
+
+// sharedSession is a connect session that other users can watch or type into, the owner is the user that ran connect
+// and is the only one whose window size is sent to the client
+type sharedSession struct {
+	sync.RWMutex
+
+	id       string
+	owner    string
+	clientId string
+	hostname string
+	started  time.Time
+
+	channel  ssh.Channel
+	ownerTty io.Writer
+
+	// Whether the owner lets users attach read-write, admins always can
+	allowWrite bool
+
+	viewers map[*sessionViewer]bool
+
+	closed chan bool
+}
+
+func registerSession(owner, clientId string, target *ssh.ServerConn, channel ssh.Channel, ownerTty io.Writer, allowWrite bool) (*sharedSession, error) {
+	id, err := internal.RandomString(8)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sharedSession{
+		id:       id,
+		owner:    owner,
+		clientId: clientId,
+		hostname: users.NormaliseHostname(target.User()),
+		started:  time.Now(),
+		channel:  channel,
+		ownerTty: ownerTty,
+		viewers:  make(map[*sessionViewer]bool),
+		closed:   make(chan bool),
+
+		allowWrite: allowWrite,
+	}
+
+	sharedSessionsLck.Lock()
+	sharedSessions[id] = s
+	sharedSessionsLck.Unlock()
+
+	return s, nil
+}
+
+func getSharedSession(id string) (*sharedSession, error) {
+	sharedSessionsLck.RLock()
+	defer sharedSessionsLck.RUnlock()
+
+	s, ok := sharedSessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session %q not found", id)
+	}
+
+	return s, nil
+}
+
+// Write sends the output of the remote shell to the owner and queues it for every attached viewer, viewers that have fallen too far behind miss it
+func (s *sharedSession) Write(b []byte) (int, error) {
+	n, err := s.ownerTty.Write(b)
+
+	output := make([]byte, len(b))
+	copy(output, b)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for v := range s.viewers {
+		select {
+		case v.output <- output:
+		default:
+		}
+	}
+
+	return n, err
+}
+
+func (s *sharedSession) notifyOwner(format string, v ...interface{}) {
+	fmt.Fprintf(s.ownerTty, "\r\n%s %s\r\n", color.GreenString("[rssh]"), fmt.Sprintf(format, v...))
+}
+
+func (s *sharedSession) addViewer(v *sessionViewer) {
+	v.output = make(chan []byte, viewerBacklog)
+	go v.writeOutput()
+
+	s.Lock()
+	s.viewers[v] = true
+	s.Unlock()
+
+	mode := "read-only"
+	if v.readWrite {
+		mode = "read-write"
+	}
+
+	s.notifyOwner("%s attached to this session (%s)", v.username, mode)
+}
+
+func (s *sharedSession) removeViewer(v *sessionViewer) {
+	s.Lock()
+	_, ok := s.viewers[v]
+	if ok {
+		delete(s.viewers, v)
+		close(v.output)
+	}
+	s.Unlock()
+
+	if ok {
+		s.notifyOwner("%s detached from this session", v.username)
+	}
+}
+
+func (s *sharedSession) close() {
+	sharedSessionsLck.Lock()
+	delete(sharedSessions, s.id)
+	sharedSessionsLck.Unlock()
+
+	close(s.closed)
+}
+
+// accessible returns whether the user is allowed to see this session, either by owning it or by having access to the client it is on
+func (s *sharedSession) accessible(user *users.User) bool {
+	if user.Username() == s.owner {
+		return true
+	}
+
+	_, err := user.GetClient(s.clientId)
+	return err == nil
+}
+
+// writable returns an error if the user may not type into this session, which needs the owners consent or admin privileges
+func (s *sharedSession) writable(user *users.User) error {
+	if s.allowWrite || user.Privilege() == users.AdminPermissions {
+		return nil
+	}
+
+	return fmt.Errorf("%s has not allowed read-write attaching to this session (connect --share-rw), only admins can attach read-write", s.owner)
+}
+
+type sessions struct {
+	log     logger.Logger
+	user    *users.User
+	session string
+}
+
+func (s *sessions) ValidArgs() map[string]string {
+	return map[string]string{
+		"attach": "Attach to a shared session by id, Ctrl+] detaches",
+		"rw":     "Attach in read-write mode, input is sent to the remote shell (default is read-only). Needs the owner to have used connect --share-rw, or admin privileges",
+	}
+}
+
+func (s *sessions) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if !line.IsSet("attach") {
+		return s.list(user, tty)
+	}
+
+	id, err := line.GetArgString("attach")
+	if err != nil {
+		return err
+	}
+
+	shared, err := getSharedSession(id)
+	if err != nil {
+		return err
+	}
+
+	if !shared.accessible(user) {
+		return fmt.Errorf("session %q not found", id)
+	}
+
+	if shared.owner == user.Username() {
+		return errors.New("you cannot attach to your own session")
+	}
+
+	if line.IsSet("rw") {
+		if err := shared.writable(user); err != nil {
+			return err
+		}
+	}
+
+	sess, err := s.user.Session(s.session)
+	if err != nil {
+		return err
+	}
+
+	term, ok := tty.(*terminal.Terminal)
+	if !ok {
+		return errors.New("sessions --attach can only be called from the terminal")
+	}
+
+	viewer := &sessionViewer{
+		username:  user.Username(),
+		tty:       term,
+		readWrite: line.IsSet("rw"),
+	}
+
+	term.EnableRaw()
+	defer term.DisableRaw()
+
+	fmt.Fprintf(term, "Attached to %s on %s (%s) owned by %s, press Ctrl+] to detach\r\n", shared.id, shared.clientId, shared.hostname, shared.owner)
+
+	shared.addViewer(viewer)
+	defer shared.removeViewer(viewer)
+
+	s.log.Info("%s attached to shared session %s (read-write: %t)", user.Username(), shared.id, viewer.readWrite)
+
+	detach := make(chan bool)
+	go func() {
+		defer close(detach)
+
+		b := make([]byte, 1024)
+		for {
+			n, err := term.Read(b)
+			if err != nil {
+				return
+			}
+
+			select {
+			case <-shared.closed:
+				return
+			default:
+			}
+
+			for i := 0; i < n; i++ {
+				if b[i] == multiHotkey {
+					if viewer.readWrite && i > 0 {
+						shared.channel.Write(b[:i])
+					}
+					return
+				}
+			}
+
+			if viewer.readWrite {
+				shared.channel.Write(b[:n])
+			}
+		}
+	}()
+
+	for {
+		select {
+		case r := <-sess.ShellRequests:
+			if r == nil {
+				return errors.New("Session has terminated.")
+			}
+
+			// The owner governs the size of the remote pty, so just keep track of ours locally
+			if r.Type == "window-change" {
+				w, h := internal.ParseDims(r.Payload)
+				term.SetSize(int(w), int(h))
+				sess.Pty.Columns = w
+				sess.Pty.Rows = h
+			}
+
+			if r.WantReply {
+				r.Reply(r.Type == "window-change", nil)
+			}
+		case <-detach:
+			return errors.New("Detached from session.")
+		case <-shared.closed:
+			return errors.New("Shared session has terminated.")
+		}
+	}
+}
+
+func (s *sessions) list(user *users.User, tty io.ReadWriter) error {
+
+	sharedSessionsLck.RLock()
+	visible := []*sharedSession{}
+	for _, shared := range sharedSessions {
+		if shared.accessible(user) {
+			visible = append(visible, shared)
+		}
+	}
+	sharedSessionsLck.RUnlock()
+
+	if len(visible) == 0 {
+		return errors.New("No shared sessions")
+	}
+
+	sort.Slice(visible, func(i, j int) bool {
+		return visible[i].started.Before(visible[j].started)
+	})
+
+	t, _ := table.NewTable("Sessions", "ID", "Client", "Owner", "Viewers", "Started")
+	for _, shared := range visible {
+		shared.RLock()
+		viewers := ""
+		for v := range shared.viewers {
+			mode := "ro"
+			if v.readWrite {
+				mode = "rw"
+			}
+			viewers += fmt.Sprintf("%s (%s)\n", v.username, mode)
+		}
+		shared.RUnlock()
+
+		if viewers == "" {
+			viewers = "none"
+		}
+
+		t.AddValues(shared.id, fmt.Sprintf("%s\n%s", shared.clientId, shared.hostname), shared.owner, viewers, shared.started.Format("2006-01-02 15:04:05"))
+	}
+
+	t.Fprint(tty)
+
+	return nil
+}
+
+func (s *sessions) Expect(line terminal.ParsedLine) []string {
+	return nil
+}
+
+func (s *sessions) Help(explain bool) string {
+	const description = "List or attach to live connect sessions."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(s.ValidArgs(),
+		"sessions",
+		"sessions --attach <session id> [--rw]",
+		description,
+		"The session owner controls the window size and is notified when someone attaches.",
+		"Read-write attaching needs the owner to have connected with --share-rw, or admin privileges.",
+	)
+}
+
+func Sessions(session string, user *users.User, log logger.Logger) *sessions {
+	return &sessions{
+		session: session,
+		user:    user,
+		log:     log,
+	}
+}
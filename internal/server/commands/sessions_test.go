@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+)
+
+func TestSharedSessionWritable(t *testing.T) {
+	shared := &sharedSession{owner: "alice"}
+
+	err := shared.writable(&users.User{})
+	if err == nil || !strings.Contains(err.Error(), "--share-rw") {
+		t.Fatalf("expected read-write to need the owners consent, got %v", err)
+	}
+
+	shared.allowWrite = true
+	if err := shared.writable(&users.User{}); err != nil {
+		t.Fatalf("expected read-write to be allowed once the owner consents, got %v", err)
+	}
+}
+
+// recordingWriter passes writes on to a channel, so a test can see what a viewer was sent
+type recordingWriter chan []byte
+
+func (r recordingWriter) Write(b []byte) (int, error) {
+	r <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestSharedSessionSlowViewer(t *testing.T) {
+	var owner bytes.Buffer
+	shared := &sharedSession{
+		owner:    "alice",
+		ownerTty: &owner,
+		viewers:  make(map[*sessionViewer]bool),
+	}
+
+	// Never read from, so every write to it blocks
+	stuckReader, stuckWriter := io.Pipe()
+	defer stuckReader.Close()
+
+	stuck := &sessionViewer{username: "bob", tty: stuckWriter}
+	shared.addViewer(stuck)
+	defer shared.removeViewer(stuck)
+
+	watching := make(recordingWriter, viewerBacklog*2)
+	viewer := &sessionViewer{username: "carol", tty: watching}
+	shared.addViewer(viewer)
+	defer shared.removeViewer(viewer)
+
+	written := make(chan bool)
+	go func() {
+		defer close(written)
+		for i := 0; i < viewerBacklog*2; i++ {
+			shared.Write([]byte("x"))
+		}
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output to the owner was held up by a viewer that is not reading")
+	}
+
+	if !strings.HasSuffix(owner.String(), strings.Repeat("x", viewerBacklog*2)) {
+		t.Fatalf("owner did not get all the output: %q", owner.String())
+	}
+
+	select {
+	case b := <-watching:
+		if string(b) != "x" {
+			t.Fatalf("viewer got %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("viewer that is reading got no output")
+	}
+}
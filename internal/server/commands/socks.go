@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/NHAS/reverse_ssh/internal/server/socks"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+type socksCommand struct {
+	log logger.Logger
+}
+
+func (s *socksCommand) ValidArgs() map[string]string {
+	r := map[string]string{
+		"on":   "Address for the server to listen for socks on, e.g --on 127.0.0.1:1080",
+		"off":  "Stop the socks listener on address, e.g --off 127.0.0.1:1080",
+		"l":    "List socks listeners",
+		"auth": "Require socks clients to log in, e.g --auth username:password",
+	}
+
+	addDuplicateFlags("Client to make connections through, e.g -c <remote_id>", r, "client", "c")
+
+	return r
+}
+
+func (s *socksCommand) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	// Listeners on clients the user cannot see are left out, as if they did not exist
+	visible, err := user.SearchClients("*")
+	if err != nil {
+		return err
+	}
+
+	if line.IsSet("l") {
+		found := false
+		for _, l := range socks.All() {
+			if _, ok := visible[l.ClientID]; ok {
+				fmt.Fprintln(tty, l)
+				found = true
+			}
+		}
+
+		if !found {
+			fmt.Fprintln(tty, "No socks listeners")
+		}
+		return nil
+	}
+
+	offAddrs, err := line.GetArgsString("off")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	if len(offAddrs) > 0 {
+		for _, addr := range offAddrs {
+			l, ok := socks.Get(addr)
+			if ok {
+				_, ok = visible[l.ClientID]
+			}
+
+			if !ok {
+				fmt.Fprintf(tty, "no socks listener on %s\n", addr)
+				continue
+			}
+
+			if err := socks.Stop(l); err != nil {
+				fmt.Fprintf(tty, "error stopping socks listener %s: %s\n", l, err)
+				continue
+			}
+
+			fmt.Fprintf(tty, "stopped socks listener %s\n", l)
+		}
+		return nil
+	}
+
+	onAddrs, err := line.GetArgsString("on")
+	if err != nil {
+		return errors.New("no actionable argument supplied, please add --on, --off or -l (list)")
+	}
+
+	specifier, err := line.GetArgString("c")
+	if err != nil {
+		specifier, err = line.GetArgString("client")
+		if err != nil {
+			return errors.New("socks listeners need a client, e.g -c <remote_id>")
+		}
+	}
+
+	foundClients, err := user.SearchClients(specifier)
+	if err != nil {
+		return err
+	}
+
+	if len(foundClients) != 1 {
+		return fmt.Errorf("'%s' matches %d clients, a socks listener can only connect through one", specifier, len(foundClients))
+	}
+
+	credentials, err := line.GetArgString("auth")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	for id := range foundClients {
+		for _, addr := range onAddrs {
+			l, err := socks.Start(user, id, addr, credentials, s.log)
+			if err != nil {
+				fmt.Fprintf(tty, "error starting socks listener on %s: %s\n", addr, err)
+				continue
+			}
+
+			s.log.Info("%s started socks listener %s", user.Username(), l)
+			fmt.Fprintf(tty, "started socks listener %s\n", l)
+		}
+	}
+
+	return nil
+}
+
+func (s *socksCommand) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil {
+		switch line.Section.Value() {
+		case "c", "client":
+			return []string{autocomplete.RemoteId}
+		}
+	}
+
+	return nil
+}
+
+func (s *socksCommand) Help(explain bool) string {
+	const description = "Start a socks5 proxy on the server that connects through a client."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(s.ValidArgs(),
+		"socks -c <remote_id> --on <address> [--auth username:password]",
+		"socks -l",
+		"socks --off <address>",
+		description,
+		"Unlike ssh -D it supports UDP ASSOCIATE and BIND as well as CONNECT. The listener is closed when the client disconnects.",
+		"Every request is checked against the clients the user who started the listener can currently access.",
+	)
+}
+
+func Socks(log logger.Logger) *socksCommand {
+	return &socksCommand{
+		log: log,
+	}
+}
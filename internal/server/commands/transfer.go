@@ -0,0 +1,495 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type get struct {
+	datadir string
+}
+
+type put struct {
+	datadir string
+}
+
+func (g *get) ValidArgs() map[string]string {
+	return map[string]string{
+		"r":      "Recursively download directories",
+		"filter": "Download from every client matching the filter, each client gets its own folder",
+		"q":      "Do not show progress",
+	}
+}
+
+func (g *get) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	args := line.ArgumentsAsStrings()
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New(g.Help(false))
+	}
+
+	filter, remotePattern := args[0], args[1]
+
+	localDir := retrievedDir(g.datadir)
+	if len(args) == 3 {
+		var err error
+		localDir, err = insideDir(localDir, args[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	clients, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(clients) == 0 {
+		return fmt.Errorf("No clients matched '%s'", filter)
+	}
+
+	if len(clients) > 1 && !line.IsSet("filter") {
+		return fmt.Errorf("'%s' matches multiple clients, use --filter to download from all of them", filter)
+	}
+
+	for id, client := range clients {
+		dest := localDir
+		if line.IsSet("filter") {
+			dest = filepath.Join(localDir, id)
+		}
+
+		err := func() error {
+			sc, err := openSftp(client)
+			if err != nil {
+				return err
+			}
+			defer sc.Close()
+
+			matches, err := sc.Glob(remotePattern)
+			if err != nil {
+				return err
+			}
+
+			if len(matches) == 0 {
+				return fmt.Errorf("no files matched '%s'", remotePattern)
+			}
+
+			if err := os.MkdirAll(dest, 0700); err != nil {
+				return err
+			}
+
+			for _, match := range matches {
+				if err := g.download(sc, tty, match, dest, line); err != nil {
+					fmt.Fprintf(tty, "%s: %s\n", match, err)
+				}
+			}
+
+			return nil
+		}()
+		if err != nil {
+			fmt.Fprintf(tty, "%s (%s): %s\n", id, users.NormaliseHostname(client.User()), err)
+		}
+	}
+
+	return nil
+}
+
+func (g *get) download(sc *sftp.Client, tty io.Writer, remote, dest string, line terminal.ParsedLine) error {
+	info, err := sc.Stat(remote)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		// Glob results come from the client, so they cannot be trusted to name a file in dest
+		name := path.Base(remote)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("client returned an unsafe file name %q", name)
+		}
+
+		return fetchFile(sc, tty, remote, filepath.Join(dest, name), info.Size(), line.IsSet("q"))
+	}
+
+	if !line.IsSet("r") {
+		return errors.New("is a directory, use -r to download it")
+	}
+
+	root := path.Dir(path.Clean(remote))
+	walker := sc.Walk(remote)
+	for walker.Step() {
+		if walker.Err() != nil {
+			fmt.Fprintf(tty, "%s: %s\n", walker.Path(), walker.Err())
+			continue
+		}
+
+		// The paths are from the clients sftp server, a hostile one could return ../ to write anywhere on the server
+		rel := filepath.FromSlash(relativeTo(root, walker.Path()))
+		if !filepath.IsLocal(rel) {
+			fmt.Fprintf(tty, "%s: client returned an unsafe path, skipping\n", walker.Path())
+			if walker.Stat().IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		target := filepath.Join(dest, rel)
+
+		if walker.Stat().IsDir() {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !walker.Stat().Mode().IsRegular() {
+			continue
+		}
+
+		if err := fetchFile(sc, tty, walker.Path(), target, walker.Stat().Size(), line.IsSet("q")); err != nil {
+			fmt.Fprintf(tty, "%s: %s\n", walker.Path(), err)
+		}
+	}
+
+	return nil
+}
+
+func fetchFile(sc *sftp.Client, tty io.Writer, remote, local string, size int64, quiet bool) error {
+	src, err := sc.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(local, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return copyWithProgress(tty, dst, src, path.Base(remote), size, quiet)
+}
+
+func (g *get) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (g *get) Help(explain bool) string {
+	const description = "Download files from a client into the servers retrieved directory."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(g.ValidArgs(),
+		"get [OPTIONS] <remote_id> <remote path or glob> [local directory]",
+		"get --filter [OPTIONS] <glob pattern> <remote path or glob> [local directory]",
+		description,
+		"Local paths are relative to the retrieved directory in the data directory, which unlike downloads is not served to clients.",
+	)
+}
+
+func (p *put) ValidArgs() map[string]string {
+	return map[string]string{
+		"r": "Recursively upload directories",
+		"q": "Do not show progress",
+	}
+}
+
+func (p *put) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+	args := line.ArgumentsAsStrings()
+	if len(args) != 3 {
+		return errors.New(p.Help(false))
+	}
+
+	filter, localPattern, remote := args[0], args[1], args[2]
+
+	matches, err := globInside(downloadsDir(p.datadir), localPattern)
+	if err != nil {
+		return err
+	}
+
+	if len(matches) == 0 {
+		return fmt.Errorf("no files in the downloads directory matched '%s'", localPattern)
+	}
+
+	clients, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(clients) == 0 {
+		return fmt.Errorf("No clients matched '%s'", filter)
+	}
+
+	for id, client := range clients {
+		if len(clients) > 1 {
+			fmt.Fprintf(tty, "%s (%s):\n", id, users.NormaliseHostname(client.User()))
+		}
+
+		err := func() error {
+			sc, err := openSftp(client)
+			if err != nil {
+				return err
+			}
+			defer sc.Close()
+
+			// Multiple sources, or an existing directory means we put things inside it rather than naming the file
+			remoteIsDir := len(matches) > 1
+			if info, err := sc.Stat(remote); err == nil && info.IsDir() {
+				remoteIsDir = true
+			}
+
+			if remoteIsDir {
+				if err := sc.MkdirAll(remote); err != nil {
+					return err
+				}
+			}
+
+			for _, match := range matches {
+				target := remote
+				if remoteIsDir {
+					target = path.Join(remote, filepath.Base(match))
+				}
+
+				if err := p.upload(sc, tty, match, target, line); err != nil {
+					fmt.Fprintf(tty, "%s: %s\n", match, err)
+				}
+			}
+
+			return nil
+		}()
+		if err != nil {
+			fmt.Fprintf(tty, "%s (%s): %s\n", id, users.NormaliseHostname(client.User()), err)
+		}
+	}
+
+	return nil
+}
+
+func (p *put) upload(sc *sftp.Client, tty io.Writer, local, remote string, line terminal.ParsedLine) error {
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return sendFile(sc, tty, local, remote, info.Size(), line.IsSet("q"))
+	}
+
+	if !line.IsSet("r") {
+		return errors.New("is a directory, use -r to upload it")
+	}
+
+	return filepath.Walk(local, func(current string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Fprintf(tty, "%s: %s\n", current, err)
+			return nil
+		}
+
+		rel, err := filepath.Rel(local, current)
+		if err != nil {
+			return err
+		}
+
+		target := path.Join(remote, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return sc.MkdirAll(target)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if err := sendFile(sc, tty, current, target, info.Size(), line.IsSet("q")); err != nil {
+			fmt.Fprintf(tty, "%s: %s\n", current, err)
+		}
+		return nil
+	})
+}
+
+func sendFile(sc *sftp.Client, tty io.Writer, local, remote string, size int64, quiet bool) error {
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := sc.OpenFile(remote, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return copyWithProgress(tty, dst, src, filepath.Base(local), size, quiet)
+}
+
+func (p *put) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (p *put) Help(explain bool) string {
+	const description = "Upload files from the servers downloads directory to clients."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(p.ValidArgs(),
+		"put [OPTIONS] <remote_id or glob pattern> <local path or glob> <remote path>",
+		description,
+		"Local paths are relative to the downloads directory.",
+	)
+}
+
+func Get(datadir string) *get {
+	return &get{datadir: datadir}
+}
+
+func Put(datadir string) *put {
+	return &put{datadir: datadir}
+}
+
+func openSftp(client ssh.Conn) (*sftp.Client, error) {
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+
+	ok, err := ch.SendRequest("subsystem", true, ssh.Marshal(internal.ShellStruct{Cmd: "sftp"}))
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	if !ok {
+		ch.Close()
+		return nil, errors.New("client refused to start sftp")
+	}
+
+	return sftp.NewClientPipe(ch, ch)
+}
+
+// downloadsDir is what put uploads from, it is also served to clients
+func downloadsDir(datadir string) string {
+	return filepath.Join(datadir, "downloads")
+}
+
+// retrievedDir is where get stores files, it is kept apart from downloads so one client cannot fetch what was taken from another
+func retrievedDir(datadir string) string {
+	return filepath.Join(datadir, "retrieved")
+}
+
+// insideDir resolves a user supplied path inside base, refusing anything that would escape it
+func insideDir(base, p string) (string, error) {
+	full := filepath.Join(base, filepath.Clean("/"+p))
+
+	if full != base && !strings.HasPrefix(full, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("path '%s' is outside of the %s directory", p, filepath.Base(base))
+	}
+
+	return full, nil
+}
+
+// globInside expands a user supplied glob pattern inside base
+func globInside(base, pattern string) ([]string, error) {
+	full, err := insideDir(base, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return filepath.Glob(full)
+}
+
+// relativeTo returns p relative to the remote directory dir, or an empty path if p is not inside it
+func relativeTo(dir, p string) string {
+	if dir == "." {
+		return p
+	}
+
+	rel, ok := strings.CutPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+	if !ok {
+		return ""
+	}
+
+	return rel
+}
+
+type progress struct {
+	tty   io.Writer
+	name  string
+	total int64
+	done  int64
+	last  int
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	p.draw(false)
+	return len(b), nil
+}
+
+func (p *progress) draw(final bool) {
+	const width = 30
+
+	percent := 100
+	if p.total > 0 {
+		percent = int(p.done * 100 / p.total)
+	}
+
+	if percent == p.last && !final {
+		return
+	}
+	p.last = percent
+
+	filled := width * percent / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+
+	fmt.Fprintf(p.tty, "\r%s [%s] %3d%% %s/%s", p.name, bar, percent, humanBytes(p.done), humanBytes(p.total))
+	if final {
+		fmt.Fprint(p.tty, "\n")
+	}
+}
+
+func copyWithProgress(tty io.Writer, dst io.Writer, src io.Reader, name string, size int64, quiet bool) error {
+	if quiet {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	bar := &progress{tty: tty, name: name, total: size, last: -1}
+	_, err := io.Copy(io.MultiWriter(dst, bar), src)
+	bar.draw(true)
+
+	return err
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
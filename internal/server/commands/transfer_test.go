@@ -0,0 +1,303 @@
+package commands
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/pkg/sftp"
+)
+
+func TestInsideDir(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "retrieved")
+
+	for p, expected := range map[string]string{
+		"":                  base,
+		".":                 base,
+		"loot":              filepath.Join(base, "loot"),
+		"loot/../other":     filepath.Join(base, "other"),
+		"..":                base,
+		"../downloads":      filepath.Join(base, "downloads"),
+		"loot/../../../etc": filepath.Join(base, "etc"),
+		"/etc/passwd":       filepath.Join(base, "etc", "passwd"),
+		"//etc":             filepath.Join(base, "etc"),
+	} {
+		full, err := insideDir(base, p)
+		if err != nil {
+			t.Errorf("%q: %s", p, err)
+			continue
+		}
+
+		if full != expected {
+			t.Errorf("%q: expected %q got %q", p, expected, full)
+		}
+	}
+}
+
+func TestGlobInside(t *testing.T) {
+	datadir := t.TempDir()
+	downloads := downloadsDir(datadir)
+
+	for _, f := range []string{
+		filepath.Join(downloads, "implant"),
+		filepath.Join(downloads, "tools", "nmap"),
+		filepath.Join(datadir, "secret"),
+		filepath.Join(retrievedDir(datadir), "passwd"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for pattern, expected := range map[string][]string{
+		"implant":                   {"implant"},
+		"*":                         {"implant", "tools"},
+		"tools/*":                   {"tools/nmap"},
+		"../*":                      {"implant", "tools"},
+		"../secret":                 nil,
+		"../retrieved/*":            nil,
+		"*/../../*":                 {"implant", "tools"},
+		".?/secret":                 nil,
+		"[.][.]/secret":             nil,
+		"*/[.][.]/../secret":        nil,
+		filepath.Join(datadir, "*"): nil,
+	} {
+		matches, err := globInside(downloads, pattern)
+		if err != nil {
+			t.Errorf("%q: %s", pattern, err)
+			continue
+		}
+
+		var rel []string
+		for _, m := range matches {
+			r, err := filepath.Rel(downloads, m)
+			if err != nil || !filepath.IsLocal(r) {
+				t.Errorf("%q: matched %q outside of the downloads directory", pattern, m)
+				continue
+			}
+			rel = append(rel, filepath.ToSlash(r))
+		}
+
+		if strings.Join(rel, ",") != strings.Join(expected, ",") {
+			t.Errorf("%q: expected %v got %v", pattern, expected, rel)
+		}
+	}
+}
+
+func TestRelativeTo(t *testing.T) {
+	for _, c := range []struct {
+		dir, p   string
+		expected string
+	}{
+		{"/srv", "/srv/loot", "loot"},
+		{"/srv", "/srv/loot/a", "loot/a"},
+		{"/", "/etc/passwd", "etc/passwd"},
+		{".", "loot/a", "loot/a"},
+		{".", ".hidden/a", ".hidden/a"},
+		{".", "../a", "../a"},
+		{"/srv", "/srv", ""},
+		{"/srv", "/srvx/a", ""},
+		{"/srv", "/etc/passwd", ""},
+	} {
+		if rel := relativeTo(c.dir, c.p); rel != c.expected {
+			t.Errorf("%q in %q: expected %q got %q", c.p, c.dir, c.expected, rel)
+		}
+	}
+}
+
+// hostileInfo describes an entry on the hostile sftp server, its name can be anything the server likes
+type hostileInfo struct {
+	name string
+	dir  bool
+}
+
+func (i hostileInfo) Name() string       { return i.name }
+func (i hostileInfo) Size() int64        { return 1 }
+func (i hostileInfo) ModTime() time.Time { return time.Time{} }
+func (i hostileInfo) IsDir() bool        { return i.dir }
+func (i hostileInfo) Sys() any           { return nil }
+
+func (i hostileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+type hostileLister []os.FileInfo
+
+func (l hostileLister) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(out, l[offset:])
+	if int(offset)+n == len(l) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// hostileServer is a clients sftp server that lists file names trying to escape the directory they are downloaded to
+type hostileServer struct {
+	// Paths as the server sees them, which are absolute
+	dirs map[string][]os.FileInfo
+}
+
+func (h *hostileServer) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return strings.NewReader("x"), nil
+}
+
+func (h *hostileServer) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return nil, errors.New("read only")
+}
+
+func (h *hostileServer) Filecmd(r *sftp.Request) error {
+	return errors.New("read only")
+}
+
+func (h *hostileServer) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	entries, isDir := h.dirs[r.Filepath]
+
+	switch r.Method {
+	case "List":
+		return hostileLister(entries), nil
+	case "Stat", "Lstat":
+		// Anything that is not a directory is a file, including .. and /
+		return hostileLister{hostileInfo{name: filepath.Base(r.Filepath), dir: isDir}}, nil
+	}
+
+	return nil, errors.New("unsupported")
+}
+
+func hostileSftp(t *testing.T) *sftp.Client {
+	t.Helper()
+
+	h := &hostileServer{
+		dirs: map[string][]os.FileInfo{
+			"/loot": {
+				hostileInfo{name: "ok.txt"},
+				hostileInfo{name: "../../escape.txt"},
+				hostileInfo{name: "..", dir: true},
+				hostileInfo{name: "sub", dir: true},
+			},
+			"/loot/sub": {
+				hostileInfo{name: "nested.txt"},
+				hostileInfo{name: "../../../../deep.txt"},
+			},
+			"/srv": {
+				hostileInfo{name: "loot", dir: true},
+			},
+			"/srv/loot": {
+				hostileInfo{name: "ok.txt"},
+				hostileInfo{name: "../../../tmp/escape.txt"},
+			},
+		},
+	}
+
+	server, client := net.Pipe()
+
+	rs := sftp.NewRequestServer(server, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+	go rs.Serve()
+	t.Cleanup(func() { rs.Close() })
+
+	sc, err := sftp.NewClientPipe(client, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sc.Close() })
+
+	return sc
+}
+
+// written lists every file under dir
+func written(t *testing.T, dir string) (files []string) {
+	t.Helper()
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(files)
+	return files
+}
+
+func TestDownloadUnsafePaths(t *testing.T) {
+	sc := hostileSftp(t)
+	g := &get{}
+	line := terminal.ParseLine("get -r -q", 0)
+
+	for _, c := range []struct {
+		remote   string
+		expected []string
+	}{
+		// The sftp client drops . and .. from listings and keeps only the last element of other names
+		{"loot", []string{"loot/escape.txt", "loot/ok.txt", "loot/sub/deep.txt", "loot/sub/nested.txt"}},
+		{"/srv/loot", []string{"loot/escape.txt", "loot/ok.txt"}},
+	} {
+		// Everything written, anywhere, is seen by walking the parent of the destination
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "retrieved")
+		if err := os.Mkdir(dest, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		var tty strings.Builder
+		if err := g.download(sc, &tty, c.remote, dest, line); err != nil {
+			t.Fatalf("%s: %s", c.remote, err)
+		}
+
+		var expected []string
+		for _, e := range c.expected {
+			expected = append(expected, "retrieved/"+e)
+		}
+
+		if files := written(t, parent); strings.Join(files, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v to be written, got %v", c.remote, expected, files)
+		}
+	}
+
+	// A single file has to be named by the client, which could name it after a directory
+	for _, remote := range []string{"..", "/", "loot/.."} {
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "retrieved")
+		if err := os.Mkdir(dest, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		var tty strings.Builder
+		err := g.download(sc, &tty, remote, dest, line)
+		if err == nil || !strings.Contains(err.Error(), "unsafe file name") {
+			t.Errorf("%q: expected the file name to be refused, got %v", remote, err)
+		}
+
+		if files := written(t, parent); len(files) != 0 {
+			t.Errorf("%q: files were written %v", remote, files)
+		}
+	}
+}
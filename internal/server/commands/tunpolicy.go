@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+)
+
+type tunPolicy struct {
+}
+
+func (t *tunPolicy) ValidArgs() map[string]string {
+	return map[string]string{
+		"policy": "The tun policy to set, e.g allow=10.0.0.0/8,deny=10.0.0.1,port=22,port=8000-9000,proto=tcp,max-flows=100",
+		"clear":  "Remove the policy set by the server, any policy baked into the client still applies",
+	}
+}
+
+func (t *tunPolicy) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	filter, ok := trailingFilter(line, "policy")
+	if !ok {
+		return errors.New(t.Help(false))
+	}
+
+	var policy internal.TunPolicy
+	if !line.IsSet("clear") {
+		policyString, err := line.GetArgString("policy")
+		if err != nil {
+			return errors.New("missing --policy or --clear")
+		}
+
+		policy, err = internal.ParseTunPolicy(policyString)
+		if err != nil {
+			return err
+		}
+
+		if policy.IsZero() {
+			return errors.New("policy is empty, use --clear to remove it")
+		}
+	} else if line.IsSet("policy") {
+		return errors.New("--policy and --clear cannot be used together")
+	}
+
+	connections, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(connections) == 0 {
+		return fmt.Errorf("No clients matched '%s'", filter)
+	}
+
+	for id, serverConn := range connections {
+		ok, response, err := serverConn.SendRequest("tun-policy", true, []byte(policy.String()))
+		if err != nil {
+			fmt.Fprintf(tty, "%s failed: %s\n", id, err)
+			continue
+		}
+
+		if !ok {
+			if len(response) == 0 {
+				response = []byte("client does not support tun policies (may be outdated)")
+			}
+			fmt.Fprintf(tty, "%s failed: %s\n", id, response)
+			continue
+		}
+
+		if policy.IsZero() {
+			fmt.Fprintf(tty, "%s tun policy cleared\n", id)
+			continue
+		}
+
+		fmt.Fprintf(tty, "%s tun policy set to %s\n", id, policy)
+	}
+
+	return nil
+}
+
+func (t *tunPolicy) Expect(line terminal.ParsedLine) []string {
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (t *tunPolicy) Help(explain bool) string {
+	const description = "Limit where clients forward traffic sent into tun sessions."
+	if explain {
+		return description
+	}
+
+	return terminal.MakeHelpText(t.ValidArgs(),
+		"tun-policy --policy <policy> <remote_id or glob pattern>",
+		"tun-policy --clear <remote_id or glob pattern>",
+		description,
+		"Denied ranges win over allowed ones, and ports only apply to tcp and udp. The policy applies to tunnels that are already open, bridged tunnels are closed as their frames cannot be filtered.",
+		"Clients enforce both this and any policy baked in with link --tun-policy, so a baked in policy cannot be loosened.",
+	)
+}
@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+)
+
+func TestTunPolicyArguments(t *testing.T) {
+	p := &tunPolicy{}
+
+	for line, expected := range map[string]string{
+		"tun-policy --policy allow=10.0.0.0/8 nosuchclient": "No clients matched 'nosuchclient'",
+		"tun-policy --clear nosuchclient":                   "No clients matched 'nosuchclient'",
+		"tun-policy --policy allow=10.0.0.0/8":              p.Help(false),
+		"tun-policy nosuchclient":                           "missing --policy or --clear",
+	} {
+		var tty bytes.Buffer
+		err := p.Run(&users.User{}, &tty, terminal.ParseLine(line, 0))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: expected %q got %v", line, expected, err)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/updates"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/internal/server/webserver"
+	"github.com/NHAS/reverse_ssh/internal/terminal"
+	"github.com/NHAS/reverse_ssh/internal/terminal/autocomplete"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultUpdateTimeout = 2 * time.Minute
+
+type update struct {
+	log logger.Logger
+}
+
+func (u *update) ValidArgs() map[string]string {
+	return map[string]string{
+		"use":     "Send an existing link (by name) instead of building a new client, it must have the same owners and restrictions as the client",
+		"cached":  "Send the newest existing link that matches each clients platform, owners and restrictions, building one if there isnt any",
+		"timeout": "Seconds to wait for the new client to connect before the old one rolls back (default 120)",
+	}
+}
+
+// updateBinary is a client executable from the link cache
+type updateBinary struct {
+	name, path, version string
+
+	settings clientSettings
+}
+
+// clientSettings are what a replacement client has to keep, so an update can never lift the owners or restrictions of the client it replaces
+type clientSettings struct {
+	owners    string
+	disabled  string
+	tunPolicy string
+}
+
+func (c clientSettings) String() string {
+	return fmt.Sprintf("owners: %q, disabled: %q, tun policy: %q", c.owners, c.disabled, c.tunPolicy)
+}
+
+// runningSettings are the settings of a connected client, from what it reported about itself
+func runningSettings(conn *ssh.ServerConn, info internal.ClientInfo) clientSettings {
+	return clientSettings{
+		owners:    normaliseList(conn.Permissions.Extensions["owners"]),
+		disabled:  normaliseList(strings.Join(info.Disabled, ",")),
+		tunPolicy: normaliseTunPolicy(info.TunPolicy),
+	}
+}
+
+// linkSettings are the settings a link was built with
+func linkSettings(download data.Download) clientSettings {
+	return clientSettings{
+		owners:    normaliseList(download.Owners),
+		disabled:  normaliseList(download.Disabled),
+		tunPolicy: normaliseTunPolicy(download.TunPolicy),
+	}
+}
+
+func normaliseList(list string) string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" && !slices.Contains(items, item) {
+			items = append(items, item)
+		}
+	}
+	sort.Strings(items)
+
+	return strings.Join(items, ",")
+}
+
+func normaliseTunPolicy(policy string) string {
+	parsed, err := internal.ParseTunPolicy(policy)
+	if err != nil {
+		return policy
+	}
+
+	return parsed.String()
+}
+
+func (u *update) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLine) error {
+
+	if user.Privilege() != users.AdminPermissions {
+		return errors.New("only admins can update clients")
+	}
+
+	filter, ok := trailingFilter(line, "use", "timeout")
+	if !ok {
+		return errors.New(u.Help(false))
+	}
+
+	timeout := defaultUpdateTimeout
+	timeoutString, err := line.GetArgString("timeout")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	if timeoutString != "" {
+		seconds, err := strconv.Atoi(timeoutString)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("invalid timeout %q, expected a number of seconds", timeoutString)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	use, err := line.GetArgString("use")
+	if err != nil && err != terminal.ErrFlagNotSet {
+		return err
+	}
+
+	connections, err := user.SearchClients(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(connections) == 0 {
+		return fmt.Errorf("No clients matched '%s'", filter)
+	}
+
+	ids := []string{}
+	for id := range connections {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Clients with the same platform and settings get the same build
+	built := map[string]updateBinary{}
+
+	outcomes := map[string]<-chan error{}
+	for _, id := range ids {
+		conn := connections[id]
+
+		goos, goarch, err := clientPlatform(id, conn)
+		if err != nil {
+			fmt.Fprintf(tty, "%s: %s\n", id, err)
+			continue
+		}
+
+		info, reported := users.GetClientInfo(id)
+		running := runningSettings(conn, info)
+
+		var binary updateBinary
+		switch {
+		case use != "":
+			binary, err = namedLink(use, goos, goarch)
+			if err == nil && binary.settings != running {
+				err = fmt.Errorf("link %q was built with different settings (%s) to the client (%s)", use, binary.settings, running)
+			}
+		case line.IsSet("cached"):
+			binary, err = newestLink(goos, goarch, running)
+			if err == nil {
+				break
+			}
+			fallthrough
+		default:
+			config := replacementConfig(goos, goarch, conn, info, reported)
+
+			key := strings.Join([]string{goos, goarch, fmt.Sprintf("%+v", config)}, "|")
+
+			var ok bool
+			binary, ok = built[key]
+			if !ok {
+				fmt.Fprintf(tty, "%s: building client for %s/%s\n", id, goos, goarch)
+
+				binary, err = buildUpdate(config)
+				if err == nil {
+					built[key] = binary
+				}
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(tty, "%s: %s\n", id, err)
+			continue
+		}
+
+		outcome, err := updates.Send(id, conn, binary.path, binary.version, timeout)
+		if err != nil {
+			u.log.Warning("Unable to update %s: %s", id, err)
+			fmt.Fprintf(tty, "%s: %s\n", id, err)
+			continue
+		}
+
+		fmt.Fprintf(tty, "%s: started %s (%s), waiting for it to connect\n", id, binary.version, binary.name)
+		outcomes[id] = outcome
+	}
+
+	for _, id := range ids {
+		outcome, ok := outcomes[id]
+		if !ok {
+			continue
+		}
+
+		if err := <-outcome; err != nil {
+			fmt.Fprintf(tty, "%s: %s\n", id, err)
+			continue
+		}
+
+		fmt.Fprintf(tty, "%s: updated\n", id)
+	}
+
+	return nil
+}
+
+// clientPlatform uses the system information the client sent, or for older clients the platform in their version string (SSH-<version>-<goos>_<goarch>)
+func clientPlatform(id string, conn *ssh.ServerConn) (goos, goarch string, err error) {
+	if info, ok := users.GetClientInfo(id); ok && info.GoOS != "" && info.GoArch != "" {
+		return info.GoOS, info.GoArch, nil
+	}
+
+	version := string(conn.ClientVersion())
+	platform := version[strings.LastIndex(version, "-")+1:]
+
+	goos, goarch, ok := strings.Cut(platform, "_")
+	if !ok || goos == "" || goarch == "" {
+		return "", "", fmt.Errorf("unable to determine platform from client version %q", version)
+	}
+
+	return goos, goarch, nil
+}
+
+func namedLink(name, goos, goarch string) (updateBinary, error) {
+	download, err := data.GetDownload(name)
+	if err != nil {
+		return updateBinary{}, fmt.Errorf("no link named %q", name)
+	}
+
+	if download.FileType != "executable" {
+		return updateBinary{}, fmt.Errorf("link %q is a %s, not an executable", name, download.FileType)
+	}
+
+	if download.Goos != goos || download.Goarch != goarch {
+		return updateBinary{}, fmt.Errorf("link %q is for %s/%s, client is %s/%s", name, download.Goos, download.Goarch, goos, goarch)
+	}
+
+	return updateBinary{name: download.UrlPath, path: download.FilePath, version: strings.TrimSpace(download.Version), settings: linkSettings(download)}, nil
+}
+
+// newestLink finds the most recent executable for the platform that was built with the same settings as the client
+func newestLink(goos, goarch string, running clientSettings) (updateBinary, error) {
+	downloads, err := data.ListDownloads("")
+	if err != nil {
+		return updateBinary{}, err
+	}
+
+	var newest *data.Download
+	for _, download := range downloads {
+		if download.FileType != "executable" || download.Goos != goos || download.Goarch != goarch || linkSettings(download) != running {
+			continue
+		}
+
+		if newest == nil || download.CreatedAt.After(newest.CreatedAt) {
+			d := download
+			newest = &d
+		}
+	}
+
+	if newest == nil {
+		return updateBinary{}, fmt.Errorf("no cached link for %s/%s with the same settings as the client (%s)", goos, goarch, running)
+	}
+
+	return updateBinary{name: newest.UrlPath, path: newest.FilePath, version: strings.TrimSpace(newest.Version), settings: linkSettings(*newest)}, nil
+}
+
+// replacementConfig is the build for a client that replaces conn. If the server built the client its settings are kept (destinations, proxy, tls verification and so on),
+// otherwise it connects back to the default address. Either way it gets the owners and comment of the client, and every restriction the client reported
+func replacementConfig(goos, goarch string, conn *ssh.ServerConn, info internal.ClientInfo, reported bool) webserver.BuildConfig {
+	config := webserver.BuildConfig{
+		ConnectBackAdress: webserver.DefaultConnectBack,
+		LogLevel:          logger.UrgencyToStr(logger.GetLogLevel()),
+	}
+
+	if original, err := data.GetDownloadByKey(conn.Permissions.Extensions["pubkey-fp"]); err == nil {
+		config = webserver.ConfigOf(original)
+	}
+
+	config.GOOS = goos
+	config.GOARCH = goarch
+	if config.GOARCH != "arm" {
+		config.GOARM = ""
+	}
+
+	config.Owners = conn.Permissions.Extensions["owners"]
+	config.Comment = conn.Permissions.Extensions["comment"]
+
+	// What the client reports covers restrictions from its config file, environment and arguments as well as the ones baked in
+	config.Disabled = normaliseList(config.Disabled + "," + strings.Join(info.Disabled, ","))
+	if reported {
+		config.TunPolicy = info.TunPolicy
+	}
+
+	return config
+}
+
+// buildUpdate builds a client from config, under a random link name
+func buildUpdate(config webserver.BuildConfig) (updateBinary, error) {
+	name, err := internal.RandomString(16)
+	if err != nil {
+		return updateBinary{}, err
+	}
+	config.Name = name
+
+	_, err = webserver.Build(config)
+	if err != nil {
+		return updateBinary{}, err
+	}
+
+	return namedLink(name, config.GOOS, config.GOARCH)
+}
+
+func (u *update) Expect(line terminal.ParsedLine) []string {
+	if line.Section != nil && line.Section.Value() == "use" {
+		return []string{autocomplete.WebServerFileIds}
+	}
+
+	if len(line.Arguments) <= 1 {
+		return []string{autocomplete.RemoteId}
+	}
+	return nil
+}
+
+func (u *update) Help(explain bool) string {
+	if explain {
+		return "Replace running clients with a new build."
+	}
+
+	return terminal.MakeHelpText(u.ValidArgs(),
+		"update [OPTIONS] <remote_id>",
+		"update [OPTIONS] <glob pattern>",
+		"Sends each client a binary for its platform, signed by the server key. The client starts it with the same arguments,",
+		"and exits once the new client has connected. If it doesnt connect within the timeout the old client restores itself.",
+		"New builds keep the settings of the link the client was built from, or connect back to the default address for clients the server didnt build.",
+		"Owners, disabled capabilities and the tun policy are always kept, and --use or --cached links with different ones are refused.",
+	)
+}
+
+func Update(log logger.Logger) *update {
+	return &update{
+		log: log,
+	}
+}
@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/webserver"
+	"golang.org/x/crypto/ssh"
+)
+
+func loadTestDatabase(t *testing.T) {
+	t.Helper()
+
+	if err := data.LoadDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addTestLink(t *testing.T, download data.Download, age time.Duration) {
+	t.Helper()
+
+	download.Goos = "linux"
+	download.Goarch = "amd64"
+	download.FileType = "executable"
+	download.FilePath = "/nonexistent/" + download.UrlPath
+	download.CreatedAt = time.Now().Add(-age)
+
+	if err := data.CreateDownload(download); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testClientConn(fingerprint, owners string) *ssh.ServerConn {
+	return &ssh.ServerConn{Permissions: &ssh.Permissions{Extensions: map[string]string{
+		"pubkey-fp": fingerprint,
+		"owners":    owners,
+		"comment":   "test client",
+	}}}
+}
+
+func TestUpdateLinkSelection(t *testing.T) {
+	loadTestDatabase(t)
+
+	addTestLink(t, data.Download{UrlPath: "old-open"}, 3*time.Hour)
+	addTestLink(t, data.Download{UrlPath: "restricted", Owners: "alice", Disabled: "tun,socks", TunPolicy: "allow=10.0.0.0/8"}, 2*time.Hour)
+	addTestLink(t, data.Download{UrlPath: "newest-open"}, time.Hour)
+
+	restricted := runningSettings(testClientConn("", "alice"), internal.ClientInfo{Disabled: []string{"socks", "tun"}, TunPolicy: "allow=10.0.0.0/8"})
+
+	// The newest link is not restricted, so it cannot replace the restricted client
+	binary, err := newestLink("linux", "amd64", restricted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.name != "restricted" {
+		t.Fatalf("expected the link with the same restrictions to be picked, got %s", binary.name)
+	}
+
+	binary, err = newestLink("linux", "amd64", runningSettings(testClientConn("", ""), internal.ClientInfo{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.name != "newest-open" {
+		t.Fatalf("expected the newest unrestricted link for an unrestricted client, got %s", binary.name)
+	}
+
+	for _, settings := range []clientSettings{
+		runningSettings(testClientConn("", "alice"), internal.ClientInfo{Disabled: []string{"tun"}, TunPolicy: "allow=10.0.0.0/8"}),
+		runningSettings(testClientConn("", "alice"), internal.ClientInfo{Disabled: []string{"socks", "tun"}}),
+		runningSettings(testClientConn("", "bob"), internal.ClientInfo{Disabled: []string{"socks", "tun"}, TunPolicy: "allow=10.0.0.0/8"}),
+	} {
+		if binary, err := newestLink("linux", "amd64", settings); err == nil {
+			t.Errorf("expected no link for a client with %s, got %s", settings, binary.name)
+		}
+	}
+
+	if _, err := newestLink("windows", "amd64", restricted); err == nil {
+		t.Error("expected no link for a platform nothing was built for")
+	}
+
+	// --use checks the same settings
+	binary, err = namedLink("newest-open", "linux", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.settings == restricted {
+		t.Fatal("expected an unrestricted link to have different settings to a restricted client")
+	}
+
+	if _, err := namedLink("newest-open", "linux", "arm64"); err == nil {
+		t.Error("expected a link for another platform to be refused")
+	}
+}
+
+func TestUpdateReplacementConfig(t *testing.T) {
+	loadTestDatabase(t)
+
+	webserver.DefaultConnectBack = "rssh.example.com:3232"
+
+	addTestLink(t, data.Download{
+		UrlPath:         "original",
+		KeyFingerprint:  "original-fp",
+		CallbackAddress: "tls://rssh.example.com:443,rssh.example.com:2222",
+		Owners:          "alice",
+		Disabled:        "exec",
+		TunPolicy:       "allow=10.0.0.0/8",
+		Proxy:           "http://proxy.internal:8080",
+		TLSVerify:       "system",
+		Failback:        "5m",
+		ReconnectPolicy: "initial=5s,max=1m",
+	}, time.Hour)
+
+	// Restrictions from the clients arguments are on top of the ones baked in
+	config := replacementConfig("linux", "amd64", testClientConn("original-fp", "alice"), internal.ClientInfo{Disabled: []string{"tun", "exec"}, TunPolicy: "allow=10.0.0.0/8,proto=tcp"}, true)
+
+	if config.ConnectBackAdress != "tls://rssh.example.com:443,rssh.example.com:2222" || config.Proxy != "http://proxy.internal:8080" ||
+		config.TLSVerify != "system" || config.Failback != "5m" || config.ReconnectPolicy != "initial=5s,max=1m" {
+		t.Fatalf("expected the settings of the original build to be kept, got %+v", config)
+	}
+
+	if config.Disabled != "exec,tun" {
+		t.Fatalf("expected the baked and reported disabled capabilities, got %q", config.Disabled)
+	}
+
+	if config.TunPolicy != "allow=10.0.0.0/8,proto=tcp" {
+		t.Fatalf("expected the reported tun policy, got %q", config.TunPolicy)
+	}
+
+	if config.Owners != "alice" || config.Comment != "test client" {
+		t.Fatalf("expected the owners and comment of the client, got %q and %q", config.Owners, config.Comment)
+	}
+
+	// Older clients dont report anything, so the baked settings are all there is
+	config = replacementConfig("linux", "amd64", testClientConn("original-fp", "alice"), internal.ClientInfo{}, false)
+	if config.Disabled != "exec" || config.TunPolicy != "allow=10.0.0.0/8" {
+		t.Fatalf("expected the baked restrictions for a client that reported nothing, got %q and %q", config.Disabled, config.TunPolicy)
+	}
+
+	// A client the server didnt build
+	config = replacementConfig("windows", "arm64", testClientConn("unknown-fp", ""), internal.ClientInfo{Disabled: []string{"socks"}}, true)
+	if config.ConnectBackAdress != "rssh.example.com:3232" || config.Proxy != "" {
+		t.Fatalf("expected a client the server didnt build to connect back to the default address, got %+v", config)
+	}
+
+	if config.Disabled != "socks" || config.GOOS != "windows" || config.GOARCH != "arm64" {
+		t.Fatalf("expected the reported restrictions and platform, got %+v", config)
+	}
+
+	if !strings.Contains(linkSettings(data.Download{Disabled: "tun, exec"}).disabled, "exec,tun") {
+		t.Fatal("expected link settings to be normalised")
+	}
+}
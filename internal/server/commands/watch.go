@@ -122,6 +122,10 @@ func (w *watch) Run(user *users.User, tty io.ReadWriter, line terminal.ParsedLin
 	messages := make(chan string)
 
 	observerId := observers.ConnectionState.Register(func(c observers.ClientState) {
+		// System information reported after connecting is not a change in connection state
+		if c.Status == "info" {
+			return
+		}
 
 		var arrowDirection = "<-"
 		if c.Status == "disconnected" {
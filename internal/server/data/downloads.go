@@ -27,6 +27,24 @@ type Download struct {
 
 	// Where to download the file to
 	WorkingDirectory string
+
+	// SHA1 hex fingerprint of the key built into a client, the same as the pubkey-fp of the client when it connects
+	KeyFingerprint string
+
+	// The settings a client was built with, so update can build a replacement that keeps them
+	Owners          string
+	Comment         string
+	Disabled        string
+	TunPolicy       string
+	Fingerprint     string
+	HostCA          string
+	Proxy           string
+	SNI             string
+	NTLMProxyCreds  string
+	UseKerberos     bool
+	Failback        string
+	ReconnectPolicy string
+	TLSVerify       string
 }
 
 func CreateDownload(file Download) error {
@@ -47,6 +65,14 @@ func GetDownload(urlPath string) (Download, error) {
 	return download, nil
 }
 
+// GetDownloadByKey finds the client that was built with the key that has the SHA1 hex fingerprint, without counting it as a download
+func GetDownloadByKey(fingerprint string) (Download, error) {
+	var download Download
+	err := db.Where("key_fingerprint = ? AND key_fingerprint != ''", fingerprint).First(&download).Error
+
+	return download, err
+}
+
 func ListDownloads(filter string) (matchingFiles map[string]Download, err error) {
 	_, err = filepath.Match(filter, "")
 	if err != nil {
@@ -2,9 +2,7 @@ package handlers
 
 import (
 	"errors"
-	"fmt"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
@@ -14,15 +12,10 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-var (
-	currentRemoteForwardsLck sync.RWMutex
-	currentRemoteForwards    = map[string]string{}
-	remoteForwards           = map[string]ssh.Channel{}
-)
-
 type chanConn struct {
-	channel ssh.Channel
-	drtMsg  internal.ChannelOpenDirectMsg
+	channel  ssh.Channel
+	drtMsg   internal.ChannelOpenDirectMsg
+	clientId string
 }
 
 func (c *chanConn) Read(b []byte) (n int, err error) {
@@ -37,17 +30,22 @@ func (c *chanConn) Close() error {
 	return c.channel.Close()
 }
 
+// The address that was connected to on the client
 func (c *chanConn) LocalAddr() net.Addr {
 	return &net.TCPAddr{
-		IP:   net.ParseIP(c.drtMsg.Laddr),
-		Port: int(c.drtMsg.Lport),
+		IP:   net.ParseIP(c.drtMsg.Raddr),
+		Port: int(c.drtMsg.Rport),
 	}
 }
 
+// Who connected to the client
 func (c *chanConn) RemoteAddr() net.Addr {
-	return &net.TCPAddr{
-		IP:   net.ParseIP(c.drtMsg.Raddr),
-		Port: int(c.drtMsg.Rport),
+	return &multiplexer.RelayAddr{
+		TCPAddr: net.TCPAddr{
+			IP:   net.ParseIP(c.drtMsg.Laddr),
+			Port: int(c.drtMsg.Lport),
+		},
+		Via: c.clientId,
 	}
 }
 
@@ -65,9 +63,9 @@ func (c *chanConn) SetWriteDeadline(t time.Time) error {
 
 }
 
-func channelToConn(channel ssh.Channel, drtMsg internal.ChannelOpenDirectMsg) net.Conn {
+func channelToConn(channel ssh.Channel, drtMsg internal.ChannelOpenDirectMsg, clientId string) net.Conn {
 
-	return &chanConn{channel, drtMsg}
+	return &chanConn{channel, drtMsg, clientId}
 }
 
 func ServerPortForward(clientId string) func(_ string, _ *users.User, newChannel ssh.NewChannel, log logger.Logger) {
@@ -89,34 +87,13 @@ func ServerPortForward(clientId string) func(_ string, _ *users.User, newChannel
 			return
 		}
 
-		go func() {
-			for req := range requests {
-				if req.WantReply {
-					req.Reply(false, nil)
-				}
-			}
-
-			StopRemoteForward(clientId)
-		}()
-
-		currentRemoteForwardsLck.Lock()
-		remoteForwards[clientId] = connection
-		currentRemoteForwards[clientId] = fmt.Sprintf("%s:%d", drtMsg.Raddr, drtMsg.Rport)
-		currentRemoteForwardsLck.Unlock()
+		go ssh.DiscardRequests(requests)
 
-		multiplexer.ServerMultiplexer.QueueConn(channelToConn(connection, drtMsg))
-
-	}
-}
-
-func StopRemoteForward(clientId string) {
-	currentRemoteForwardsLck.Lock()
-	defer currentRemoteForwardsLck.Unlock()
-
-	if remoteForwards[clientId] != nil {
-		remoteForwards[clientId].Close()
+		// The connection is treated as if it was made to the server directly, so a client can relay other clients to the server
+		err = multiplexer.ServerMultiplexer.QueueConn(channelToConn(connection, drtMsg, clientId))
+		if err != nil {
+			log.Warning("Unable to relay connection from %s:%d through %s: %s", drtMsg.Laddr, drtMsg.Lport, clientId, err)
+			connection.Close()
+		}
 	}
-
-	delete(remoteForwards, clientId)
-	delete(currentRemoteForwards, clientId)
 }
@@ -58,7 +58,7 @@ func LocalForward(_ string, user *users.User, newChannel ssh.NewChannel, log log
 		break
 	}
 
-	targetConnection, targetRequests, err := target.OpenChannel("jump", nil)
+	targetConnection, targetRequests, err := target.OpenChannel("jump", ssh.Marshal(&internal.JumpInfo{Owner: user.Username()}))
 	if err != nil {
 		newChannel.Reject(ssh.ConnectionFailed, err.Error())
 		return
@@ -1,69 +1,194 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/forwards"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"golang.org/x/crypto/ssh"
 )
 
+var (
+	proxyListenersLck sync.Mutex
+	// Open ports for each proxy key by fingerprint, as the limit applies across all of a keys connections
+	proxyListeners = map[string]int{}
+)
+
+// checkProxyListen enforces the permitlisten and max-listeners options of a proxy key, and takes a listener from its allowance
+func checkProxyListen(perms *ssh.Permissions, port uint32) error {
+	if port > 65535 {
+		return fmt.Errorf("port %d is out of range", port)
+	}
+
+	if permitted, ok := perms.Extensions["permitlisten"]; ok {
+		if port == 0 {
+			return errors.New("a port must be chosen as this key may only open some ports")
+		}
+
+		allowed := false
+		if permitted != "none" {
+			for _, r := range strings.Split(permitted, ",") {
+				portRange, err := internal.ParsePortRange(r)
+				if err == nil && portRange.Contains(uint16(port)) {
+					allowed = true
+					break
+				}
+			}
+		}
+
+		if !allowed {
+			return fmt.Errorf("port %d is not permitted for this key (permitlisten=%s)", port, permitted)
+		}
+	}
+
+	proxyListenersLck.Lock()
+	defer proxyListenersLck.Unlock()
+
+	key := perms.Extensions["pubkey-fp"]
+
+	if limit, ok := perms.Extensions["max-listeners"]; ok {
+		maxListeners, err := strconv.Atoi(limit)
+		if err != nil || maxListeners < 1 {
+			return errors.New("this key may not open any ports")
+		}
+
+		if proxyListeners[key] >= maxListeners {
+			return fmt.Errorf("this key already has the maximum of %d ports open", maxListeners)
+		}
+	}
+
+	proxyListeners[key]++
+
+	return nil
+}
+
+func releaseProxyListen(perms *ssh.Permissions) {
+	proxyListenersLck.Lock()
+	defer proxyListenersLck.Unlock()
+
+	key := perms.Extensions["pubkey-fp"]
+
+	proxyListeners[key]--
+	if proxyListeners[key] <= 0 {
+		delete(proxyListeners, key)
+	}
+}
+
 // A different kind of handler, this is allowed to open ports on the actual server itself
 // This is so when on a machine with strict av that has a regular ssh client you can do `ssh -R port rssh.server` and get a proxiable port into the network
-func RemoteDynamicForward(sshConn ssh.Conn, reqs <-chan *ssh.Request, log logger.Logger) {
+// The ports a key may open are restricted by its permitlisten and max-listeners options, and the forwards command lists them under the keys comment
+func RemoteDynamicForward(sshConn *ssh.ServerConn, reqs <-chan *ssh.Request, log logger.Logger) {
 	defer sshConn.Close()
-	clientClosed := make(chan bool)
+
+	owner := sshConn.Permissions.Extensions["comment"]
+	if owner == "" {
+		owner = "proxy key " + sshConn.Permissions.Extensions["pubkey-fp"]
+	}
+
+	var (
+		listenersLck sync.Mutex
+		listeners    = map[uint32]net.Listener{}
+	)
+
 	for r := range reqs {
 
 		switch r.Type {
 
 		case "tcpip-forward":
+			var rf internal.RemoteForwardRequest
 
-			go func(req *ssh.Request) {
-				var rf internal.RemoteForwardRequest
+			err := ssh.Unmarshal(r.Payload, &rf)
+			if err != nil {
+				log.Warning("failed to unmarshal remote forward request: %s", err)
+				r.Reply(false, []byte("Unable to open remote forward"))
+				continue
+			}
 
-				err := ssh.Unmarshal(req.Payload, &rf)
-				if err != nil {
-					log.Warning("failed to unmarshal remote forward request: %s", err)
-					req.Reply(false, []byte("Unable to open remote forward"))
-					return
-				}
+			if err := checkProxyListen(sshConn.Permissions, rf.BindPort); err != nil {
+				log.Warning("%s refused remote forward on port %d: %s", owner, rf.BindPort, err)
+				r.Reply(false, []byte(err.Error()))
+				continue
+			}
 
-				// Ignore rf.BindAddr, helps us mitigate malicious clients
-				l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", rf.BindPort))
-				if err != nil {
-					log.Warning("failed to listen for remote forward request: %s", err)
-					req.Reply(false, []byte("Unable to open remote forward"))
-					return
-				}
+			// Ignore rf.BindAddr, helps us mitigate malicious clients
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", rf.BindPort))
+			if err != nil {
+				releaseProxyListen(sshConn.Permissions)
+				log.Warning("failed to listen for remote forward request: %s", err)
+				r.Reply(false, []byte("Unable to open remote forward"))
+				continue
+			}
+
+			//https://datatracker.ietf.org/doc/html/rfc4254
+			responseData := []byte{}
+			if rf.BindPort == 0 {
+				rf.BindPort = uint32(l.Addr().(*net.TCPAddr).Port)
+				responseData = ssh.Marshal(rf.BindPort)
+			}
 
-				log.Info("Opened remote forward port on server: 127.0.0.1:%d", rf.BindPort)
+			listenersLck.Lock()
+			listeners[rf.BindPort] = l
+			listenersLck.Unlock()
 
-				go func() {
-					<-clientClosed
-					l.Close()
-				}()
-				defer l.Close()
+			log.Info("Opened remote forward port on server for %s: 127.0.0.1:%d", owner, rf.BindPort)
 
-				req.Reply(true, nil)
+			r.Reply(true, responseData)
 
-				for {
+			go func(rf internal.RemoteForwardRequest) {
+				defer releaseProxyListen(sshConn.Permissions)
 
-					proxyCon, err := l.Accept()
+				f := forwards.Add(forwards.Proxy, owner, "", l.Addr().String(), "(ssh client)", l.Close)
+				defer f.Remove()
+
+				counted := f.Listener(l)
+				for {
+					proxyCon, err := counted.Accept()
 					if err != nil {
-						if !strings.Contains(err.Error(), "use of a closed") {
+						if !errors.Is(err, net.ErrClosed) {
 							log.Warning("failed to accept tcp connection: %s", err)
 						}
-						return
+						break
 					}
 					go handleData(rf, proxyCon, sshConn)
 				}
 
-			}(r)
+				listenersLck.Lock()
+				if listeners[rf.BindPort] == l {
+					delete(listeners, rf.BindPort)
+				}
+				listenersLck.Unlock()
+
+				log.Info("Closed remote forward port on server for %s: 127.0.0.1:%d", owner, rf.BindPort)
+			}(rf)
+
+		case "cancel-tcpip-forward":
+			var rf internal.RemoteForwardRequest
+
+			err := ssh.Unmarshal(r.Payload, &rf)
+			if err != nil {
+				r.Reply(false, []byte("Unable to unmarshal remote forward request in order to stop it"))
+				continue
+			}
+
+			listenersLck.Lock()
+			l, ok := listeners[rf.BindPort]
+			listenersLck.Unlock()
+
+			if !ok {
+				r.Reply(false, []byte("unable to find remote forward request"))
+				continue
+			}
+
+			l.Close()
+			r.Reply(true, nil)
+
 		default:
 
 			log.Info("Client %s sent unknown proxy request type: %s", sshConn.RemoteAddr(), r.Type)
@@ -75,7 +200,11 @@ func RemoteDynamicForward(sshConn ssh.Conn, reqs <-chan *ssh.Request, log logger
 		}
 	}
 
-	clientClosed <- true
+	listenersLck.Lock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	listenersLck.Unlock()
 
 	log.Info("Proxy client %s ended", sshConn.RemoteAddr())
 
@@ -83,22 +212,17 @@ func RemoteDynamicForward(sshConn ssh.Conn, reqs <-chan *ssh.Request, log logger
 
 func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh.Conn) error {
 
-	originatorAddress := proxyCon.LocalAddr().String()
-	var originatorPort uint32
-
-	for i := len(originatorAddress) - 1; i > 0; i-- {
-		if originatorAddress[i] == ':' {
-
-			e, err := strconv.ParseInt(originatorAddress[i+1:], 10, 32)
-			if err != nil {
-				sshConn.Close()
-				return fmt.Errorf("failed to parse port number: %s", err)
-			}
+	// The originator is whoever connected to us, rfc4254 7.2
+	originatorAddress, port, err := net.SplitHostPort(proxyCon.RemoteAddr().String())
+	if err != nil {
+		proxyCon.Close()
+		return err
+	}
 
-			originatorPort = uint32(e)
-			originatorAddress = originatorAddress[:i]
-			break
-		}
+	originatorPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		proxyCon.Close()
+		return fmt.Errorf("failed to parse port number: %s", err)
 	}
 
 	drtMsg := internal.ChannelOpenDirectMsg{
@@ -106,13 +230,14 @@ func handleData(rf internal.RemoteForwardRequest, proxyCon net.Conn, sshConn ssh
 		Rport: rf.BindPort,
 
 		Laddr: originatorAddress,
-		Lport: originatorPort,
+		Lport: uint32(originatorPort),
 	}
 
 	b := ssh.Marshal(&drtMsg)
 
 	destination, reqs, err := sshConn.OpenChannel("forwarded-tcpip", b)
 	if err != nil {
+		proxyCon.Close()
 		return err
 	}
 
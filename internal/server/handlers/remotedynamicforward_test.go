@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func proxyPermissions(fingerprint string, extensions map[string]string) *ssh.Permissions {
+	perms := &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": fingerprint}}
+	for k, v := range extensions {
+		perms.Extensions[k] = v
+	}
+	return perms
+}
+
+func TestCheckProxyListen(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		extensions map[string]string
+		allowed    []uint32
+		refused    []uint32
+	}{
+		{
+			name:    "unrestricted",
+			allowed: []uint32{0, 1, 22, 8080, 65535},
+			refused: []uint32{65536, 73536},
+		},
+		{
+			name:       "ranges",
+			extensions: map[string]string{"permitlisten": "8000-8100,9000"},
+			allowed:    []uint32{8000, 8050, 8100, 9000},
+			// 73536 would be 8000 if it was truncated to 16 bits
+			refused: []uint32{0, 7999, 8101, 8999, 9001, 73536},
+		},
+		{
+			name:       "any port",
+			extensions: map[string]string{"permitlisten": "1-65535"},
+			allowed:    []uint32{1, 65535},
+			refused:    []uint32{0, 65536},
+		},
+		{
+			name:       "none",
+			extensions: map[string]string{"permitlisten": "none"},
+			refused:    []uint32{0, 22, 8000},
+		},
+		{
+			name:       "malformed permitlisten",
+			extensions: map[string]string{"permitlisten": "http,8000-"},
+			refused:    []uint32{0, 80, 8000},
+		},
+		{
+			name:       "malformed max-listeners",
+			extensions: map[string]string{"max-listeners": "many"},
+			refused:    []uint32{8000},
+		},
+		{
+			name:       "no listeners",
+			extensions: map[string]string{"max-listeners": "-1"},
+			refused:    []uint32{8000},
+		},
+	} {
+		perms := proxyPermissions(c.name, c.extensions)
+
+		for _, port := range c.allowed {
+			if err := checkProxyListen(perms, port); err != nil {
+				t.Errorf("%s: port %d was refused: %s", c.name, port, err)
+				continue
+			}
+			releaseProxyListen(perms)
+		}
+
+		for _, port := range c.refused {
+			if err := checkProxyListen(perms, port); err == nil {
+				releaseProxyListen(perms)
+				t.Errorf("%s: port %d was allowed", c.name, port)
+			}
+		}
+
+		proxyListenersLck.Lock()
+		open := proxyListeners[c.name]
+		proxyListenersLck.Unlock()
+
+		if open != 0 {
+			t.Errorf("%s: %d listeners are still counted after they were all released or refused", c.name, open)
+		}
+	}
+}
+
+func TestProxyMaxListenersAcrossConnections(t *testing.T) {
+	extensions := map[string]string{"permitlisten": "8000-8100", "max-listeners": "2"}
+
+	// Two connections with the same key share the allowance
+	first := proxyPermissions("shared", extensions)
+	second := proxyPermissions("shared", extensions)
+	other := proxyPermissions("other", extensions)
+
+	if err := checkProxyListen(first, 8000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkProxyListen(second, 8001); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkProxyListen(second, 8002); err == nil {
+		t.Fatal("a third port was opened by a key with max-listeners=2 across two connections")
+	}
+
+	if err := checkProxyListen(first, 8002); err == nil {
+		t.Fatal("a third port was opened by a key with max-listeners=2 across two connections")
+	}
+
+	// A different key has its own allowance
+	if err := checkProxyListen(other, 8003); err != nil {
+		t.Fatalf("another key was refused: %s", err)
+	}
+	releaseProxyListen(other)
+
+	// Closing a port on one connection frees it up for the other
+	releaseProxyListen(first)
+	if err := checkProxyListen(second, 8002); err != nil {
+		t.Fatalf("a port was refused after one was closed: %s", err)
+	}
+
+	releaseProxyListen(second)
+	releaseProxyListen(second)
+
+	proxyListenersLck.Lock()
+	defer proxyListenersLck.Unlock()
+	if len(proxyListeners) != 0 {
+		t.Errorf("listeners are still counted after they were all released: %v", proxyListeners)
+	}
+}
@@ -0,0 +1,292 @@
+package hostkeys
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	currentKeyName = "id_ed25519"
+	nextKeyName    = "id_ed25519_next"
+	retiredKeyName = "id_ed25519.old"
+
+	// Same naming as openssh, e.g id_ed25519-cert.pub
+	certificateSuffix = "-cert.pub"
+)
+
+var (
+	lck sync.RWMutex
+
+	dataDir string
+
+	current ssh.Signer
+	// Optional, the current key signed by a host CA
+	certificate ssh.Signer
+	// The key that will replace current on rotation, nil if there isnt one
+	next ssh.Signer
+
+	// Client ids that have accepted the trust list containing the next key
+	confirmed = map[string]bool{}
+)
+
+// Load sets the key the server is currently using, and picks up the next key and host certificate from the data directory if they exist
+func Load(dir string, currentKey ssh.Signer) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	dataDir = dir
+	current = currentKey
+
+	var err error
+	certificate, err = loadCertificate(filepath.Join(dataDir, currentKeyName+certificateSuffix), current)
+	if err != nil {
+		return err
+	}
+
+	if certificate != nil {
+		log.Println("Loaded server host certificate")
+	}
+
+	nextPath := filepath.Join(dataDir, nextKeyName)
+	if _, err := os.Stat(nextPath); err == nil {
+		next, err = loadKey(nextPath)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Next server key fingerprint: ", internal.FingerprintSHA256Hex(next.PublicKey()))
+	}
+
+	return nil
+}
+
+func loadKey(path string) (ssh.Signer, error) {
+	privateBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key (%s): %s", path, err)
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key (%s): %s", path, err)
+	}
+
+	return private, nil
+}
+
+func loadCertificate(path string, key ssh.Signer) (ssh.Signer, error) {
+	certBytes, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load host certificate (%s): %s", path, err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host certificate (%s): %s", path, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s is not a host certificate", path)
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("host certificate (%s) is not for the server key", path)
+	}
+
+	return ssh.NewCertSigner(cert, key)
+}
+
+// Signers returns the host keys the server presents to new connections
+func Signers() []ssh.Signer {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	signers := []ssh.Signer{current}
+	if certificate != nil {
+		signers = append(signers, certificate)
+	}
+
+	return signers
+}
+
+func Current() ssh.Signer {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return current
+}
+
+func Next() ssh.Signer {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return next
+}
+
+// Authority returns the fingerprint of the CA that signed the host certificate, or an empty string if there is no certificate
+func Authority() string {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	if certificate == nil {
+		return ""
+	}
+
+	return internal.FingerprintSHA256Hex(certificate.PublicKey().(*ssh.Certificate).SignatureKey)
+}
+
+// Fingerprints returns the SHA256 fingerprints clients should trust, the current key and the next key if there is one
+func Fingerprints() []string {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	fingerprints := []string{internal.FingerprintSHA256Hex(current.PublicKey())}
+	if next != nil {
+		fingerprints = append(fingerprints, internal.FingerprintSHA256Hex(next.PublicKey()))
+	}
+
+	return fingerprints
+}
+
+// GenerateNext creates the key that will be used after the next rotation
+func GenerateNext() (ssh.Signer, error) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if next != nil {
+		return nil, errors.New("there is already a next key, rotate to it or discard it first")
+	}
+
+	privateKeyPem, err := internal.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate private key: %s", err)
+	}
+
+	private, err := ssh.ParsePrivateKey(privateKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(dataDir, nextKeyName), privateKeyPem, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write next key to disk: %s", err)
+	}
+
+	next = private
+	confirmed = map[string]bool{}
+
+	return next, nil
+}
+
+// DiscardNext deletes the next key, clients that were told to trust it will keep doing so until they restart
+func DiscardNext() error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if next == nil {
+		return errors.New("there is no next key")
+	}
+
+	if err := os.Remove(filepath.Join(dataDir, nextKeyName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	os.Remove(filepath.Join(dataDir, nextKeyName+certificateSuffix))
+
+	next = nil
+	confirmed = map[string]bool{}
+
+	return nil
+}
+
+// Rotate makes the next key the current key, the old key is kept on disk as id_ed25519.old
+// Only new connections are affected, existing connections stay up
+func Rotate() error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if next == nil {
+		return errors.New("there is no next key to rotate to, generate one first")
+	}
+
+	currentPath := filepath.Join(dataDir, currentKeyName)
+	nextPath := filepath.Join(dataDir, nextKeyName)
+
+	newCertificate, err := loadCertificate(nextPath+certificateSuffix, next)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(currentPath); err == nil {
+		if err := os.Rename(currentPath, filepath.Join(dataDir, retiredKeyName)); err != nil {
+			return fmt.Errorf("unable to retire current key: %s", err)
+		}
+	}
+
+	if err := os.Rename(nextPath, currentPath); err != nil {
+		return fmt.Errorf("unable to move next key into place: %s", err)
+	}
+
+	// The old certificate is for the old key, so it can only be replaced or retired
+	os.Rename(currentPath+certificateSuffix, filepath.Join(dataDir, retiredKeyName+certificateSuffix))
+	if newCertificate != nil {
+		os.Rename(nextPath+certificateSuffix, currentPath+certificateSuffix)
+	}
+
+	current = next
+	certificate = newCertificate
+	next = nil
+	confirmed = map[string]bool{}
+
+	log.Println("Rotated server key, new fingerprint: ", internal.FingerprintSHA256Hex(current.PublicKey()))
+
+	return nil
+}
+
+// Push sends the current trust list to a client, replacing the keys it will accept
+func Push(id string, conn ssh.Conn) error {
+	fingerprints := Fingerprints()
+
+	ok, response, err := conn.SendRequest("trusted-host-keys", true, []byte(strings.Join(fingerprints, ",")))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if len(response) == 0 {
+			response = []byte("client does not support trusted host key updates (may be outdated)")
+		}
+		return errors.New(string(response))
+	}
+
+	lck.Lock()
+	defer lck.Unlock()
+
+	// Only counts if the list the client accepted still includes the next key
+	if next != nil && len(fingerprints) == 2 && fingerprints[1] == internal.FingerprintSHA256Hex(next.PublicKey()) {
+		confirmed[id] = true
+	}
+
+	return nil
+}
+
+// Confirmed returns whether a client has accepted the next key
+func Confirmed(id string) bool {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	return confirmed[id]
+}
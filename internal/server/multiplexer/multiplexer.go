@@ -1,5 +1,16 @@
 package multiplexer
 
-import "github.com/NHAS/reverse_ssh/pkg/mux"
+import (
+	"net"
+
+	"github.com/NHAS/reverse_ssh/pkg/mux"
+)
 
 var ServerMultiplexer *mux.Multiplexer
+
+// RelayAddr is the remote address of a connection that a client relayed to the server from a port opened with listen -c
+type RelayAddr struct {
+	net.TCPAddr
+	// The id of the client it came through
+	Via string
+}
@@ -5,16 +5,21 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/pkg/observer"
 )
 
 type ClientState struct {
+	// connected, disconnected, or info when a connected client reports its system information
 	Status    string
 	ID        string
 	IP        string
 	HostName  string
 	Version   string
 	Timestamp time.Time
+
+	// System information the client reported, if it has
+	Info *internal.ClientInfo `json:",omitempty"`
 }
 
 func (cs ClientState) Summary() string {
@@ -0,0 +1,408 @@
+// Package publish serves http services that are only reachable from a client on the server webserver, mapped by path or virtual host with the publish command
+package publish
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/forwards"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+// Header is set on every request sent to the service, an empty value removes it instead
+type Header struct {
+	Name  string
+	Value string
+}
+
+// ParseHeader reads a header in the form "Name: value", "Name:" removes the header
+func ParseHeader(s string) (Header, error) {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return Header{}, fmt.Errorf("invalid header %q, expected 'Name: value' or 'Name:' to remove it", s)
+	}
+
+	return Header{Name: http.CanonicalHeaderKey(name), Value: strings.TrimSpace(value)}, nil
+}
+
+// Options describe where a service is published and how requests to it are changed
+type Options struct {
+	// Virtual host to match, any host when empty
+	Host string
+	// Path prefix to match, which is removed before the request is sent on
+	Path string
+	// The service as seen from the client, e.g 10.0.0.5:8080 or https://intranet.local
+	Target string
+	// username:password for basic auth, or empty for none
+	Credentials string
+	Headers     []Header
+	// Skip verifying the certificate of https services
+	Insecure bool
+}
+
+// Mapping is a published service, requests are made through the client with ClientID for as long as Owner can access it
+type Mapping struct {
+	Host     string
+	Path     string
+	ClientID string
+	Target   string
+	Owner    string
+	Auth     bool
+	Headers  []Header
+
+	username, password string
+
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+	forward   *forwards.Forward
+}
+
+// Route is the host and path the mapping is found by, e.g wiki.example.com/ or /grafana/
+func (m *Mapping) Route() string {
+	return m.Host + m.Path
+}
+
+func (m *Mapping) String() string {
+	auth := "no auth"
+	if m.Auth {
+		auth = "basic auth"
+	}
+	return fmt.Sprintf("%s -> %s via %s (%s, started by %s)", m.Route(), m.Target, m.ClientID, auth, m.Owner)
+}
+
+var (
+	lck      sync.RWMutex
+	mappings = map[string]*Mapping{}
+)
+
+// Start publishes the service at opts.Target through the client with clientID until it is stopped or the client disconnects (see StopClient),
+// every new connection to the service checks that user can still access the client
+func Start(user *users.User, clientID string, opts Options, log logger.Logger) (*Mapping, error) {
+
+	target, err := parseTarget(opts.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mapping{
+		Host:     strings.ToLower(opts.Host),
+		Path:     normalisePath(opts.Path),
+		ClientID: clientID,
+		Target:   target.String(),
+		Owner:    user.Username(),
+		Headers:  opts.Headers,
+	}
+
+	if m.Host == "" && m.Path == "/" {
+		return nil, errors.New("a published service needs a host or a path, otherwise it would hide the downloads")
+	}
+
+	if m.Path == "/" && user.Privilege() != users.AdminPermissions {
+		return nil, errors.New("only admins can publish a service for a whole host, publish it at a path instead")
+	}
+
+	if opts.Credentials != "" {
+		username, password, ok := strings.Cut(opts.Credentials, ":")
+		if !ok || username == "" {
+			return nil, errors.New("credentials must be in the form username:password")
+		}
+
+		m.Auth = true
+		m.username = username
+		m.password = password
+	}
+
+	m.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return m.dial(user, addr)
+		},
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: opts.Insecure},
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	m.proxy = &httputil.ReverseProxy{
+		Transport: m.transport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Path = "/" + strings.TrimPrefix(r.In.URL.Path, m.Path)
+			r.Out.URL.RawPath = ""
+
+			r.SetURL(target)
+			r.SetXForwarded()
+			if m.Path != "/" {
+				r.Out.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(m.Path, "/"))
+			}
+
+			// The credentials for the published service are not the services own
+			if m.Auth {
+				r.Out.Header.Del("Authorization")
+			}
+
+			for _, h := range m.Headers {
+				if h.Value == "" {
+					r.Out.Header.Del(h.Name)
+					continue
+				}
+
+				if h.Name == "Host" {
+					r.Out.Host = h.Value
+					continue
+				}
+
+				r.Out.Header.Set(h.Name, h.Value)
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// Redirects within the service have to stay under the path it is published at
+			if location := resp.Header.Get("Location"); m.Path != "/" && strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+				resp.Header.Set("Location", strings.TrimSuffix(m.Path, "/")+location)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Warning("published service %s failed: %s", m.Route(), err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	lck.Lock()
+	if _, ok := mappings[m.Route()]; ok {
+		lck.Unlock()
+		return nil, fmt.Errorf("%s is already published", m.Route())
+	}
+
+	m.forward = forwards.Add(forwards.Published, m.Owner, clientID, m.Route(), m.Target, func() error {
+		return Stop(m)
+	})
+	mappings[m.Route()] = m
+	lck.Unlock()
+
+	return m, nil
+}
+
+// dial opens a connection to the service through the client, there is no requester to give as the originator as connections are reused
+func (m *Mapping) dial(user *users.User, addr string) (net.Conn, error) {
+	clients, err := user.SearchClients(m.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, ok := clients[m.ClientID]
+	if !ok {
+		return nil, fmt.Errorf("client %s is not connected or %s cannot access it", m.ClientID, user.Username())
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	drtMsg := internal.ChannelOpenDirectMsg{
+		Raddr: host,
+		Rport: uint32(p),
+	}
+
+	channel, reqs, err := conn.OpenChannel("direct-tcpip", ssh.Marshal(&drtMsg))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+
+	return m.forward.Conn(&channelConn{Channel: channel, remote: &net.TCPAddr{IP: net.ParseIP(host), Port: int(p)}}), nil
+}
+
+func (m *Mapping) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.Auth {
+		username, password, ok := req.BasicAuth()
+
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(m.username)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(m.password)) == 1
+		if !ok || !usernameMatch || !passwordMatch {
+			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if m.Path != "/" && req.URL.Path == strings.TrimSuffix(m.Path, "/") {
+		http.Redirect(w, req, m.Path, http.StatusMovedPermanently)
+		return
+	}
+
+	// The webserver timeouts are for downloads, streamed responses and websockets can last far longer
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	m.proxy.ServeHTTP(w, req)
+}
+
+// Match finds the mapping for a request, mappings for a host are preferred and then the one with the longest path
+func Match(req *http.Request) (*Mapping, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	lck.RLock()
+	defer lck.RUnlock()
+
+	var best *Mapping
+	for _, m := range mappings {
+		if m.Host != "" && m.Host != host {
+			continue
+		}
+
+		if m.Path != "/" && req.URL.Path != strings.TrimSuffix(m.Path, "/") && !strings.HasPrefix(req.URL.Path, m.Path) {
+			continue
+		}
+
+		if best == nil || m.moreSpecific(best) {
+			best = m
+		}
+	}
+
+	return best, best != nil
+}
+
+func (m *Mapping) moreSpecific(other *Mapping) bool {
+	if (m.Host == "") != (other.Host == "") {
+		return m.Host != ""
+	}
+
+	return len(m.Path) > len(other.Path)
+}
+
+// Stop unpublishes the service, requests that are already in progress are left to finish
+func Stop(m *Mapping) error {
+	lck.Lock()
+	if mappings[m.Route()] == m {
+		delete(mappings, m.Route())
+	}
+	lck.Unlock()
+
+	m.forward.Remove()
+	m.transport.CloseIdleConnections()
+
+	return nil
+}
+
+// StopClient unpublishes every service of a client, client ids are only unique to a single connection so the mappings cannot outlive it
+func StopClient(clientID string) {
+	lck.RLock()
+	var stopping []*Mapping
+	for _, m := range mappings {
+		if m.ClientID == clientID {
+			stopping = append(stopping, m)
+		}
+	}
+	lck.RUnlock()
+
+	for _, m := range stopping {
+		Stop(m)
+	}
+}
+
+// Get returns the mapping for a route, as shown by Mapping.Route
+func Get(route string) (*Mapping, bool) {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	m, ok := mappings[route]
+	return m, ok
+}
+
+// All returns every mapping sorted by route
+func All() (out []*Mapping) {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	for _, m := range mappings {
+		out = append(out, m)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Route() < out[j].Route()
+	})
+
+	return out
+}
+
+func parseTarget(target string) (*url.URL, error) {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q, only http and https services can be published", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, errors.New("target has no host")
+	}
+
+	return u, nil
+}
+
+// normalisePath makes a path prefix start and end with /
+func normalisePath(p string) string {
+	p = path.Clean("/" + p)
+	if p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+// channelConn is an ssh channel carrying a connection to the service
+type channelConn struct {
+	ssh.Channel
+	remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *channelConn) SetDeadline(t time.Time) error {
+	return errors.New("not implemented on a channel")
+}
+
+func (c *channelConn) SetReadDeadline(t time.Time) error {
+	return errors.New("not implemented on a channel")
+}
+
+func (c *channelConn) SetWriteDeadline(t time.Time) error {
+	return errors.New("not implemented on a channel")
+}
@@ -0,0 +1,309 @@
+package publish
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+// publishTest publishes service as if it was reachable from a client, returning the webserver it is published on
+func publishTest(t *testing.T, clientID string, opts Options, service http.Handler) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(service)
+	t.Cleanup(backend.Close)
+
+	if opts.Target == "" {
+		opts.Target = "service.internal:8080"
+	}
+
+	m, err := Start(&users.User{}, clientID, opts, logger.NewLog("publish_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Stop(m) })
+
+	// There is no client to go through, so every connection goes straight to the service
+	m.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, backend.Listener.Addr().String())
+	}
+
+	webserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if published, ok := Match(req); ok {
+			published.ServeHTTP(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(webserver.Close)
+
+	return webserver
+}
+
+func noRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+func get(t *testing.T, url string, modify func(*http.Request)) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if modify != nil {
+		modify(req)
+	}
+
+	resp, err := (&http.Client{CheckRedirect: noRedirects}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPathStripping(t *testing.T) {
+	webserver := publishTest(t, "client", Options{Path: "/wiki"}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s?%s %s", req.URL.Path, req.URL.RawQuery, req.Header.Get("X-Forwarded-Prefix"))
+	}))
+
+	for path, expected := range map[string]string{
+		"/wiki/":           "/? /wiki",
+		"/wiki/a/b?page=2": "/a/b?page=2 /wiki",
+	} {
+		resp := get(t, webserver.URL+path, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d", path, resp.StatusCode)
+			continue
+		}
+
+		if got := body(t, resp); got != expected {
+			t.Errorf("%s: service got %q, expected %q", path, got, expected)
+		}
+	}
+
+	resp := get(t, webserver.URL+"/wiki", nil)
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/wiki/" {
+		t.Errorf("/wiki: expected a redirect to /wiki/, got %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	for _, path := range []string{"/", "/wikipedia", "/other/wiki/"} {
+		if resp := get(t, webserver.URL+path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected it not to be published, got status %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestLocationRewrite(t *testing.T) {
+	webserver := publishTest(t, "client", Options{Path: "/app/"}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Location", req.URL.Query().Get("to"))
+		w.WriteHeader(http.StatusFound)
+	}))
+
+	for to, expected := range map[string]string{
+		"/login":                "/app/login",
+		"/":                     "/app/",
+		"https://example.com/x": "https://example.com/x",
+		"//cdn.example.com/x":   "//cdn.example.com/x",
+		"relative/page":         "relative/page",
+	} {
+		resp := get(t, webserver.URL+"/app/redirect?to="+to, nil)
+		if got := resp.Header.Get("Location"); got != expected {
+			t.Errorf("redirect to %q was rewritten to %q, expected %q", to, got, expected)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	webserver := publishTest(t, "client", Options{Path: "/private", Credentials: "team:hunter2"}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "authorization=%q", req.Header.Get("Authorization"))
+	}))
+
+	for _, c := range []struct {
+		name               string
+		username, password string
+		status             int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "team", "hunter3", http.StatusUnauthorized},
+		{"wrong username", "admin", "hunter2", http.StatusUnauthorized},
+		{"correct", "team", "hunter2", http.StatusOK},
+	} {
+		resp := get(t, webserver.URL+"/private/", func(req *http.Request) {
+			if c.username != "" {
+				req.SetBasicAuth(c.username, c.password)
+			}
+		})
+
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: got status %d, expected %d", c.name, resp.StatusCode, c.status)
+			continue
+		}
+
+		if c.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", c.name)
+		}
+
+		if c.status == http.StatusOK {
+			if got := body(t, resp); got != `authorization=""` {
+				t.Errorf("credentials were passed on to the service: %s", got)
+			}
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	headers := []Header{}
+	for _, h := range []string{"Host: intranet.local", "x-team: red", "Cookie:", "X-Forwarded-For:"} {
+		header, err := ParseHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+	}
+
+	webserver := publishTest(t, "client", Options{Path: "/headers", Headers: headers}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "host=%s team=%s cookie=%q forwarded=%q user-agent=%s", req.Host, req.Header.Get("X-Team"), req.Header.Get("Cookie"), req.Header.Get("X-Forwarded-For"), req.Header.Get("User-Agent"))
+	}))
+
+	resp := get(t, webserver.URL+"/headers/", func(req *http.Request) {
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-Team", "blue")
+		req.Header.Set("User-Agent", "publish_test")
+	})
+
+	expected := `host=intranet.local team=red cookie="" forwarded="" user-agent=publish_test`
+	if got := body(t, resp); got != expected {
+		t.Errorf("service got %q, expected %q", got, expected)
+	}
+
+	for _, bad := range []string{"no colon", ": value", "Two Words: value"} {
+		if _, err := ParseHeader(bad); err == nil {
+			t.Errorf("header %q was accepted", bad)
+		}
+	}
+}
+
+func TestWebsocketUpgrade(t *testing.T) {
+	webserver := publishTest(t, "client", Options{Path: "/ws"}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/socket" || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "expected a websocket upgrade on /socket", http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+
+		// Echo whatever is sent once upgraded
+		io.Copy(conn, rw)
+	}))
+
+	conn, err := net.Dial("tcp", webserver.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET /ws/socket HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", webserver.Listener.Addr())
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the upgrade to be passed through, got status %d", resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(echo) != "ping" {
+		t.Errorf("got %q back through the upgraded connection", echo)
+	}
+}
+
+func TestStartRefusesHostWide(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{Path: "/"},
+		{Host: "intranet.example.com"},
+		{Host: "intranet.example.com", Path: "/"},
+	} {
+		opts.Target = "service.internal:8080"
+
+		m, err := Start(&users.User{}, "client", opts, logger.NewLog("publish_test"))
+		if err == nil {
+			Stop(m)
+			t.Errorf("%+v was published by a user who is not an admin", opts)
+		}
+	}
+
+	m, err := Start(&users.User{}, "client", Options{Host: "intranet.example.com", Path: "/wiki", Target: "service.internal:8080"}, logger.NewLog("publish_test"))
+	if err != nil {
+		t.Fatalf("a path on a virtual host was refused: %s", err)
+	}
+	Stop(m)
+}
+
+func TestStopClient(t *testing.T) {
+	for _, c := range []struct {
+		client, path string
+	}{
+		{"disconnecting", "/one"},
+		{"disconnecting", "/two"},
+		{"staying", "/three"},
+	} {
+		m, err := Start(&users.User{}, c.client, Options{Path: c.path, Target: "service.internal:8080"}, logger.NewLog("publish_test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { Stop(m) })
+	}
+
+	StopClient("disconnecting")
+
+	var remaining []string
+	for _, m := range All() {
+		remaining = append(remaining, m.Route())
+	}
+
+	if strings.Join(remaining, ",") != "/three/" {
+		t.Errorf("expected only the mapping of the client that is still connected to be left, got %v", remaining)
+	}
+}
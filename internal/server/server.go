@@ -99,7 +99,7 @@ func Run(addr, dataDir, connectBackAddress string, autogeneratedConnectBack bool
 		if len(connectBackAddress) == 0 {
 			connectBackAddress = addr
 		}
-		go webserver.Start(multiplexer.ServerMultiplexer.HTTPDownloadRequests(), connectBackAddress, autogeneratedConnectBack, "../", dataDir, private.PublicKey())
+		go webserver.Start(multiplexer.ServerMultiplexer.HTTPDownloadRequests(), connectBackAddress, autogeneratedConnectBack, "../", dataDir)
 		go tcp.Start(multiplexer.ServerMultiplexer.TCPDownloadRequests())
 	}
 
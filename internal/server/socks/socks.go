@@ -0,0 +1,408 @@
+// Package socks runs SOCKS5 listeners on the server that make their connections through a client, started by the socks command
+package socks
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/forwards"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/socks5"
+	"github.com/NHAS/reverse_ssh/pkg/udpproxy"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long to wait for a client to start listening for a BIND
+const bindSetupTimeout = 10 * time.Second
+
+// Listener is a SOCKS5 listener for one client
+type Listener struct {
+	ClientID string
+	Addr     string
+	// The user who started it, every request is checked against what they can access
+	Owner string
+	Auth  bool
+
+	listener net.Listener
+	forward  *forwards.Forward
+}
+
+func (l *Listener) String() string {
+	auth := "no auth"
+	if l.Auth {
+		auth = "password auth"
+	}
+	return fmt.Sprintf("%s -> %s (%s, started by %s)", l.Addr, l.ClientID, auth, l.Owner)
+}
+
+var (
+	lck       sync.Mutex
+	listeners = map[string]*Listener{}
+)
+
+// Start listens for SOCKS5 on addr, connections go through the client with clientID until it disconnects (see StopClient), and every request
+// checks that user can still access it. credentials is username:password, or empty for no authentication
+func Start(user *users.User, clientID, addr, credentials string, log logger.Logger) (*Listener, error) {
+	server := &socks5.Server{
+		Logf: log.Warning,
+	}
+
+	if credentials != "" {
+		username, password, ok := strings.Cut(credentials, ":")
+		if !ok || username == "" {
+			return nil, errors.New("socks credentials must be in the form username:password")
+		}
+
+		server.Authenticate = func(u, p string) bool {
+			usernameMatch := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+			passwordMatch := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+			return usernameMatch && passwordMatch
+		}
+	}
+
+	client := func() (ssh.Conn, error) {
+		clients, err := user.SearchClients(clientID)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, ok := clients[clientID]
+		if !ok {
+			return nil, &socks5.ReplyError{Reply: socks5.ReplyNetworkUnreachable, Err: fmt.Errorf("client %s is not connected or %s cannot access it", clientID, user.Username())}
+		}
+
+		return conn, nil
+	}
+
+	server.Allow = func(net.Addr) error {
+		_, err := client()
+		return err
+	}
+
+	server.Dial = func(target string, from net.Addr) (net.Conn, error) {
+		conn, err := client()
+		if err != nil {
+			return nil, err
+		}
+
+		drtMsg, err := directMsg(target, from)
+		if err != nil {
+			return nil, err
+		}
+
+		channel, reqs, err := conn.OpenChannel("direct-tcpip", ssh.Marshal(&drtMsg))
+		if err != nil {
+			return nil, openError(err)
+		}
+		go ssh.DiscardRequests(reqs)
+
+		return &channelConn{Channel: channel, local: from, remote: &net.TCPAddr{IP: net.ParseIP(drtMsg.Raddr), Port: int(drtMsg.Rport)}}, nil
+	}
+
+	server.DialUDP = func(target string, from net.Addr) (net.Conn, error) {
+		conn, err := client()
+		if err != nil {
+			return nil, err
+		}
+
+		drtMsg, err := directMsg(target, from)
+		if err != nil {
+			return nil, err
+		}
+
+		channel, reqs, err := conn.OpenChannel("direct-udp", ssh.Marshal(&drtMsg))
+		if err != nil {
+			return nil, openError(err)
+		}
+		go ssh.DiscardRequests(reqs)
+
+		return udpproxy.NewStreamConn(channel, from, &net.UDPAddr{IP: net.ParseIP(drtMsg.Raddr), Port: int(drtMsg.Rport)}), nil
+	}
+
+	server.Bind = func(peer string, from net.Addr) (net.Listener, error) {
+		conn, err := client()
+		if err != nil {
+			return nil, err
+		}
+
+		drtMsg, err := directMsg(peer, from)
+		if err != nil {
+			return nil, err
+		}
+
+		return bind(conn, drtMsg)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the address as it was given so it can be used to stop the listener, only filling in the port if any was asked for
+	host, _, _ := net.SplitHostPort(addr)
+
+	socksListener := &Listener{
+		ClientID: clientID,
+		Addr:     net.JoinHostPort(host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)),
+		Owner:    user.Username(),
+		Auth:     server.Authenticate != nil,
+		listener: l,
+	}
+
+	lck.Lock()
+	if _, ok := listeners[socksListener.Addr]; ok {
+		lck.Unlock()
+		l.Close()
+		return nil, fmt.Errorf("socks listener on %s already exists", socksListener.Addr)
+	}
+	listeners[socksListener.Addr] = socksListener
+	lck.Unlock()
+
+	socksListener.forward = forwards.Add(forwards.Dynamic, socksListener.Owner, clientID, socksListener.Addr, "socks5", func() error {
+		return Stop(socksListener)
+	})
+
+	go func() {
+		server.Serve(socksListener.forward.Listener(l))
+
+		socksListener.forward.Remove()
+
+		lck.Lock()
+		if listeners[socksListener.Addr] == socksListener {
+			delete(listeners, socksListener.Addr)
+		}
+		lck.Unlock()
+	}()
+
+	return socksListener, nil
+}
+
+// Stop closes the listener, connections that are already open are left alone
+func Stop(l *Listener) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if listeners[l.Addr] == l {
+		delete(listeners, l.Addr)
+	}
+
+	return l.listener.Close()
+}
+
+// StopClient closes every listener of a client, client ids are only unique to a single connection so the listeners cannot outlive it
+func StopClient(clientID string) {
+	lck.Lock()
+	var stopping []*Listener
+	for _, l := range listeners {
+		if l.ClientID == clientID {
+			stopping = append(stopping, l)
+		}
+	}
+	lck.Unlock()
+
+	for _, l := range stopping {
+		Stop(l)
+	}
+}
+
+func Get(addr string) (*Listener, bool) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	l, ok := listeners[addr]
+	return l, ok
+}
+
+// All returns every listener sorted by address
+func All() (out []*Listener) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	for _, l := range listeners {
+		out = append(out, l)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Addr < out[j].Addr
+	})
+
+	return out
+}
+
+func directMsg(target string, from net.Addr) (internal.ChannelOpenDirectMsg, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return internal.ChannelOpenDirectMsg{}, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return internal.ChannelOpenDirectMsg{}, err
+	}
+
+	drtMsg := internal.ChannelOpenDirectMsg{
+		Raddr: host,
+		Rport: uint32(p),
+	}
+
+	if originator, ok := from.(*net.TCPAddr); ok {
+		drtMsg.Laddr = originator.IP.String()
+		drtMsg.Lport = uint32(originator.Port)
+	}
+
+	return drtMsg, nil
+}
+
+// openError turns a client refusing a channel into the closest socks reply
+func openError(err error) error {
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		switch openErr.Reason {
+		case ssh.Prohibited:
+			return &socks5.ReplyError{Reply: socks5.ReplyNotAllowed, Err: err}
+		case ssh.ConnectionFailed:
+			return &socks5.ReplyError{Reply: socks5.ReplyHostUnreachable, Err: err}
+		}
+	}
+
+	return &socks5.ReplyError{Reply: socks5.ReplyGeneralFailure, Err: err}
+}
+
+// bind asks the client to listen for the peer, and waits for it to say where it is listening
+func bind(conn ssh.Conn, drtMsg internal.ChannelOpenDirectMsg) (net.Listener, error) {
+	channel, reqs, err := conn.OpenChannel("socks-bind", ssh.Marshal(&drtMsg))
+	if err != nil {
+		return nil, openError(err)
+	}
+
+	l := &bindListener{
+		channel:   channel,
+		connected: make(chan net.Addr, 1),
+		closed:    make(chan struct{}),
+	}
+
+	select {
+	case req, ok := <-reqs:
+		if !ok || req.Type != "bound" {
+			channel.Close()
+			return nil, errors.New("client did not start listening")
+		}
+
+		l.addr, err = parseAddr(req.Payload)
+		if err != nil {
+			channel.Close()
+			return nil, err
+		}
+	case <-time.After(bindSetupTimeout):
+		channel.Close()
+		return nil, errors.New("timed out waiting for client to start listening")
+	}
+
+	go func() {
+		defer close(l.closed)
+
+		for req := range reqs {
+			if req.Type == "connected" {
+				if addr, err := parseAddr(req.Payload); err == nil {
+					l.connected <- addr
+				}
+			}
+
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	return l, nil
+}
+
+func parseAddr(payload []byte) (*net.TCPAddr, error) {
+	var addr internal.RemoteForwardRequest
+	if err := ssh.Unmarshal(payload, &addr); err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{IP: net.ParseIP(addr.BindAddr), Port: int(addr.BindPort)}, nil
+}
+
+// bindListener is the listener for a BIND on the client, which accepts a single connection
+type bindListener struct {
+	channel ssh.Channel
+	addr    net.Addr
+
+	connected chan net.Addr
+	closed    chan struct{}
+
+	acceptedLck sync.Mutex
+	accepted    bool
+}
+
+func (b *bindListener) Accept() (net.Conn, error) {
+	select {
+	case remote := <-b.connected:
+		b.acceptedLck.Lock()
+		defer b.acceptedLck.Unlock()
+
+		if b.accepted {
+			return nil, net.ErrClosed
+		}
+		b.accepted = true
+
+		return &channelConn{Channel: b.channel, local: b.addr, remote: remote}, nil
+	case <-b.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the client listening, unless the connection has already been accepted in which case it belongs to that
+func (b *bindListener) Close() error {
+	b.acceptedLck.Lock()
+	defer b.acceptedLck.Unlock()
+
+	if b.accepted {
+		return nil
+	}
+	b.accepted = true
+
+	return b.channel.Close()
+}
+
+func (b *bindListener) Addr() net.Addr {
+	return b.addr
+}
+
+// channelConn is an ssh channel carrying a tcp connection
+type channelConn struct {
+	ssh.Channel
+	local, remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *channelConn) SetDeadline(t time.Time) error {
+	return errors.New("not implemented on a channel")
+}
+
+func (c *channelConn) SetReadDeadline(t time.Time) error {
+	return errors.New("not implemented on a channel")
+}
+
+func (c *channelConn) SetWriteDeadline(t time.Time) error {
+	return errors.New("not implemented on a channel")
+}
@@ -0,0 +1,40 @@
+package socks
+
+import (
+	"net"
+	"testing"
+
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+)
+
+func TestStopClient(t *testing.T) {
+	started := map[string]*Listener{}
+	for _, client := range []string{"disconnecting", "disconnecting", "staying"} {
+		l, err := Start(&users.User{}, client, "127.0.0.1:0", "", logger.NewLog("socks_test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { Stop(l) })
+
+		started[l.Addr] = l
+	}
+
+	StopClient("disconnecting")
+
+	remaining := All()
+	if len(remaining) != 1 || remaining[0].ClientID != "staying" {
+		t.Fatalf("expected only the listener of the client that is still connected to be left, got %v", remaining)
+	}
+
+	for addr, l := range started {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+
+		if open := err == nil; open != (l.ClientID == "staying") {
+			t.Errorf("listener %s for %s is open: %t", addr, l.ClientID, open)
+		}
+	}
+}
@@ -13,8 +13,15 @@ import (
 	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/bandwidth"
+	"github.com/NHAS/reverse_ssh/internal/server/accounting"
 	"github.com/NHAS/reverse_ssh/internal/server/handlers"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
 	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"github.com/NHAS/reverse_ssh/internal/server/publish"
+	"github.com/NHAS/reverse_ssh/internal/server/socks"
+	"github.com/NHAS/reverse_ssh/internal/server/udpforwards"
+	"github.com/NHAS/reverse_ssh/internal/server/updates"
 	"github.com/NHAS/reverse_ssh/internal/server/users"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"github.com/fatih/color"
@@ -27,6 +34,12 @@ type Options struct {
 	Comment   string
 
 	Owners []string
+
+	// Ports a proxy key may open on the server, unrestricted unless RestrictListen is set
+	PermitListen   []internal.PortRange
+	RestrictListen bool
+	// How many ports a proxy key may have open at once, 0 is unlimited and negative allows none
+	MaxListeners int
 }
 
 func readPubKeys(path string) (m map[string]Options, err error) {
@@ -62,6 +75,23 @@ func readPubKeys(path string) (m map[string]Options, err error) {
 					opts.DenyList = append(opts.DenyList, deny...)
 				case "owner":
 					opts.Owners = ParseOwnerDirective(parts[1])
+				case "permitlisten":
+					opts.RestrictListen = true
+
+					ports, err := ParsePermitListenDirective(parts[1])
+					if err != nil {
+						log.Println("Unable to parse permitlisten ", parts[1], " for ", comment, ", it will not allow any ports: ", err)
+						continue
+					}
+					opts.PermitListen = append(opts.PermitListen, ports...)
+				case "max-listeners":
+					maxListeners, err := strconv.Atoi(strings.Trim(parts[1], "\""))
+					if err != nil || maxListeners < 1 {
+						// Fail closed rather than letting a typo remove the limit
+						log.Println("Unable to parse max-listeners ", parts[1], " for ", comment, ", it will not allow any ports")
+						maxListeners = -1
+					}
+					opts.MaxListeners = maxListeners
 				}
 
 			}
@@ -83,6 +113,35 @@ func ParseOwnerDirective(owners string) []string {
 	return strings.Split(unquoted, ",")
 }
 
+// ParsePermitListenDirective parses the ports in permitlisten="8000-8100,9000", a host can be given as in openssh but is ignored
+// as proxy keys can only listen on localhost. * allows any port, and none allows none
+func ParsePermitListenDirective(ports string) (permitted []internal.PortRange, err error) {
+	list := strings.Trim(ports, "\"")
+
+	for _, directive := range strings.Split(list, ",") {
+		if i := strings.LastIndex(directive, ":"); i != -1 {
+			directive = directive[i+1:]
+		}
+
+		switch directive {
+		case "none":
+			continue
+		case "*":
+			permitted = append(permitted, internal.PortRange{Low: 1, High: 65535})
+			continue
+		}
+
+		portRange, err := internal.ParsePortRange(directive)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %s", directive, err)
+		}
+
+		permitted = append(permitted, portRange)
+	}
+
+	return permitted, nil
+}
+
 func ParseFromDirective(addresses string) (deny, allow []*net.IPNet) {
 	list := strings.Trim(addresses, "\"")
 
@@ -168,6 +227,13 @@ func ParseAddress(address string) (cidr []*net.IPNet, err error) {
 
 var ErrKeyNotInList = errors.New("key not found")
 
+// Keys that are only let in by --insecure or --openproxy are held to these, as anyone can make one. Listed keys keep their own options in those modes
+var unlistedKeyOptions = Options{
+	PermitListen:   []internal.PortRange{{Low: 1024, High: 65535}},
+	RestrictListen: true,
+	MaxListeners:   4,
+}
+
 func CheckAuth(keysPath string, publicKey ssh.PublicKey, src net.IP, insecure bool) (*ssh.Permissions, error) {
 
 	keys, err := readPubKeys(keysPath)
@@ -175,14 +241,16 @@ func CheckAuth(keysPath string, publicKey ssh.PublicKey, src net.IP, insecure bo
 		return nil, ErrKeyNotInList
 	}
 
-	var opt Options
-	if !insecure {
-		var ok bool
-		opt, ok = keys[string(ssh.MarshalAuthorizedKey(publicKey))]
-		if !ok {
+	opt, listed := keys[string(ssh.MarshalAuthorizedKey(publicKey))]
+	if !listed {
+		if !insecure {
 			return nil, ErrKeyNotInList
 		}
 
+		opt = unlistedKeyOptions
+	}
+
+	if !insecure {
 		for _, deny := range opt.DenyList {
 			if deny.Contains(src) {
 				return nil, fmt.Errorf("not authorized ip on deny list")
@@ -202,14 +270,32 @@ func CheckAuth(keysPath string, publicKey ssh.PublicKey, src net.IP, insecure bo
 		}
 	}
 
-	return &ssh.Permissions{
+	perms := &ssh.Permissions{
 		// Record the public key used for authentication.
 		Extensions: map[string]string{
 			"comment":   opt.Comment,
 			"pubkey-fp": internal.FingerprintSHA1Hex(publicKey),
 			"owners":    strings.Join(opt.Owners, ","),
 		},
-	}, nil
+	}
+
+	if opt.RestrictListen {
+		var permitted []string
+		for _, r := range opt.PermitListen {
+			permitted = append(permitted, r.String())
+		}
+
+		perms.Extensions["permitlisten"] = "none"
+		if len(permitted) > 0 {
+			perms.Extensions["permitlisten"] = strings.Join(permitted, ",")
+		}
+	}
+
+	if opt.MaxListeners != 0 {
+		perms.Extensions["max-listeners"] = strconv.Itoa(opt.MaxListeners)
+	}
+
+	return perms, nil
 
 }
 
@@ -312,9 +398,15 @@ func StartSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 		},
 	}
 
-	config.AddHostKey(privateKey)
+	if err := hostkeys.Load(dataDir, privateKey); err != nil {
+		log.Fatal(err)
+	}
 
 	observers.ConnectionState.Register(func(c observers.ClientState) {
+		if c.Status == "info" {
+			return
+		}
+
 		var arrowDirection = "<-"
 		if c.Status == "disconnected" {
 			arrowDirection = "->"
@@ -340,7 +432,13 @@ func StartSSHServer(sshListener net.Listener, privateKey ssh.Signer, insecure, o
 			continue
 		}
 
-		go acceptConn(conn, config, timeout, dataDir)
+		// The host keys can be rotated while the server is running, so each connection gets the keys that are current when it connects
+		connConfig := *config
+		for _, signer := range hostkeys.Signers() {
+			connConfig.AddHostKey(signer)
+		}
+
+		go acceptConn(conn, &connConfig, timeout, dataDir)
 	}
 }
 
@@ -359,8 +457,11 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 	//Initially set the timeout high, so people who type in their ssh key password can actually use rssh
 	realConn := &internal.TimeoutConn{Conn: c, Timeout: time.Duration(timeout) * time.Minute}
 
+	// Counted and limited outside of the timeout, so waiting on a rate limit does not look like the connection has died
+	meteredConn := bandwidth.NewConn(realConn)
+
 	// Before use, a handshake must be performed on the incoming net.Conn.
-	sshConn, chans, reqs, err := ssh.NewServerConn(realConn, config)
+	sshConn, chans, reqs, err := ssh.NewServerConn(meteredConn, config)
 	if err != nil {
 		log.Printf("Failed to handshake (%s)", err.Error())
 		return
@@ -397,6 +498,8 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 			return
 		}
 
+		accounting.TrackOperator(meteredConn, user.Username())
+
 		// Since we're handling a shell, local and remote forward, so we expect
 		// channel type of "session" or "direct-tcpip"
 		go func() {
@@ -425,17 +528,74 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 			return
 		}
 
+		disconnected := accounting.TrackClient(meteredConn, sshConn)
+
+		// Clients send their system information as soon as they connect, it follows the connected event so clients that never send it are not held up
+		connectedNotified := make(chan struct{})
 		go func() {
-			go ssh.DiscardRequests(reqs)
+			received := false
+			for req := range reqs {
+				switch req.Type {
+				case "client-info":
+					info, err := internal.ParseClientInfo(req.Payload)
+					if err != nil {
+						clientLog.Warning("Client sent invalid system information: %s", err)
+						req.Reply(false, nil)
+						continue
+					}
+
+					users.SetClientInfo(id, info)
+					req.Reply(true, nil)
+
+					if !received {
+						received = true
+
+						<-connectedNotified
+						observers.ConnectionState.Notify(observers.ClientState{
+							Status:    "info",
+							ID:        id,
+							IP:        sshConn.RemoteAddr().String(),
+							HostName:  username,
+							Version:   string(sshConn.ClientVersion()),
+							Timestamp: time.Now(),
+							Info:      &info,
+						})
+					}
+
+				case "update-confirmed":
+					replaced, ok := updates.Confirm(string(req.Payload))
+					if ok {
+						clientLog.Info("Client %s replaced %s, version %s", id, replaced, sshConn.ClientVersion())
+					}
+					req.Reply(ok, nil)
+				default:
+					if req.WantReply {
+						req.Reply(false, nil)
+					}
+				}
+			}
+		}()
 
+		go func() {
 			err = registerChannelCallbacks("", nil, chans, clientLog, map[string]func(_ string, user *users.User, newChannel ssh.NewChannel, log logger.Logger){
 				"rssh-download":   handlers.Download(dataDir),
 				"forwarded-tcpip": handlers.ServerPortForward(id),
+				"forwarded-udp":   udpforwards.Handler(id),
 			})
 
 			clientLog.Info("SSH client disconnected")
+
+			var info *internal.ClientInfo
+			if i, ok := users.GetClientInfo(id); ok {
+				info = &i
+			}
+
 			users.DisassociateClient(id, sshConn)
+			publish.StopClient(id)
+			socks.StopClient(id)
+			disconnected()
 
+			<-connectedNotified
 			observers.ConnectionState.Notify(observers.ClientState{
 				Status:    "disconnected",
 				ID:        id,
@@ -443,11 +603,25 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 				HostName:  username,
 				Version:   string(sshConn.ClientVersion()),
 				Timestamp: time.Now(),
+				Info:      info,
 			})
 		}()
 
 		clientLog.Info("New controllable connection from %s with id %s", color.BlueString(username), color.YellowString(id))
 
+		if hostkeys.Next() != nil {
+			go func() {
+				if err := hostkeys.Push(id, sshConn); err != nil {
+					clientLog.Warning("Unable to send trusted host keys to %s: %s", id, err)
+				}
+			}()
+		}
+
+		var info *internal.ClientInfo
+		if i, ok := users.GetClientInfo(id); ok {
+			info = &i
+		}
+
 		observers.ConnectionState.Notify(observers.ClientState{
 			Status:    "connected",
 			ID:        id,
@@ -455,7 +629,9 @@ func acceptConn(c net.Conn, config *ssh.ServerConfig, timeout int, dataDir strin
 			HostName:  username,
 			Version:   string(sshConn.ClientVersion()),
 			Timestamp: time.Now(),
+			Info:      info,
 		})
+		close(connectedNotified)
 
 	case "proxy":
 		clientLog.Info("New remote dynamic forward connected: %s", sshConn.ClientVersion())
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/observers"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParsePermitListenDirective(t *testing.T) {
+	for _, c := range []struct {
+		directive string
+		expected  []internal.PortRange
+		invalid   bool
+	}{
+		{directive: `"8000"`, expected: []internal.PortRange{{Low: 8000, High: 8000}}},
+		{directive: `"8000-8100,9000"`, expected: []internal.PortRange{{Low: 8000, High: 8100}, {Low: 9000, High: 9000}}},
+		{directive: `"*"`, expected: []internal.PortRange{{Low: 1, High: 65535}}},
+		{directive: `"none"`, expected: nil},
+		{directive: `"none,9000"`, expected: []internal.PortRange{{Low: 9000, High: 9000}}},
+		// Hosts are allowed as in openssh, but ignored
+		{directive: `"localhost:8000"`, expected: []internal.PortRange{{Low: 8000, High: 8000}}},
+		{directive: `"*:8000-8001"`, expected: []internal.PortRange{{Low: 8000, High: 8001}}},
+		{directive: `"[::1]:9000,127.0.0.1:*"`, expected: []internal.PortRange{{Low: 9000, High: 9000}, {Low: 1, High: 65535}}},
+
+		{directive: `""`, invalid: true},
+		{directive: `"8000,"`, invalid: true},
+		{directive: `"http"`, invalid: true},
+		{directive: `"70000"`, invalid: true},
+		{directive: `"-1"`, invalid: true},
+		{directive: `"8100-8000"`, invalid: true},
+		{directive: `"8000-"`, invalid: true},
+		{directive: `"localhost:"`, invalid: true},
+	} {
+		permitted, err := ParsePermitListenDirective(c.directive)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", c.directive, permitted)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", c.directive, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(permitted, c.expected) {
+			t.Errorf("%s: got %v, expected %v", c.directive, permitted, c.expected)
+		}
+	}
+}
+
+func testKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestCheckAuthListenRestrictions(t *testing.T) {
+	restricted, malformed, maxOnly, unrestricted, unlisted := testKey(t), testKey(t), testKey(t), testKey(t), testKey(t)
+
+	keys := `permitlisten="8000-8100,9000",max-listeners="2" ` + string(ssh.MarshalAuthorizedKey(restricted)) +
+		`permitlisten="80,http",max-listeners="many" ` + string(ssh.MarshalAuthorizedKey(malformed)) +
+		`max-listeners="3" ` + string(ssh.MarshalAuthorizedKey(maxOnly)) +
+		string(ssh.MarshalAuthorizedKey(unrestricted))
+
+	path := filepath.Join(t.TempDir(), "authorized_proxy_keys")
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		key      ssh.PublicKey
+		insecure bool
+
+		permitListen, maxListeners string
+		refused                    bool
+	}{
+		{name: "restricted", key: restricted, permitListen: "8000-8100,9000", maxListeners: "2"},
+		{name: "restricted with openproxy", key: restricted, insecure: true, permitListen: "8000-8100,9000", maxListeners: "2"},
+		// Fails closed rather than dropping the restrictions it could not read
+		{name: "malformed", key: malformed, permitListen: "none", maxListeners: "-1"},
+		{name: "max-listeners only", key: maxOnly, maxListeners: "3"},
+		{name: "unrestricted", key: unrestricted},
+		{name: "unlisted", key: unlisted, refused: true},
+		{name: "unlisted with openproxy", key: unlisted, insecure: true, permitListen: "1024-65535", maxListeners: "4"},
+	} {
+		perms, err := CheckAuth(path, c.key, net.ParseIP("127.0.0.1"), c.insecure)
+		if c.refused {
+			if err == nil {
+				t.Errorf("%s: key was let in", c.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+
+		permitListen, hasPermitListen := perms.Extensions["permitlisten"]
+		if hasPermitListen != (c.permitListen != "") || permitListen != c.permitListen {
+			t.Errorf("%s: permitlisten is %q (set: %t), expected %q", c.name, permitListen, hasPermitListen, c.permitListen)
+		}
+
+		maxListeners, hasMaxListeners := perms.Extensions["max-listeners"]
+		if hasMaxListeners != (c.maxListeners != "") || maxListeners != c.maxListeners {
+			t.Errorf("%s: max-listeners is %q (set: %t), expected %q", c.name, maxListeners, hasMaxListeners, c.maxListeners)
+		}
+	}
+}
+
+// connectClient connects a client to a server that lets it straight in, returning the connection state events for it
+func connectClient(t *testing.T) (*ssh.Client, <-chan observers.ClientState) {
+	t.Helper()
+
+	// Events go to every observer, so each client needs a name of its own to pick out its events
+	hostname, err := internal.RandomString(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, clientPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := ssh.NewSignerFromKey(clientPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"type": "client", "pubkey-fp": internal.FingerprintSHA256Hex(key)}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	events := make(chan observers.ClientState, 10)
+	id := observers.ConnectionState.Register(func(c observers.ClientState) {
+		if c.HostName == hostname {
+			events <- c
+		}
+	})
+	t.Cleanup(func() { observers.ConnectionState.Deregister(id) })
+
+	// Not a net.Pipe, as both ends write their version before reading
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dataDir := t.TempDir()
+	go func() {
+		server, err := l.Accept()
+		if err != nil {
+			return
+		}
+		acceptConn(server, config, 0, dataDir)
+	}()
+
+	client, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(client, "", &ssh.ClientConfig{
+		User:            hostname,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshClient := ssh.NewClient(conn, chans, reqs)
+	t.Cleanup(func() { sshClient.Close() })
+
+	return sshClient, events
+}
+
+func nextEvent(t *testing.T, events <-chan observers.ClientState, within time.Duration) observers.ClientState {
+	t.Helper()
+
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(within):
+		t.Fatalf("no connection state event within %s", within)
+		return observers.ClientState{}
+	}
+}
+
+func TestConnectedNotHeldForClientInfo(t *testing.T) {
+	// Older clients never send their system information, they should not have to wait for it
+	_, events := connectClient(t)
+
+	if e := nextEvent(t, events, 500*time.Millisecond); e.Status != "connected" || e.Info != nil {
+		t.Fatalf("expected a connected event without system information, got %+v", e)
+	}
+
+	client, events := connectClient(t)
+
+	if e := nextEvent(t, events, 500*time.Millisecond); e.Status != "connected" {
+		t.Fatalf("expected a connected event, got %+v", e)
+	}
+
+	if ok, _, err := client.SendRequest("client-info", true, ssh.Marshal(internal.ClientInfo{Hostname: "reporting", GoOS: "linux"})); err != nil || !ok {
+		t.Fatalf("client info was not accepted: %t %v", ok, err)
+	}
+
+	e := nextEvent(t, events, time.Second)
+	if e.Status != "info" || e.Info == nil || e.Info.Hostname != "reporting" {
+		t.Fatalf("expected the system information to follow the connected event, got %+v", e)
+	}
+
+	client.Close()
+	if e := nextEvent(t, events, time.Second); e.Status != "disconnected" {
+		t.Fatalf("expected a disconnected event, got %+v", e)
+	}
+}
@@ -0,0 +1,324 @@
+// Package udpforwards tracks the udp forwards started through clients by the listen command
+package udpforwards
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	inventory "github.com/NHAS/reverse_ssh/internal/forwards"
+	"github.com/NHAS/reverse_ssh/internal/server/users"
+	"github.com/NHAS/reverse_ssh/pkg/logger"
+	"github.com/NHAS/reverse_ssh/pkg/udpproxy"
+	"golang.org/x/crypto/ssh"
+)
+
+// Forward is a udp forward through a client
+type Forward struct {
+	ClientID string
+	// Where datagrams are received, on the server or (if Remote) on the client
+	Bind string
+	// Where datagrams are sent, from the client or (if Remote) from the server
+	Target string
+	Remote bool
+	// The user who started it
+	Owner string
+
+	proxy   *udpproxy.Proxy
+	client  ssh.Conn
+	forward *inventory.Forward
+}
+
+func (f *Forward) String() string {
+	if f.Remote {
+		return fmt.Sprintf("%s %s (client) -> %s (server)", f.ClientID, f.Bind, f.Target)
+	}
+	return fmt.Sprintf("%s %s (server) -> %s (client)", f.ClientID, f.Bind, f.Target)
+}
+
+func (f *Forward) key() string {
+	if f.Remote {
+		return forwardKey(f.ClientID, f.Bind, true)
+	}
+	return forwardKey("", f.Bind, false)
+}
+
+// Server listeners are unique across the server, client ones only per client
+func forwardKey(clientID, bind string, remote bool) string {
+	if remote {
+		return clientID + " " + bind
+	}
+	return "server " + bind
+}
+
+var (
+	lck      sync.Mutex
+	forwards = map[string]*Forward{}
+)
+
+// Start listens for udp on bind, sending each source address through the client in its own direct-udp channel
+func Start(owner, clientID string, client ssh.Conn, bind, target string) (*Forward, error) {
+	targetHost, targetPort, err := splitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+
+	bindHost, _, err := splitHostPort(bind)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.ListenPacket("udp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the address as it was given so it can be used to stop the forward, only filling in the port if any was asked for
+	bound := listener.LocalAddr().(*net.UDPAddr)
+
+	f := &Forward{
+		ClientID: clientID,
+		Bind:     net.JoinHostPort(bindHost, strconv.Itoa(bound.Port)),
+		Target:   target,
+		Owner:    owner,
+		client:   client,
+	}
+
+	f.proxy, _ = udpproxy.New(listener, func(from net.Addr) (net.Conn, error) {
+		source := from.(*net.UDPAddr)
+
+		drtMsg := internal.ChannelOpenDirectMsg{
+			Raddr: targetHost,
+			Rport: targetPort,
+
+			Laddr: source.IP.String(),
+			Lport: uint32(source.Port),
+		}
+
+		channel, reqs, err := client.OpenChannel("direct-udp", ssh.Marshal(&drtMsg))
+		if err != nil {
+			return nil, fmt.Errorf("client %s could not open udp forward to %s: %s", clientID, target, err)
+		}
+		go ssh.DiscardRequests(reqs)
+
+		return f.forward.Conn(udpproxy.NewStreamConn(channel, source, &net.UDPAddr{IP: net.ParseIP(targetHost), Port: int(targetPort)})), nil
+	})
+
+	if err := add(f); err != nil {
+		f.proxy.Close()
+		return nil, err
+	}
+
+	go func() {
+		f.proxy.Run()
+		remove(f)
+	}()
+
+	return f, nil
+}
+
+// StartRemote asks the client to listen for udp on bind, its forwarded-udp channels are then sent to target from the server
+func StartRemote(owner, clientID string, client ssh.Conn, bind, target string) (*Forward, error) {
+	bindHost, bindPort, err := splitHostPort(bind)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := splitHostPort(target); err != nil {
+		return nil, err
+	}
+
+	rf := internal.RemoteForwardRequest{
+		BindAddr: bindHost,
+		BindPort: bindPort,
+	}
+
+	ok, response, err := client.SendRequest("udp-forward", true, ssh.Marshal(&rf))
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		if len(response) == 0 {
+			response = []byte("client does not support udp forwarding (may be outdated)")
+		}
+		return nil, errors.New(string(response))
+	}
+
+	if rf.BindPort == 0 {
+		if err := ssh.Unmarshal(response, &rf.BindPort); err != nil {
+			return nil, fmt.Errorf("client sent an invalid port for the udp forward: %s", err)
+		}
+	}
+
+	f := &Forward{
+		ClientID: clientID,
+		Bind:     net.JoinHostPort(rf.BindAddr, strconv.Itoa(int(rf.BindPort))),
+		Target:   target,
+		Remote:   true,
+		Owner:    owner,
+		client:   client,
+	}
+
+	if err := add(f); err != nil {
+		client.SendRequest("cancel-udp-forward", false, ssh.Marshal(&rf))
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func add(f *Forward) error {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if _, ok := forwards[f.key()]; ok {
+		return fmt.Errorf("udp forward on %s already exists", f.Bind)
+	}
+
+	forwards[f.key()] = f
+
+	kind := inventory.UDP
+	if f.Remote {
+		kind = inventory.RemoteUDP
+	}
+
+	f.forward = inventory.Add(kind, f.Owner, f.ClientID, f.Bind, f.Target, func() error {
+		return Stop(f)
+	})
+
+	// Nothing can be forwarded once the client has gone
+	go func() {
+		f.client.Wait()
+		Stop(f)
+	}()
+
+	return nil
+}
+
+func remove(f *Forward) bool {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if forwards[f.key()] != f {
+		return false
+	}
+
+	delete(forwards, f.key())
+	f.forward.Remove()
+
+	return true
+}
+
+// Stop closes the forward, asking the client to stop listening if it is a remote forward
+func Stop(f *Forward) error {
+	if !remove(f) {
+		return nil
+	}
+
+	if !f.Remote {
+		return f.proxy.Close()
+	}
+
+	bindHost, bindPort, _ := splitHostPort(f.Bind)
+	rf := internal.RemoteForwardRequest{
+		BindAddr: bindHost,
+		BindPort: bindPort,
+	}
+
+	ok, response, err := f.client.SendRequest("cancel-udp-forward", true, ssh.Marshal(&rf))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New(string(response))
+	}
+
+	return nil
+}
+
+// Get finds a forward by the address it listens on, clientID is only needed for remote forwards
+func Get(clientID, bind string, remote bool) (*Forward, bool) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	f, ok := forwards[forwardKey(clientID, bind, remote)]
+	return f, ok
+}
+
+// All returns every forward sorted by client
+func All() (out []*Forward) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	for _, f := range forwards {
+		out = append(out, f)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].String() < out[j].String()
+	})
+
+	return out
+}
+
+// Handler handles forwarded-udp channels from a client, which are only accepted for a remote forward the server started
+// The client only picks which of its forwards the datagrams came from, never where they are sent
+func Handler(clientID string) func(_ string, _ *users.User, newChannel ssh.NewChannel, log logger.Logger) {
+	return func(_ string, _ *users.User, newChannel ssh.NewChannel, log logger.Logger) {
+		var drtMsg internal.ChannelOpenDirectMsg
+		err := ssh.Unmarshal(newChannel.ExtraData(), &drtMsg)
+		if err != nil {
+			log.Warning("Unable to unmarshal udp forward %s", err)
+			newChannel.Reject(ssh.ResourceShortage, "Unable to unmarshal udp forward")
+			return
+		}
+
+		bind := net.JoinHostPort(drtMsg.Raddr, strconv.Itoa(int(drtMsg.Rport)))
+
+		f, ok := Get(clientID, bind, true)
+		if !ok {
+			log.Warning("Client %s sent datagrams for udp forward %s which the server did not start", clientID, bind)
+			newChannel.Reject(ssh.Prohibited, "no udp forward on "+bind)
+			return
+		}
+
+		udpConn, err := net.Dial("udp", f.Target)
+		if err != nil {
+			log.Warning("Unable to dial udp forward target %s: %s", f.Target, err)
+			newChannel.Reject(ssh.ConnectionFailed, "Unable to connect to "+f.Target)
+			return
+		}
+		defer udpConn.Close()
+
+		connection, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Warning("Unable to accept new channel %s", err)
+			return
+		}
+		go ssh.DiscardRequests(requests)
+
+		originator := &net.UDPAddr{IP: net.ParseIP(drtMsg.Laddr), Port: int(drtMsg.Lport)}
+
+		udpproxy.Relay(udpproxy.NewStreamConn(connection, originator, udpConn.RemoteAddr()), f.forward.Conn(udpConn))
+	}
+}
+
+func splitHostPort(addr string) (string, uint32, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q: %s", port, err)
+	}
+
+	return host, uint32(p), nil
+}
@@ -0,0 +1,169 @@
+package updates
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
+	"golang.org/x/crypto/ssh"
+)
+
+type pendingUpdate struct {
+	id      string
+	conn    ssh.Conn
+	version string
+
+	timer  *time.Timer
+	result chan error
+}
+
+var (
+	lck sync.Mutex
+
+	// Token to the update waiting for the new client to connect
+	pending = map[string]*pendingUpdate{}
+)
+
+// Send streams a new client binary to a connected client, signed by the current host key. The client starts it, and keeps running
+// until the new client connects and is confirmed, or timeout passes and it is told to roll back.
+// The returned channel gets the outcome, nil if the new client connected
+func Send(id string, conn ssh.Conn, path, version string, timeout time.Duration) (<-chan error, error) {
+	binary, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := hostkeys.Current()
+	if signer == nil {
+		return nil, errors.New("server has no host key loaded")
+	}
+
+	token, err := internal.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	header := internal.UpdateHeader{
+		Version: version,
+		Token:   token,
+		Size:    uint64(len(binary)),
+		Timeout: uint32(timeout.Seconds()),
+	}
+
+	digest := sha256.Sum256(binary)
+	signature, err := signer.Sign(rand.Reader, internal.UpdateSignedData(header, digest[:]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign update: %s", err)
+	}
+	header.Signature = ssh.Marshal(signature)
+
+	ch, reqs, err := conn.OpenChannel("rssh-update", ssh.Marshal(header))
+	if err != nil {
+		return nil, fmt.Errorf("client refused update (may be outdated): %s", err)
+	}
+	defer ch.Close()
+
+	p := &pendingUpdate{
+		id:      id,
+		conn:    conn,
+		version: version,
+		result:  make(chan error, 1),
+	}
+
+	// Registered before the binary is sent, as the new client can connect before the old one tells us it started
+	lck.Lock()
+	pending[token] = p
+	lck.Unlock()
+
+	result, err := stream(ch, reqs, binary)
+	if err == nil && !result.Ok {
+		err = errors.New(result.Message)
+	}
+
+	if err != nil {
+		lck.Lock()
+		delete(pending, token)
+		lck.Unlock()
+
+		return nil, err
+	}
+
+	lck.Lock()
+	if _, ok := pending[token]; ok {
+		p.timer = time.AfterFunc(timeout, func() {
+			rollback(token)
+		})
+	}
+	lck.Unlock()
+
+	return p.result, nil
+}
+
+func stream(ch ssh.Channel, reqs <-chan *ssh.Request, binary []byte) (result internal.UpdateResult, err error) {
+	if _, err := ch.Write(binary); err != nil {
+		return result, fmt.Errorf("failed to send update: %s", err)
+	}
+	ch.CloseWrite()
+
+	for req := range reqs {
+		if req.Type != "update-result" {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		if err := ssh.Unmarshal(req.Payload, &result); err != nil {
+			return result, fmt.Errorf("client sent invalid update result: %s", err)
+		}
+
+		return result, nil
+	}
+
+	return result, errors.New("client closed the update channel without starting the update")
+}
+
+func rollback(token string) {
+	lck.Lock()
+	p, ok := pending[token]
+	delete(pending, token)
+	lck.Unlock()
+
+	if !ok {
+		return
+	}
+
+	log.Printf("Updated client for %s did not connect, rolling back", p.id)
+
+	p.conn.SendRequest("update-rollback", false, []byte(token))
+	p.result <- fmt.Errorf("new client did not connect in time, told %s to roll back", p.id)
+}
+
+// Confirm is called when a new client connects with an update token, and tells the client it replaced to exit.
+// Returns the id of the replaced client
+func Confirm(token string) (string, bool) {
+	lck.Lock()
+	p, ok := pending[token]
+	delete(pending, token)
+	lck.Unlock()
+
+	if !ok {
+		return "", false
+	}
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+
+	p.conn.SendRequest("update-confirmed", false, []byte(token))
+	p.result <- nil
+
+	return p.id, true
+}
@@ -0,0 +1,259 @@
+package updates
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
+	"golang.org/x/crypto/ssh"
+)
+
+// updateClient is the client end of a connection, which answers update channels the way a real client would
+type updateClient struct {
+	headers  chan internal.UpdateHeader
+	binaries chan []byte
+	requests chan *ssh.Request
+}
+
+func testSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// startUpdateClient connects a client to a stand in server, returning the servers side of the connection. The client starts every update if start is ok
+func startUpdateClient(t *testing.T, start internal.UpdateResult) (*ssh.ServerConn, *updateClient) {
+	t.Helper()
+
+	hostKey := testSigner(t)
+	if err := hostkeys.Load(t.TempDir(), hostKey); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	serverConns := make(chan *ssh.ServerConn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for newChannel := range chans {
+				newChannel.Reject(ssh.Prohibited, "no")
+			}
+		}()
+
+		serverConns <- sshConn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, "", &ssh.ClientConfig{HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+
+	c := &updateClient{
+		headers:  make(chan internal.UpdateHeader, 4),
+		binaries: make(chan []byte, 4),
+		requests: make(chan *ssh.Request, 4),
+	}
+
+	go func() {
+		for req := range reqs {
+			c.requests <- req
+		}
+	}()
+
+	go func() {
+		for newChannel := range chans {
+			var header internal.UpdateHeader
+			if newChannel.ChannelType() != "rssh-update" || ssh.Unmarshal(newChannel.ExtraData(), &header) != nil {
+				newChannel.Reject(ssh.UnknownChannelType, "no")
+				continue
+			}
+
+			ch, reqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+
+			binary, _ := io.ReadAll(ch)
+
+			c.headers <- header
+			c.binaries <- binary
+
+			ch.SendRequest("update-result", false, ssh.Marshal(start))
+		}
+	}()
+
+	select {
+	case sshConn := <-serverConns:
+		t.Cleanup(func() { sshConn.Close() })
+		return sshConn, c
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not connect")
+	}
+
+	return nil, nil
+}
+
+func writeBinary(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	binary := bytes.Repeat([]byte("new client"), 1000)
+	path := filepath.Join(t.TempDir(), "client")
+	if err := os.WriteFile(path, binary, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, binary
+}
+
+func (c *updateClient) expectRequest(t *testing.T, requestType string) *ssh.Request {
+	t.Helper()
+
+	select {
+	case req := <-c.requests:
+		if req.Type != requestType {
+			t.Fatalf("expected %s request, got %s", requestType, req.Type)
+		}
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s request", requestType)
+	}
+
+	return nil
+}
+
+func TestUpdateConfirmed(t *testing.T) {
+	conn, client := startUpdateClient(t, internal.UpdateResult{Ok: true})
+	path, binary := writeBinary(t)
+
+	outcome, err := Send("client1", conn, path, "v2.0.0", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := <-client.headers
+	if received := <-client.binaries; !bytes.Equal(received, binary) || header.Size != uint64(len(binary)) || header.Version != "v2.0.0" {
+		t.Fatalf("client got a %d byte binary, header %+v", len(received), header)
+	}
+
+	// The client only starts binaries signed by the key it verified the server with
+	signature := new(ssh.Signature)
+	if err := ssh.Unmarshal(header.Signature, signature); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(binary)
+	if err := hostkeys.Current().PublicKey().Verify(internal.UpdateSignedData(header, digest[:]), signature); err != nil {
+		t.Fatalf("update signature does not verify: %s", err)
+	}
+
+	// What the server does when the new client connects with the token
+	id, ok := Confirm(header.Token)
+	if !ok || id != "client1" {
+		t.Fatalf("expected the token to confirm the update of client1, got %q %t", id, ok)
+	}
+
+	if req := client.expectRequest(t, "update-confirmed"); string(req.Payload) != header.Token {
+		t.Fatalf("confirmation for the wrong token %q", req.Payload)
+	}
+
+	select {
+	case err := <-outcome:
+		if err != nil {
+			t.Fatalf("expected the update to succeed, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no outcome for the update")
+	}
+
+	if _, ok := Confirm(header.Token); ok {
+		t.Fatal("expected a token to only confirm once")
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	conn, client := startUpdateClient(t, internal.UpdateResult{Ok: true})
+	path, _ := writeBinary(t)
+
+	outcome, err := Send("client1", conn, path, "v2.0.0", 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := <-client.headers
+
+	// The new client never connects
+	if req := client.expectRequest(t, "update-rollback"); string(req.Payload) != header.Token {
+		t.Fatalf("rollback for the wrong token %q", req.Payload)
+	}
+
+	select {
+	case err := <-outcome:
+		if err == nil {
+			t.Fatal("expected the update to fail when the new client did not connect")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no outcome for the update")
+	}
+
+	if _, ok := Confirm(header.Token); ok {
+		t.Fatal("expected a rolled back update to not be confirmable")
+	}
+}
+
+func TestUpdateNotStarted(t *testing.T) {
+	conn, client := startUpdateClient(t, internal.UpdateResult{Ok: false, Message: "unable to write new binary"})
+	path, _ := writeBinary(t)
+
+	_, err := Send("client1", conn, path, "v2.0.0", time.Minute)
+	if err == nil || err.Error() != "unable to write new binary" {
+		t.Fatalf("expected the clients error, got %v", err)
+	}
+
+	header := <-client.headers
+	if _, ok := Confirm(header.Token); ok {
+		t.Fatal("expected an update that never started to not be confirmable")
+	}
+}
@@ -1,6 +1,8 @@
 package users
 
 import (
+	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 
@@ -24,6 +26,9 @@ var (
 	globalAutoComplete = trie.NewTrie()
 
 	PublicClientsAutoComplete = trie.NewTrie()
+
+	// What clients have told us about themselves, older clients never send this
+	clientInfo = map[string]internal.ClientInfo{}
 )
 
 func NormaliseHostname(hostname string) string {
@@ -128,6 +133,7 @@ func DisassociateClient(uniqueId string, conn *ssh.ServerConn) {
 
 	delete(allClients, uniqueId)
 	delete(uniqueIdToAllAliases, uniqueId)
+	delete(clientInfo, uniqueId)
 
 }
 
@@ -162,3 +168,43 @@ func _disassociateFromOwners(uniqueId, owners string) {
 		}
 	}
 }
+
+func SetClientInfo(uniqueId string, info internal.ClientInfo) {
+	lck.Lock()
+	defer lck.Unlock()
+
+	if _, ok := allClients[uniqueId]; !ok {
+		return
+	}
+
+	clientInfo[uniqueId] = info
+}
+
+func GetClientInfo(uniqueId string) (internal.ClientInfo, bool) {
+	lck.RLock()
+	defer lck.RUnlock()
+
+	info, ok := clientInfo[uniqueId]
+	return info, ok
+}
+
+// RefreshClientInfo asks the client to send its system information again, and stores the result
+func RefreshClientInfo(uniqueId string, conn ssh.Conn) (internal.ClientInfo, error) {
+	ok, payload, err := conn.SendRequest("client-info", true, nil)
+	if err != nil {
+		return internal.ClientInfo{}, err
+	}
+
+	if !ok {
+		return internal.ClientInfo{}, errors.New("client does not support sending system information")
+	}
+
+	info, err := internal.ParseClientInfo(payload)
+	if err != nil {
+		return internal.ClientInfo{}, fmt.Errorf("client sent invalid system information: %s", err)
+	}
+
+	SetClientInfo(uniqueId, info)
+
+	return info, nil
+}
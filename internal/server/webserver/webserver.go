@@ -11,24 +11,22 @@ import (
 	"strings"
 	"time"
 
-	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/NHAS/reverse_ssh/internal/server/accounting"
 	"github.com/NHAS/reverse_ssh/internal/server/data"
+	"github.com/NHAS/reverse_ssh/internal/server/publish"
 	"github.com/NHAS/reverse_ssh/internal/server/webserver/shellscripts"
 	"github.com/NHAS/reverse_ssh/pkg/logger"
-	"golang.org/x/crypto/ssh"
 )
 
 var (
 	DefaultConnectBack string
-	defaultFingerPrint string
 	projectRoot        string
 	webserverOn        bool
 )
 
-func Start(webListener net.Listener, connectBackAddress string, autogeneratedConnectBack bool, projRoot, dataDir string, publicKey ssh.PublicKey) {
+func Start(webListener net.Listener, connectBackAddress string, autogeneratedConnectBack bool, projRoot, dataDir string) {
 	projectRoot = projRoot
 	DefaultConnectBack = connectBackAddress
-	defaultFingerPrint = internal.FingerprintSHA256Hex(publicKey)
 
 	err := startBuildManager(filepath.Join(dataDir, "cache"))
 	if err != nil {
@@ -44,10 +42,15 @@ func Start(webListener net.Listener, connectBackAddress string, autogeneratedCon
 	log.Println("Started Web Server")
 	webserverOn = true
 
-	log.Fatal(srv.Serve(webListener))
+	log.Fatal(srv.Serve(accounting.TrackWebserver(webListener)))
 
 }
 
+// Enabled reports whether the webserver is serving downloads and published services
+func Enabled() bool {
+	return webserverOn
+}
+
 const notFound = `<html>
 <head><title>404 Not Found</title></head>
 <body>
@@ -72,6 +75,12 @@ func buildAndServe(autogeneratedConnectBack bool) http.HandlerFunc {
 		if err != nil {
 			f, err = data.GetDownload(filenameWithoutExtension)
 			if err != nil {
+				// Downloads come first so a published service can never take the place of one
+				if published, ok := publish.Match(req); ok {
+					published.ServeHTTP(w, req)
+					return
+				}
+
 				log.Println("could not get: ", filenameWithoutExtension, " err: ", err)
 
 				w.Header().Set("content-type", "text/html")
@@ -126,6 +126,30 @@ func (pl *ParsedLine) GetArgsString(flag string) ([]string, error) {
 	return nil, ErrFlagNotSet
 }
 
+// GetArgsStringOrdered returns the arguments of every occurrence of a flag in the order they were written, e.g -s a -s b gives [a, b]
+func (pl *ParsedLine) GetArgsStringOrdered(flag string) (out []string, err error) {
+	found := false
+	previous := 0
+	for _, f := range pl.FlagsOrdered {
+		if f.Value() != flag {
+			continue
+		}
+		found = true
+
+		// Each occurrence of a repeated flag has the arguments of the previous occurrences appended to it
+		for _, arg := range f.Args[:len(f.Args)-previous] {
+			out = append(out, arg.Value())
+		}
+		previous = len(f.Args)
+	}
+
+	if !found {
+		return nil, ErrFlagNotSet
+	}
+
+	return out, nil
+}
+
 func (pl *ParsedLine) GetArg(flag string) (Argument, error) {
 	arg, err := pl.ExpectArgs(flag, 1)
 	if err != nil {
@@ -231,3 +231,27 @@ func TestQuoteHandling(t *testing.T) {
 		}
 	}
 }
+
+func TestRepeatedFlagsOrdered(t *testing.T) {
+	line := ParseLine("link -s first:1 -s second:2 third:3 --tls -s fourth:4", 0)
+
+	c, err := line.GetArgsStringOrdered("s")
+	if err != nil {
+		t.Fatalf("Did not expect to get an error here: %s", err)
+	}
+
+	expected := []string{"first:1", "second:2", "third:3", "fourth:4"}
+	if len(c) != len(expected) {
+		t.Fatalf("expected %d arguments got %d: %v", len(expected), len(c), c)
+	}
+
+	for i := range expected {
+		if c[i] != expected[i] {
+			t.Fatalf("expected %v got %v", expected, c)
+		}
+	}
+
+	if _, err := line.GetArgsStringOrdered("missing"); err != ErrFlagNotSet {
+		t.Fatalf("expected flag not set error, got %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Protocols a tun policy can allow
+var TunProtocols = []string{"tcp", "udp", "icmp"}
+
+// TunPolicy limits where traffic sent into a tun session is forwarded, the zero value allows everything
+type TunPolicy struct {
+	// If set, destinations must be in one of these
+	Allow []netip.Prefix
+	// Destinations in these are refused even if they are allowed
+	Deny []netip.Prefix
+	// If set, tcp and udp destination ports must be in one of these
+	Ports []PortRange
+	// If set, only these protocols are forwarded
+	Protocols []string
+
+	// Concurrent tcp and udp flows per tunnel, 0 is unlimited
+	MaxFlows int
+}
+
+type PortRange struct {
+	Low, High uint16
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Low && port <= r.High
+}
+
+func (r PortRange) String() string {
+	if r.Low == r.High {
+		return strconv.Itoa(int(r.Low))
+	}
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
+}
+
+// ParseTunPolicy parses a policy in the form allow=10.0.0.0/8,deny=10.0.0.1,port=22,port=8000-9000,proto=tcp,max-flows=100
+// allow, deny, port and proto can be repeated, and an empty string is the policy that allows everything
+func ParseTunPolicy(s string) (TunPolicy, error) {
+	var policy TunPolicy
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return policy, fmt.Errorf("tun policy option %q is not in the form key=value", part)
+		}
+
+		var err error
+		switch strings.ToLower(key) {
+		case "allow", "deny":
+			var prefix netip.Prefix
+			prefix, err = parsePrefix(value)
+			if err != nil {
+				break
+			}
+
+			if strings.ToLower(key) == "allow" {
+				policy.Allow = append(policy.Allow, prefix)
+			} else {
+				policy.Deny = append(policy.Deny, prefix)
+			}
+		case "port":
+			var portRange PortRange
+			portRange, err = ParsePortRange(value)
+			if err == nil {
+				policy.Ports = append(policy.Ports, portRange)
+			}
+		case "proto":
+			value = strings.ToLower(value)
+			if !slices.Contains(TunProtocols, value) {
+				err = fmt.Errorf("must be one of %s", strings.Join(TunProtocols, ", "))
+				break
+			}
+
+			if !slices.Contains(policy.Protocols, value) {
+				policy.Protocols = append(policy.Protocols, value)
+			}
+		case "max-flows":
+			policy.MaxFlows, err = strconv.Atoi(value)
+			if err == nil && policy.MaxFlows < 0 {
+				err = errors.New("cannot be negative")
+			}
+		default:
+			return policy, fmt.Errorf("unknown tun policy option %q", key)
+		}
+
+		if err != nil {
+			return policy, fmt.Errorf("invalid value for tun policy option %q: %s", key, err)
+		}
+	}
+
+	return policy, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ParsePortRange parses a port, or an inclusive range of ports e.g 8000-9000
+func ParsePortRange(s string) (PortRange, error) {
+	low, high, isRange := strings.Cut(s, "-")
+	if !isRange {
+		high = low
+	}
+
+	l, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	h, err := strconv.ParseUint(high, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	if l > h {
+		return PortRange{}, fmt.Errorf("range %q is backwards", s)
+	}
+
+	return PortRange{Low: uint16(l), High: uint16(h)}, nil
+}
+
+func (p TunPolicy) IsZero() bool {
+	return len(p.Allow) == 0 && len(p.Deny) == 0 && len(p.Ports) == 0 && len(p.Protocols) == 0 && p.MaxFlows == 0
+}
+
+func (p TunPolicy) String() string {
+	var parts []string
+	for _, prefix := range p.Allow {
+		parts = append(parts, "allow="+prefix.String())
+	}
+	for _, prefix := range p.Deny {
+		parts = append(parts, "deny="+prefix.String())
+	}
+	for _, portRange := range p.Ports {
+		parts = append(parts, "port="+portRange.String())
+	}
+	for _, protocol := range p.Protocols {
+		parts = append(parts, "proto="+protocol)
+	}
+	if p.MaxFlows > 0 {
+		parts = append(parts, fmt.Sprintf("max-flows=%d", p.MaxFlows))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Check returns an error saying why the policy refuses a flow, port is ignored for icmp
+func (p TunPolicy) Check(protocol string, destination netip.Addr, port uint16) error {
+	if len(p.Protocols) > 0 && !slices.Contains(p.Protocols, protocol) {
+		return fmt.Errorf("protocol %s is not allowed", protocol)
+	}
+
+	destination = destination.Unmap()
+
+	for _, prefix := range p.Deny {
+		if prefix.Contains(destination) {
+			return fmt.Errorf("%s is denied by %s", destination, prefix)
+		}
+	}
+
+	if len(p.Allow) > 0 && !slices.ContainsFunc(p.Allow, func(prefix netip.Prefix) bool { return prefix.Contains(destination) }) {
+		return fmt.Errorf("%s is not in an allowed range", destination)
+	}
+
+	if protocol != "icmp" && len(p.Ports) > 0 && !slices.ContainsFunc(p.Ports, func(r PortRange) bool { return r.Contains(port) }) {
+		return fmt.Errorf("port %d is not allowed", port)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// UpdateHeader is the extra data of the "rssh-update" channel, the new client binary is streamed over the channel itself
+type UpdateHeader struct {
+	Version string
+	// Sent back by the new client when it connects, so the server can match it to the client it replaced
+	Token string
+	Size  uint64
+	// Seconds the server will wait for the new client before telling the old one to roll back
+	Timeout uint32
+	// ssh.Signature by the servers host key over UpdateSignedData
+	Signature []byte
+}
+
+// UpdateResult is sent by the client ("update-result") once it has either started the new binary or refused the update
+type UpdateResult struct {
+	Ok      bool
+	Message string
+}
+
+// UpdateSignedData is what the server signs, so a client only runs a binary that came from the server it verified when connecting
+func UpdateSignedData(header UpdateHeader, sha256 []byte) []byte {
+	return ssh.Marshal(struct {
+		Purpose string
+		Version string
+		Token   string
+		Size    uint64
+		Timeout uint32
+		SHA256  []byte
+	}{
+		Purpose: "rssh-update",
+		Version: header.Version,
+		Token:   header.Token,
+		Size:    header.Size,
+		Timeout: header.Timeout,
+		SHA256:  sha256,
+	})
+}
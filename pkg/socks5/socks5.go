@@ -0,0 +1,552 @@
+// Package socks5 is a SOCKS5 (RFC 1928) server supporting CONNECT, BIND and UDP ASSOCIATE, with optional username/password auth (RFC 1929)
+// Where connections actually go is up to the caller, so they can be made through something other than the local network stack
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/pkg/udpproxy"
+)
+
+const (
+	socksVersion = 5
+
+	authNone         = 0
+	authPassword     = 2
+	authNoAcceptable = 0xff
+
+	passwordAuthVersion = 1
+
+	cmdConnect      = 1
+	cmdBind         = 2
+	cmdUDPAssociate = 3
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+// Reply codes
+const (
+	ReplySucceeded           = 0
+	ReplyGeneralFailure      = 1
+	ReplyNotAllowed          = 2
+	ReplyNetworkUnreachable  = 3
+	ReplyHostUnreachable     = 4
+	ReplyConnectionRefused   = 5
+	ReplyCommandNotSupported = 7
+	ReplyAddressNotSupported = 8
+)
+
+const (
+	// How long a client has to finish negotiating
+	handshakeTimeout = 30 * time.Second
+	// How long a BIND waits for the peer to connect
+	bindTimeout = 2 * time.Minute
+)
+
+// ReplyError lets Dial, DialUDP and Bind choose the reply code sent to the client, other errors are sent as host unreachable
+type ReplyError struct {
+	Reply byte
+	Err   error
+}
+
+func (e *ReplyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// Server answers SOCKS5 requests, commands without a function are refused as not supported
+type Server struct {
+	// If set clients must authenticate with a username and password, otherwise no authentication is offered
+	Authenticate func(username, password string) bool
+
+	// If set every request is checked with it first, a ReplyError sets the reply code
+	Allow func(from net.Addr) error
+
+	// CONNECT, addr is host:port where host may be a domain name
+	Dial func(addr string, from net.Addr) (net.Conn, error)
+
+	// UDP ASSOCIATE, called for each destination. The connection must keep datagram boundaries and is closed after it has been idle
+	DialUDP func(addr string, from net.Addr) (net.Conn, error)
+
+	// BIND, peer is the address the client expects to connect. The listener only needs to accept one connection, with the peer as its RemoteAddr
+	Bind func(peer string, from net.Addr) (net.Listener, error)
+
+	// Called with anything that went wrong for a client, may be nil
+	Logf func(format string, args ...interface{})
+}
+
+// Serve answers clients from l until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.ServeConn(conn); err != nil && s.Logf != nil {
+				s.Logf("socks client %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn answers a single client, closing conn when done
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	if err := s.negotiate(conn); err != nil {
+		return err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+
+	target, err := readAddr(conn)
+	if err != nil {
+		if errors.Is(err, errAddressType) {
+			writeReply(conn, ReplyAddressNotSupported, nil)
+		}
+		return err
+	}
+
+	if s.Allow != nil {
+		if err := s.Allow(conn.RemoteAddr()); err != nil {
+			writeReply(conn, replyCode(err, ReplyNotAllowed), nil)
+			return err
+		}
+	}
+
+	switch {
+	case header[1] == cmdConnect && s.Dial != nil:
+		return s.connect(conn, target)
+	case header[1] == cmdBind && s.Bind != nil:
+		return s.bind(conn, target)
+	case header[1] == cmdUDPAssociate && s.DialUDP != nil:
+		return s.associate(conn, target)
+	}
+
+	writeReply(conn, ReplyCommandNotSupported, nil)
+	return fmt.Errorf("unsupported command %d", header[1])
+}
+
+func (s *Server) negotiate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	wanted := byte(authNone)
+	if s.Authenticate != nil {
+		wanted = authPassword
+	}
+
+	offered := false
+	for _, method := range methods {
+		offered = offered || method == wanted
+	}
+
+	if !offered {
+		conn.Write([]byte{socksVersion, authNoAcceptable})
+		return errors.New("no acceptable authentication method offered")
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, wanted}); err != nil {
+		return err
+	}
+
+	if wanted == authNone {
+		return nil
+	}
+
+	// RFC 1929, VER ULEN UNAME PLEN PASSWD
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+
+	if version[0] != passwordAuthVersion {
+		return fmt.Errorf("unsupported password authentication version %d", version[0])
+	}
+
+	username, err := readString(conn)
+	if err != nil {
+		return err
+	}
+
+	password, err := readString(conn)
+	if err != nil {
+		return err
+	}
+
+	if !s.Authenticate(username, password) {
+		conn.Write([]byte{passwordAuthVersion, 1})
+		return fmt.Errorf("authentication failed for %q", username)
+	}
+
+	_, err = conn.Write([]byte{passwordAuthVersion, 0})
+	return err
+}
+
+func (s *Server) connect(conn net.Conn, target string) error {
+	remote, err := s.Dial(target, conn.RemoteAddr())
+	if err != nil {
+		writeReply(conn, replyCode(err, ReplyHostUnreachable), nil)
+		return fmt.Errorf("connect to %s failed: %s", target, err)
+	}
+	defer remote.Close()
+
+	if err := writeReply(conn, ReplySucceeded, remote.LocalAddr()); err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	splice(conn, remote)
+	return nil
+}
+
+func (s *Server) bind(conn net.Conn, peer string) error {
+	l, err := s.Bind(peer, conn.RemoteAddr())
+	if err != nil {
+		writeReply(conn, replyCode(err, ReplyGeneralFailure), nil)
+		return fmt.Errorf("bind for %s failed: %s", peer, err)
+	}
+	defer l.Close()
+
+	if err := writeReply(conn, ReplySucceeded, l.Addr()); err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	timeout := time.AfterFunc(bindTimeout, func() {
+		l.Close()
+	})
+
+	remote, err := l.Accept()
+	timeout.Stop()
+	if err != nil {
+		writeReply(conn, ReplyGeneralFailure, nil)
+		return fmt.Errorf("bind for %s did not get a connection: %s", peer, err)
+	}
+	defer remote.Close()
+
+	// Only the peer the client told us about may use the binding, if it gave an address
+	if expected, err := netip.ParseAddrPort(peer); err == nil && !expected.Addr().IsUnspecified() {
+		if actual, err := netip.ParseAddrPort(remote.RemoteAddr().String()); err != nil || actual.Addr().Unmap() != expected.Addr().Unmap() {
+			writeReply(conn, ReplyNotAllowed, nil)
+			return fmt.Errorf("bind for %s was connected to by %s", peer, remote.RemoteAddr())
+		}
+	}
+
+	if err := writeReply(conn, ReplySucceeded, remote.RemoteAddr()); err != nil {
+		return err
+	}
+
+	splice(conn, remote)
+	return nil
+}
+
+// associate relays datagrams between the client and each destination it sends to, for as long as the control connection stays open
+func (s *Server) associate(conn net.Conn, requested string) error {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		writeReply(conn, ReplyGeneralFailure, nil)
+		return errors.New("udp associate needs a tcp control connection")
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeReply(conn, ReplyGeneralFailure, nil)
+		return err
+	}
+	defer relay.Close()
+
+	if err := writeReply(conn, ReplySucceeded, relay.LocalAddr()); err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// The association ends when the client closes the control connection
+	go func() {
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+
+	clientIP, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+
+	// The client can say which port it will send from, otherwise it is the first one we hear from
+	var clientAddr netip.AddrPort
+	if expected, err := netip.ParseAddrPort(requested); err == nil && expected.Port() != 0 {
+		clientAddr = netip.AddrPortFrom(clientIP.Addr().Unmap(), expected.Port())
+	}
+
+	var (
+		destinationsLck sync.Mutex
+		destinations    = map[string]net.Conn{}
+	)
+
+	defer func() {
+		destinationsLck.Lock()
+		defer destinationsLck.Unlock()
+
+		for _, d := range destinations {
+			d.Close()
+		}
+	}()
+
+	buff := make([]byte, udpproxy.BufSize)
+	for {
+		n, from, err := relay.ReadFromUDPAddrPort(buff)
+		if err != nil {
+			return nil
+		}
+
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if from.Addr() != clientIP.Addr().Unmap() || (clientAddr.IsValid() && from != clientAddr) {
+			continue
+		}
+		clientAddr = from
+
+		// RSV RSV FRAG, fragments are not supported so are dropped as the RFC allows
+		if n < 4 || buff[2] != 0 {
+			continue
+		}
+
+		target, headerLength, err := parseAddr(buff[3:n])
+		if err != nil {
+			continue
+		}
+		payload := buff[3+headerLength : n]
+
+		destinationsLck.Lock()
+		destination, ok := destinations[target]
+		destinationsLck.Unlock()
+
+		if !ok {
+			// Opening a destination can take a round trip to wherever it is dialled from, so it is done without holding the lock the replies need to clean up
+			destination, err = s.DialUDP(target, conn.RemoteAddr())
+			if err != nil {
+				if s.Logf != nil {
+					s.Logf("socks client %s: udp to %s failed: %s", conn.RemoteAddr(), target, err)
+				}
+				continue
+			}
+
+			destinationsLck.Lock()
+			destinations[target] = destination
+			destinationsLck.Unlock()
+
+			go func(target string, destination net.Conn, replyTo netip.AddrPort) {
+				defer func() {
+					destinationsLck.Lock()
+					if destinations[target] == destination {
+						delete(destinations, target)
+					}
+					destinationsLck.Unlock()
+
+					destination.Close()
+				}()
+
+				header, err := appendAddr([]byte{0, 0, 0}, target)
+				if err != nil {
+					return
+				}
+
+				reply := make([]byte, udpproxy.BufSize)
+				for {
+					destination.SetReadDeadline(time.Now().Add(udpproxy.ConnTrackTimeout))
+
+					n, err := destination.Read(reply)
+					if err != nil {
+						return
+					}
+
+					if _, err := relay.WriteToUDPAddrPort(append(header, reply[:n]...), replyTo); err != nil {
+						return
+					}
+				}
+			}(target, destination, clientAddr)
+		}
+
+		destination.SetReadDeadline(time.Now().Add(udpproxy.ConnTrackTimeout))
+		destination.Write(payload)
+	}
+}
+
+func replyCode(err error, fallback byte) byte {
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Reply
+	}
+	return fallback
+}
+
+// writeReply sends VER REP RSV ATYP BND.ADDR BND.PORT, with an all zero address if bound is nil or not an ip address
+func writeReply(conn net.Conn, code byte, bound net.Addr) error {
+	header := []byte{socksVersion, code, 0}
+
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+
+	reply, err := appendAddr(header, addr)
+	if err != nil {
+		reply, _ = appendAddr(header, "0.0.0.0:0")
+	}
+
+	_, err = conn.Write(reply)
+	return err
+}
+
+func splice(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+		close(done)
+	}()
+
+	io.Copy(b, a)
+	b.Close()
+	<-done
+}
+
+var errAddressType = errors.New("unsupported address type")
+
+// readAddr reads ATYP DST.ADDR DST.PORT from a stream
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		domain, err := readString(r)
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	default:
+		return "", errAddressType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// parseAddr is readAddr for a datagram header, also returning how many bytes the address took
+func parseAddr(b []byte) (string, int, error) {
+	r := &countingReader{b: b}
+	addr, err := readAddr(r)
+	return addr, r.read, err
+}
+
+type countingReader struct {
+	b    []byte
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.read >= len(c.b) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, c.b[c.read:])
+	c.read += n
+	return n, nil
+}
+
+// appendAddr writes addr (host:port, host may be a domain) as ATYP ADDR PORT
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			b = append(b, atypIPv4)
+		} else {
+			b = append(b, atypIPv6)
+		}
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain %q is too long", host)
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func readString(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+
+	s := make([]byte, length[0])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+
+	return string(s), nil
+}
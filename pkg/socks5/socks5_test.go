@@ -0,0 +1,339 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go s.Serve(l)
+
+	return l.Addr().String()
+}
+
+func echoTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func request(t *testing.T, conn net.Conn, cmd byte, addr string) (byte, string) {
+	req, err := appendAddr([]byte{socksVersion, cmd, 0}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	bound, err := readAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reply[1], bound
+}
+
+func TestConnectWithPassword(t *testing.T) {
+	echo := echoTCP(t)
+
+	addr := startServer(t, &Server{
+		Authenticate: func(username, password string) bool {
+			return username == "user" && password == "pass"
+		},
+		Dial: func(addr string, _ net.Addr) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		},
+	})
+
+	login := func(password string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		conn.Write([]byte{socksVersion, 1, authPassword})
+
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(conn, method); err != nil || method[1] != authPassword {
+			t.Fatalf("expected password auth to be chosen, got %v %v", method, err)
+		}
+
+		auth := []byte{passwordAuthVersion, 4}
+		auth = append(auth, "user"...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		conn.Write(auth)
+
+		status := make([]byte, 2)
+		io.ReadFull(conn, status)
+
+		return conn, status[1]
+	}
+
+	conn, status := login("wrong")
+	conn.Close()
+	if status == 0 {
+		t.Fatal("wrong password was accepted")
+	}
+
+	conn, status = login("pass")
+	defer conn.Close()
+	if status != 0 {
+		t.Fatal("correct password was refused")
+	}
+
+	if reply, _ := request(t, conn, cmdConnect, echo); reply != ReplySucceeded {
+		t.Fatalf("connect failed with %d", reply)
+	}
+
+	conn.Write([]byte("hello"))
+
+	buff := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buff); err != nil || string(buff) != "hello" {
+		t.Fatalf("expected echo, got %q %v", buff, err)
+	}
+}
+
+func TestRefusedRequests(t *testing.T) {
+	dial := func(addr string, _ net.Addr) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	denied := startServer(t, &Server{
+		Allow: func(net.Addr) error {
+			return &ReplyError{Reply: ReplyNotAllowed, Err: io.EOF}
+		},
+		Dial: dial,
+	})
+
+	connectOnly := startServer(t, &Server{
+		Dial: dial,
+	})
+
+	for _, c := range []struct {
+		server   string
+		cmd      byte
+		expected byte
+	}{
+		{denied, cmdConnect, ReplyNotAllowed},
+		{connectOnly, cmdBind, ReplyCommandNotSupported},
+		{connectOnly, cmdUDPAssociate, ReplyCommandNotSupported},
+	} {
+		conn, err := net.Dial("tcp", c.server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		conn.Write([]byte{socksVersion, 1, authNone})
+		io.ReadFull(conn, make([]byte, 2))
+
+		if reply, _ := request(t, conn, c.cmd, "127.0.0.1:1"); reply != c.expected {
+			t.Fatalf("command %d: expected reply %d, got %d", c.cmd, c.expected, reply)
+		}
+		conn.Close()
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	go func() {
+		buff := make([]byte, 1024)
+		for {
+			n, from, err := target.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			target.WriteTo(append([]byte("echo "), buff[:n]...), from)
+		}
+	}()
+
+	addr := startServer(t, &Server{
+		DialUDP: func(addr string, _ net.Addr) (net.Conn, error) {
+			return net.Dial("udp", addr)
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{socksVersion, 1, authNone})
+	io.ReadFull(conn, make([]byte, 2))
+
+	reply, relay := request(t, conn, cmdUDPAssociate, "0.0.0.0:0")
+	if reply != ReplySucceeded {
+		t.Fatalf("udp associate failed with %d", reply)
+	}
+
+	udpConn, err := net.Dial("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	header, err := appendAddr([]byte{0, 0, 0}, target.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := udpConn.Write(append(header, "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	buff := make([]byte, 1024)
+	n, err := udpConn.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(buff[:n], header) {
+		t.Fatalf("reply should have the target address in its header, got %v", buff[:n])
+	}
+
+	if got := string(buff[len(header):n]); got != "echo ping" {
+		t.Fatalf("expected echo, got %q", got)
+	}
+
+	port := binary.BigEndian.Uint16(header[len(header)-2:])
+	if int(port) != target.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatal("header port does not match target")
+	}
+}
+
+// closeNotifyConn reports when the server closes a destination
+type closeNotifyConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return c.Conn.Close()
+}
+
+func TestUDPAssociateSlowDial(t *testing.T) {
+	fastTarget, slowTarget := "127.0.0.1:1001", "127.0.0.1:1002"
+
+	fast, peer := net.Pipe()
+	defer peer.Close()
+	fastConn := &closeNotifyConn{Conn: fast, closed: make(chan struct{})}
+
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	addr := startServer(t, &Server{
+		DialUDP: func(addr string, _ net.Addr) (net.Conn, error) {
+			if addr == fastTarget {
+				return fastConn, nil
+			}
+
+			close(dialing)
+			<-release
+			return nil, io.EOF
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{socksVersion, 1, authNone})
+	io.ReadFull(conn, make([]byte, 2))
+
+	reply, relay := request(t, conn, cmdUDPAssociate, "0.0.0.0:0")
+	if reply != ReplySucceeded {
+		t.Fatalf("udp associate failed with %d", reply)
+	}
+
+	udpConn, err := net.Dial("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	for _, target := range []string{fastTarget, slowTarget} {
+		header, err := appendAddr([]byte{0, 0, 0}, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := udpConn.Write(append(header, "ping"...)); err != nil {
+			t.Fatal(err)
+		}
+
+		if target == fastTarget {
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(peer, make([]byte, 4)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	select {
+	case <-dialing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow destination was never dialled")
+	}
+
+	// The fast destination going away has to be cleaned up while the slow one is still being dialled
+	peer.Close()
+
+	select {
+	case <-fastConn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a destination could not be cleaned up while another was being dialled")
+	}
+}
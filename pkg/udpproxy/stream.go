@@ -0,0 +1,175 @@
+package udpproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StreamConn carries datagrams over a stream, like an ssh channel, by prefixing each one with its length as a big endian uint16
+type StreamConn struct {
+	stream io.ReadWriteCloser
+
+	local, remote net.Addr
+
+	readLck  sync.Mutex
+	writeLck sync.Mutex
+
+	deadlineLck sync.Mutex
+	deadline    *time.Timer
+}
+
+// NewStreamConn wraps stream, local and remote are only reported by LocalAddr and RemoteAddr
+func NewStreamConn(stream io.ReadWriteCloser, local, remote net.Addr) *StreamConn {
+	return &StreamConn{
+		stream: stream,
+		local:  local,
+		remote: remote,
+	}
+}
+
+// Read reads one datagram, like udp anything that doesnt fit in b is discarded
+func (c *StreamConn) Read(b []byte) (int, error) {
+	c.readLck.Lock()
+	defer c.readLck.Unlock()
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.stream, header[:]); err != nil {
+		return 0, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[:]))
+
+	n, err := io.ReadFull(c.stream, b[:min(length, len(b))])
+	if err != nil {
+		return n, err
+	}
+
+	if length > n {
+		if _, err := io.CopyN(io.Discard, c.stream, int64(length-n)); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Write sends b as one datagram
+func (c *StreamConn) Write(b []byte) (int, error) {
+	if len(b) > BufSize {
+		return 0, fmt.Errorf("datagram of %d bytes is larger than the maximum %d", len(b), BufSize)
+	}
+
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	c.writeLck.Lock()
+	defer c.writeLck.Unlock()
+
+	if _, err := c.stream.Write(frame); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *StreamConn) Close() error {
+	c.deadlineLck.Lock()
+	if c.deadline != nil {
+		c.deadline.Stop()
+	}
+	c.deadlineLck.Unlock()
+
+	return c.stream.Close()
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline is the same as SetReadDeadline
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline closes the stream if it isnt moved again before t. Streams cant interrupt a read without closing, and expiring an idle flow is all
+// the proxy uses deadlines for
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLck.Lock()
+	defer c.deadlineLck.Unlock()
+
+	switch {
+	case t.IsZero():
+		if c.deadline != nil {
+			c.deadline.Stop()
+		}
+	case c.deadline != nil:
+		c.deadline.Reset(time.Until(t))
+	default:
+		c.deadline = time.AfterFunc(time.Until(t), func() {
+			c.stream.Close()
+		})
+	}
+
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes to a stream only block while its window is full
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Relay copies datagrams between a and b until either is closed, or no datagram has gone either way for ConnTrackTimeout
+func Relay(a, b net.Conn) {
+	refresh := func() {
+		deadline := time.Now().Add(ConnTrackTimeout)
+		_ = a.SetReadDeadline(deadline)
+		_ = b.SetReadDeadline(deadline)
+	}
+	refresh()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyDatagrams := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		// Either side finishing ends the relay
+		defer dst.Close()
+		defer src.Close()
+
+		buff := make([]byte, BufSize)
+		for {
+			n, err := src.Read(buff)
+			if err != nil {
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					// An earlier write had nothing listening for it, the target may still come up
+					continue
+				}
+				return
+			}
+
+			// Traffic in either direction keeps the flow alive, so one way protocols like syslog dont expire
+			refresh()
+
+			if _, err := dst.Write(buff[:n]); err != nil {
+				return
+			}
+		}
+	}
+
+	go copyDatagrams(a, b)
+	go copyDatagrams(b, a)
+
+	wg.Wait()
+}
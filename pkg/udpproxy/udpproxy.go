@@ -0,0 +1,171 @@
+// Package udpproxy forwards udp datagrams from a listener to a connection per source address, and carries datagrams over streams such as ssh channels
+package udpproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Modified version of https://github.com/moby/moby/blob/master/cmd/docker-proxy/udp_proxy.go and
+// https://github.com/moby/vpnkit/blob/master/go/pkg/libproxy/udp_proxy.go
+
+const (
+	// ConnTrackTimeout is the timeout used for UDP connection tracking
+	ConnTrackTimeout = 90 * time.Second
+	// BufSize is the buffer size for the UDP proxy
+	BufSize = 65507
+)
+
+// A net.Addr where the IP is split into two fields so you can use it as a key
+// in a map:
+type connTrackKey struct {
+	IPHigh uint64
+	IPLow  uint64
+	Port   int
+}
+
+func newConnTrackKey(addr *net.UDPAddr) *connTrackKey {
+	if len(addr.IP) == net.IPv4len {
+		return &connTrackKey{
+			IPHigh: 0,
+			IPLow:  uint64(binary.BigEndian.Uint32(addr.IP)),
+			Port:   addr.Port,
+		}
+	}
+	return &connTrackKey{
+		IPHigh: binary.BigEndian.Uint64(addr.IP[:8]),
+		IPLow:  binary.BigEndian.Uint64(addr.IP[8:]),
+		Port:   addr.Port,
+	}
+}
+
+type connTrackMap map[connTrackKey]net.Conn
+
+// Proxy is proxy for which handles UDP datagrams. It implements the Proxy
+// interface to handle UDP traffic forwarding between the frontend and backend
+// addresses.
+type Proxy struct {
+	listener       PacketConn
+	dialer         func(from net.Addr) (net.Conn, error)
+	connTrackTable connTrackMap
+	connTrackLock  sync.Mutex
+}
+
+// New creates a new Proxy, dialer is called for each new source address to open its connection to the backend
+func New(listener PacketConn, dialer func(from net.Addr) (net.Conn, error)) (*Proxy, error) {
+	return &Proxy{
+		listener:       listener,
+		connTrackTable: make(connTrackMap),
+		dialer:         dialer,
+	}, nil
+}
+
+func (proxy *Proxy) replyLoop(proxyConn net.Conn, clientAddr net.Addr, clientKey *connTrackKey) {
+	defer func() {
+		proxy.connTrackLock.Lock()
+		delete(proxy.connTrackTable, *clientKey)
+		proxy.connTrackLock.Unlock()
+		proxyConn.Close()
+	}()
+
+	readBuf := make([]byte, BufSize)
+	for {
+		_ = proxyConn.SetReadDeadline(time.Now().Add(ConnTrackTimeout))
+	again:
+		read, err := proxyConn.Read(readBuf)
+		if err != nil {
+			if err, ok := err.(*net.OpError); ok && err.Err == syscall.ECONNREFUSED {
+				// This will happen if the last write failed
+				// (e.g: nothing is actually listening on the
+				// proxied port on the container), ignore it
+				// and continue until ConnTrackTimeout
+				// expires:
+				goto again
+			}
+			return
+		}
+		for i := 0; i != read; {
+			written, err := proxy.listener.WriteTo(readBuf[i:read], clientAddr)
+			if err != nil {
+				return
+			}
+			i += written
+		}
+	}
+}
+
+// Run starts forwarding the traffic using UDP.
+func (proxy *Proxy) Run() {
+	readBuf := make([]byte, BufSize)
+	for {
+		read, from, err := proxy.listener.ReadFrom(readBuf)
+		if err != nil {
+			// NOTE: Apparently ReadFrom doesn't return
+			// ECONNREFUSED like Read do (see comment in
+			// Proxy.replyLoop)
+			if !isClosedError(err) {
+				log.Printf("Stopping udp proxy (%s)", err)
+			}
+			break
+		}
+
+		fromKey := newConnTrackKey(from.(*net.UDPAddr))
+		proxy.connTrackLock.Lock()
+		proxyConn, hit := proxy.connTrackTable[*fromKey]
+		if !hit {
+			proxyConn, err = proxy.dialer(from)
+			if err != nil {
+				log.Printf("Can't proxy a datagram to udp: %s\n", err)
+				proxy.connTrackLock.Unlock()
+				continue
+			}
+			proxy.connTrackTable[*fromKey] = proxyConn
+			go proxy.replyLoop(proxyConn, from, fromKey)
+		}
+		proxy.connTrackLock.Unlock()
+		for i := 0; i != read; {
+			_ = proxyConn.SetReadDeadline(time.Now().Add(ConnTrackTimeout))
+			written, err := proxyConn.Write(readBuf[i:read])
+			if err != nil {
+				log.Printf("Can't proxy a datagram to udp: %s\n", err)
+				break
+			}
+			i += written
+		}
+	}
+}
+
+// Close stops forwarding the traffic.
+func (proxy *Proxy) Close() error {
+	proxy.listener.Close()
+	proxy.connTrackLock.Lock()
+	defer proxy.connTrackLock.Unlock()
+	for _, conn := range proxy.connTrackTable {
+		conn.Close()
+	}
+	return nil
+}
+
+func isClosedError(err error) bool {
+	/* This comparison is ugly, but unfortunately, net.go doesn't export errClosing.
+	 * See:
+	 * http://golang.org/src/pkg/net/net.go
+	 * https://code.google.com/p/go/issues/detail?id=4337
+	 * https://groups.google.com/forum/#!msg/golang-nuts/0_aaCvBmOcM/SptmDyX1XJMJ
+	 */
+	return strings.HasSuffix(err.Error(), "use of closed network connection")
+}
+
+// PacketConn is the part of net.PacketConn the proxy listens with
+type PacketConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	SetReadDeadline(t time.Time) error
+	io.Closer
+}
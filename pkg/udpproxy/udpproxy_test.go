@@ -0,0 +1,139 @@
+package udpproxy
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamConnKeepsDatagramBoundaries(t *testing.T) {
+	a, b := net.Pipe()
+	sender, receiver := NewStreamConn(a, nil, nil), NewStreamConn(b, nil, nil)
+	defer sender.Close()
+	defer receiver.Close()
+
+	datagrams := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("x"), BufSize), []byte("last")}
+
+	go func() {
+		for _, d := range datagrams {
+			if _, err := sender.Write(d); err != nil {
+				return
+			}
+		}
+	}()
+
+	buff := make([]byte, BufSize)
+	for i, expected := range datagrams {
+		n, err := receiver.Read(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buff[:n], expected) {
+			t.Fatalf("datagram %d: got %d bytes, expected %d", i, n, len(expected))
+		}
+	}
+
+	if _, err := sender.Write(make([]byte, BufSize+1)); err == nil {
+		t.Fatal("expected a datagram larger than the maximum to be refused")
+	}
+}
+
+func TestStreamConnTruncatesLikeUDP(t *testing.T) {
+	a, b := net.Pipe()
+	sender, receiver := NewStreamConn(a, nil, nil), NewStreamConn(b, nil, nil)
+	defer sender.Close()
+	defer receiver.Close()
+
+	go func() {
+		sender.Write([]byte("too long for the buffer"))
+		sender.Write([]byte("next"))
+	}()
+
+	small := make([]byte, 3)
+	n, err := receiver.Read(small)
+	if err != nil || string(small[:n]) != "too" {
+		t.Fatalf("expected truncated datagram, got %q %v", small[:n], err)
+	}
+
+	buff := make([]byte, 100)
+	n, err = receiver.Read(buff)
+	if err != nil || string(buff[:n]) != "next" {
+		t.Fatalf("expected the rest of the truncated datagram to be discarded, got %q %v", buff[:n], err)
+	}
+}
+
+// The same shape as a udp forward, the proxy sends each source over its own stream and the far end relays it to the target
+func TestProxyOverStreams(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	go func() {
+		buff := make([]byte, BufSize)
+		for {
+			n, from, err := target.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			target.WriteTo(append([]byte("echo "), buff[:n]...), from)
+		}
+	}()
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var streams atomic.Int32
+	proxy, _ := New(listener, func(from net.Addr) (net.Conn, error) {
+		streams.Add(1)
+
+		near, far := net.Pipe()
+
+		udpConn, err := net.Dial("udp", target.LocalAddr().String())
+		if err != nil {
+			return nil, err
+		}
+
+		go Relay(NewStreamConn(far, nil, nil), udpConn)
+
+		return NewStreamConn(near, nil, from), nil
+	})
+	go proxy.Run()
+	defer proxy.Close()
+
+	for _, source := range []string{"a", "b"} {
+		conn, err := net.Dial("udp", listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		for i := 0; i < 2; i++ {
+			if _, err := conn.Write([]byte(source)); err != nil {
+				t.Fatal(err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			buff := make([]byte, 100)
+			n, err := conn.Read(buff)
+			if err != nil {
+				t.Fatalf("no reply for source %s: %s", source, err)
+			}
+
+			if string(buff[:n]) != "echo "+source {
+				t.Fatalf("source %s got the wrong reply %q", source, buff[:n])
+			}
+		}
+	}
+
+	if n := streams.Load(); n != 2 {
+		t.Fatalf("expected one stream per source address, got %d", n)
+	}
+}